@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// roomActivityBucket holds, by room name, the last message saved in each
+// room.
+const roomActivityBucket = "room_activity"
+
+// roomActivity is the last message saved in a room, and its sequence
+// number, which read cursors are compared with.
+type roomActivity struct {
+	Room      string
+	MessageID string
+	Seq       uint64
+	Last      time.Time
+}
+
+// recordActivity saves msg, just saved to the room, as its last activity.
+// It runs inside run.
+func (r *room) recordActivity(msg *message) {
+	activity := roomActivity{Room: r.name, MessageID: msg.ID, Seq: msg.Seq, Last: msg.When}
+	if err := r.state.Put(roomActivityBucket, r.name, activity); err != nil {
+		r.tracer.Warn("Failed to save the room's activity: ", err)
+	}
+}
+
+// roomListing is a room in the rooms list, with how much of it the user
+// asking has not read.
+type roomListing struct {
+	Room    string
+	Private bool `json:",omitempty"`
+	// LastActivity is when the last message was sent to the room, zero if
+	// none has been.
+	LastActivity time.Time
+	LastMessage  string `json:",omitempty"`
+	Seq          uint64
+	// ReadSeq is how far the user has read, and Unread how many messages
+	// they have not; both are zero in rooms they never read.
+	ReadSeq uint64
+	Unread  uint64
+}
+
+// listRooms answers GET /api/rooms?sort={recent|unread} with the rooms the
+// caller may enter, most recently active first, or with sort=unread those
+// with unread messages first.
+func (a *roomSettingsAPI) listRooms(w http.ResponseWriter, r *http.Request, user map[string]interface{}) {
+	order := r.URL.Query().Get("sort")
+	if order != "" && order != "recent" && order != "unread" {
+		http.Error(w, "sort must be recent or unread", http.StatusBadRequest)
+		return
+	}
+	activities, err := a.state.List(roomActivityBucket)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	settings, err := a.state.List(roomSettingsBucket)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	names := make(map[string]bool)
+	for name := range activities {
+		names[name] = true
+	}
+	for name := range settings {
+		names[name] = true
+	}
+	userID, _ := user["userid"].(string)
+	rooms := []*roomListing{}
+	for name := range names {
+		if !canRead(userID, name) {
+			continue
+		}
+		var s roomSettings
+		if doc, ok := settings[name]; ok && json.Unmarshal(doc, &s) == nil && s.Archived {
+			continue
+		}
+		if ok, err := canEnter(a.state, name, user); err != nil || !ok {
+			continue
+		}
+		listing := &roomListing{Room: name, Private: s.Private}
+		var activity roomActivity
+		if doc, ok := activities[name]; ok && json.Unmarshal(doc, &activity) == nil {
+			listing.LastActivity, listing.LastMessage, listing.Seq = activity.Last, activity.MessageID, activity.Seq
+		}
+		var cursor readCursor
+		if userID != "" && a.state.Get(readCursorsBucket, readCursorKey(name, userID), &cursor) == nil {
+			listing.ReadSeq = cursor.Seq
+			if listing.Seq > cursor.Seq {
+				listing.Unread = listing.Seq - cursor.Seq
+			}
+		}
+		rooms = append(rooms, listing)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if order == "unread" && (rooms[i].Unread > 0) != (rooms[j].Unread > 0) {
+			return rooms[i].Unread > 0
+		}
+		if !rooms[i].LastActivity.Equal(rooms[j].LastActivity) {
+			return rooms[i].LastActivity.After(rooms[j].LastActivity)
+		}
+		return rooms[i].Room < rooms[j].Room
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rooms)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestListRooms(t *testing.T) {
+	rooms := newRoomManager()
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})
+	createRoom(rooms.state, nil, "secret", "ann", true, nil, nil)
+	createRoom(rooms.state, nil, "quiet", "ann", false, nil, nil)
+
+	send := func(room, id string) {
+		r := rooms.get(room)
+		c := &client{send: make(chan *message, messageBufferSize), room: r, userData: bob}
+		r.join <- c
+		r.forward <- &message{ID: id, Type: msgTypeMessage, UserID: "bob", Name: "Bob", Message: id, When: time.Now(), from: c}
+		for receiveChat(t, c).ID != id {
+		}
+		r.leave <- c
+	}
+	send("ops", "o1")
+	send("dev", "d1")
+	send("dev", "d2")
+	send("secret", "s1")
+	send("ops", "o2")
+	rooms.state.Put(readCursorsBucket, readCursorKey("ops", "bob"), readCursor{UserID: "bob", MessageID: "o2", Seq: 2})
+	rooms.state.Put(readCursorsBucket, readCursorKey("dev", "bob"), readCursor{UserID: "bob", MessageID: "d1", Seq: 1})
+
+	list := func(query string) []*roomListing {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(http.MethodGet, "/api/rooms"+query, nil, bob))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var listed []*roomListing
+		json.NewDecoder(w.Body).Decode(&listed)
+		return listed
+	}
+	listed := list("")
+	if len(listed) != 3 || listed[0].Room != "ops" || listed[1].Room != "dev" || listed[2].Room != "quiet" {
+		t.Fatalf("expected the rooms bob may enter, most recent first, got %+v", listed)
+	}
+	if listed[0].LastMessage != "o2" || listed[0].Unread != 0 || listed[1].Seq != 2 || listed[1].Unread != 1 {
+		t.Errorf("unexpected activity %+v %+v", listed[0], listed[1])
+	}
+	if listed := list("?sort=unread"); listed[0].Room != "dev" || listed[1].Room != "ops" {
+		t.Errorf("rooms with unread messages should come first, got %+v", listed)
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, withAuthCookie(http.MethodGet, "/api/rooms?sort=size", nil, bob))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("an unknown order should be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// admins holds the email addresses of users allowed to use the admin API.
+// It is populated from the -admins flag at startup and by the first-run
+// setup, and guarded by adminsMu.
+var (
+	adminsMu sync.RWMutex
+	admins   = map[string]bool{}
+)
+
+// setAdmins parses a comma separated list of admin emails.
+func setAdmins(list string) {
+	adminsMu.Lock()
+	defer adminsMu.Unlock()
+	for _, email := range strings.Split(list, ",") {
+		if email = strings.TrimSpace(strings.ToLower(email)); email != "" {
+			admins[email] = true
+		}
+	}
+}
+
+// isAdmin reports whether email is one of the admins.
+func isAdmin(email string) bool {
+	adminsMu.RLock()
+	defer adminsMu.RUnlock()
+	return admins[strings.ToLower(email)]
+}
+
+// haveAdmins reports whether any admin is configured.
+func haveAdmins() bool {
+	adminsMu.RLock()
+	defer adminsMu.RUnlock()
+	return len(admins) > 0
+}
+
+// adminHandler works just like authHandler, except that being signed in is not
+// enough: the email address in the auth cookie must also be one of the configured
+// admins, otherwise the request is refused with 403 Forbidden.
+type adminHandler struct {
+	next http.Handler
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userData := currentUser(r)
+	if userData.Get("email").Str() == "" {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	if !isAdmin(userData.Get("email").Str()) {
+		http.Error(w, "admin access required", http.StatusForbidden)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// MustAdmin wraps handler so that only configured admins may reach it.
+func MustAdmin(handler http.Handler) http.Handler {
+	return &adminHandler{next: handler}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// alertMentionsBucket maps an alert severity to who is mentioned when
+// alerts of that severity fire.
+const alertMentionsBucket = "alert_mentions"
+
+// alertmanagerIntegration is a Prometheus Alertmanager webhook receiver.
+// Alertmanager is configured to POST to /integrations/alertmanager/{room}
+// with the alertmanager_token secret as its bearer token; each notification
+// is posted into the room as one message.
+type alertmanagerIntegration struct {
+	secrets SecretSource
+	state   StateStore
+	rooms   *roomManager
+}
+
+// alertNotification is the Alertmanager webhook payload (version 4).
+type alertNotification struct {
+	Status            string
+	Receiver          string
+	GroupLabels       map[string]string
+	CommonLabels      map[string]string
+	CommonAnnotations map[string]string
+	ExternalURL       string
+	Alerts            []alert
+}
+
+// alert is a single alert of an alertNotification.
+type alert struct {
+	Status       string
+	Labels       map[string]string
+	Annotations  map[string]string
+	StartsAt     time.Time
+	EndsAt       time.Time
+	GeneratorURL string
+}
+
+func (a *alertmanagerIntegration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, err := a.secrets.Secret("alertmanager_token")
+	if err != nil {
+		http.Error(w, "Alertmanager integration is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	room := roomFromPath("/integrations/alertmanager", r.URL.Path)
+	if !validRoomName(room) {
+		http.Error(w, "invalid room name", http.StatusBadRequest)
+		return
+	}
+	var n alertNotification
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookBody)).Decode(&n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(n.Alerts) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	a.rooms.get(room).forward <- &message{
+		ID:      newID(),
+		Name:    "Alertmanager",
+		Message: formatAlerts(&n, a.mentions(&n)),
+		When:    time.Now(),
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// mentions returns who to mention for the firing alerts in n, according to
+// their severity label.
+func (a *alertmanagerIntegration) mentions(n *alertNotification) []string {
+	seen := make(map[string]bool)
+	var mentions []string
+	for _, alert := range n.Alerts {
+		if alert.Status != "firing" {
+			continue
+		}
+		var rule []string
+		if err := a.state.Get(alertMentionsBucket, alert.Labels["severity"], &rule); err != nil {
+			continue
+		}
+		for _, m := range rule {
+			if !seen[m] {
+				seen[m] = true
+				mentions = append(mentions, m)
+			}
+		}
+	}
+	return mentions
+}
+
+// formatAlerts renders a notification as a header line, such as
+// "[FIRING:2] HighLatency (severity=critical)", and a line per alert with
+// its summary, the labels not common to the group and a link.
+func formatAlerts(n *alertNotification, mentions []string) string {
+	var b strings.Builder
+	if len(mentions) > 0 {
+		b.WriteString(strings.Join(mentions, " ") + " ")
+	}
+	firing := 0
+	for _, alert := range n.Alerts {
+		if alert.Status == "firing" {
+			firing++
+		}
+	}
+	if n.Status == "resolved" {
+		fmt.Fprintf(&b, "[RESOLVED] %s", n.GroupLabels["alertname"])
+	} else {
+		fmt.Fprintf(&b, "[FIRING:%d] %s", firing, n.GroupLabels["alertname"])
+	}
+	if labels := formatLabels(n.GroupLabels, "alertname"); labels != "" {
+		b.WriteString(" (" + labels + ")")
+	}
+	for _, alert := range n.Alerts {
+		summary := alert.Annotations["summary"]
+		if summary == "" {
+			summary = alert.Annotations["description"]
+		}
+		if summary == "" {
+			summary = alert.Labels["alertname"]
+		}
+		fmt.Fprintf(&b, "\n- %s: %s", strings.ToUpper(alert.Status), summary)
+		var extra []string
+		for k, v := range alert.Labels {
+			if _, common := n.CommonLabels[k]; !common {
+				extra = append(extra, k+"="+v)
+			}
+		}
+		if len(extra) > 0 {
+			sort.Strings(extra)
+			b.WriteString(" (" + strings.Join(extra, ", ") + ")")
+		}
+		if alert.GeneratorURL != "" {
+			b.WriteString(" " + alert.GeneratorURL)
+		}
+	}
+	return b.String()
+}
+
+// formatLabels returns labels as sorted "k=v" pairs, leaving out skip.
+func formatLabels(labels map[string]string, skip string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		if k != skip {
+			pairs = append(pairs, k+"="+v)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// mentionRules is the admin API for severity based mentions:
+//
+//	GET    /admin/integrations/alertmanager             list rules
+//	PUT    /admin/integrations/alertmanager/{severity}  set a rule: ["@oncall", "@alice"]
+//	DELETE /admin/integrations/alertmanager/{severity}  remove a rule
+func (a *alertmanagerIntegration) mentionRules(w http.ResponseWriter, r *http.Request) {
+	severity := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/integrations/alertmanager"), "/")
+	switch {
+	case r.Method == http.MethodGet && severity == "":
+		rules, err := a.state.List(alertMentionsBucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules)
+	case r.Method == http.MethodPut && severity != "":
+		var mentions []string
+		if err := json.NewDecoder(r.Body).Decode(&mentions); err != nil {
+			http.Error(w, "body must be a list of mentions", http.StatusBadRequest)
+			return
+		}
+		if err := a.state.Put(alertMentionsBucket, severity, mentions); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && severity != "":
+		if err := a.state.Delete(alertMentionsBucket, severity); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
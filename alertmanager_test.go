@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAlertmanagerReceiver(t *testing.T) {
+	rooms := newRoomManager()
+	state := newFileState("")
+	state.Put(alertMentionsBucket, "critical", []string{"@oncall"})
+	a := &alertmanagerIntegration{secrets: mapSecrets{"alertmanager_token": "t0ken"}, state: state, rooms: rooms}
+	c := &client{send: make(chan *message, messageBufferSize), room: rooms.get("ops")}
+	rooms.get("ops").join <- c
+
+	body := `{"version":"4","status":"firing","groupLabels":{"alertname":"HighLatency"},
+		"commonLabels":{"alertname":"HighLatency","severity":"critical"},
+		"alerts":[
+			{"status":"firing","labels":{"alertname":"HighLatency","severity":"critical","instance":"web-1"},
+			 "annotations":{"summary":"p99 over 2s"},"generatorURL":"http://prom/graph"},
+			{"status":"resolved","labels":{"alertname":"HighLatency","severity":"critical","instance":"web-2"},
+			 "annotations":{"summary":"p99 over 2s"}}]}`
+	post := func(token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/integrations/alertmanager/ops", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := post("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong token should be rejected, got %d", code)
+	}
+	if code := post("t0ken"); code != http.StatusAccepted {
+		t.Fatalf("notification should be accepted, got %d", code)
+	}
+	want := "@oncall [FIRING:1] HighLatency\n" +
+		"- FIRING: p99 over 2s (instance=web-1) http://prom/graph\n" +
+		"- RESOLVED: p99 over 2s (instance=web-2)"
+	if msg := receive(t, c); msg.Message != want {
+		t.Errorf("got message\n%s\nwant\n%s", msg.Message, want)
+	}
+}
+
+func TestAlertMentionsOnlyForFiringAlerts(t *testing.T) {
+	state := newFileState("")
+	state.Put(alertMentionsBucket, "critical", []string{"@oncall", "@alice"})
+	state.Put(alertMentionsBucket, "warning", []string{"@alice"})
+	a := &alertmanagerIntegration{state: state}
+	n := &alertNotification{Alerts: []alert{
+		{Status: "firing", Labels: map[string]string{"severity": "warning"}},
+		{Status: "firing", Labels: map[string]string{"severity": "critical"}},
+		{Status: "resolved", Labels: map[string]string{"severity": "critical"}},
+	}}
+	if got := strings.Join(a.mentions(n), " "); got != "@alice @oncall" {
+		t.Errorf("got mentions %q", got)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// fakeFirstNames, fakeLastNames and fakeWords are what anonymized people and
+// messages are made of.
+var (
+	fakeFirstNames = []string{"Alex", "Blair", "Casey", "Dana", "Eli", "Frankie", "Gray", "Harper", "Indy", "Jordan",
+		"Kai", "Logan", "Morgan", "Noel", "Oakley", "Parker", "Quinn", "Riley", "Sage", "Taylor"}
+	fakeLastNames = []string{"Abbott", "Baker", "Carter", "Dixon", "Ellis", "Foster", "Garcia", "Hughes", "Iverson", "Jensen",
+		"Keller", "Lopez", "Moreno", "Nolan", "Owens", "Patel", "Reyes", "Sato", "Turner", "Walsh"}
+	fakeWords = []string{"the", "build", "is", "green", "again", "can", "you", "review", "my", "change", "deploy", "after",
+		"lunch", "meeting", "moved", "to", "tomorrow", "looks", "good", "thanks", "ticket", "release", "notes", "ready",
+		"server", "logs", "show", "timeout", "we", "should", "ship", "it", "test", "failing", "on", "main", "fixed", "now"}
+)
+
+// fakeUser is who a real user is replaced by.
+type fakeUser struct {
+	UserID    string
+	Name      string
+	Email     string
+	AvatarURL string
+}
+
+// anonymizer replaces the people and text in messages with realistic fakes.
+// Each person is replaced by the same fake everywhere, so conversations keep
+// their shape, but the fakes are chosen with a key made up for each run and
+// cannot be traced back.
+type anonymizer struct {
+	key    []byte
+	users  map[string]*fakeUser
+	emails map[string]bool
+}
+
+func newAnonymizer() *anonymizer {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("chat: unable to read random bytes: " + err.Error())
+	}
+	return &anonymizer{key: key, users: make(map[string]*fakeUser), emails: make(map[string]bool)}
+}
+
+// rand returns a source of fakes for s, the same for the same s in a run.
+func (a *anonymizer) rand(s string) *mrand.Rand {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(s))
+	return mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(mac.Sum(nil)))))
+}
+
+// user returns the fake for the user with userID, or for name if the
+// message had no userid.
+func (a *anonymizer) user(userID, name string) *fakeUser {
+	key := "user:" + userID
+	if userID == "" {
+		key = "name:" + name
+	}
+	if u, ok := a.users[key]; ok {
+		return u
+	}
+	rnd := a.rand(key)
+	first, last := fakeFirstNames[rnd.Intn(len(fakeFirstNames))], fakeLastNames[rnd.Intn(len(fakeLastNames))]
+	local := strings.ToLower(first + "." + last)
+	email := local + "@example.com"
+	for n := 2; a.emails[email]; n++ {
+		email = fmt.Sprintf("%s%d@example.com", local, n)
+	}
+	a.emails[email] = true
+	// userids are the MD5 of the email, as for real users
+	id := fmt.Sprintf("%x", md5.Sum([]byte(email)))
+	u := &fakeUser{UserID: id, Name: first + " " + last, Email: email, AvatarURL: "//www.gravatar.com/avatar/" + id + "?d=identicon"}
+	a.users[key] = u
+	return u
+}
+
+// userID returns the fake userid for userID.
+func (a *anonymizer) userID(userID string) string {
+	if userID == "" {
+		return ""
+	}
+	return a.user(userID, "").UserID
+}
+
+// text returns made up text with as many words as s, seeded by seed.
+func (a *anonymizer) text(seed, s string) string {
+	n := len(strings.Fields(s))
+	if n == 0 {
+		return ""
+	}
+	rnd := a.rand("text:" + seed)
+	words := make([]string, n)
+	for i := range words {
+		words[i] = fakeWords[rnd.Intn(len(fakeWords))]
+	}
+	r := []rune(words[0])
+	r[0] = unicode.ToUpper(r[0])
+	words[0] = string(r)
+	return strings.Join(words, " ")
+}
+
+// message returns a copy of msg with its sender, recipient, text, avatar and
+// the names in its attachments and event replaced. Links are dropped, since
+// they came from the real text.
+func (a *anonymizer) message(msg *message) *message {
+	m := *msg
+	if msg.UserID != "" || msg.Name != "" {
+		u := a.user(msg.UserID, msg.Name)
+		if msg.UserID != "" {
+			m.UserID = u.UserID
+		}
+		m.Name = u.Name
+		if msg.AvatarURL != "" {
+			m.AvatarURL = u.AvatarURL
+		}
+	}
+	m.To = a.userID(msg.To)
+	if strings.HasPrefix(msg.Room, "dm:") {
+		x, y, _ := strings.Cut(strings.TrimPrefix(msg.Room, "dm:"), ":")
+		m.Room = dmRoom(a.userID(x), a.userID(y))
+	}
+	m.Message = a.text(msg.ID, msg.Message)
+	m.Links = nil
+	m.Attachments = nil
+	for i, at := range msg.Attachments {
+		at.Name = fmt.Sprintf("file-%d%s", i+1, path.Ext(at.Name))
+		m.Attachments = append(m.Attachments, at)
+	}
+	if msg.Event != nil {
+		e := *msg.Event
+		e.Title = a.text(msg.ID+" title", e.Title)
+		e.Location = a.text(msg.ID+" location", e.Location)
+		e.Description = a.text(msg.ID+" description", e.Description)
+		e.CreatedBy = a.userID(e.CreatedBy)
+		m.Event = &e
+	}
+	return &m
+}
+
+// anonymize copies every message in src to dst, anonymized, and returns how
+// many it copied.
+func anonymize(src, dst MessageStore) (int, error) {
+	msgs, err := src.Query(messageQuery{})
+	if err != nil {
+		return 0, err
+	}
+	a := newAnonymizer()
+	for i, msg := range msgs {
+		if err := dst.Save(a.message(msg)); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// anonymizeStore copies the history in the store cfg uses to the store
+// described by spec, anonymized, for staging servers and load tests to use.
+func anonymizeStore(cfg *serverConfig, spec string) (int, error) {
+	kind, _, _ := strings.Cut(spec, ":")
+	if kind == "" || kind == "memory" {
+		return 0, errors.New("give the store to copy to, sqlite:<path> or postgres:<dsn>")
+	}
+	if spec == cfg.storeSpec {
+		return 0, errors.New("the copy must go to another store than -store")
+	}
+	source, err := newSecretSource(cfg.secretsSpec)
+	if err != nil {
+		return 0, err
+	}
+	secrets := &settingsSecrets{next: source}
+	src, err := newMessageStore(cfg.storeSpec, secrets)
+	if err != nil {
+		return 0, fmt.Errorf("-store: %w", err)
+	}
+	if cfg.encrypt {
+		if src, err = sealStore(src, newStateStore(src, cfg.dataDir), secrets); err != nil {
+			return 0, fmt.Errorf("-encrypt: %w", err)
+		}
+	}
+	dst, err := newMessageStore(spec, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", spec, err)
+	}
+	return anonymize(src, dst)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnonymize(t *testing.T) {
+	src, dst := newMemoryStore(), newMemoryStore()
+	now := time.Now()
+	for _, msg := range []*message{
+		{ID: "1", Room: "golang", UserID: "ann1", Name: "Ann Real", AvatarURL: "/avatars/ann1.png", Message: "ping bob@corp.example about it", When: now},
+		{ID: "2", Room: "golang", UserID: "bob1", Name: "Bob Real", Message: "on it", When: now.Add(time.Second),
+			Attachments: []attachment{{ID: "a", Name: "salaries.xlsx", Size: 10}}},
+		{ID: "3", Room: dmRoom("ann1", "bob1"), Type: msgTypeDM, UserID: "ann1", To: "bob1", Name: "Ann Real", Message: "secret", When: now.Add(2 * time.Second)},
+	} {
+		src.Save(msg)
+	}
+	n, err := anonymize(src, dst)
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 messages copied, got %d, %v", n, err)
+	}
+	copied, _ := dst.Query(messageQuery{})
+	data, _ := json.Marshal(copied)
+	for _, real := range []string{"ann1", "bob1", "Ann Real", "Bob Real", "bob@corp", "secret", "salaries"} {
+		if strings.Contains(string(data), real) {
+			t.Errorf("%q was copied: %s", real, data)
+		}
+	}
+	ann, bob, dm := copied[0], copied[1], copied[2]
+	if dm.UserID != ann.UserID || dm.Name != ann.Name || dm.To != bob.UserID {
+		t.Errorf("the same person should get the same fake, got %+v and %+v", ann, dm)
+	}
+	if dm.Room != dmRoom(ann.UserID, bob.UserID) || !canRead(bob.UserID, dm.Room) {
+		t.Errorf("the direct message should be between the fakes, got %q", dm.Room)
+	}
+	if len(strings.Fields(ann.Message)) != 4 || ann.AvatarURL == "" || !ann.When.Equal(now) {
+		t.Errorf("the message should keep its shape, got %+v", ann)
+	}
+	if bob.Attachments[0].Name != "file-1.xlsx" || bob.Attachments[0].Size != 10 {
+		t.Errorf("expected the attachment renamed, got %+v", bob.Attachments[0])
+	}
+}
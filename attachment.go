@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// attachmentsBucket holds an attachment per uploaded file, by ID.
+	attachmentsBucket = "attachments"
+	// attachmentRefsBucket holds, by content hash, how many unsent uploads
+	// and stored messages refer to each file.
+	attachmentRefsBucket = "attachment_refs"
+	// defaultMaxAttachment is the largest file users may upload unless
+	// configured otherwise.
+	defaultMaxAttachment = 10 << 20
+	// maxAttachmentsPerMessage caps how many files one message carries.
+	maxAttachmentsPerMessage = 10
+)
+
+// attachment is a file attached to a message. Clients upload the file
+// first and then send only its ID; the server fills in the rest.
+type attachment struct {
+	ID          string
+	Name        string
+	ContentType string
+	Size        int64
+	URL         string
+}
+
+// storedAttachment is how an attachment is recorded in the state store.
+type storedAttachment struct {
+	attachment
+	// UserID is who uploaded the file; only they may attach it.
+	UserID   string
+	Uploaded time.Time
+	// Hash is the SHA-256 of the file, which it is kept under, so that a
+	// file uploaded again is kept once. Files uploaded before that are
+	// kept under their ID and have none.
+	Hash string `json:",omitempty"`
+	// Sent is set once the file has been sent in a message, which took
+	// over the reference to it the upload held.
+	Sent bool `json:",omitempty"`
+}
+
+// file returns the name of the file a is kept in.
+func (a *storedAttachment) file() string {
+	if a.Hash != "" {
+		return a.Hash
+	}
+	return a.ID
+}
+
+// inlineTypes are the content types browsers may show in the page rather
+// than download. Anything that can run script, like SVG or HTML, is left out.
+var inlineTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// attachmentStore keeps uploaded files in dir, named by the hash of their
+// contents, and their details in the state store. Servers sharing a state
+// store must share dir too, for instance on a network volume.
+//
+// Every upload not sent yet and every stored message with a file counts a
+// reference to it, and the file is deleted once there are none. References
+// are counted under mu, so servers sharing dir can miscount when they
+// change the same file's at once; the orphan collector finds what that
+// leaves behind.
+type attachmentStore struct {
+	mu      sync.Mutex
+	dir     string
+	state   StateStore
+	maxSize int64
+	// meter counts uploads against workspace storage quotas; nil if
+	// not metering.
+	meter *usageMeter
+	// metrics records the sizes of uploads; nil if not recorded.
+	metrics *metrics
+	// keys seal the files kept from now on; nil to keep them as
+	// uploaded.
+	keys *dataKeys
+}
+
+// ServeHTTP accepts an upload, POST /api/attachments with the file in the
+// multipart field "file", and answers with the attachment.
+func (s *attachmentStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "the file must be in the multipart field \"file\"", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if !validCSRF(r) {
+		http.Error(w, errCSRF, http.StatusForbidden)
+		return
+	}
+	user := currentUser(r)
+	a, err := s.save(user.Get("userid").Str(), header.Filename, file)
+	if err == errAttachmentTooLarge {
+		http.Error(w, fmt.Sprintf("files may be at most %d bytes", s.maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.meter.allow(workspaceOf(user), user.Get("userid").Str(), 0, a.Size); err != nil {
+		s.discard(a.ID)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	s.metrics.observeUpload("attachment", a.Size)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// save writes the file uploaded by userID and records it. The file is
+// written aside first, and only kept if no file with the same contents is.
+func (s *attachmentStore) save(userID, name string, file io.Reader) (*attachment, error) {
+	a := &storedAttachment{attachment: attachment{ID: newID(), Name: path.Base(filepath.ToSlash(name))}, UserID: userID, Uploaded: time.Now()}
+	if a.Name == "." || a.Name == "/" {
+		a.Name = "file"
+	}
+	f, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	// keep the start of the file to tell its content type
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	a.ContentType = http.DetectContentType(head[:n])
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(io.MultiReader(bytes.NewReader(head[:n]), file), s.maxSize+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && written > s.maxSize {
+		err = errAttachmentTooLarge
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	a.Size = written
+	a.Hash = hex.EncodeToString(hash.Sum(nil))
+	a.URL = "/attachments/" + a.ID + "/" + url.PathEscape(a.Name)
+	if err := s.keep(f.Name(), a.Hash); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := s.state.Put(attachmentsBucket, a.ID, a); err != nil {
+		s.mu.Lock()
+		s.addRefs(a.Hash, -1)
+		s.mu.Unlock()
+		return nil, err
+	}
+	return &a.attachment, nil
+}
+
+// keep makes the file written at tmp the one kept under hash, unless there
+// is one already, and counts a reference to it.
+func (s *attachmentStore) keep(tmp, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(filepath.Join(s.dir, hash)); err == nil {
+		// the orphan collector leaves files written lately alone
+		now := time.Now()
+		os.Chtimes(filepath.Join(s.dir, hash), now, now)
+		os.Remove(tmp)
+	} else {
+		if err := s.sealFile(tmp, hash); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(s.dir, hash)); err != nil {
+			return err
+		}
+	}
+	return s.addRefs(hash, 1)
+}
+
+// sealFile encrypts the file written at tmp, to be kept under hash, with
+// a data key of its own, if s has keys.
+func (s *attachmentStore) sealFile(tmp, hash string) error {
+	if s.keys == nil {
+		return nil
+	}
+	plain, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.keys.seal(fileKeysBucket, hash, plain)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tmp, sealed, 0600)
+}
+
+// addRefs adds n, which may be negative, to the references to the file
+// kept under hash, deleting it when there are none left. s.mu must be held.
+func (s *attachmentStore) addRefs(hash string, n int) error {
+	var refs int
+	if err := s.state.Get(attachmentRefsBucket, hash, &refs); err != nil && err != ErrNoState {
+		return err
+	}
+	if refs += n; refs > 0 {
+		return s.state.Put(attachmentRefsBucket, hash, refs)
+	}
+	if err := os.Remove(filepath.Join(s.dir, hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := s.keys.forget(fileKeysBucket, hash); err != nil && err != ErrNoState {
+		return err
+	}
+	if err := s.state.Delete(attachmentRefsBucket, hash); err != nil && err != ErrNoState {
+		return err
+	}
+	return nil
+}
+
+// claim counts a reference to the files attached to a message that has
+// just been stored. The first message an upload is sent in takes over the
+// upload's reference. A nil *attachmentStore counts nothing.
+func (s *attachmentStore) claim(attached []attachment) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, at := range attached {
+		a, err := lookupAttachment(s.state, at.ID)
+		if err != nil || a.Hash == "" {
+			continue
+		}
+		if !a.Sent {
+			a.Sent = true
+			err = s.state.Put(attachmentsBucket, a.ID, a)
+		} else {
+			err = s.addRefs(a.Hash, 1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release drops the references to the files attached to a message that
+// has been deleted. A nil *attachmentStore releases nothing.
+func (s *attachmentStore) release(attached []attachment) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, at := range attached {
+		a, err := lookupAttachment(s.state, at.ID)
+		if err != nil || a.Hash == "" {
+			continue
+		}
+		if err := s.addRefs(a.Hash, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard forgets the upload with the given ID, dropping its reference to
+// its file if it was never sent.
+func (s *attachmentStore) discard(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, err := lookupAttachment(s.state, id)
+	if err != nil {
+		return err
+	}
+	if err := s.state.Delete(attachmentsBucket, id); err != nil {
+		return err
+	}
+	switch {
+	case a.Sent:
+		return nil
+	case a.Hash == "":
+		if err := os.Remove(filepath.Join(s.dir, a.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	default:
+		return s.addRefs(a.Hash, -1)
+	}
+}
+
+// serveFile answers GET /attachments/{id}/{name} with the file.
+func (s *attachmentStore) serveFile(w http.ResponseWriter, r *http.Request) {
+	id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/attachments/"), "/")
+	a, err := lookupAttachment(s.state, id)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	f, err := s.openFile(a)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	disposition := "attachment"
+	if inlineTypes[a.ContentType] {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename*=UTF-8''%s", disposition, url.PathEscape(a.Name)))
+	http.ServeContent(w, r, "", a.Uploaded, f)
+}
+
+// openFile returns the contents of the file a is kept in, decrypted if it
+// was sealed.
+func (s *attachmentStore) openFile(a *storedAttachment) (io.ReadSeeker, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, a.file()))
+	if err != nil || s.keys == nil || a.Hash == "" {
+		return bytes.NewReader(data), err
+	}
+	plain, err := s.keys.open(fileKeysBucket, a.Hash, data)
+	if err == errNoDataKey {
+		// kept before files were sealed
+		return bytes.NewReader(data), nil
+	}
+	return bytes.NewReader(plain), err
+}
+
+// lookupAttachment returns the attachment with the given ID.
+func lookupAttachment(state StateStore, id string) (*storedAttachment, error) {
+	if !validID(id) {
+		return nil, ErrNoState
+	}
+	var a storedAttachment
+	if err := state.Get(attachmentsBucket, id, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// errAttachmentTooLarge is returned by save for a file over maxSize.
+var errAttachmentTooLarge = errors.New("file too large")
+
+// errBadAttachment is returned by resolveAttachments for an attachment
+// that was not uploaded by the sender.
+var errBadAttachment = errors.New("attachments must be files you uploaded")
+
+// resolveAttachments replaces the attachments a client sent, which only
+// need their IDs, with what was recorded on upload. userID must have
+// uploaded them all.
+func resolveAttachments(state StateStore, userID string, sent []attachment) ([]attachment, error) {
+	if len(sent) > maxAttachmentsPerMessage {
+		return nil, fmt.Errorf("a message can have at most %d attachments", maxAttachmentsPerMessage)
+	}
+	var resolved []attachment
+	for _, s := range sent {
+		a, err := lookupAttachment(state, s.ID)
+		if err != nil || userID == "" || a.UserID != userID {
+			return nil, errBadAttachment
+		}
+		resolved = append(resolved, a.attachment)
+	}
+	return resolved, nil
+}
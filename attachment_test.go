@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/objx"
+)
+
+func uploadRequest(t *testing.T, userID, name string, content []byte) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+	r := withAuthCookie(http.MethodPost, "/api/attachments", &body, objx.New(map[string]interface{}{"userid": userID}))
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	cookie, token := testCSRF()
+	r.AddCookie(cookie)
+	r.Header.Set(csrfHeader, token)
+	return r
+}
+
+func TestAttachments(t *testing.T) {
+	s := &attachmentStore{dir: t.TempDir(), state: newFileState(""), maxSize: 1024}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, uploadRequest(t, "ann", "../notes.txt", []byte("hello")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+	var a attachment
+	json.NewDecoder(w.Body).Decode(&a)
+	if a.Name != "notes.txt" || a.Size != 5 || a.ContentType != "text/plain; charset=utf-8" || a.URL != "/attachments/"+a.ID+"/notes.txt" {
+		t.Errorf("unexpected attachment %+v", a)
+	}
+
+	w = httptest.NewRecorder()
+	s.serveFile(w, httptest.NewRequest(http.MethodGet, a.URL, nil))
+	if body, _ := ioutil.ReadAll(w.Body); string(body) != "hello" || w.Header().Get("Content-Disposition") != "attachment; filename*=UTF-8''notes.txt" {
+		t.Errorf("unexpected download %q %v", body, w.Header())
+	}
+
+	if got, err := resolveAttachments(s.state, "ann", []attachment{{ID: a.ID, Name: "other.exe", Size: 1}}); err != nil || len(got) != 1 || got[0] != a {
+		t.Errorf("the recorded details should replace what the client sent, got %+v %v", got, err)
+	}
+	if _, err := resolveAttachments(s.state, "bob", []attachment{{ID: a.ID}}); err != errBadAttachment {
+		t.Errorf("only the uploader should be able to attach a file, got %v", err)
+	}
+	if _, err := resolveAttachments(s.state, "ann", []attachment{{ID: "nope"}}); err != errBadAttachment {
+		t.Errorf("unknown attachments should be refused, got %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, uploadRequest(t, "ann", "big.bin", make([]byte, 2048)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("a file over the limit should be refused, got %d", w.Code)
+	}
+	if files, _ := ioutil.ReadDir(s.dir); len(files) != 1 {
+		t.Errorf("a refused file should not be kept, found %d files", len(files))
+	}
+}
+
+func TestImagesAreShownInline(t *testing.T) {
+	s := &attachmentStore{dir: t.TempDir(), state: newFileState(""), maxSize: 1024}
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0, 0, 0, '\r', 'I', 'H', 'D', 'R'}
+	a, err := s.save("ann", "cat.png", bytes.NewReader(png))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.serveFile(w, httptest.NewRequest(http.MethodGet, a.URL, nil))
+	if w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Content-Disposition") != "inline; filename*=UTF-8''cat.png" {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+}
+
+func TestAttachmentsAreKeptOnce(t *testing.T) {
+	s := &attachmentStore{dir: t.TempDir(), state: newFileState(""), maxSize: 1024}
+	a, _ := s.save("ann", "cat.png", bytes.NewReader([]byte("meow")))
+	b, err := s.save("bob", "same-cat.png", bytes.NewReader([]byte("meow")))
+	if err != nil || a.ID == b.ID {
+		t.Fatalf("second upload: %+v %v", b, err)
+	}
+	files := func() int {
+		infos, _ := ioutil.ReadDir(s.dir)
+		return len(infos)
+	}
+	refs := func() int {
+		stored, _ := lookupAttachment(s.state, a.ID)
+		var n int
+		s.state.Get(attachmentRefsBucket, stored.Hash, &n)
+		return n
+	}
+	if files() != 1 || refs() != 2 {
+		t.Fatalf("want one file with two references, got %d files and %d references", files(), refs())
+	}
+	w := httptest.NewRecorder()
+	s.serveFile(w, httptest.NewRequest(http.MethodGet, b.URL, nil))
+	if body, _ := ioutil.ReadAll(w.Body); string(body) != "meow" || w.Header().Get("Content-Disposition") != "attachment; filename*=UTF-8''same-cat.png" {
+		t.Errorf("unexpected download %q %v", body, w.Header())
+	}
+
+	// Ann's upload is sent twice, taking over its reference the first
+	// time, and Bob's once
+	s.claim([]attachment{*a})
+	s.claim([]attachment{*a})
+	s.claim([]attachment{*b})
+	if refs() != 3 {
+		t.Fatalf("want 3 references, got %d", refs())
+	}
+	s.release([]attachment{*a})
+	s.release([]attachment{*b})
+	if files() != 1 || refs() != 1 {
+		t.Fatalf("a message still has the file, but got %d files and %d references", files(), refs())
+	}
+	s.release([]attachment{*a})
+	if files() != 0 {
+		t.Errorf("the file should be deleted with the last message it is in")
+	}
+
+	// an upload never sent only has its own reference
+	c, _ := s.save("ann", "dog.png", bytes.NewReader([]byte("woof")))
+	if err := s.discard(c.ID); err != nil || files() != 0 {
+		t.Errorf("a discarded upload should be deleted: %v, %d files", err, files())
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// auditBucket holds what admins changed, keyed by when, so that the keys
+// sort in the order the changes were made.
+const auditBucket = "audit_log"
+
+// defaultAuditLimit is how many entries GET /admin/audit returns unless
+// asked for more.
+const defaultAuditLimit = 100
+
+// auditEntry records a change an admin made.
+type auditEntry struct {
+	ID     string
+	Time   time.Time
+	Admin  string
+	Action string
+	Detail string `json:",omitempty"`
+}
+
+// auditLog keeps the audit log in a StateStore. Its now may be replaced
+// in tests.
+type auditLog struct {
+	state StateStore
+	now   func() time.Time
+}
+
+func newAuditLog(state StateStore) *auditLog {
+	return &auditLog{state: state, now: time.Now}
+}
+
+// record adds an entry for action, taken by the admin signed in to r.
+func (a *auditLog) record(r *http.Request, action, detail string) error {
+	now := a.now()
+	entry := auditEntry{
+		ID:     fmt.Sprintf("%020d-%s", now.UnixNano(), newID()[:8]),
+		Time:   now,
+		Admin:  currentUser(r).Get("email").Str(),
+		Action: action,
+		Detail: detail,
+	}
+	return a.state.Put(auditBucket, entry.ID, entry)
+}
+
+// ServeHTTP lists the audit log, newest first:
+//
+//	GET /admin/audit   the last entries, ?limit= (default 100)
+func (a *auditLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultAuditLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	docs, err := a.state.List(auditBucket)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	keys := make([]string, 0, len(docs))
+	for key := range docs {
+		keys = append(keys, key)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	entries := make([]auditEntry, 0, len(keys))
+	for _, key := range keys {
+		var entry auditEntry
+		if err := json.Unmarshal(docs[key], &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
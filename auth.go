@@ -7,10 +7,16 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/stretchr/gomniauth"
 	gomniauthcommon "github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/gomniauth/providers/facebook"
+	"github.com/stretchr/gomniauth/providers/github"
+	"github.com/stretchr/gomniauth/providers/google"
 	"github.com/stretchr/objx"
 )
 
@@ -55,9 +61,16 @@ type authHandler struct {
 }
 
 func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_, err := r.Cookie("auth")
-	if errors.Is(err, http.ErrNoCookie) {
-		// not authenticated
+	userData, err := authenticate(r)
+	if errors.Is(err, errBadToken) {
+		// scripts can't follow a redirect to the login page
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, http.ErrNoCookie) || errors.Is(err, errBadAuthCookie) {
+		// not authenticated, or the cookie was tampered with; come
+		// back here once signed in
+		rememberReturnTo(w, r)
 		w.Header().Set("Location", "/login")
 		w.WriteHeader(http.StatusTemporaryRedirect)
 		return
@@ -67,6 +80,11 @@ func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// a read-only bot may only look
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions && !mayChange(userData) {
+		http.Error(w, "this bot may only read", http.StatusForbidden)
+		return
+	}
 	// success - call the next handler
 	h.next.ServeHTTP(w, r)
 }
@@ -74,6 +92,162 @@ func MustAuth(handler http.Handler) http.Handler {
 	return &authHandler{next: handler}
 }
 
+// authKeys signs and verifies auth cookies. main replaces it with the
+// persistent key ring; the in-memory one is only good for a single run.
+var authKeys, _ = newKeyRing("", 0)
+
+// sessions holds the signed in users, and sessionTTL is how long they stay
+// signed in. main sets both from flags.
+var (
+	sessions   SessionStore = newMemorySessions()
+	sessionTTL              = defaultSessionTTL
+)
+
+// errBadAuthCookie is returned for auth cookies that are malformed, whose
+// signature does not verify or whose session has ended.
+var errBadAuthCookie = errors.New("chat: invalid auth cookie")
+
+// startSession signs the user in: it stores a new session with userData and
+// sets the auth cookie to its ID, a '.' and the ID's signature.
+func startSession(w http.ResponseWriter, r *http.Request, userData objx.Map) error {
+	now := time.Now()
+	s := &session{
+		ID:         newID(),
+		User:       userData,
+		Created:    now,
+		Expires:    now.Add(sessionTTL),
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: r.RemoteAddr,
+	}
+	if err := sessions.Save(s); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth",
+		Value:    s.ID + "." + authKeys.sign([]byte(s.ID)),
+		Path:     "/",
+		Expires:  s.Expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// rememberReturnTo keeps the page a signed out user asked for in a cookie,
+// so that signing in can take them back to it.
+func rememberReturnTo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !localPath(r.URL.RequestURI()) {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "return_to",
+		Value:    url.QueryEscape(r.URL.RequestURI()),
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+	})
+}
+
+// returnTo returns the page to go to after signing in, /chat unless one was
+// remembered, and forgets it.
+func returnTo(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie("return_to")
+	if err != nil {
+		return "/chat"
+	}
+	http.SetCookie(w, &http.Cookie{Name: "return_to", Value: "", Path: "/", MaxAge: -1})
+	path, err := url.QueryUnescape(cookie.Value)
+	if err != nil || !localPath(path) {
+		return "/chat"
+	}
+	return path
+}
+
+// localPath reports whether p is a path on this server rather than a URL
+// that could lead elsewhere.
+func localPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.Contains(p, "\\")
+}
+
+// endSession signs the user out, ending the session on the server as well
+// as clearing the cookie.
+func endSession(w http.ResponseWriter, r *http.Request) error {
+	var err error
+	if id, cookieErr := sessionCookieID(r); cookieErr == nil {
+		err = sessions.Delete(id)
+		accounts.signedOut(id)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   "auth",
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+	return err
+}
+
+// readAuthCookie returns the user data of the session named by the
+// request's auth cookie, unless it was revoked.
+func readAuthCookie(r *http.Request) (objx.Map, error) {
+	id, err := sessionCookieID(r)
+	if err != nil {
+		return nil, err
+	}
+	s, err := sessions.Get(id)
+	if errors.Is(err, ErrNoSession) {
+		return nil, errBadAuthCookie
+	}
+	if err != nil {
+		return nil, err
+	}
+	userData := objx.Map(s.User)
+	if revoked, err := accounts.revoked(userData.Get("userid").Str(), s.Created); err != nil {
+		return nil, err
+	} else if revoked {
+		sessions.Delete(id)
+		return nil, errBadAuthCookie
+	}
+	return userData, nil
+}
+
+// currentUser returns the data of the user making the request, or an empty
+// map if there is no valid cookie or token.
+func currentUser(r *http.Request) objx.Map {
+	userData, err := authenticate(r)
+	if err != nil {
+		return objx.New(nil)
+	}
+	return userData
+}
+
+// errNoIdentity is returned for users a login provider gives neither a
+// verified email address nor an ID.
+var errNoIdentity = errors.New("the login provider did not say who you are; sign in another way")
+
+// userIdentity returns the userid of user, signed in with provider, and the
+// email address it is known by. A user whose email address the provider
+// vouches for is the hash of that address, the same whichever provider
+// they sign in with; any other is the hash of the provider's name and its
+// ID for them, and has no email address, so it can't be an admin.
+func userIdentity(provider string, user gomniauthcommon.User) (userID, email string, err error) {
+	// GitHub, Google and Facebook only give addresses they verified
+	verified := true
+	if v, ok := user.(interface{ EmailVerified() bool }); ok {
+		verified = v.EmailVerified()
+	}
+	m := md5.New()
+	if email = user.Email(); email != "" && verified {
+		io.WriteString(m, strings.ToLower(email))
+		return fmt.Sprintf("%x", m.Sum(nil)), email, nil
+	}
+	id := user.IDForProvider(provider)
+	if id == "" {
+		return "", "", errNoIdentity
+	}
+	io.WriteString(m, provider+":"+id)
+	return fmt.Sprintf("%x", m.Sum(nil)), "", nil
+}
+
 // loginHandler handles the third-party login process.
 // format: /auth/{action}/{provider}
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -82,6 +256,10 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	provider := segs[3]
 	switch action {
 	case "login":
+		if msg, down := loginHealth.downProviders()[provider]; down {
+			http.Error(w, msg, http.StatusServiceUnavailable)
+			return
+		}
 		provider, err := gomniauth.Provider(provider)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error when trying to get provider %s: %s", provider, err), http.StatusBadRequest)
@@ -106,13 +284,20 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		//method uses the values to complete the OAuth2 provider handshake with the provider. All
 		//being well, we will be given some authorized credentials with which we will be able to
 		//access our user's basic data
+		//A user who declined to sign in is not the provider failing, so only the
+		//token exchange and the profile request count toward its health
+		start := time.Now()
 		creds, err := provider.CompleteAuth(objx.MustFromURLQuery(r.URL.RawQuery))
 		if err != nil {
+			if r.URL.Query().Get("error") == "" {
+				loginHealth.record(provider, time.Since(start), err)
+			}
 			http.Error(w, fmt.Sprintf("Error when trying to complete auth for %s: %s",
 				provider, err), http.StatusInternalServerError)
 			return
 		}
 		user, err := provider.GetUser(creds)
+		loginHealth.record(provider, time.Since(start), err)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error when trying to get user from %s: %s",
 				provider, err), http.StatusInternalServerError)
@@ -128,27 +313,129 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		//	"email":      user.Email(),
 		//}).MustBase64()
 		chatUser := &chatUser{User: user}
-		m := md5.New()
-		io.WriteString(m, strings.ToLower(user.Email()))
-		chatUser.uniqueID = fmt.Sprintf("%x", m.Sum(nil))
+		var email string
+		chatUser.uniqueID, email, err = userIdentity(provider.Name(), user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		// a user who deactivated their own account reactivates it by
+		// signing in; one deactivated by an admin stays out
+		d, err := accounts.deactivation(chatUser.uniqueID)
+		if err == nil && d != nil && d.By == deactivatedBySelf {
+			err = accounts.reactivate(chatUser.uniqueID)
+		} else if err == nil && d != nil {
+			http.Error(w, "This account has been deactivated.", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error when trying to check the account: %s", err), http.StatusInternalServerError)
+			return
+		}
 		avatarURL, err := avatars.GetAvatarURL(chatUser)
 		if err != nil {
-			log.Fatalln("Error when trying to GetAvatarURL", "-", err)
+			log.Println("Error when trying to GetAvatarURL", "-", err)
+			avatarURL, _ = UseDefaultAvatar.GetAvatarURL(chatUser)
 		}
-		authCookieValue := objx.New(map[string]interface{}{
+		userData := objx.New(map[string]interface{}{
 			"userid":     chatUser.uniqueID,
 			"name":       user.Name(),
 			"avatar_url": avatarURL,
-			"email":      user.Email(),
-		}).MustBase64()
-		http.SetCookie(w, &http.Cookie{
-			Name:  "auth",
-			Value: authCookieValue,
-			Path:  "/"})
-		w.Header().Set("Location", "/chat")
+			"email":      email,
+		})
+		rememberProvider(w, provider.Name())
+		// users with a second factor get their session once they enter a code
+		required, err := twoFactor.required(chatUser.uniqueID)
+		if err == nil && required {
+			err = twoFactor.challenge(w, r, userData)
+			if err == nil {
+				return
+			}
+		}
+		if err == nil {
+			err = startSession(w, r, userData)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error when trying to start session: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", returnTo(w, r))
 		w.WriteHeader(http.StatusTemporaryRedirect)
 	default:
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "Auth action %s not supported", action)
 	}
 }
+
+// authBaseURL is where users reach the server, which login providers send
+// them back to. It is set from -public-url or by the first-run setup, and
+// guarded by authBaseMu.
+var (
+	authBaseMu  sync.Mutex
+	authBaseURL = "http://localhost:8080"
+	// authHTTPS is set when the server terminates TLS itself, so the
+	// callbacks use https whatever authBaseURL says.
+	authHTTPS bool
+)
+
+// setAuthBaseURL changes authBaseURL; setupAuth must be called again for
+// it to take effect.
+func setAuthBaseURL(base string) {
+	authBaseMu.Lock()
+	defer authBaseMu.Unlock()
+	authBaseURL = strings.TrimSuffix(base, "/")
+}
+
+// useHTTPSCallbacks makes setupAuth give login providers https callback
+// URLs; setupAuth must be called again for it to take effect.
+func useHTTPSCallbacks() {
+	authBaseMu.Lock()
+	defer authBaseMu.Unlock()
+	authHTTPS = true
+}
+
+// randomSecurityKey is used when no security_key secret is configured.
+var randomSecurityKey = newID() + newID()
+
+// setupAuth configures gomniauth from secrets. It is called again whenever
+// the secrets are rotated; gomniauth.WithProviders replaces the old providers.
+func setupAuth(secrets *secretCache) {
+	securityKey, err := secrets.Secret("security_key")
+	if err != nil {
+		// without a shared key every instance signs OAuth state with a
+		// different key, but a random one still lets a single server start
+		log.Println("No security_key secret found, using a random key:", err)
+		securityKey = randomSecurityKey
+	}
+	gomniauth.SetSecurityKey(securityKey)
+	authBaseMu.Lock()
+	base := authBaseURL
+	if authHTTPS && strings.HasPrefix(base, "http://") {
+		base = "https://" + strings.TrimPrefix(base, "http://")
+	}
+	authBaseMu.Unlock()
+	providers := []gomniauthcommon.Provider{
+		facebook.New(secrets.secretOr("facebook_client_id", ""), secrets.secretOr("facebook_client_sec", ""),
+			base+"/auth/callback/facebook"),
+		github.New(secrets.secretOr("github_client_id", ""), secrets.secretOr("github_client_sec", ""),
+			base+"/auth/callback/github"),
+		google.New(secrets.secretOr("google_client_id", ""), secrets.secretOr("google_client_sec", ""),
+			base+"/auth/callback/google"),
+		newOAuthProvider(gitlabEndpoints(gitlabURL), secrets.secretOr("gitlab_client_id", ""), secrets.secretOr("gitlab_client_sec", ""),
+			base+"/auth/callback/gitlab"),
+		newOAuthProvider(discordEndpoints(), secrets.secretOr("discord_client_id", ""), secrets.secretOr("discord_client_sec", ""),
+			base+"/auth/callback/discord"),
+		newOAuthProvider(microsoftEndpoints(microsoftTenant), secrets.secretOr("microsoft_client_id", ""), secrets.secretOr("microsoft_client_sec", ""),
+			base+"/auth/callback/microsoft"),
+	}
+	if oidcIssuer != "" {
+		if endpoints, err := discoverOIDC(oidcClient, oidcIssuer, oidcName); err != nil {
+			log.Println("OpenID Connect provider not available:", err)
+		} else {
+			providers = append(providers, newOAuthProvider(endpoints, secrets.secretOr("oidc_client_id", ""), secrets.secretOr("oidc_client_sec", ""),
+				base+"/auth/callback/oidc"))
+		}
+	}
+	gomniauth.WithProviders(providers...)
+	setLoginOptions(providers, secrets)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+// withAuthCookie returns a request carrying the auth cookie of a new
+// session for userData.
+func withAuthCookie(method, path string, body io.Reader, userData objx.Map) *http.Request {
+	w := httptest.NewRecorder()
+	if err := startSession(w, httptest.NewRequest(http.MethodGet, "/auth/callback/test", nil), userData); err != nil {
+		panic(err)
+	}
+	r := httptest.NewRequest(method, path, body)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestAuthCookieSignature(t *testing.T) {
+	r := withAuthCookie(http.MethodGet, "/chat", nil, objx.New(map[string]interface{}{"userid": "abc", "name": "Ann"}))
+	if user := currentUser(r); user.Get("userid").Str() != "abc" {
+		t.Errorf("signed cookie should be accepted, got %v", user)
+	}
+	cookie, _ := r.Cookie("auth")
+	id, sig, _ := strings.Cut(cookie.Value, ".")
+	for _, bad := range []string{
+		id,
+		newID() + "." + sig,
+		cookie.Value + "x",
+		objx.New(map[string]interface{}{"userid": "admin"}).MustBase64(),
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/chat", nil)
+		r.AddCookie(&http.Cookie{Name: "auth", Value: bad})
+		if _, err := readAuthCookie(r); err != errBadAuthCookie {
+			t.Errorf("cookie %q should be rejected, got %v", bad, err)
+		}
+	}
+}
+
+func TestAuthCookieHoldsNoUserData(t *testing.T) {
+	user := objx.New(map[string]interface{}{"userid": "abc", "name": "Ann Example", "email": "ann@example.com"})
+	w := httptest.NewRecorder()
+	if err := startSession(w, httptest.NewRequest(http.MethodGet, "/auth/callback/test", nil), user); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		value := cookie.Value
+		if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+			value += string(decoded)
+		}
+		for _, pii := range []string{"Ann", "ann@example.com"} {
+			if strings.Contains(value, pii) {
+				t.Errorf("cookie %s gives away %q: %q", cookie.Name, pii, cookie.Value)
+			}
+		}
+	}
+}
+
+func TestAuthCookieIsSameSite(t *testing.T) {
+	w := httptest.NewRecorder()
+	if err := startSession(w, httptest.NewRequest(http.MethodGet, "/auth/callback/test", nil), objx.New(map[string]interface{}{"userid": "abc"})); err != nil {
+		t.Fatal(err)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Errorf("expected a SameSite=Lax auth cookie, got %v", cookies)
+	}
+}
+
+func TestMustAuthRejectsTamperedCookie(t *testing.T) {
+	h := MustAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, withAuthCookie(http.MethodGet, "/chat", nil, objx.New(map[string]interface{}{"userid": "abc"})))
+	if w.Code != http.StatusOK {
+		t.Errorf("signed cookie: expected 200, got %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/chat", nil)
+	r.AddCookie(&http.Cookie{Name: "auth", Value: objx.New(map[string]interface{}{"userid": "abc"}).MustBase64()})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/login" {
+		t.Errorf("unsigned cookie: expected redirect to /login, got %d", w.Code)
+	}
+}
+
+func TestLoginReturnsToPage(t *testing.T) {
+	h := MustAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/invite/abc?x=1", nil))
+	r := httptest.NewRequest(http.MethodGet, "/auth/callback/test", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if to := returnTo(httptest.NewRecorder(), r); to != "/invite/abc?x=1" {
+		t.Errorf("signing in should return to the invite, got %q", to)
+	}
+	for _, bad := range []string{"//evil.example.com", "https://evil.example.com", "/\\evil.example.com"} {
+		r := httptest.NewRequest(http.MethodGet, "/auth/callback/test", nil)
+		r.AddCookie(&http.Cookie{Name: "return_to", Value: url.QueryEscape(bad)})
+		if to := returnTo(httptest.NewRecorder(), r); to != "/chat" {
+			t.Errorf("%q should not be followed, got %q", bad, to)
+		}
+	}
+}
+
+func TestRoomRejectsUnsignedCookie(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/room", nil)
+	r.AddCookie(&http.Cookie{Name: "auth", Value: objx.New(map[string]interface{}{"userid": "abc"}).MustBase64()})
+	w := httptest.NewRecorder()
+	newRoom(defaultRoom).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 before the websocket upgrade, got %d", w.Code)
+	}
+}
+
+func TestRoomSurvivesPlainGET(t *testing.T) {
+	w := httptest.NewRecorder()
+	newRoom(defaultRoom).ServeHTTP(w, withAuthCookie(http.MethodGet, "/room", nil, objx.New(map[string]interface{}{"userid": "abc"})))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a request that is not a websocket, got %d", w.Code)
+	}
+}
+
+func TestLogoutEndsSession(t *testing.T) {
+	r := withAuthCookie(http.MethodGet, "/logout", nil, objx.New(map[string]interface{}{"userid": "abc"}))
+	cookie, _ := r.Cookie("auth")
+	w := httptest.NewRecorder()
+	if err := endSession(w, r); err != nil {
+		t.Fatal(err)
+	}
+	// a copy of the cookie kept by the client must not work any more
+	replay := httptest.NewRequest(http.MethodGet, "/chat", nil)
+	replay.AddCookie(cookie)
+	if _, err := readAuthCookie(replay); err != errBadAuthCookie {
+		t.Errorf("cookie of an ended session should be rejected, got %v", err)
+	}
+}
+
+func TestMemorySessionsExpire(t *testing.T) {
+	m := newMemorySessions()
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	m.Save(&session{ID: "s1", Expires: now.Add(time.Hour)})
+	if _, err := m.Get("s1"); err != nil {
+		t.Fatalf("live session: %v", err)
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := m.Get("s1"); err != ErrNoSession {
+		t.Errorf("expired session should be gone, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// letsEncryptURL is the directory of the Let's Encrypt ACME server.
+	letsEncryptURL = acme.LetsEncryptURL
+	// renewBefore is how long before it expires a certificate is renewed.
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// newAutocert returns a manager getting certificates for domains from the
+// ACME server at directoryURL, such as Let's Encrypt, and renewing them
+// before they expire. It proves control of the domains with http-01
+// challenges, answered by its HTTPHandler on the plain HTTP port, and keeps
+// the account key and the certificates in dir so a restart does not ask
+// for new ones. Certificates are only got for domains, whatever name
+// clients ask for.
+func newAutocert(domains []string, email, dir, directoryURL string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  autocert.HostWhitelist(domains...),
+		Cache:       autocert.DirCache(dir),
+		Email:       email,
+		RenewBefore: renewBefore,
+		Client:      &acme.Client{DirectoryURL: directoryURL},
+	}
+}
+
+// redirectHTTPS sends a plain HTTP request to the same URL over HTTPS.
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
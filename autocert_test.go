@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAutocertOnlyServesItsDomains(t *testing.T) {
+	certs := newAutocert([]string{"chat.example.com"}, "ops@example.com", t.TempDir(), letsEncryptURL)
+	if err := certs.HostPolicy(context.Background(), "chat.example.com"); err != nil {
+		t.Errorf("the configured domain should be allowed, got %v", err)
+	}
+	if err := certs.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Error("no certificate should be got for other domains")
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	certs := newAutocert([]string{"chat.example.com"}, "", t.TempDir(), letsEncryptURL)
+	handler := certs.HTTPHandler(http.HandlerFunc(redirectHTTPS))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://chat.example.com:80/chat?room=go", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://chat.example.com/chat?room=go" {
+		t.Errorf("plain HTTP should redirect to HTTPS, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://chat.example.com/.well-known/acme-challenge/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown challenges should not be answered, got %d", w.Code)
+	}
+}
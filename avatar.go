@@ -2,8 +2,10 @@ package main
 
 import (
 	"errors"
-	"io/ioutil"
-	"path"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // ErrNoAvatarURL ErrNoAvatar is the error that is returned when the
@@ -42,32 +44,115 @@ type GravatarAvatar struct{}
 
 var UseGravatar GravatarAvatar
 
+//With gravatarProxy set the picture comes through the server, and users
+//Gravatar is known to have none for get ErrNoAvatarURL.
 func (GravatarAvatar) GetAvatarURL(u ChatUser) (string, error) {
+	if gravatarProxy != nil && validGravatarHash(u.UniqueID()) {
+		if found, missing := gravatarProxy.known(u.UniqueID()); found && missing {
+			return "", ErrNoAvatarURL
+		}
+		return "/gravatar/" + u.UniqueID(), nil
+	}
 	return "//www.gravatar.com/avatar/" + u.UniqueID(), nil
 }
 
+// avatarDir is where uploaded avatars are kept, unless avatarBlobs is set
+// to keep them elsewhere.
+var avatarDir = "avatars"
+
+// avatarBlobs is where FileSystemAvatar finds uploaded avatars.
+var avatarBlobs BlobStore = dirBlobs(avatarDir)
+
 type FileSystemAvatar struct{}
 
 var UseFileSystemAvatar FileSystemAvatar
 
 func (FileSystemAvatar) GetAvatarURL(u ChatUser) (string, error) {
-	if files, err := ioutil.ReadDir("avatars"); err == nil {
-		for _, file := range files {
-			if file.IsDir() {
-				continue
-			}
-			if match, _ := path.Match(u.UniqueID()+"*", file.Name()); match {
-				return "/avatars/" + file.Name(), nil
+	if names, err := avatarBlobs.List(u.UniqueID() + "."); err == nil {
+		for _, name := range names {
+			if !strings.HasSuffix(name, staticAvatarSuffix) {
+				return "/avatars/" + name, nil
 			}
 		}
 	}
 	return "", ErrNoAvatarURL
 }
 
+// defaultAvatarProviders is the chain of avatar providers used unless
+// -avatar-providers names another.
+const defaultAvatarProviders = "filesystem,auth,gravatar"
+
+var (
+	avatarProvidersMu sync.Mutex
+	avatarProviders   = map[string]Avatar{}
+)
+
+//RegisterAvatar makes an Avatar implementation available by name, for
+//-avatar-providers to put in the chain. Implementations register themselves
+//from an init function; registering a name twice panics.
+func RegisterAvatar(name string, a Avatar) {
+	avatarProvidersMu.Lock()
+	defer avatarProvidersMu.Unlock()
+	if _, ok := avatarProviders[name]; ok {
+		panic("chat: avatar provider " + name + " registered twice")
+	}
+	avatarProviders[name] = a
+}
+
+func init() {
+	RegisterAvatar("filesystem", UseFileSystemAvatar)
+	RegisterAvatar("auth", UseAuthAvatar)
+	RegisterAvatar("gravatar", UseGravatar)
+	RegisterAvatar("default", UseDefaultAvatar)
+}
+
+//avatarChain returns the registered providers named in the comma separated
+//list names, to be tried in that order.
+func avatarChain(names string) (TryAvatars, error) {
+	avatarProvidersMu.Lock()
+	defer avatarProvidersMu.Unlock()
+	var chain TryAvatars
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		a, ok := avatarProviders[name]
+		if !ok {
+			known := make([]string, 0, len(avatarProviders))
+			for name := range avatarProviders {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown avatar provider %q, want one of %s", name, strings.Join(known, ", "))
+		}
+		chain = append(chain, a)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no avatar providers given")
+	}
+	return chain, nil
+}
+
+// defaultAvatarURL is the picture, bundled in assets, of users who have
+// no other.
+const defaultAvatarURL = "/assets/default-avatar.svg"
+
+// DefaultAvatar gives every user the bundled default picture. It never
+// fails, which makes it the last resort of TryAvatars.
+type DefaultAvatar struct{}
+
+var UseDefaultAvatar DefaultAvatar
+
+func (DefaultAvatar) GetAvatarURL(u ChatUser) (string, error) {
+	return defaultAvatarURL, nil
+}
+
 //TryAvatars implement a mechanism in which each Avatar
 //implementation takes a turn in trying to get a URL for a user. If the first implementation
 //returns the ErrNoAvatarURL error, we will try the next and so on until we find a useable
-//value.
+//value. If none has one, the user gets the DefaultAvatar, so TryAvatars never
+//returns an error.
 type TryAvatars []Avatar
 
 func (a TryAvatars) GetAvatarURL(u ChatUser) (string, error) {
@@ -76,5 +161,5 @@ func (a TryAvatars) GetAvatarURL(u ChatUser) (string, error) {
 			return url, nil
 		}
 	}
-	return "", ErrNoAvatarURL
+	return UseDefaultAvatar.GetAvatarURL(u)
 }
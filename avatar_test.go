@@ -9,6 +9,17 @@ import (
 	gomniauthtest "github.com/stretchr/gomniauth/test"
 )
 
+// TestMain makes the avatars directory TestFileSystemAvatar writes to, and
+// removes it again if nothing else was left in it.
+func TestMain(m *testing.M) {
+	made := os.Mkdir("avatars", 0755) == nil
+	code := m.Run()
+	if made {
+		os.Remove("avatars")
+	}
+	os.Exit(code)
+}
+
 func TestAuthAvatar(t *testing.T) {
 	var authAvatar AuthAvatar
 	testUser := &gomniauthtest.TestUser{}
@@ -57,3 +68,67 @@ func TestFileSystemAvatar(t *testing.T) {
 		t.Errorf("FileSystemAvatar.GetAvatarURL wrongly returned %s", url)
 	}
 }
+
+func TestFileSystemAvatarWithoutDirectory(t *testing.T) {
+	saved := avatarBlobs
+	avatarBlobs = dirBlobs(path.Join(t.TempDir(), "avatars"))
+	defer func() { avatarBlobs = saved }()
+	user := &chatUser{uniqueID: "abc"}
+	if url, err := UseFileSystemAvatar.GetAvatarURL(user); err != ErrNoAvatarURL {
+		t.Errorf("FileSystemAvatar.GetAvatarURL should return ErrNoAvatarURL without an avatars directory, got %q %v", url, err)
+	}
+}
+
+func TestTryAvatarsDefault(t *testing.T) {
+	testUser := &gomniauthtest.TestUser{}
+	testUser.On("AvatarURL").Return("", ErrNoAvatarURL)
+	user := &chatUser{User: testUser, uniqueID: "nobody"}
+	url, err := TryAvatars{UseAuthAvatar, UseFileSystemAvatar}.GetAvatarURL(user)
+	if err != nil {
+		t.Errorf("TryAvatars.GetAvatarURL should not return an error, got %v", err)
+	}
+	if url != defaultAvatarURL {
+		t.Errorf("TryAvatars.GetAvatarURL should fall back to the default avatar, got %s", url)
+	}
+	if _, err := os.Stat(path.Join("assets", path.Base(defaultAvatarURL))); err != nil {
+		t.Errorf("the default avatar should be bundled: %v", err)
+	}
+}
+
+// staticAvatar gives every user the same picture.
+type staticAvatar string
+
+func (a staticAvatar) GetAvatarURL(u ChatUser) (string, error) {
+	return string(a), nil
+}
+
+func TestAvatarChain(t *testing.T) {
+	RegisterAvatar("test-static", staticAvatar("/static.png"))
+	defer func() {
+		avatarProvidersMu.Lock()
+		delete(avatarProviders, "test-static")
+		avatarProvidersMu.Unlock()
+	}()
+	chain, err := avatarChain("gravatar, test-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[0] != UseGravatar || chain[1] != staticAvatar("/static.png") {
+		t.Errorf("expected gravatar then the registered provider, got %v", chain)
+	}
+	if chain, err := avatarChain(defaultAvatarProviders); err != nil || len(chain) != 3 || chain[0] != UseFileSystemAvatar {
+		t.Errorf("expected the default chain, got %v %v", chain, err)
+	}
+	if _, err := avatarChain("filesystem,flickr"); err == nil {
+		t.Error("an unknown provider should be refused")
+	}
+	if _, err := avatarChain(" , "); err == nil {
+		t.Error("an empty chain should be refused")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice should panic")
+		}
+	}()
+	RegisterAvatar("auth", UseAuthAvatar)
+}
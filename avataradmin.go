@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// avatarUploadsBucket holds the last avatar each user uploaded, by
+	// userid, for admins to review.
+	avatarUploadsBucket = "avatar_uploads"
+	// avatarBlocksBucket holds, by userid, the users who may not upload
+	// avatars for a while.
+	avatarBlocksBucket = "avatar_blocks"
+)
+
+// avatarUpload is an avatar a user uploaded.
+type avatarUpload struct {
+	UserID string
+	Name   string
+	URL    string
+	// StaticURL is where the avatar is still: the first frame of an
+	// animated one, or the default avatar if that can't be had.
+	StaticURL   string
+	ContentType string
+	Animated    bool
+	Size        int64
+	Uploaded    time.Time
+}
+
+// avatarBlock stops a user uploading avatars until Until.
+type avatarBlock struct {
+	UserID string
+	Until  time.Time
+	By     string
+}
+
+// avatarStore keeps uploaded avatars in blobs, where FileSystemAvatar finds
+// them, and is the admin API for moderating them:
+//
+//	GET    /admin/avatars                       recent uploads, newest first
+//	DELETE /admin/avatars/{userid}              remove the user's avatar
+//	PUT    /admin/avatars/{userid}/block?for=24h  stop the user uploading for a while
+//	DELETE /admin/avatars/{userid}/block        let the user upload again
+//
+// A removed avatar's URL redirects to the default avatar, so users whose
+// sessions still point at it get that until they sign in again and are
+// given their next avatar.
+type avatarStore struct {
+	blobs BlobStore
+	state StateStore
+	// maxSize is the largest picture, in bytes, users may upload.
+	maxSize int64
+	now     func() time.Time
+}
+
+func newAvatarStore(blobs BlobStore, state StateStore) *avatarStore {
+	return &avatarStore{blobs: blobs, state: state, maxSize: defaultMaxAvatar, now: time.Now}
+}
+
+// blocked reports whether userID may not upload avatars now.
+func (s *avatarStore) blocked(userID string) bool {
+	var block avatarBlock
+	return s.state.Get(avatarBlocksBucket, userID, &block) == nil && s.now().Before(block.Until)
+}
+
+// remove deletes the avatar files of userID.
+func (s *avatarStore) remove(userID string) error {
+	names, err := s.blobs.List(userID + ".")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := s.blobs.Delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveFile serves GET /avatars/{file}, or redirects to the default avatar
+// if there is no such file. With ?static=1 an animated avatar is served as
+// its first frame, or as the default avatar if it has no still version.
+func (s *avatarStore) serveFile(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(strings.TrimPrefix(r.URL.Path, "/avatars/"))
+	if r.URL.Query().Get("static") != "" && !strings.HasSuffix(name, staticAvatarSuffix) {
+		userID := strings.TrimSuffix(name, path.Ext(name))
+		var upload avatarUpload
+		if data, modified, err := s.blobs.Get(userID + staticAvatarSuffix); err == nil {
+			http.ServeContent(w, r, userID+staticAvatarSuffix, modified, bytes.NewReader(data))
+			return
+		} else if s.state.Get(avatarUploadsBucket, userID, &upload) == nil && upload.Animated {
+			http.Redirect(w, r, defaultAvatarURL, http.StatusFound)
+			return
+		}
+	}
+	data, modified, err := s.blobs.Get(name)
+	if name == "/" || name == "." || err != nil {
+		http.Redirect(w, r, defaultAvatarURL, http.StatusFound)
+		return
+	}
+	http.ServeContent(w, r, name, modified, bytes.NewReader(data))
+}
+
+func (s *avatarStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID, op, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/avatars"), "/"), "/")
+	if userID != "" && !validAvatarUserID(userID) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && userID == "":
+		docs, err := s.state.List(avatarUploadsBucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		uploads := make([]*avatarUpload, 0, len(docs))
+		for _, doc := range docs {
+			var upload avatarUpload
+			if json.Unmarshal(doc, &upload) == nil {
+				uploads = append(uploads, &upload)
+			}
+		}
+		sort.Slice(uploads, func(i, j int) bool { return uploads[i].Uploaded.After(uploads[j].Uploaded) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(uploads)
+	case r.Method == http.MethodDelete && userID != "" && op == "":
+		if err := s.remove(userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := s.state.Delete(avatarUploadsBucket, userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && userID != "" && op == "block":
+		d, err := time.ParseDuration(r.URL.Query().Get("for"))
+		if err != nil || d <= 0 {
+			http.Error(w, "for must be a duration such as 24h", http.StatusBadRequest)
+			return
+		}
+		block := &avatarBlock{UserID: userID, Until: s.now().Add(d), By: currentUser(r).Get("email").Str()}
+		if err := s.state.Put(avatarBlocksBucket, userID, block); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(block)
+	case r.Method == http.MethodDelete && userID != "" && op == "block":
+		if err := s.state.Delete(avatarBlocksBucket, userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// validAvatarUserID reports whether userID can name avatar files without
+// reaching outside their directory or matching other users' files.
+func validAvatarUserID(userID string) bool {
+	return userID != "" && userID == path.Base(userID) && !strings.ContainsAny(userID, `*?[\.`)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/objx"
+)
+
+func avatarRequest(t *testing.T, userID, name string, content []byte) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	cookie, token := testCSRF()
+	form.WriteField(csrfField, token)
+	part, err := form.CreateFormFile("avatarFile", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+	r := withAuthCookie(http.MethodPost, "/uploader", &body, objx.New(map[string]interface{}{"userid": userID, "name": "Ann"}))
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.AddCookie(cookie)
+	return r
+}
+
+func TestAvatarModeration(t *testing.T) {
+	s := newAvatarStore(dirBlobs(t.TempDir()), newFileState(""))
+	w := httptest.NewRecorder()
+	s.upload(w, avatarRequest(t, "abc", "me.gif", testGIF(t, 2)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+	// a new avatar replaces the old one, and its still version
+	w = httptest.NewRecorder()
+	s.upload(w, avatarRequest(t, "abc", "me.gif", testPNG(t)))
+	if files, _ := s.blobs.List("abc"); len(files) != 1 || files[0] != "abc.png" {
+		t.Fatalf("want only abc.png, got %v", files)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/avatars", nil))
+	var uploads []avatarUpload
+	json.NewDecoder(w.Body).Decode(&uploads)
+	if len(uploads) != 1 || uploads[0].UserID != "abc" || uploads[0].Name != "Ann" || uploads[0].URL != "/avatars/abc.png" {
+		t.Fatalf("unexpected uploads %+v", uploads)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/avatars/abc", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("removing failed: %d %s", w.Code, w.Body)
+	}
+	if _, _, err := s.blobs.Get("abc.png"); err != ErrNoBlob {
+		t.Error("the avatar should be removed")
+	}
+	w = httptest.NewRecorder()
+	s.serveFile(w, httptest.NewRequest(http.MethodGet, "/avatars/abc.png", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != defaultAvatarURL {
+		t.Errorf("a removed avatar should redirect to the default, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/avatars/abc/block?for=24h", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("blocking failed: %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	s.upload(w, avatarRequest(t, "abc", "me.png", testPNG(t)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("a blocked user should not upload, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/avatars/abc/block", nil))
+	w = httptest.NewRecorder()
+	s.upload(w, avatarRequest(t, "abc", "me.png", testPNG(t)))
+	if w.Code != http.StatusOK {
+		t.Errorf("an unblocked user should upload again, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/avatars/..", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("user IDs should not reach outside the avatars, got %d", w.Code)
+	}
+}
+
+func TestAvatarUploadValidation(t *testing.T) {
+	s := newAvatarStore(dirBlobs(t.TempDir()), newFileState(""))
+	s.maxSize = 1 << 10
+	for _, tc := range []struct {
+		name, file string
+		content    []byte
+		code       int
+	}{
+		{"picture", "me.png", testPNG(t), http.StatusOK},
+		{"too large", "big.png", make([]byte, 2<<10), http.StatusRequestEntityTooLarge},
+		{"not a picture", "me.png", []byte("<script>alert(1)</script>"), http.StatusUnsupportedMediaType},
+		{"path in the name", `..\..\me.png`, testPNG(t), http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		s.upload(w, avatarRequest(t, "abc", tc.file, tc.content))
+		if w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.code, w.Code, w.Body)
+		}
+	}
+	files, _ := s.blobs.List("")
+	if len(files) != 1 || files[0] != "abc.png" {
+		t.Errorf("only the valid picture should be stored, got %v", files)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+// errUnsupportedAvatar is returned for uploads that are not a picture in
+// one of the formats avatars may be in.
+var errUnsupportedAvatar = errors.New("pictures must be PNG, JPEG, GIF, WebP or AVIF")
+
+const (
+	// staticAvatarSuffix ends the name of the still version of an
+	// animated avatar, next to the avatar itself.
+	staticAvatarSuffix = ".static.png"
+	// avatarSize is the width and height avatars are stored at.
+	avatarSize = 256
+	// defaultMaxAvatar is the largest picture, in bytes, users may upload
+	// unless -max-avatar says otherwise.
+	defaultMaxAvatar = 5 << 20
+	// maxAvatarPixels caps the pictures we decode, so that a small file
+	// claiming to be huge can't take all the memory.
+	maxAvatarPixels = 50 << 20
+)
+
+// avatarImage is an uploaded avatar made ready to store.
+type avatarImage struct {
+	ContentType string
+	// Ext is the extension the avatar is stored with.
+	Ext string
+	// Data is the avatar to store.
+	Data     []byte
+	Animated bool
+	// Static is a PNG of the first frame of an animated avatar, for
+	// clients that would rather not animate; nil if the avatar is still or
+	// its frames cannot be decoded here.
+	Static []byte
+}
+
+// processAvatar checks that data is a picture avatars may be and makes it
+// ready to store. Still pictures are decoded, cropped square, scaled to
+// avatarSize and encoded again, which also drops their metadata, such as
+// EXIF; a still GIF becomes a PNG. Animated GIFs are kept as uploaded, with
+// a still version of their first frame. WebP and AVIF are kept as uploaded:
+// the standard library cannot decode them, so animated ones have no still
+// version.
+func processAvatar(data []byte) (*avatarImage, error) {
+	contentType := sniffImage(data)
+	switch contentType {
+	case "image/gif", "image/png", "image/jpeg":
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxAvatarPixels {
+			return nil, errUnsupportedAvatar
+		}
+	}
+	switch contentType {
+	case "image/gif":
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil || len(g.Image) == 0 {
+			return nil, errUnsupportedAvatar
+		}
+		// frames may only cover part of the picture
+		frame := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+		draw.Draw(frame, g.Image[0].Bounds(), g.Image[0], g.Image[0].Bounds().Min, draw.Over)
+		if len(g.Image) == 1 {
+			return encodeAvatar(frame, "image/png")
+		}
+		static, err := encodePNG(scaleAvatar(frame, avatarSize))
+		if err != nil {
+			return nil, err
+		}
+		return &avatarImage{ContentType: contentType, Ext: ".gif", Data: data, Animated: true, Static: static}, nil
+	case "image/png", "image/jpeg":
+		src, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, errUnsupportedAvatar
+		}
+		return encodeAvatar(src, contentType)
+	case "image/webp":
+		// an extended WebP header has the animation flag
+		animated := len(data) > 20 && string(data[12:16]) == "VP8X" && data[20]&0x02 != 0
+		return &avatarImage{ContentType: contentType, Ext: ".webp", Data: data, Animated: animated}, nil
+	case "image/avif":
+		// image sequences have their own brand
+		return &avatarImage{ContentType: contentType, Ext: ".avif", Data: data, Animated: string(data[8:12]) == "avis"}, nil
+	}
+	return nil, errUnsupportedAvatar
+}
+
+// encodeAvatar scales src to avatarSize and encodes it as contentType,
+// image/png or image/jpeg.
+func encodeAvatar(src image.Image, contentType string) (*avatarImage, error) {
+	scaled := scaleAvatar(src, avatarSize)
+	if contentType == "image/png" {
+		data, err := encodePNG(scaled)
+		if err != nil {
+			return nil, err
+		}
+		return &avatarImage{ContentType: contentType, Ext: ".png", Data: data}, nil
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	return &avatarImage{ContentType: contentType, Ext: ".jpg", Data: buf.Bytes()}, nil
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleAvatar crops the middle square out of src and scales it to size by
+// size, averaging the pixels each one of the result covers.
+func scaleAvatar(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0, y0 := b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0, sy1 := y0+y*side/size, y0+(y+1)*side/size
+		if sy1 == sy0 {
+			sy1++
+		}
+		for x := 0; x < size; x++ {
+			sx0, sx1 := x0+x*side/size, x0+(x+1)*side/size
+			if sx1 == sx0 {
+				sx1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// sniffImage returns the content type of data, telling AVIF apart, which
+// http.DetectContentType does not.
+func sniffImage(data []byte) string {
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" && (string(data[8:12]) == "avif" || string(data[8:12]) == "avis") {
+		return "image/avif"
+	}
+	return http.DetectContentType(data)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testGIF makes a GIF of frames frames, the first of them red.
+func testGIF(t *testing.T, frames int) []byte {
+	palette := color.Palette{color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i % 2)
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessAvatar(t *testing.T) {
+	img, err := processAvatar(testGIF(t, 3))
+	if err != nil || img.ContentType != "image/gif" || img.Ext != ".gif" || !img.Animated || img.Static == nil {
+		t.Fatalf("an animated GIF should get a still version, got %+v %v", img, err)
+	}
+	still, err := png.Decode(bytes.NewReader(img.Static))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := still.At(1, 1).RGBA(); r != 0xffff || g != 0 || b != 0 {
+		t.Errorf("the still version should be the first frame, got %d %d %d", r, g, b)
+	}
+	if img, err := processAvatar(testGIF(t, 1)); err != nil || img.Animated || img.Static != nil {
+		t.Errorf("a still GIF needs no still version, got %+v %v", img, err)
+	}
+	webp := append([]byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02"), make([]byte, 16)...)
+	if img, err := processAvatar(webp); err != nil || img.Ext != ".webp" || !img.Animated || img.Static != nil {
+		t.Errorf("an animated WebP should be kept as it is, got %+v %v", img, err)
+	}
+	avif := append([]byte("\x00\x00\x00\x1cftypavif"), make([]byte, 16)...)
+	if img, err := processAvatar(avif); err != nil || img.ContentType != "image/avif" || img.Animated {
+		t.Errorf("a still AVIF should be accepted, got %+v %v", img, err)
+	}
+	if _, err := processAvatar([]byte("<svg></svg>")); err != errUnsupportedAvatar {
+		t.Errorf("other files should be refused, got %v", err)
+	}
+}
+
+func TestProcessAvatarNormalizes(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 600, 400))
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 600; x++ {
+			src.Set(x, y, color.RGBA{0, 0, 255, 255})
+			if x < 100 {
+				// cropped off the left
+				src.Set(x, y, color.RGBA{255, 0, 0, 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	// an EXIF segment, such as a camera writes with where it was
+	exif := append([]byte{0xff, 0xe1, 0x00, 0x10}, []byte("Exif\x00\x00GPS-here")...)
+	upload := append(append([]byte{0xff, 0xd8}, exif...), buf.Bytes()[2:]...)
+	img, err := processAvatar(upload)
+	if err != nil || img.Ext != ".jpg" {
+		t.Fatalf("expected a JPEG, got %+v %v", img, err)
+	}
+	if bytes.Contains(img.Data, []byte("GPS-here")) {
+		t.Error("the EXIF data should be dropped")
+	}
+	out, err := jpeg.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := out.Bounds(); b.Dx() != avatarSize || b.Dy() != avatarSize {
+		t.Errorf("expected %dx%d, got %v", avatarSize, avatarSize, b)
+	}
+	if r, _, b, _ := out.At(0, avatarSize/2).RGBA(); r > 0x2000 || b < 0xe000 {
+		t.Errorf("the picture should be cropped to its middle, got %x %x at the left edge", r, b)
+	}
+
+	img, err = processAvatar(testGIF(t, 1))
+	if err != nil || img.ContentType != "image/png" || img.Ext != ".png" {
+		t.Errorf("a still GIF should become a PNG, got %+v %v", img, err)
+	}
+	if _, err := processAvatar(testPNG(t)[:30]); err != errUnsupportedAvatar {
+		t.Errorf("a broken picture should be refused, got %v", err)
+	}
+}
+
+func TestStaticAvatar(t *testing.T) {
+	s := newAvatarStore(dirBlobs(t.TempDir()), newFileState(""))
+	s.upload(httptest.NewRecorder(), avatarRequest(t, "abc", "me.gif", testGIF(t, 2)))
+	w := httptest.NewRecorder()
+	s.serveFile(w, httptest.NewRequest(http.MethodGet, "/avatars/abc.gif?static=1", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("the still version should be served, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	w = httptest.NewRecorder()
+	s.serveFile(w, httptest.NewRequest(http.MethodGet, "/avatars/abc.gif", nil))
+	if w.Header().Get("Content-Type") != "image/gif" {
+		t.Errorf("the animation should be served by default, got %s", w.Header().Get("Content-Type"))
+	}
+
+	webp := append([]byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02"), make([]byte, 16)...)
+	s.upload(httptest.NewRecorder(), avatarRequest(t, "def", "me.webp", webp))
+	w = httptest.NewRecorder()
+	s.serveFile(w, httptest.NewRequest(http.MethodGet, "/avatars/def.webp?static=1", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != defaultAvatarURL {
+		t.Errorf("an animation without a still version should fall back to the default, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// bandwidthCap limits how many bytes a second each user may send and be
+// sent over their websockets, on this server, counting every connection and
+// room. Up to Burst bytes may go at once. A zero Rate is no limit.
+type bandwidthCap struct {
+	Rate  int64
+	Burst int64
+}
+
+// bandwidthMeter keeps a bucket of bytes for each user and direction.
+// Connections over the cap are slowed down rather than cut off: reading
+// from a client that sends too much waits, which holds it back through TCP
+// flow control, and writing to one that is sent too much waits, so its
+// send buffer fills and it misses messages like any slow client. A nil
+// *bandwidthMeter caps nothing.
+type bandwidthMeter struct {
+	limit bandwidthCap
+
+	mu      sync.Mutex
+	buckets map[string]*byteBucket
+}
+
+// byteBucket holds the bytes a user may still move in one direction. It
+// may go negative after a frame larger than what was left.
+type byteBucket struct {
+	bytes float64
+	last  time.Time
+}
+
+// maxBandwidthBuckets is how many buckets a meter keeps before forgetting
+// the full ones.
+const maxBandwidthBuckets = 10000
+
+func newBandwidthMeter(limit bandwidthCap) *bandwidthMeter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if limit.Burst < limit.Rate {
+		limit.Burst = limit.Rate
+	}
+	return &bandwidthMeter{limit: limit, buckets: make(map[string]*byteBucket)}
+}
+
+// take takes n bytes from the bucket of userID for dir, "in" or "out", and
+// reports how long the connection should wait before moving more.
+func (m *bandwidthMeter) take(userID, dir string, n int, now time.Time) time.Duration {
+	if m == nil || userID == "" {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := dir + ":" + userID
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= maxBandwidthBuckets {
+			m.forget(now)
+		}
+		b = &byteBucket{bytes: float64(m.limit.Burst), last: now}
+		m.buckets[key] = b
+	}
+	b.bytes += now.Sub(b.last).Seconds() * float64(m.limit.Rate)
+	if b.bytes > float64(m.limit.Burst) {
+		b.bytes = float64(m.limit.Burst)
+	}
+	b.last = now
+	b.bytes -= float64(n)
+	if b.bytes >= 0 {
+		return 0
+	}
+	return time.Duration(-b.bytes / float64(m.limit.Rate) * float64(time.Second))
+}
+
+// forget drops the buckets that have filled up again, which are the same
+// as new ones. It is called with m.mu held.
+func (m *bandwidthMeter) forget(now time.Time) {
+	for key, b := range m.buckets {
+		if b.bytes+now.Sub(b.last).Seconds()*float64(m.limit.Rate) >= float64(m.limit.Burst) {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestBandwidthMeter(t *testing.T) {
+	if newBandwidthMeter(bandwidthCap{}) != nil {
+		t.Fatal("no rate should be no meter")
+	}
+	m := newBandwidthMeter(bandwidthCap{Rate: 100, Burst: 200})
+	now := time.Now()
+	if wait := m.take("ann", "in", 150, now); wait != 0 {
+		t.Errorf("the burst should go at once, waited %v", wait)
+	}
+	if wait := m.take("ann", "in", 100, now); wait != 500*time.Millisecond {
+		t.Errorf("50 bytes over at 100 a second should wait 500ms, waited %v", wait)
+	}
+	if wait := m.take("ann", "out", 150, now); wait != 0 {
+		t.Errorf("each direction should have its own bucket, waited %v", wait)
+	}
+	if wait := m.take("ann", "in", 50, now.Add(time.Second)); wait != 0 {
+		t.Errorf("the bucket should refill, waited %v", wait)
+	}
+}
+
+func TestClientBytesAreCounted(t *testing.T) {
+	r := newRoomManager().get("golang")
+	r.metrics = newMetrics()
+	server := httptest.NewServer(r)
+	defer server.Close()
+	conn := dialRoom(t, server, objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"}))
+	conn.WriteJSON(&message{ID: "one", Message: "counted"})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == msgTypeAck {
+			break
+		}
+	}
+	clients := r.do(controlList, "", nil)
+	if len(clients) != 1 || clients[0].BytesIn == 0 || clients[0].BytesOut == 0 {
+		t.Errorf("expected bytes both ways, got %+v", clients)
+	}
+	r.metrics.mu.Lock()
+	in := r.metrics.socketBytes["in"]
+	r.metrics.mu.Unlock()
+	if in != uint64(clients[0].BytesIn) {
+		t.Errorf("metrics should count %d bytes in, got %d", clients[0].BytesIn, in)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// roomBansBucket holds the users banned from each room, by room/userid.
+const roomBansBucket = "room_bans"
+
+// roomBan keeps a user out of a room until Until, or for good if it is zero.
+type roomBan struct {
+	Room   string
+	UserID string
+	Reason string `json:",omitempty"`
+	By     string
+	Banned time.Time
+	Until  time.Time `json:",omitempty"`
+}
+
+// active reports whether the ban still applies at now.
+func (b *roomBan) active(now time.Time) bool {
+	return b.Until.IsZero() || now.Before(b.Until)
+}
+
+// banned returns the ban keeping the user with userID out of room at now,
+// or nil if there is none.
+func banned(state StateStore, room, userID string, now time.Time) (*roomBan, error) {
+	if userID == "" {
+		return nil, nil
+	}
+	var ban roomBan
+	switch err := state.Get(roomBansBucket, room+"/"+userID, &ban); {
+	case err == ErrNoState:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case !ban.active(now):
+		return nil, nil
+	}
+	return &ban, nil
+}
+
+// roomBans returns the bans of room that apply at now.
+func roomBans(state StateStore, room string, now time.Time) ([]*roomBan, error) {
+	docs, err := state.List(roomBansBucket)
+	if err != nil {
+		return nil, err
+	}
+	bans := []*roomBan{}
+	for key, doc := range docs {
+		if !strings.HasPrefix(key, room+"/") {
+			continue
+		}
+		var ban roomBan
+		if json.Unmarshal(doc, &ban) == nil && ban.active(now) {
+			bans = append(bans, &ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].UserID < bans[j].UserID })
+	return bans, nil
+}
+
+// removeUser has run send every client of the user with userID a
+// disconnect message saying reason and remove them from the room.
+func (r *room) removeUser(userID, reason string) []clientInfo {
+	msg := &message{ID: newID(), Type: msgTypeDisconnect, Room: r.name, Name: "system", Message: reason, When: time.Now()}
+	req := &roomControl{op: controlRemove, userID: userID, msg: msg, done: make(chan []clientInfo)}
+	r.control <- req
+	return <-req.done
+}
+
+// removeUser disconnects the user with userID from room on every server.
+func (m *roomManager) removeUser(room, userID, reason string) {
+	// the other servers disconnect them when they see the kick
+	m.publish(&message{ID: newID(), Type: msgTypeKick, Room: room, Name: "system", Target: userID, Message: reason, When: time.Now()})
+	if r, ok := m.lookup(room); ok {
+		r.removeUser(userID, reason)
+	}
+}
+
+// serveBans is the bans part of the rooms API:
+//
+//	GET    /api/rooms/{name}/bans           the users banned from the room
+//	PUT    /api/rooms/{name}/bans/{userid}  ban one: {"Reason", "Duration"}
+//	DELETE /api/rooms/{name}/bans/{userid}  lift a ban
+//
+// Only the room's moderators, owner and the admins may see or change its
+// bans, and nobody may ban someone of their own rank or above. Duration is
+// in seconds; without one the ban lasts until it is lifted. A banned user is
+// disconnected and refused when they try to join again.
+func (a *roomSettingsAPI) serveBans(w http.ResponseWriter, r *http.Request, name, userID string, user map[string]interface{}) {
+	role, err := roleOf(a.state, name, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowed(role, permKick) {
+		http.Error(w, "only the room's moderators may ban", http.StatusForbidden)
+		return
+	}
+	now := time.Now()
+	switch {
+	case r.Method == http.MethodGet && userID == "":
+		bans, err := roomBans(a.state, name, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bans)
+	case r.Method == http.MethodPut && userID != "":
+		var req struct {
+			Reason   string
+			Duration int64
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Duration < 0 {
+				http.Error(w, "body must be {\"Reason\": \"...\", \"Duration\": seconds} or empty", http.StatusBadRequest)
+				return
+			}
+		}
+		target, err := userRole(a.state, name, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if roleRank[target] >= roleRank[role] {
+			http.Error(w, "you may only ban those below you", http.StatusForbidden)
+			return
+		}
+		by, _ := user["userid"].(string)
+		ban := &roomBan{Room: name, UserID: userID, Reason: req.Reason, By: by, Banned: now}
+		if req.Duration > 0 {
+			ban.Until = now.Add(time.Duration(req.Duration) * time.Second)
+		}
+		if err := a.state.Put(roomBansBucket, name+"/"+userID, ban); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if a.rooms != nil {
+			reason := "You were banned from this room."
+			if req.Reason != "" {
+				reason += " " + req.Reason
+			}
+			a.rooms.removeUser(name, userID, reason)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ban)
+	case r.Method == http.MethodDelete && userID != "":
+		if err := a.state.Delete(roomBansBucket, name+"/"+userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
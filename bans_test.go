@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestBanRemovesAndKeepsOut(t *testing.T) {
+	rooms := newRoomManager()
+	r := rooms.get("golang")
+	r.state.Put(roomSettingsBucket, "golang", roomSettings{Room: "golang", Owner: "ann"})
+	api := &roomSettingsAPI{state: r.state, rooms: rooms}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})
+	serve := func(method, path, body string, user objx.Map) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(method, path, strings.NewReader(body), user))
+		return w
+	}
+
+	c := &client{send: make(chan *message, messageBufferSize), room: r, userData: bob}
+	r.join <- c
+	waitMembers(t, r, 1)
+	if w := serve(http.MethodPut, "/api/rooms/golang/bans/ann", "", bob); w.Code != http.StatusForbidden {
+		t.Errorf("a member may not ban, got %d", w.Code)
+	}
+	if w := serve(http.MethodPut, "/api/rooms/golang/bans/bob", `{"Reason": "spam"}`, ann); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	for {
+		msg, ok := <-c.send
+		if !ok {
+			t.Fatal("expected a disconnect before the send channel closed")
+		}
+		if msg.Type == msgTypeDisconnect {
+			if !strings.Contains(msg.Message, "spam") {
+				t.Errorf("expected the reason, got %q", msg.Message)
+			}
+			break
+		}
+	}
+	// removing bob closes his send channel
+	for range c.send {
+	}
+	waitMembers(t, r, 0)
+	// and his connection leaving afterwards is harmless
+	r.leave <- c
+	if n := len(r.do(controlList, "", nil)); n != 0 {
+		t.Errorf("bob should have been removed from the room, %d clients left", n)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, withAuthCookie(http.MethodGet, "/room", nil, bob))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("a banned user should be refused, got %d", w.Code)
+	}
+	if w := serve(http.MethodGet, "/api/rooms/golang/bans", "", ann); !strings.Contains(w.Body.String(), `"bob"`) {
+		t.Errorf("expected bob's ban listed, got %s", w.Body)
+	}
+	if w := serve(http.MethodDelete, "/api/rooms/golang/bans/bob", "", ann); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if ban, _ := banned(r.state, "golang", "bob", time.Now()); ban != nil {
+		t.Errorf("the ban should be lifted, got %+v", ban)
+	}
+}
+
+func TestBanExpires(t *testing.T) {
+	state := newFileState("")
+	now := time.Now()
+	state.Put(roomBansBucket, "golang/bob", roomBan{Room: "golang", UserID: "bob", Banned: now, Until: now.Add(time.Hour)})
+	if ban, _ := banned(state, "golang", "bob", now); ban == nil {
+		t.Error("bob should be banned for an hour")
+	}
+	if ban, _ := banned(state, "golang", "bob", now.Add(2*time.Hour)); ban != nil {
+		t.Error("the ban should have expired")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNoBlob is returned by BlobStore.Get for a name nothing is stored under.
+var ErrNoBlob = errors.New("chat: no such blob")
+
+// BlobStore keeps named files, such as uploaded avatars. Names are plain
+// file names, without slashes.
+type BlobStore interface {
+	// Put stores data under name, replacing what was there.
+	Put(name string, data []byte) error
+	// Get returns what is stored under name and when it was stored, or
+	// ErrNoBlob.
+	Get(name string) ([]byte, time.Time, error)
+	// Delete removes name; removing a name that is not there is not an
+	// error.
+	Delete(name string) error
+	// List returns the names starting with prefix, sorted.
+	List(prefix string) ([]string, error)
+}
+
+// newBlobStore opens the blob store described by spec:
+//
+//	<dir>                            files in a local directory
+//	s3://<bucket>[/<prefix>]?endpoint=<url>&region=<region>
+//	                                 an S3 compatible object store, such as
+//	                                 AWS S3, MinIO or Google Cloud Storage
+//	                                 with HMAC keys; the credentials are the
+//	                                 blob_store_credentials secret,
+//	                                 "<access key>:<secret key>"
+func newBlobStore(spec string, secrets SecretSource) (BlobStore, error) {
+	if !strings.HasPrefix(spec, "s3://") {
+		return dirBlobs(spec), nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("blob store %q: want s3://bucket/prefix?endpoint=...", spec)
+	}
+	store := &s3Blobs{
+		endpoint: strings.TrimSuffix(u.Query().Get("endpoint"), "/"),
+		region:   u.Query().Get("region"),
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		client:   &http.Client{Timeout: 30 * time.Second},
+		now:      time.Now,
+	}
+	if store.endpoint == "" {
+		store.endpoint = "https://s3.amazonaws.com"
+	}
+	if store.region == "" {
+		store.region = "us-east-1"
+	}
+	if secrets == nil {
+		return nil, errors.New("s3 blob store: no secrets to read blob_store_credentials from")
+	}
+	credentials, err := secrets.Secret("blob_store_credentials")
+	if err != nil {
+		return nil, fmt.Errorf("s3 blob store: blob_store_credentials secret: %w", err)
+	}
+	var ok bool
+	if store.accessKey, store.secretKey, ok = strings.Cut(credentials, ":"); !ok {
+		return nil, errors.New("s3 blob store: blob_store_credentials must be access key:secret key")
+	}
+	return store, nil
+}
+
+// dirBlobs keeps blobs as files in a directory.
+type dirBlobs string
+
+func (d dirBlobs) path(name string) string {
+	return filepath.Join(string(d), filepath.Base(name))
+}
+
+func (d dirBlobs) Put(name string, data []byte) error {
+	// uploads fail until it exists
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.path(name), data, 0644)
+}
+
+func (d dirBlobs) Get(name string) ([]byte, time.Time, error) {
+	info, err := os.Stat(d.path(name))
+	if os.IsNotExist(err) || err == nil && info.IsDir() {
+		return nil, time.Time{}, ErrNoBlob
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := ioutil.ReadFile(d.path(name))
+	return data, info.ModTime(), err
+}
+
+func (d dirBlobs) Delete(name string) error {
+	if err := os.Remove(d.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d dirBlobs) List(prefix string) ([]string, error) {
+	files, err := ioutil.ReadDir(string(d))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasPrefix(file.Name(), prefix) {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+// s3Blobs keeps blobs in a bucket of an S3 compatible object store, under
+// prefix, signing its requests with AWS Signature Version 4. Buckets are
+// addressed by path, which every such store supports.
+type s3Blobs struct {
+	endpoint  string
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+// key returns the object key of name.
+func (s *s3Blobs) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+// do sends a signed request for the object key, or the bucket if key is
+// empty, and returns the response if its status is 2xx.
+func (s *s3Blobs) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := s.endpoint + "/" + s.bucket + "/" + key
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && method == http.MethodGet && key != "" {
+			return nil, ErrNoBlob
+		}
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 Authorization header to req, whose
+// body is body. Every header already set is signed, along with host and
+// the x-amz- headers sign adds.
+func (s *s3Blobs) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := stamp[:8]
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	// the query must be sorted, with spaces as %20
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), query, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	key := mac([]byte("AWS4"+s.secretKey), []byte(day))
+	key = mac(key, []byte(s.region))
+	key = mac(key, []byte("s3"))
+	key = mac(key, []byte("aws4_request"))
+	signature := hex.EncodeToString(mac(key, []byte(toSign)))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func (s *s3Blobs) Put(name string, data []byte) error {
+	resp, err := s.do(http.MethodPut, s.key(name), nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Blobs) Get(name string) ([]byte, time.Time, error) {
+	resp, err := s.do(http.MethodGet, s.key(name), nil, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, modified, err
+}
+
+func (s *s3Blobs) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, s.key(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Blobs) List(prefix string) ([]string, error) {
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.key(prefix)}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents              []struct{ Key string }
+			NextContinuationToken string
+			IsTruncated           bool
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list: %w", err)
+		}
+		for _, object := range page.Contents {
+			names = append(names, path.Base(object.Key))
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+const (
+	// botsBucket holds a botAccount per bot, by userid.
+	botsBucket = "bots"
+	// botIDPrefix starts the userid of every bot, so that no user signing
+	// in can have it.
+	botIDPrefix = "bot-"
+)
+
+// botAccount is a bot an admin created. It signs in with the tokens issued
+// for it, connecting to /room or posting with POST
+// /api/rooms/{name}/messages, and its messages are marked as a bot's.
+// Scopes limits what all of its tokens may do.
+type botAccount struct {
+	UserID    string
+	Name      string
+	AvatarURL string
+	Scopes    botScopes
+	Created   time.Time
+	By        string
+}
+
+// botScopes is what a bot may do, besides what any user may.
+type botScopes struct {
+	// Rooms are the rooms the bot may enter; it may enter any if empty.
+	Rooms []string `json:",omitempty"`
+	// ReadOnly bots may watch rooms and read the API, but not post or
+	// change anything.
+	ReadOnly bool `json:",omitempty"`
+	// Commands is whether the bot may use slash commands.
+	Commands bool `json:",omitempty"`
+}
+
+// inRoom reports whether the scopes let the bot enter room.
+func (s botScopes) inRoom(room string) bool {
+	if len(s.Rooms) == 0 {
+		return true
+	}
+	for _, r := range s.Rooms {
+		if r == room {
+			return true
+		}
+	}
+	return false
+}
+
+// userData returns the bot's user data, in the same shape as a session's.
+func (b *botAccount) userData() objx.Map {
+	return objx.New(map[string]interface{}{
+		"userid":     b.UserID,
+		"name":       b.Name,
+		"avatar_url": b.AvatarURL,
+		"bot":        true,
+		"scopes":     b.Scopes,
+	})
+}
+
+// isBot reports whether userData is a bot's.
+func isBot(userData map[string]interface{}) bool {
+	bot, _ := userData["bot"].(bool)
+	return bot
+}
+
+// scopesOf returns the scopes of the bot in userData, and whether it is a
+// bot at all; users have none.
+func scopesOf(userData map[string]interface{}) (botScopes, bool) {
+	scopes, _ := userData["scopes"].(botScopes)
+	return scopes, isBot(userData)
+}
+
+// mayChange reports whether the user in userData may post or change
+// anything: anyone but a read-only bot.
+func mayChange(userData map[string]interface{}) bool {
+	scopes, bot := scopesOf(userData)
+	return !bot || !scopes.ReadOnly
+}
+
+// mayUseCommands reports whether the user in userData may use slash
+// commands: users may, and bots given the Commands scope.
+func mayUseCommands(userData map[string]interface{}) bool {
+	scopes, bot := scopesOf(userData)
+	return !bot || scopes.Commands && !scopes.ReadOnly
+}
+
+// validScopes reports what is wrong with scopes, if anything.
+func validScopes(scopes botScopes) error {
+	for _, room := range scopes.Rooms {
+		if !validRoomName(room) {
+			return fmt.Errorf("%q is not a room name", room)
+		}
+	}
+	return nil
+}
+
+// botStore keeps the bots in a StateStore. rooms, if set, is where a
+// deleted bot's connections are closed.
+type botStore struct {
+	state StateStore
+	rooms *roomManager
+	audit *auditLog
+}
+
+// botAccounts are the bots of this server. main replaces it with one kept
+// with the server's state.
+var botAccounts = &botStore{state: newFileState("")}
+
+// lookup returns the bot with userID, or nil if there is none.
+func (s *botStore) lookup(userID string) (*botAccount, error) {
+	var bot botAccount
+	switch err := s.state.Get(botsBucket, userID, &bot); err {
+	case nil:
+		return &bot, nil
+	case ErrNoState:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// ServeHTTP is the admin API for bots:
+//
+//	GET    /admin/bots                 the bots
+//	POST   /admin/bots                 create one: {"ID": "deploy", "Name": "Deploy bot", "AvatarURL": "...", "TTL": "720h", "Scopes": {...}}
+//	POST   /admin/bots/{userid}/token  issue another token: {"TTL": "720h"}
+//	PUT    /admin/bots/{userid}/scopes change what it may do: {"Rooms": ["ops"], "ReadOnly": false, "Commands": true}
+//	DELETE /admin/bots/{userid}        delete a bot, which ends its tokens and connections
+//
+// Creating a bot and issuing a token answer with the token, which is not
+// kept. A bot's userid is its ID with botIDPrefix before it; bots without
+// an avatar get an identicon. Its scopes hold for all its tokens; changing
+// them closes its connections, so it reconnects with the new ones. Changes
+// are recorded in the audit log.
+func (s *botStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID, op, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/bots"), "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && userID == "":
+		docs, err := s.state.List(botsBucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list := []*botAccount{}
+		for _, doc := range docs {
+			var bot botAccount
+			if json.Unmarshal(doc, &bot) == nil {
+				list = append(list, &bot)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].UserID < list[j].UserID })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPost && userID == "":
+		var req struct {
+			ID, Name, AvatarURL, TTL string
+			Scopes                   botScopes
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validID(req.ID) || strings.TrimSpace(req.Name) == "" {
+			http.Error(w, "body must be {\"ID\": \"...\", \"Name\": \"...\"}, the ID made of letters, digits, '-' or '_'", http.StatusBadRequest)
+			return
+		}
+		if err := validScopes(req.Scopes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl, err := tokenTTL(req.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bot := &botAccount{UserID: botIDPrefix + req.ID, Name: strings.TrimSpace(req.Name), AvatarURL: req.AvatarURL, Scopes: req.Scopes,
+			Created: time.Now(), By: currentUser(r).Get("email").Str()}
+		if bot.AvatarURL == "" {
+			bot.AvatarURL = fmt.Sprintf("//www.gravatar.com/avatar/%x?d=identicon&f=y", md5.Sum([]byte(bot.UserID)))
+		}
+		created, err := s.state.Create(botsBucket, bot.UserID, bot)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !created {
+			http.Error(w, "there is already a bot with that ID", http.StatusConflict)
+			return
+		}
+		s.record(r, "create_bot", bot.UserID)
+		s.serveToken(w, bot, ttl, http.StatusCreated)
+	case r.Method == http.MethodPost && userID != "" && op == "token":
+		var req struct{ TTL string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "body must be {\"TTL\": \"720h\"} or empty", http.StatusBadRequest)
+			return
+		}
+		ttl, err := tokenTTL(req.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bot, err := s.lookup(userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if bot == nil {
+			http.Error(w, "no such bot", http.StatusNotFound)
+			return
+		}
+		s.record(r, "issue_bot_token", bot.UserID)
+		s.serveToken(w, bot, ttl, http.StatusOK)
+	case r.Method == http.MethodPut && userID != "" && op == "scopes":
+		var scopes botScopes
+		if err := json.NewDecoder(r.Body).Decode(&scopes); err != nil {
+			http.Error(w, "body must be {\"Rooms\": [...], \"ReadOnly\": false, \"Commands\": false}", http.StatusBadRequest)
+			return
+		}
+		if err := validScopes(scopes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bot, err := s.lookup(userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if bot == nil {
+			http.Error(w, "no such bot", http.StatusNotFound)
+			return
+		}
+		bot.Scopes = scopes
+		if err := s.state.Put(botsBucket, bot.UserID, bot); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if s.rooms != nil {
+			s.rooms.signOut(bot.UserID, "", "This bot's scopes changed; connect again.")
+		}
+		s.record(r, "change_bot_scopes", bot.UserID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bot)
+	case r.Method == http.MethodDelete && userID != "" && op == "":
+		bot, err := s.lookup(userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if bot == nil {
+			http.Error(w, "no such bot", http.StatusNotFound)
+			return
+		}
+		if err := s.state.Delete(botsBucket, userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if s.rooms != nil {
+			s.rooms.signOut(userID, "", "This bot was deleted.")
+		}
+		s.record(r, "delete_bot", userID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// serveToken answers with a new token for bot that lasts ttl.
+func (s *botStore) serveToken(w http.ResponseWriter, bot *botAccount, ttl time.Duration, status int) {
+	token, err := issueToken(bot.userData(), ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"Bot": bot, "Token": token, "Expires": time.Now().Add(ttl)})
+}
+
+func (s *botStore) record(r *http.Request, action, userID string) {
+	if s.audit == nil {
+		return
+	}
+	if err := s.audit.record(r, action, userID); err != nil && s.rooms != nil {
+		s.rooms.tracer.Error("Failed to record ", action, " in the audit log: ", err)
+	}
+}
+
+// serveMessages is the messages part of the rooms API, for bots:
+//
+//	POST /api/rooms/{name}/messages  post a message: {"Text": "...", "Components": [...]}
+//
+// The message goes through what a message sent over a websocket does: the
+// rate limit, quotas, bans, mutes and moderation. Only being refused before
+// it reaches the room is answered with an error; a bot has no connection to
+// be told it was muted or moderated.
+func (a *roomSettingsAPI) serveMessages(w http.ResponseWriter, r *http.Request, name string, user map[string]interface{}) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isBot(user) || a.rooms == nil {
+		http.Error(w, "only bots may post messages over HTTP; users send them over the websocket", http.StatusForbidden)
+		return
+	}
+	if !mayChange(user) {
+		http.Error(w, "this bot may only read", http.StatusForbidden)
+		return
+	}
+	var req struct {
+		Text       string
+		Components []component
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+		http.Error(w, "body must be {\"Text\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	if err := validComponents(req.Components); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if max := a.rooms.maxMessage; max > 0 && len(req.Text) > max {
+		http.Error(w, fmt.Sprintf("messages may be at most %d bytes", max), http.StatusRequestEntityTooLarge)
+		return
+	}
+	userData := objx.Map(user)
+	userID := userData.Get("userid").Str()
+	now := time.Now()
+	// getting an archived room would start it again
+	settings, err := loadRoomSettings(a.state, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if settings.Archived {
+		http.Error(w, "this room has been archived", http.StatusGone)
+		return
+	}
+	if ban, err := banned(a.state, name, userID, now); err != nil || ban != nil {
+		http.Error(w, "the bot is banned from this room", http.StatusForbidden)
+		return
+	}
+	if ok, wait := a.rooms.rateLimit.forUser(user).take(a.rooms.limiter, userID, "", now); !ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+		http.Error(w, "too many messages", http.StatusTooManyRequests)
+		return
+	}
+	if _, err := a.rooms.meter.allow(workspaceOf(userData), userID, 1, int64(len(req.Text))); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	msg := &message{
+		ID:         newID(),
+		Type:       msgTypeMessage,
+		UserID:     userID,
+		Name:       userData.Get("name").Str(),
+		AvatarURL:  userData.Get("avatar_url").Str(),
+		Bot:        true,
+		Message:    req.Text,
+		Components: req.Components,
+		Links:      a.rooms.expander.expand(req.Text),
+		When:       now,
+	}
+	a.rooms.get(name).forward <- msg
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"ID": msg.ID})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/objx"
+)
+
+func withBots(t *testing.T) *botStore {
+	saved := botAccounts
+	botAccounts = &botStore{state: newFileState("")}
+	t.Cleanup(func() { botAccounts = saved })
+	return botAccounts
+}
+
+func TestBotAccounts(t *testing.T) {
+	s := withBots(t)
+	admin := objx.New(map[string]interface{}{"userid": "root", "email": "root@example.com"})
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, withAuthCookie(method, path, strings.NewReader(body), admin))
+		return w
+	}
+	var created struct {
+		Bot   botAccount
+		Token string
+	}
+	w := serve(http.MethodPost, "/admin/bots", `{"ID": "deploy", "Name": "Deploy bot"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil || created.Bot.UserID != "bot-deploy" || created.Bot.By != "root@example.com" ||
+		!strings.Contains(created.Bot.AvatarURL, "identicon") || created.Token == "" {
+		t.Fatalf("unexpected bot %+v %v", created, err)
+	}
+	if w := serve(http.MethodPost, "/admin/bots", `{"ID": "deploy", "Name": "Another"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a taken ID, got %d", w.Code)
+	}
+	if w := serve(http.MethodPost, "/admin/bots", `{"ID": "../x", "Name": "Bad"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad ID, got %d", w.Code)
+	}
+
+	user, err := readToken(created.Token)
+	if err != nil || !isBot(user) || user.Get("userid").Str() != "bot-deploy" || user.Get("name").Str() != "Deploy bot" {
+		t.Fatalf("the token should sign in as the bot, got %v %v", user, err)
+	}
+	if w := serve(http.MethodPost, "/admin/bots/bot-deploy/token", `{"TTL": "720h"}`); w.Code != http.StatusOK {
+		t.Errorf("expected another token, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(http.MethodPost, "/admin/bots/bot-deploy/token", `{"TTL": "10000h"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for too long a TTL, got %d", w.Code)
+	}
+	var list []botAccount
+	if err := json.NewDecoder(serve(http.MethodGet, "/admin/bots", "").Body).Decode(&list); err != nil || len(list) != 1 || list[0].Name != "Deploy bot" {
+		t.Errorf("unexpected bots %+v %v", list, err)
+	}
+
+	if w := serve(http.MethodDelete, "/admin/bots/bot-deploy", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := readToken(created.Token); err != errBadToken {
+		t.Errorf("a deleted bot's token should not sign in, got %v", err)
+	}
+	if w := serve(http.MethodDelete, "/admin/bots/bot-deploy", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted bot, got %d", w.Code)
+	}
+}
+
+func TestBotPostsOverHTTP(t *testing.T) {
+	rooms := newRoomManager()
+	r := rooms.get("golang")
+	api := &roomSettingsAPI{state: r.state, rooms: rooms}
+	bot := &botAccount{UserID: "bot-deploy", Name: "Deploy bot", AvatarURL: "/avatars/deploy.png"}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	serve := func(body string, user objx.Map) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(http.MethodPost, "/api/rooms/golang/messages", strings.NewReader(body), user))
+		return w
+	}
+	c := &client{send: make(chan *message, messageBufferSize), room: r, userData: ann}
+	r.join <- c
+	waitMembers(t, r, 1)
+
+	if w := serve(`{"Text": "hi"}`, ann); w.Code != http.StatusForbidden {
+		t.Errorf("users should not post over HTTP, got %d", w.Code)
+	}
+	if w := serve(`{"Text": "deployed v1.2"}`, bot.userData()); w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body)
+	}
+	msg := receiveChat(t, c)
+	if msg.Message != "deployed v1.2" || !msg.Bot || msg.UserID != "bot-deploy" || msg.AvatarURL != "/avatars/deploy.png" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if w := serve(`{"Text": "`+strings.Repeat("x", defaultMaxMessage+1)+`"}`, bot.userData()); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for too long a message, got %d", w.Code)
+	}
+}
+
+func TestBotScopes(t *testing.T) {
+	s := withBots(t)
+	admin := objx.New(map[string]interface{}{"userid": "root", "email": "root@example.com"})
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, withAuthCookie(method, path, strings.NewReader(body), admin))
+		return w
+	}
+	if w := serve(http.MethodPost, "/admin/bots", `{"ID": "ops", "Name": "Ops bot", "Scopes": {"Rooms": ["ops"], "Commands": true}}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	bot, _ := s.lookup("bot-ops")
+	token, _ := issueToken(bot.userData(), time.Hour)
+	user, _ := readToken(token)
+	for room, want := range map[string]bool{"ops": true, "golang": false} {
+		if ok, err := canEnter(s.state, room, user); err != nil || ok != want {
+			t.Errorf("%s: expected %v, got %v %v", room, want, ok, err)
+		}
+	}
+	if !mayChange(user) || !mayUseCommands(user) {
+		t.Error("the bot should post and use commands")
+	}
+
+	if w := serve(http.MethodPut, "/admin/bots/bot-ops/scopes", `{"Rooms": ["../x"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad room, got %d", w.Code)
+	}
+	if w := serve(http.MethodPut, "/admin/bots/bot-nope/scopes", `{}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for no bot, got %d", w.Code)
+	}
+	if w := serve(http.MethodPut, "/admin/bots/bot-ops/scopes", `{"ReadOnly": true}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	// the same token now has the new scopes
+	user, _ = readToken(token)
+	if ok, _ := canEnter(s.state, "golang", user); !ok || mayChange(user) || mayUseCommands(user) {
+		t.Errorf("the bot should read any room and do nothing else, got %v", user)
+	}
+	for _, bot := range []objx.Map{objx.New(map[string]interface{}{"userid": "ann"}), (&botAccount{UserID: "bot-x"}).userData()} {
+		if !mayChange(bot) {
+			t.Errorf("%v should be able to post", bot)
+		}
+	}
+	if mayUseCommands((&botAccount{UserID: "bot-x"}).userData()) {
+		t.Error("bots should only use commands when allowed to")
+	}
+
+	h := MustAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for method, want := range map[string]int{http.MethodGet: http.StatusOK, http.MethodPost: http.StatusForbidden, http.MethodDelete: http.StatusForbidden} {
+		r := httptest.NewRequest(method, "/api/rooms", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s by a read-only bot: expected %d, got %d", method, want, w.Code)
+		}
+	}
+}
+
+func TestBotScopesOverWebsocket(t *testing.T) {
+	s := withBots(t)
+	rooms := newRoomManager()
+	dial := func(room string, bot *botAccount) (*websocket.Conn, *http.Response, error) {
+		s.state.Put(botsBucket, bot.UserID, bot)
+		token, _ := issueToken(bot.userData(), time.Hour)
+		server := httptest.NewServer(rooms.get(room))
+		t.Cleanup(server.Close)
+		return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"Authorization": {"Bearer " + token}})
+	}
+	notice := func(conn *websocket.Conn) string {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var msg message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type == msgTypeNotice {
+				return msg.Message
+			}
+		}
+	}
+
+	if _, resp, err := dial("golang", &botAccount{UserID: "bot-ops", Scopes: botScopes{Rooms: []string{"ops"}}}); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("the bot should not enter a room outside its scopes, got %v", err)
+	}
+	reader, _, err := dial("ops", &botAccount{UserID: "bot-reader", Scopes: botScopes{Rooms: []string{"ops"}, ReadOnly: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	reader.WriteJSON(&message{Message: "hi"})
+	if got := notice(reader); got != "This bot may only read." {
+		t.Errorf("unexpected notice %q", got)
+	}
+	poster, _, err := dial("ops", &botAccount{UserID: "bot-poster"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poster.Close()
+	poster.WriteJSON(&message{Message: "/create-from-template standup"})
+	if got := notice(poster); got != "This bot may not use commands." {
+		t.Errorf("unexpected notice %q", got)
+	}
+}
+
+func TestBotRateClass(t *testing.T) {
+	limit := rateLimit{Rate: 2, Burst: 10, IPRate: 5, IPBurst: 50, BotRate: 1, BotBurst: 1, Policy: rateLimitDrop}
+	if got := limit.forUser(map[string]interface{}{"userid": "ann"}); got != limit {
+		t.Errorf("users should have the user limit, got %+v", got)
+	}
+	if got := limit.forUser((&botAccount{UserID: "bot-x"}).userData()); got != (rateLimit{Rate: 1, Burst: 1, Policy: rateLimitDrop}) {
+		t.Errorf("bots should have the bot limit, got %+v", got)
+	}
+
+	rooms := newRoomManager()
+	rooms.rateLimit = limit
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	bot := (&botAccount{UserID: "bot-deploy", Name: "Deploy bot"}).userData()
+	for i, want := range []int{http.StatusAccepted, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(http.MethodPost, "/api/rooms/golang/messages", strings.NewReader(`{"Text": "deployed"}`), bot))
+		if w.Code != want {
+			t.Errorf("post %d: expected %d, got %d", i, want, w.Code)
+		}
+	}
+	readOnly := (&botAccount{UserID: "bot-reader", Scopes: botScopes{ReadOnly: true}}).userData()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, withAuthCookie(http.MethodPost, "/api/rooms/golang/messages", strings.NewReader(`{"Text": "hi"}`), readOnly))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("a read-only bot should not post, got %d", w.Code)
+	}
+}
+
+func TestBotsCannotPostToArchivedRooms(t *testing.T) {
+	rooms := newRoomManager()
+	rooms.state.Put(roomSettingsBucket, "inc-1", roomSettings{Room: "inc-1", Owner: "ann", Archived: true})
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, withAuthCookie(http.MethodPost, "/api/rooms/inc-1/messages", strings.NewReader(`{"Text": "deployed"}`),
+		(&botAccount{UserID: "bot-deploy", Name: "Deploy bot"}).userData()))
+	if w.Code != http.StatusGone {
+		t.Errorf("expected 410, got %d: %s", w.Code, w.Body)
+	}
+	if _, ok := rooms.lookup("inc-1"); ok {
+		t.Error("the archived room should not be started again")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Broker carries messages between servers hosting the same rooms, so that
+// clients connected to different servers can talk to each other. Every
+// message a server accepts is saved and broadcast by that server and then
+// published; the other servers only broadcast it to their own clients.
+type Broker interface {
+	// Publish sends msg to the other servers.
+	Publish(msg *message) error
+	// Subscribe calls deliver with every message published by another
+	// server. It blocks until the connection to the broker fails.
+	Subscribe(deliver func(*message)) error
+}
+
+// newBroker returns the broker described by spec, or nil when spec is empty
+// and the server runs on its own:
+//
+//	redis://[:password@]host[:port][/db]   Redis pub/sub
+func newBroker(spec string) (Broker, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, "redis://"):
+		client, err := newRedisClient(spec)
+		if err != nil {
+			return nil, err
+		}
+		return &redisBroker{client: client, node: nodeID}, nil
+	}
+	return nil, fmt.Errorf("unknown broker %q", spec)
+}
+
+// redisChannelPrefix is prepended to the room name to make the Redis
+// channel the room's messages are published on.
+const redisChannelPrefix = "chat:room:"
+
+// redisBroker publishes messages on a Redis channel per room. Each server
+// tags what it publishes with a random node ID so it can ignore its own
+// messages when they come back.
+type redisBroker struct {
+	client *redisClient
+	node   string
+}
+
+// brokerEnvelope is what is published to the broker.
+type brokerEnvelope struct {
+	Node    string
+	Message *message
+}
+
+func (b *redisBroker) Publish(msg *message) error {
+	data, err := json.Marshal(brokerEnvelope{Node: b.node, Message: msg})
+	if err != nil {
+		return err
+	}
+	_, err = b.client.do("PUBLISH", redisChannelPrefix+msg.Room, string(data))
+	return err
+}
+
+func (b *redisBroker) Subscribe(deliver func(*message)) error {
+	return b.client.psubscribe(redisChannelPrefix+"*", func(channel, payload string) {
+		var env brokerEnvelope
+		if err := json.Unmarshal([]byte(payload), &env); err != nil || env.Message == nil || env.Node == b.node {
+			return
+		}
+		deliver(env.Message)
+	})
+}
+
+// runBroker delivers messages from the broker to the rooms of this server,
+// resubscribing after a pause whenever the connection is lost.
+func (m *roomManager) runBroker() {
+	for {
+		err := m.broker.Subscribe(m.receive)
+		m.tracer.Warn("Broker subscription lost: ", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// receive hands a message published by another server to the clients of
+// this server. Rooms nobody here has joined are not created for it.
+func (m *roomManager) receive(msg *message) {
+	if msg.Type == msgTypeDM {
+		m.deliverDirect(msg)
+		return
+	}
+	if msg.Type == msgTypeSignOut {
+		m.disconnect(msg)
+		return
+	}
+	if msg.Type == msgTypeInteraction {
+		m.deliverInteraction(msg)
+		return
+	}
+	m.mu.Lock()
+	r, ok := m.rooms[msg.Room]
+	m.mu.Unlock()
+	if ok {
+		r.remote <- msg
+	}
+}
+
+// publish sends msg to the other servers, if there are any.
+func (m *roomManager) publish(msg *message) {
+	if m.broker == nil {
+		return
+	}
+	if err := m.broker.Publish(msg); err != nil {
+		m.tracer.Error("Failed to publish message: ", err)
+	}
+}
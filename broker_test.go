@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeBroker hands everything published to it straight to another manager,
+// standing in for a real broker between two servers.
+type pipeBroker struct {
+	to *roomManager
+}
+
+func (b *pipeBroker) Publish(msg *message) error {
+	b.to.receive(msg)
+	return nil
+}
+
+func (b *pipeBroker) Subscribe(deliver func(*message)) error {
+	select {}
+}
+
+func TestBrokerSharesRoomsBetweenServers(t *testing.T) {
+	a, b := newRoomManager(), newRoomManager()
+	a.broker = &pipeBroker{to: b}
+	b.broker = &pipeBroker{to: a}
+	onA := &client{send: make(chan *message, messageBufferSize), room: a.get("golang")}
+	onB := &client{send: make(chan *message, messageBufferSize), room: b.get("golang")}
+	onA.room.join <- onA
+	onB.room.join <- onB
+	onA.room.forward <- &message{ID: "m1", Message: "hello from a"}
+	if msg := receive(t, onB); msg.ID != "m1" || msg.Room != "golang" {
+		t.Errorf("client on b should get the message sent on a, got %+v", msg)
+	}
+	if msg := receive(t, onA); msg.ID != "m1" {
+		t.Errorf("client on a should get its own message, got %+v", msg)
+	}
+	if history, _ := b.store.Query(messageQuery{Room: "golang"}); len(history) != 0 {
+		t.Error("only the server that accepted the message should save it")
+	}
+	b.receive(&message{ID: "m2", Room: "rust", Message: "nobody on b"})
+	if _, ok := b.rooms["rust"]; ok {
+		t.Error("messages from other servers should not create rooms")
+	}
+}
+
+// downBroker fails to publish while down, and records what it publishes
+// otherwise.
+type downBroker struct {
+	down      bool
+	published []*message
+}
+
+func (b *downBroker) Publish(msg *message) error {
+	if b.down {
+		return errors.New("broker down")
+	}
+	b.published = append(b.published, msg)
+	return nil
+}
+
+func (b *downBroker) Subscribe(deliver func(*message)) error {
+	select {}
+}
+
+func TestRelayPublishesSavedMessages(t *testing.T) {
+	m := newRoomManager()
+	broker := &downBroker{down: true}
+	m.broker = broker
+	// the test relays itself
+	m.relayOnce.Do(func() {})
+	c := &client{send: make(chan *message, messageBufferSize), room: m.get("golang")}
+	c.room.join <- c
+	c.room.forward <- &message{ID: "m1", Message: "hello"}
+	if msg := receive(t, c); msg.ID != "m1" {
+		t.Fatalf("the message should be broadcast here, got %+v", msg)
+	}
+	m.relayQueued()
+	outbox := m.store.(Outbox)
+	if queued, _ := outbox.Queued(nodeID, time.Now(), relayBatch); len(queued) != 1 {
+		t.Fatalf("the message should stay queued while the broker is down, got %d", len(queued))
+	}
+	broker.down = false
+	m.relayQueued()
+	if len(broker.published) != 1 || broker.published[0].ID != "m1" {
+		t.Errorf("the relay should publish the message, published %v", ids(broker.published))
+	}
+	if queued, _ := outbox.Queued(nodeID, time.Now(), relayBatch); len(queued) != 0 {
+		t.Errorf("published messages should be unqueued, got %d", len(queued))
+	}
+}
+
+// hub is a broker shared by servers in one process, each a hubNode. A node
+// can stop, as its server would: it then neither publishes nor saves.
+type hub struct {
+	mu    sync.Mutex
+	nodes map[*hubNode]*roomManager
+}
+
+type hubNode struct {
+	hub *hub
+	// stopAfter stops the node once it has published that many
+	// messages, if positive. It and stopped are guarded by hub.mu.
+	stopAfter int
+	stopped   bool
+}
+
+// join makes m a node of h called node, sharing store with the others.
+func (h *hub) join(m *roomManager, node string, store *memoryStore) *hubNode {
+	n := &hubNode{hub: h}
+	m.node = node
+	m.broker = n
+	m.store = &nodeStore{memoryStore: store, node: n}
+	h.mu.Lock()
+	h.nodes[n] = m
+	h.mu.Unlock()
+	return n
+}
+
+func (n *hubNode) isStopped() bool {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+	return n.stopped
+}
+
+func (n *hubNode) Publish(msg *message) error {
+	n.hub.mu.Lock()
+	if n.stopped {
+		n.hub.mu.Unlock()
+		return errors.New("server stopped")
+	}
+	var to []*roomManager
+	for other, m := range n.hub.nodes {
+		if other != n && !other.stopped {
+			to = append(to, m)
+		}
+	}
+	if n.stopAfter > 0 {
+		n.stopAfter--
+		n.stopped = n.stopAfter == 0
+	}
+	n.hub.mu.Unlock()
+	for _, m := range to {
+		m.receive(msg)
+	}
+	return nil
+}
+
+func (n *hubNode) Subscribe(deliver func(*message)) error {
+	select {}
+}
+
+// nodeStore is the store the servers of a hub share, as one of them sees
+// it: once it stopped it saves nothing.
+type nodeStore struct {
+	*memoryStore
+	node *hubNode
+}
+
+func (s *nodeStore) SaveQueued(msg *message, node string) error {
+	if s.node.isStopped() {
+		return errors.New("server stopped")
+	}
+	return s.memoryStore.SaveQueued(msg, node)
+}
+
+// waitAck reads c's messages until the ack of id, reporting true, or a
+// notice that it was refused, reporting false.
+func waitAck(t *testing.T, c *client, id string) bool {
+	t.Helper()
+	for {
+		msg := receive(t, c)
+		switch {
+		case msg.Type == msgTypeAck && msg.ID == id:
+			return true
+		case msg.Type == msgTypeNotice:
+			return false
+		}
+	}
+}
+
+func TestNoMessageLostOrRepeatedWhenAServerStops(t *testing.T) {
+	h := &hub{nodes: make(map[*hubNode]*roomManager)}
+	store := newMemoryStore()
+	a, b := newRoomManager(), newRoomManager()
+	// a is known to have stopped, so b may take over its outbox at once
+	b.orphanedAfter = 0
+	onA := h.join(a, "a", store)
+	h.join(b, "b", store)
+	// a stops halfway through publishing what it is sent
+	const n = 40
+	onA.stopAfter = n / 4
+	reader := &client{send: make(chan *message, messageBufferSize), room: b.get("golang")}
+	reader.room.join <- reader
+
+	sender := &client{send: make(chan *message, messageBufferSize), room: a.get("golang")}
+	sender.room.join <- sender
+	sent := 0
+	for ; sent < n; sent++ {
+		id := fmt.Sprintf("m%d", sent)
+		sender.room.forward <- &message{ID: id, UserID: "ann", Message: id, from: sender}
+		if !waitAck(t, sender, id) {
+			break
+		}
+	}
+	for deadline := time.Now().Add(time.Second); !onA.isStopped(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("a should have stopped")
+		}
+	}
+
+	// the sender reconnects to b and sends again what a did not
+	// acknowledge, and the last it did, as if that ack was lost
+	sender = &client{send: make(chan *message, messageBufferSize), room: b.get("golang")}
+	sender.room.join <- sender
+	for i := sent - 1; i < n; i++ {
+		id := fmt.Sprintf("m%d", i)
+		sender.room.forward <- &message{ID: id, UserID: "ann", Message: id, from: sender}
+		if !waitAck(t, sender, id) {
+			t.Fatalf("b should take %s", id)
+		}
+	}
+	// what a saved but did not publish is left to b
+	b.relayQueued()
+
+	seen := make(map[string]int)
+	deadline := time.After(time.Second)
+	for len(seen) < n {
+		select {
+		case msg := <-reader.send:
+			if msg.Type == msgTypeMessage {
+				seen[msg.ID]++
+			}
+		case <-deadline:
+			var lost []string
+			for i := 0; i < n; i++ {
+				if id := fmt.Sprintf("m%d", i); seen[id] == 0 {
+					lost = append(lost, id)
+				}
+			}
+			t.Fatalf("%v were lost (%d sent before a stopped)", lost, sent)
+		}
+	}
+	for {
+		select {
+		case msg := <-reader.send:
+			if msg.Type == msgTypeMessage {
+				seen[msg.ID]++
+			}
+			continue
+		case <-time.After(50 * time.Millisecond):
+		}
+		break
+	}
+	for id, count := range seen {
+		if count > 1 {
+			t.Errorf("%s was delivered %d times", id, count)
+		}
+	}
+}
+
+func TestRedisRESP(t *testing.T) {
+	var buf bytes.Buffer
+	writeCommand(&buf, []string{"PUBLISH", "chat:room:lobby", "hi"})
+	if want := "*3\r\n$7\r\nPUBLISH\r\n$15\r\nchat:room:lobby\r\n$2\r\nhi\r\n"; buf.String() != want {
+		t.Errorf("command encoded as %q, want %q", buf.String(), want)
+	}
+	r := bufio.NewReader(strings.NewReader("*4\r\n$8\r\npmessage\r\n:2\r\n$-1\r\n+OK\r\n-ERR wrong\r\n"))
+	reply, err := readReply(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, ok := reply.([]interface{})
+	if !ok || len(parts) != 4 || parts[0] != "pmessage" || parts[1] != int64(2) || parts[2] != nil || parts[3] != "OK" {
+		t.Errorf("unexpected reply %#v", reply)
+	}
+	if _, err := readReply(r); err == nil || err.Error() != "redis: ERR wrong" {
+		t.Errorf("expected the error reply, got %v", err)
+	}
+}
+
+func TestNewRedisClientParsesURL(t *testing.T) {
+	c, err := newRedisClient("redis://:s3cret@cache/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.addr != "cache:6379" || c.password != "s3cret" || c.db != 2 {
+		t.Errorf("parsed as %s %q %d", c.addr, c.password, c.db)
+	}
+	if _, err := newRedisClient("http://cache"); err == nil {
+		t.Error("non redis URL should be rejected")
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	eventsBucket = "events"
+	// rsvpsBucket keys are "{event id}/{userid}".
+	rsvpsBucket = "event_rsvps"
+	// reminderLead is how long before an event starts attendees are reminded.
+	reminderLead = 15 * time.Minute
+	// maxICSBody caps the size of uploaded calendar files.
+	maxICSBody = 1 << 20
+)
+
+// calendarEvent is a meeting posted into a room. It is shown as a card that
+// members answer with an RSVP; those who accept are reminded before it starts.
+type calendarEvent struct {
+	ID          string
+	UID         string `json:",omitempty"`
+	Room        string
+	Title       string
+	Start       time.Time
+	End         time.Time
+	Location    string `json:",omitempty"`
+	Description string `json:",omitempty"`
+	CreatedBy   string
+}
+
+// rsvp is a member's answer to an event.
+type rsvp struct {
+	UserID   string
+	Name     string
+	Response string
+	When     time.Time
+}
+
+// validRSVP reports whether response is one of the answers we accept.
+func validRSVP(response string) bool {
+	return response == "yes" || response == "no" || response == "maybe"
+}
+
+// calendar stores events and RSVPs in the StateStore and posts events into
+// their rooms.
+type calendar struct {
+	state StateStore
+	rooms *roomManager
+}
+
+// add validates, stores and announces an event.
+func (c *calendar) add(e *calendarEvent) error {
+	if e.Title == "" || e.Start.IsZero() {
+		return errors.New("an event needs a title and a start time")
+	}
+	if !validRoomName(e.Room) {
+		return fmt.Errorf("invalid room name %q", e.Room)
+	}
+	if e.End.IsZero() {
+		e.End = e.Start.Add(time.Hour)
+	}
+	if e.End.Before(e.Start) {
+		return errors.New("an event cannot end before it starts")
+	}
+	e.ID = newID()
+	if err := c.state.Put(eventsBucket, e.ID, e); err != nil {
+		return err
+	}
+	text := e.Title + " on " + e.Start.Format("Mon Jan 2 15:04 MST")
+	if e.Location != "" {
+		text += " at " + e.Location
+	}
+	c.rooms.get(e.Room).forward <- &message{ID: newID(), Type: msgTypeEvent, Name: "Calendar", Message: text, When: time.Now(), Event: e}
+	return nil
+}
+
+// rsvps returns the answers to an event, oldest first.
+func (c *calendar) rsvps(eventID string) ([]*rsvp, error) {
+	docs, err := c.state.List(rsvpsBucket)
+	if err != nil {
+		return nil, err
+	}
+	var answers []*rsvp
+	for key, doc := range docs {
+		if !strings.HasPrefix(key, eventID+"/") {
+			continue
+		}
+		var answer rsvp
+		if err := json.Unmarshal(doc, &answer); err != nil {
+			return nil, err
+		}
+		answers = append(answers, &answer)
+	}
+	sort.Slice(answers, func(i, j int) bool { return answers[i].When.Before(answers[j].When) })
+	return answers, nil
+}
+
+// remind sends a direct message to everyone who answered yes or maybe to an
+// event starting reminderLead after now. It is run by the scheduler every
+// minute; a claim in the schedule runs keeps servers from reminding twice.
+func (c *calendar) remind(now time.Time) {
+	docs, err := c.state.List(eventsBucket)
+	if err != nil {
+		return
+	}
+	from := now.Add(reminderLead)
+	for _, doc := range docs {
+		var e calendarEvent
+		if json.Unmarshal(doc, &e) != nil || e.Start.Before(from) || !e.Start.Before(from.Add(time.Minute)) {
+			continue
+		}
+		if claimed, err := c.state.Create(scheduleRunsBucket, "event:"+e.ID, now); err != nil || !claimed {
+			continue
+		}
+		answers, err := c.rsvps(e.ID)
+		if err != nil {
+			continue
+		}
+		for _, answer := range answers {
+			if answer.Response == "no" {
+				continue
+			}
+			c.rooms.sendDirect(&message{
+				ID:      newID(),
+				Type:    msgTypeDM,
+				UserID:  "calendar",
+				To:      answer.UserID,
+				Name:    "Calendar",
+				Message: fmt.Sprintf("Reminder: %s in #%s starts at %s", e.Title, e.Room, e.Start.Format("15:04 MST")),
+				When:    now,
+			})
+		}
+	}
+}
+
+// ServeHTTP is the events API used by the chat page:
+//
+//	POST /api/events?room={room}     add events: an ICS file (text/calendar)
+//	                                 or {"Title", "Start", "End", "Location", "Description"}
+//	GET  /api/events/{id}            an event and its RSVPs
+//	POST /api/events/{id}/rsvp       answer: {"Response": "yes" | "no" | "maybe"}
+func (c *calendar) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/events"), "/")
+	id, action, _ := strings.Cut(path, "/")
+	user := currentUser(r)
+	switch {
+	case r.Method == http.MethodPost && path == "":
+		var events []*calendarEvent
+		body := http.MaxBytesReader(w, r.Body, maxICSBody)
+		var err error
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/calendar") {
+			events, err = parseICS(body)
+		} else {
+			var e calendarEvent
+			err = json.NewDecoder(body).Decode(&e)
+			events = append(events, &e)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, e := range events {
+			e.Room = r.URL.Query().Get("room")
+			e.CreatedBy = user.Get("userid").Str()
+			if err := c.add(e); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(events)
+	case r.Method == http.MethodGet && id != "" && action == "":
+		var e calendarEvent
+		if err := c.state.Get(eventsBucket, id, &e); err != nil {
+			http.Error(w, "no such event", http.StatusNotFound)
+			return
+		}
+		answers, err := c.rsvps(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"Event": e, "RSVPs": answers})
+	case r.Method == http.MethodPost && id != "" && action == "rsvp":
+		var answer rsvp
+		if err := json.NewDecoder(r.Body).Decode(&answer); err != nil || !validRSVP(answer.Response) {
+			http.Error(w, "body must be {\"Response\": \"yes\", \"no\" or \"maybe\"}", http.StatusBadRequest)
+			return
+		}
+		var e calendarEvent
+		if err := c.state.Get(eventsBucket, id, &e); err != nil {
+			http.Error(w, "no such event", http.StatusNotFound)
+			return
+		}
+		answer.UserID = user.Get("userid").Str()
+		answer.Name = user.Get("name").Str()
+		answer.When = time.Now()
+		if err := c.state.Put(rsvpsBucket, id+"/"+answer.UserID, answer); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// parseICS reads the VEVENTs of an iCalendar (RFC 5545) file. Only the
+// properties we show are read; recurrence rules are ignored.
+func parseICS(r io.Reader) ([]*calendarEvent, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			// a folded continuation of the previous line
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var events []*calendarEvent
+	var e *calendarEvent
+	for _, line := range lines {
+		nameParams, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, params, _ := strings.Cut(nameParams, ";")
+		switch name = strings.ToUpper(name); {
+		case name == "BEGIN" && value == "VEVENT":
+			e = &calendarEvent{}
+		case name == "END" && value == "VEVENT" && e != nil:
+			events = append(events, e)
+			e = nil
+		case e == nil:
+		case name == "UID":
+			e.UID = value
+		case name == "SUMMARY":
+			e.Title = unescapeICS(value)
+		case name == "LOCATION":
+			e.Location = unescapeICS(value)
+		case name == "DESCRIPTION":
+			e.Description = unescapeICS(value)
+		case name == "DTSTART" || name == "DTEND":
+			t, err := parseICSTime(value, params)
+			if err != nil {
+				return nil, err
+			}
+			if name == "DTSTART" {
+				e.Start = t
+			} else {
+				e.End = t
+			}
+		}
+	}
+	if len(events) == 0 {
+		return nil, errors.New("no events in calendar file")
+	}
+	return events, nil
+}
+
+// parseICSTime parses a DATE-TIME in UTC ("...Z"), in the zone named by a
+// TZID parameter or floating (taken as server local time), or an all-day DATE.
+func parseICSTime(value, params string) (time.Time, error) {
+	loc := time.Local
+	for _, param := range strings.Split(params, ";") {
+		if strings.HasPrefix(param, "TZID=") {
+			if l, err := time.LoadLocation(strings.Trim(param[len("TZID="):], `"`)); err == nil {
+				loc = l
+			}
+		}
+	}
+	switch {
+	case strings.HasSuffix(value, "Z"):
+		return time.Parse("20060102T150405Z", value)
+	case len(value) == len("20060102"):
+		return time.ParseInLocation("20060102", value, loc)
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad date %q", value)
+	}
+	return t, nil
+}
+
+var icsUnescaper = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+func unescapeICS(s string) string {
+	return icsUnescaper.Replace(s)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+const testICS = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:123@example.com\r\n" +
+	"DTSTART:20261020T140000Z\r\n" +
+	"DTEND:20261020T150000Z\r\n" +
+	"SUMMARY:Sprint planning\\, Q4\r\n" +
+	"DESCRIPTION:Bring your\r\n" +
+	"  estimates\\nand coffee\r\n" +
+	"LOCATION:Room 1\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseICS(t *testing.T) {
+	events, err := parseICS(strings.NewReader(testICS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	e := events[0]
+	if e.Title != "Sprint planning, Q4" || e.Location != "Room 1" || e.Description != "Bring your estimates\nand coffee" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if want := time.Date(2026, 10, 20, 14, 0, 0, 0, time.UTC); !e.Start.Equal(want) || e.End.Sub(e.Start) != time.Hour {
+		t.Errorf("event runs %v to %v", e.Start, e.End)
+	}
+	if _, err := parseICS(strings.NewReader("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n")); err == nil {
+		t.Error("a calendar without events should be rejected")
+	}
+}
+
+func TestCalendarRSVPAndReminder(t *testing.T) {
+	rooms := newRoomManager()
+	c := &calendar{state: newFileState(""), rooms: rooms}
+	member := &client{send: make(chan *message, messageBufferSize), room: rooms.get("dev"),
+		userData: map[string]interface{}{"userid": "u1", "name": "Ann"}}
+	rooms.get("dev").join <- member
+
+	req := withAuthCookie(http.MethodPost, "/api/events?room=dev", strings.NewReader(testICS),
+		objx.New(map[string]interface{}{"userid": "u1"}))
+	req.Header.Set("Content-Type", "text/calendar")
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	announced := receiveChat(t, member)
+	if announced.Type != msgTypeEvent || announced.Event == nil || announced.Event.Title != "Sprint planning, Q4" {
+		t.Fatalf("expected an event message, got %+v", announced)
+	}
+	id := announced.Event.ID
+
+	req = withAuthCookie(http.MethodPost, "/api/events/"+id+"/rsvp", strings.NewReader(`{"Response":"yes"}`),
+		objx.New(map[string]interface{}{"userid": "u1", "name": "Ann"}))
+	w = httptest.NewRecorder()
+	c.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("rsvp: expected 204, got %d: %s", w.Code, w.Body)
+	}
+
+	c.remind(announced.Event.Start.Add(-reminderLead - time.Minute))
+	c.remind(announced.Event.Start.Add(-reminderLead))
+	c.remind(announced.Event.Start.Add(-reminderLead))
+	if msg := receive(t, member); msg.Type != msgTypeDM || !strings.HasPrefix(msg.Message, "Reminder: Sprint planning") {
+		t.Errorf("expected a reminder, got %+v", msg)
+	}
+	select {
+	case msg := <-member.send:
+		t.Errorf("attendees should be reminded once, also got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
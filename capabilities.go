@@ -0,0 +1,79 @@
+package main
+
+import "sort"
+
+// protocolVersions are the versions of the websocket protocol this server
+// speaks, one for each of protocols.
+var protocolVersions = []int{1, 2}
+
+// The capabilities a client may ask for in its hello.
+const (
+	// capCompression compresses what the server sends with
+	// permessage-deflate, if the browser negotiated it when connecting.
+	capCompression = "compression"
+	// capBatching lets the server send several messages waiting for the
+	// client as a JSON array in one frame.
+	capBatching = "batching"
+)
+
+// serverCapabilities are the capabilities this server supports; those a
+// client asks for that are not here, such as binary encodings or end to end
+// encryption, are left out of the answer.
+var serverCapabilities = []string{capCompression, capBatching}
+
+// maxBatch is the most messages sent in one batch.
+const maxBatch = 64
+
+// hello is the capability exchange that starts a conversation. A client
+// sends the protocol versions it speaks and the capabilities it would like;
+// the server answers with the version chosen and the capabilities, of
+// those, that it will use.
+type hello struct {
+	Versions     []int    `json:",omitempty"`
+	Version      int      `json:",omitempty"`
+	Capabilities []string `json:",omitempty"`
+}
+
+// negotiate answers the hello a client sent: the newest version both sides
+// speak, or the first version if they have none in common, and the
+// capabilities both support.
+func negotiate(h *hello) *hello {
+	answer := &hello{Version: protocolVersions[0], Capabilities: []string{}}
+	for _, v := range h.Versions {
+		for _, ours := range protocolVersions {
+			if v == ours && v > answer.Version {
+				answer.Version = v
+			}
+		}
+	}
+	for _, c := range serverCapabilities {
+		if hasCapability(h.Capabilities, c) {
+			answer.Capabilities = append(answer.Capabilities, c)
+		}
+	}
+	sort.Strings(answer.Capabilities)
+	return answer
+}
+
+func hasCapability(capabilities []string, c string) bool {
+	for _, have := range capabilities {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// hello answers the hello msg of the client. The version is the one the
+// client chose as its subprotocol when connecting, whatever it asks for now.
+// The answer goes through the room so it is sent in order with everything
+// else; write applies the capabilities once it has sent it.
+func (c *client) hello(msg *message) {
+	if msg.Hello == nil {
+		c.room.notice(c, "A hello needs the versions and capabilities of the client.")
+		return
+	}
+	answer := negotiate(msg.Hello)
+	answer.Version = c.protocol.version
+	c.room.direct <- &directMessage{to: c, msg: &message{ID: newID(), Type: msgTypeHello, Room: c.room.name, Hello: answer}}
+}
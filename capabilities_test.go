@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/objx"
+)
+
+func TestNegotiate(t *testing.T) {
+	answer := negotiate(&hello{Versions: []int{1, 7}, Capabilities: []string{"e2ee", capBatching, "binary", capCompression}})
+	if answer.Version != 1 || !reflect.DeepEqual(answer.Capabilities, []string{capBatching, capCompression}) {
+		t.Errorf("unexpected answer %+v", answer)
+	}
+	answer = negotiate(&hello{Versions: []int{9}})
+	if answer.Version != protocolVersions[0] || len(answer.Capabilities) != 0 {
+		t.Errorf("a client with nothing in common should get the defaults, got %+v", answer)
+	}
+}
+
+// dialRoom connects to the room served by server as the user.
+func dialRoom(t *testing.T, server *httptest.Server, user objx.Map) *websocket.Conn {
+	r := withAuthCookie(http.MethodGet, "/room", nil, user)
+	header := http.Header{"Cookie": r.Header["Cookie"]}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHello(t *testing.T) {
+	r := newRoomManager().get("golang")
+	server := httptest.NewServer(r)
+	defer server.Close()
+	conn := dialRoom(t, server, objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"}))
+	conn.WriteJSON(&message{Type: msgTypeHello, Hello: &hello{Versions: []int{1}, Capabilities: []string{capBatching, "e2ee"}}})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != msgTypeHello {
+			continue
+		}
+		if msg.Hello == nil || msg.Hello.Version != 1 || !reflect.DeepEqual(msg.Hello.Capabilities, []string{capBatching}) {
+			t.Fatalf("unexpected hello %+v", msg.Hello)
+		}
+		break
+	}
+
+	// with batching agreed, messages sent at once may come as one array
+	for _, text := range []string{"one", "two", "three"} {
+		r.forward <- &message{ID: newID(), Message: text}
+	}
+	var got []string
+	for len(got) < 3 {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var batch []message
+		if data[0] == '[' {
+			if err := json.Unmarshal(data, &batch); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			var msg message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			batch = append(batch, msg)
+		}
+		for _, msg := range batch {
+			if msg.Type == msgTypeMessage {
+				got = append(got, msg.Message)
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, []string{"one", "two", "three"}) {
+		t.Errorf("messages should arrive in order, got %v", got)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	c := &client{send: make(chan *message, maxBatch+10)}
+	for i := 0; i < maxBatch+5; i++ {
+		c.send <- &message{ID: newID()}
+	}
+	if batch := c.drain([]*message{{}}); len(batch) != maxBatch {
+		t.Errorf("a batch should hold at most %d messages, got %d", maxBatch, len(batch))
+	}
+	if batch := c.drain(nil); len(batch) != 6 {
+		t.Errorf("the rest should make the next batch, got %d", len(batch))
+	}
+	close(c.send)
+	if batch := c.drain(nil); len(batch) != 0 {
+		t.Errorf("a closed channel has nothing more, got %d", len(batch))
+	}
+}
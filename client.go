@@ -2,33 +2,144 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/law-lee/chat_server/trace"
+)
+
+// keepalive timings; each room has its own pongWait and pingPeriod,
+// starting from these, so tests can shorten them.
+const (
+	// defaultPongWait is how long a peer may stay silent, pongs
+	// included, before it is taken for dead.
+	defaultPongWait = 60 * time.Second
+	// defaultPingPeriod is how often the peer is pinged; it must be
+	// shorter than the pong wait.
+	defaultPingPeriod = defaultPongWait * 9 / 10
+	// writeWait bounds each write to the peer.
+	writeWait = 10 * time.Second
 )
 
 // client represents a single chatting user.
 type client struct {
+	// id identifies the connection to admins.
+	id string
 	// socket is the web socket for this client.
 	socket *websocket.Conn
+	// protocol is the protocol the client chose when connecting.
+	protocol *protocol
+	// frames records the frames of the connection if it was sampled for
+	// tracing; otherwise it is nil.
+	frames *trace.Frames
 	// send is a channel on which messages are sent.
 	send chan *message
 	// room is the room this client is chatting in.
 	room *room
 	// userData holds information about the user
 	userData map[string]interface{}
+	// session is the ID of the session the client connected with, or ""
+	// if it used a bearer token; signing out of it disconnects the client.
+	session string
+	// display is the name the client is shown by in the room, set by
+	// run when it joins; named, if not nil, is closed once it is.
+	display string
+	named   chan struct{}
+	// ip is the address the client connected from.
+	ip string
+	// joined is when the client joined the room.
+	joined time.Time
+	// resumeSince is when the client left the room on another server,
+	// if it is resuming; history since then is replayed to it.
+	resumeSince time.Time
+	// historyFrom is the oldest history the client may be sent, zero for
+	// all of it; see historyVisibility.
+	historyFrom time.Time
+	// lastSeq is the sequence number of the last message the client saw
+	// before reconnecting; the messages after it are replayed to it.
+	lastSeq uint64
+	// throttled is set while the client is over its limit, so that
+	// it is told only once.
+	throttled bool
+	// bytesIn and bytesOut count the bytes of the frames received from
+	// and sent to the client. They are updated atomically.
+	bytesIn  int64
+	bytesOut int64
 }
 
 func (c *client) read() {
 	defer c.closeSocket()
+	// a peer that neither sends nor answers pings is dropped when the
+	// deadline passes, so half-open connections don't linger
+	c.socket.SetReadDeadline(time.Now().Add(c.room.pongWait))
+	c.socket.SetPongHandler(func(string) error {
+		return c.socket.SetReadDeadline(time.Now().Add(c.room.pongWait))
+	})
+	// pending are the messages of the last frame still to be handled
+	var pending []*message
 	for {
-		var msg *message
-		err := c.socket.ReadJSON(&msg)
-		if err != nil {
+		var err error
+		if len(pending) == 0 {
+			var frame []byte
+			_, frame, err = c.socket.ReadMessage()
+			if err == nil {
+				c.record(trace.In, frame)
+				c.countBytes(trace.In, len(frame))
+				pending, err = c.protocol.codec.decode(frame)
+			}
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					c.room.metrics.countSocketError("timeout")
+				} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+					c.room.metrics.countSocketError("read")
+				}
+				return
+			}
+			c.socket.SetReadDeadline(time.Now().Add(c.room.pongWait))
+			continue
+		}
+		msg := pending[0]
+		pending = pending[1:]
+		if msg.Type == msgTypeHello {
+			c.hello(msg)
+			continue
+		}
+		handle, disconnect := c.throttle()
+		if disconnect {
 			return
 		}
+		if !handle {
+			continue
+		}
+		if !validID(msg.ID) {
+			msg.ID = newID()
+		}
+		// a read-only bot may say where it has read up to, and no more
+		if msg.Type != msgTypeRead && !mayChange(c.userData) {
+			c.room.notice(c, "This bot may only read.")
+			continue
+		}
+		fields := strings.Fields(msg.Message)
+		cmd, args, isCommand := c.room.commands.lookup(c.room.name, msg.Message)
+		if (isCommand || len(fields) > 0 && fields[0] == "/create-from-template") && !mayUseCommands(c.userData) {
+			c.room.notice(c, "This bot may not use commands.")
+			continue
+		}
+		if len(fields) > 0 && fields[0] == "/create-from-template" {
+			go c.createFromTemplate(fields[1:])
+			continue
+		}
+		if isCommand {
+			go c.runCommand(cmd, args)
+			continue
+		}
 		msg.When = time.Now()
-		msg.Name = c.userData["name"].(string)
+		msg.Name = c.name()
+		msg.UserID = c.userID()
 		// assigned a value to AvatarURL
 		//All we have done here is take the value from the userData field that represents what we
 		//put into the cookie and assigned it to the appropriate field in message if the value was
@@ -39,19 +150,272 @@ func (c *client) read() {
 		if avatarUrl, ok := c.userData["avatar_url"]; ok {
 			msg.AvatarURL = avatarUrl.(string)
 		}
-		c.room.forward <- msg
+		msg.Guest = isGuest(c.userData)
+		msg.Bot = isBot(c.userData)
+		// only the server announces events, finds links, counts
+		// reactions, numbers messages and seals them
+		msg.Event = nil
+		msg.Links = nil
+		msg.Resume = ""
+		msg.Shutdown = nil
+		msg.Reactions = nil
+		msg.Hello = nil
+		msg.Quote = nil
+		msg.Seq = 0
+		msg.Sealed = nil
+		if msg.Type != msgTypeReaction {
+			msg.Reaction = nil
+		}
+		if msg.Type != msgTypeRead {
+			msg.Receipt = nil
+		}
+		if msg.Type != msgTypeInteraction {
+			msg.Interaction = nil
+		}
+		// only bots put buttons and menus on their messages
+		if len(msg.Components) > 0 {
+			if !msg.Bot || msg.Type != "" && msg.Type != msgTypeMessage {
+				msg.Components = nil
+			} else if err := validComponents(msg.Components); err != nil {
+				c.room.notice(c, err.Error())
+				continue
+			}
+		}
+		switch msg.Type {
+		case msgTypeMute:
+		case msgTypePin, msgTypeUnpin, msgTypeDelete, msgTypeKick, msgTypeUnmute, msgTypeForward:
+			msg.Duration = 0
+		default:
+			msg.Target = ""
+			msg.Duration = 0
+		}
+		if msg.ReplyTo != "" {
+			if msg.Type != "" && msg.Type != msgTypeMessage && msg.Type != msgTypeDM {
+				msg.ReplyTo = ""
+			} else if msg.Quote, err = c.quoteReply(msg); err != nil {
+				c.room.notice(c, err.Error())
+				continue
+			}
+		}
+		if max := c.room.maxMessage; max > 0 && len(msg.Message) > max {
+			c.room.notice(c, fmt.Sprintf("Messages may be at most %d bytes; send a longer text in parts or as an attachment.", max))
+			continue
+		}
+		if len(msg.Attachments) > 0 {
+			if msg.Type != "" && msg.Type != msgTypeMessage && msg.Type != msgTypeDM {
+				msg.Attachments = nil
+			} else if msg.Attachments, err = resolveAttachments(c.room.state, msg.UserID, msg.Attachments); err != nil {
+				c.room.notice(c, err.Error())
+				continue
+			}
+		}
+		if msg.Type == "" || msg.Type == msgTypeMessage || msg.Type == msgTypeDM || msg.Type == msgTypeForward {
+			warning, err := c.room.meter.allow(workspaceOf(c.userData), msg.UserID, 1, int64(len(msg.Message)))
+			if err != nil {
+				c.room.notice(c, err.Error())
+				continue
+			}
+			if warning != "" {
+				c.room.notice(c, warning)
+			}
+		}
+		switch msg.Type {
+		case "", msgTypeMessage:
+			msg.Type = msgTypeMessage
+			msg.To = ""
+			msg.Links = c.room.expander.expand(msg.Message)
+			msg.from = c
+			c.room.forward <- msg
+		case msgTypeTyping:
+			msg.Message = ""
+			msg.To = ""
+			c.room.forward <- msg
+		case msgTypeReaction:
+			if msg.Reaction == nil || !validID(msg.Reaction.MessageID) || !validEmoji(msg.Reaction.Emoji) || msg.UserID == "" {
+				c.room.notice(c, "A reaction needs a message ID and an emoji.")
+				continue
+			}
+			msg.Message = ""
+			msg.To = ""
+			msg.Reaction.Count = 0
+			c.room.forward <- msg
+		case msgTypeRead:
+			if msg.Receipt == nil || msg.Receipt.Seq == 0 || msg.UserID == "" {
+				c.room.notice(c, "A read receipt needs the sequence number of a message.")
+				continue
+			}
+			if !validID(msg.Receipt.MessageID) {
+				msg.Receipt.MessageID = ""
+			}
+			msg.Message = ""
+			msg.To = ""
+			c.room.forward <- msg
+		case msgTypePin, msgTypeUnpin, msgTypeDelete, msgTypeKick, msgTypeMute, msgTypeUnmute:
+			if msg.Target == "" || msg.UserID == "" || (msg.Type == msgTypePin || msg.Type == msgTypeUnpin || msg.Type == msgTypeDelete) && !validID(msg.Target) {
+				c.room.notice(c, "A "+msg.Type+" needs a target.")
+				continue
+			}
+			msg.Message = ""
+			msg.To = ""
+			msg.from = c
+			c.room.forward <- msg
+		case msgTypeAcceptRules:
+			if msg.UserID == "" {
+				c.room.notice(c, "Sign in to accept the room's rules.")
+				continue
+			}
+			msg.Message = ""
+			msg.To = ""
+			msg.from = c
+			c.room.forward <- msg
+		case msgTypeForward:
+			if !validID(msg.Target) || msg.UserID == "" || (msg.Room == "") == (msg.To == "") {
+				c.room.notice(c, "A forward needs a message ID, and a room or a recipient.")
+				continue
+			}
+			go c.forwardMessage(msg)
+		case msgTypeInteraction:
+			if msg.Interaction == nil || !validID(msg.Interaction.MessageID) || msg.UserID == "" || c.room.rooms == nil {
+				c.room.notice(c, "An interaction needs the ID of a message and of one of its components.")
+				continue
+			}
+			msg.Message = ""
+			go c.interact(msg)
+		case msgTypeDM:
+			if msg.To == "" || c.room.rooms == nil {
+				c.room.notice(c, "A direct message needs a recipient.")
+				continue
+			}
+			msg.Links = c.room.expander.expand(msg.Message)
+			if !c.room.rooms.sendDirect(msg) {
+				c.room.notice(c, "That message ID is already taken; send the message with another.")
+				continue
+			}
+			c.room.direct <- &directMessage{to: c, msg: ackFor(msg)}
+		default:
+			c.room.notice(c, "Unsupported message type "+msg.Type)
+		}
 	}
 }
 func (c *client) write() {
 	defer c.closeSocket()
-	for msg := range c.send {
-		err := c.socket.WriteJSON(msg)
+	// batching is only touched here, so it needs no lock
+	batching := c.protocol.batching
+	ticker := time.NewTicker(c.room.pingPeriod)
+	defer ticker.Stop()
+	for {
+		var msg *message
+		select {
+		case m, ok := <-c.send:
+			if !ok {
+				return
+			}
+			msg = m
+		case <-ticker.C:
+			if err := c.socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				c.room.metrics.countSocketError("ping")
+				return
+			}
+			continue
+		}
+		batch := []*message{msg}
+		if batching {
+			batch = c.drain(batch)
+		}
+		frame, err := c.protocol.codec.encode(batch)
+		if err == nil {
+			c.record(trace.Out, frame)
+			c.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			err = c.socket.WriteMessage(websocket.TextMessage, frame)
+		}
+		if err == nil {
+			c.countBytes(trace.Out, len(frame))
+		}
 		if err != nil {
-			break
+			c.room.metrics.countSocketError("write")
+			return
+		}
+		for _, msg := range batch {
+			if msg.Type == msgTypeHello && msg.Hello != nil {
+				// what follows the answer uses what was agreed
+				batching = c.protocol.batching || hasCapability(msg.Hello.Capabilities, capBatching)
+				c.socket.EnableWriteCompression(hasCapability(msg.Hello.Capabilities, capCompression))
+			}
+			if msg.Type == msgTypeShutdown {
+				// the shutdown event explains the close frame that follows
+				reason := ""
+				if msg.Shutdown != nil {
+					reason = msg.Shutdown.Reason
+				}
+				c.socket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, closeReason(reason)), time.Now().Add(time.Second))
+				return
+			}
+			if msg.Type == msgTypeDisconnect {
+				c.socket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, closeReason(msg.Message)), time.Now().Add(time.Second))
+				return
+			}
+		}
+	}
+}
+
+// countBytes counts n bytes going in dir, trace.In or trace.Out, and waits
+// if that takes the user over their bandwidth cap.
+func (c *client) countBytes(dir string, n int) {
+	if dir == trace.In {
+		atomic.AddInt64(&c.bytesIn, int64(n))
+	} else {
+		atomic.AddInt64(&c.bytesOut, int64(n))
+	}
+	c.room.metrics.countSocketBytes(dir, n)
+	if wait := c.room.bandwidth.take(c.userID(), dir, n, time.Now()); wait > 0 {
+		time.Sleep(wait)
+		if dir == trace.In {
+			// waiting is not the peer being silent
+			c.socket.SetReadDeadline(time.Now().Add(c.room.pongWait))
 		}
 	}
 }
 
+// record records a frame of the connection, if it was sampled.
+func (c *client) record(dir string, frame []byte) {
+	if c.frames != nil {
+		c.frames.Record(dir, frame, "session", c.id, "room", c.room.name, "user", c.userID())
+	}
+}
+
+// drain adds the messages already waiting to be sent to batch, up to
+// maxBatch.
+func (c *client) drain(batch []*message) []*message {
+	for len(batch) < maxBatch {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, msg)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// name is the display name of the user: the one the room gave them, or
+// else the one they signed in with.
+func (c *client) name() string {
+	if c.display != "" {
+		return c.display
+	}
+	name, _ := c.userData["name"].(string)
+	return name
+}
+
+// userID is the unique ID of the user.
+func (c *client) userID() string {
+	id, _ := c.userData["userid"].(string)
+	return id
+}
+
 func (c *client) closeSocket() {
 	if err := c.socket.Close(); err != nil {
 		fmt.Printf("close socket err: %v", err)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+// shortKeepalive shortens the keepalive timings of r's clients.
+func shortKeepalive(r *room) {
+	r.pongWait, r.pingPeriod = 200*time.Millisecond, 50*time.Millisecond
+}
+
+// waitMembers waits for r to have n members.
+func waitMembers(t *testing.T, r *room, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&r.members) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("members = %d, want %d", atomic.LoadInt64(&r.members), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUnresponsiveClientIsDropped(t *testing.T) {
+	r := newRoomManager().get("golang")
+	shortKeepalive(r)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	// pongs are only sent while reading, so a client that never reads
+	// looks like a dead peer
+	dialRoom(t, server, objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"}))
+	waitMembers(t, r, 1)
+	waitMembers(t, r, 0)
+}
+
+func TestResponsiveClientIsKept(t *testing.T) {
+	r := newRoomManager().get("golang")
+	shortKeepalive(r)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	conn := dialRoom(t, server, objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"}))
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	waitMembers(t, r, 1)
+	time.Sleep(3 * r.pongWait)
+	if n := atomic.LoadInt64(&r.members); n != 1 {
+		t.Fatalf("members = %d, want 1", n)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/law-lee/chat_server/trace"
+)
+
+const (
+	// nodesBucket holds a nodeInfo per running server, by node ID.
+	nodesBucket = "nodes"
+	// clusterCommandsBucket holds the commands for servers: a
+	// clusterCommand by node ID, and rebalanceKey for all of them.
+	clusterCommandsBucket = "cluster_commands"
+	rebalanceKey          = "rebalance"
+	// shutdownKey in clusterCommandsBucket holds the shutdownNotice set by
+	// an admin for the next shutdown of any server.
+	shutdownKey = "shutdown"
+	// heartbeatInterval is how often servers record that they are up and
+	// look for commands; one not heard from for nodeTimeout is gone.
+	heartbeatInterval = 10 * time.Second
+	nodeTimeout       = 3 * heartbeatInterval
+	// reconnectGrace is how long a client asked to reconnect elsewhere has
+	// to go before it is disconnected.
+	reconnectGrace = 5 * time.Second
+	// resumeTokenTTL is how long a resume token can be used.
+	resumeTokenTTL = 10 * time.Minute
+	// defaultShutdownTimeout is how long a server shutting down waits for
+	// its clients to be told and disconnected unless configured otherwise.
+	defaultShutdownTimeout = 10 * time.Second
+	// maxCloseReason is the most a websocket close frame's reason can hold.
+	maxCloseReason = 123
+)
+
+// nodeID identifies this server among those sharing a broker or state store.
+var nodeID = newID()
+
+// nodeInfo is what each server records about itself on every heartbeat.
+type nodeInfo struct {
+	ID       string
+	Seen     time.Time
+	Started  time.Time
+	Clients  int
+	Draining bool
+}
+
+// clusterCommand asks a server to drain, or all servers to rebalance.
+type clusterCommand struct {
+	Drain     bool `json:",omitempty"`
+	Requested time.Time
+	// Notice is what clients of a draining server are told.
+	Notice *shutdownNotice `json:",omitempty"`
+}
+
+// shutdownNotice tells clients why their server is going away and when to
+// expect it back, so they can show more than a lost connection.
+type shutdownNotice struct {
+	Reason string
+	// Downtime is how long the server expects to be away, in seconds;
+	// 0 if it does not know or clients can reconnect elsewhere at once.
+	Downtime int `json:",omitempty"`
+}
+
+// clusterNode is this server's part in the cluster. It records a heartbeat
+// in the state store and carries out the commands admins leave there, so an
+// admin can drain any server or rebalance them all through whichever server
+// the load balancer sends them to.
+//
+// Clients moved off a server get a reconnect event with a resume token. When
+// they reconnect, the load balancer sends them to another server, which
+// replays what they missed in between.
+type clusterNode struct {
+	state   StateStore
+	rooms   *roomManager
+	tracer  trace.Tracer
+	started time.Time
+	now     func() time.Time
+	// notice is what clients are told on shutdown unless an admin set
+	// another one.
+	notice shutdownNotice
+	// lastRebalance is when the last rebalance we carried out was requested.
+	lastRebalance time.Time
+}
+
+func newClusterNode(state StateStore, rooms *roomManager) *clusterNode {
+	now := time.Now()
+	return &clusterNode{state: state, rooms: rooms, tracer: trace.Off(), started: now, now: time.Now, lastRebalance: now,
+		notice: shutdownNotice{Reason: "The server is restarting."}}
+}
+
+// heartbeat carries out pending commands, records this server's state and
+// forgets servers that stopped long ago.
+func (n *clusterNode) heartbeat() error {
+	n.applyCommands()
+	now := n.now()
+	info := nodeInfo{ID: nodeID, Seen: now, Started: n.started, Clients: n.rooms.clientCount(), Draining: n.rooms.isDraining()}
+	if err := n.state.Put(nodesBucket, nodeID, info); err != nil {
+		return err
+	}
+	nodes, err := n.state.List(nodesBucket)
+	if err != nil {
+		return err
+	}
+	for id, doc := range nodes {
+		var old nodeInfo
+		if json.Unmarshal(doc, &old) == nil && now.Sub(old.Seen) > 24*time.Hour {
+			n.state.Delete(nodesBucket, id)
+		}
+	}
+	live, err := liveNodes(n.state, now)
+	if err != nil {
+		return err
+	}
+	prunePresence(n.state, live)
+	return nil
+}
+
+// run sends a heartbeat every heartbeatInterval until stop is closed.
+func (n *clusterNode) run(stop <-chan struct{}) {
+	n.heartbeat()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := n.heartbeat(); err != nil {
+				n.tracer.Warn("Heartbeat failed: ", err)
+			}
+		}
+	}
+}
+
+// liveNodes returns the servers heard from within nodeTimeout of now.
+func liveNodes(state StateStore, now time.Time) ([]nodeInfo, error) {
+	docs, err := state.List(nodesBucket)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []nodeInfo
+	for _, doc := range docs {
+		var info nodeInfo
+		if json.Unmarshal(doc, &info) == nil && now.Sub(info.Seen) <= nodeTimeout {
+			nodes = append(nodes, info)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+func (n *clusterNode) applyCommands() {
+	var cmd clusterCommand
+	drain := n.state.Get(clusterCommandsBucket, nodeID, &cmd) == nil && cmd.Drain
+	if drain && !n.rooms.isDraining() {
+		n.drain(cmd.Notice)
+	} else if !drain && n.rooms.isDraining() {
+		n.tracer.Trace("Drain cancelled, accepting clients again")
+		n.rooms.setDraining(false)
+	}
+	if n.state.Get(clusterCommandsBucket, rebalanceKey, &cmd) == nil && cmd.Requested.After(n.lastRebalance) {
+		n.lastRebalance = cmd.Requested
+		n.rebalance()
+	}
+}
+
+// drain stops new clients joining and moves every client to another server,
+// telling them notice if it is not nil.
+func (n *clusterNode) drain(notice *shutdownNotice) {
+	n.rooms.setDraining(true)
+	msg := &message{Type: msgTypeReconnect, Message: "This server is going down for maintenance, moving you to another one.", Shutdown: notice}
+	if notice != nil && notice.Reason != "" {
+		msg.Message = notice.Reason
+	}
+	moved := n.rooms.shed(-1, msg)
+	n.tracer.Trace("Draining, moved ", moved, " clients")
+}
+
+// shutdown stops new clients joining, sends every client a shutdown event
+// followed by a close frame and waits for them to go, until ctx is done.
+// Messages already queued for a client are written before the event.
+// Clients are told the notice an admin set, or n.notice.
+func (n *clusterNode) shutdown(ctx context.Context) {
+	notice := n.notice
+	var set shutdownNotice
+	if err := n.state.Get(clusterCommandsBucket, shutdownKey, &set); err == nil && set.Reason != "" {
+		notice = set
+	}
+	n.rooms.setDraining(true)
+	told := make(chan struct{})
+	go func() {
+		// a room stuck on a slow client must not hold up the exit
+		n.tracer.Trace("Shutting down, told ", n.rooms.shed(-1, &message{Type: msgTypeShutdown, Message: notice.Reason, Shutdown: &notice}), " clients")
+		close(told)
+	}()
+	select {
+	case <-told:
+	case <-ctx.Done():
+	}
+	for n.rooms.clientCount() > 0 && ctx.Err() == nil {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if left := n.rooms.clientCount(); left > 0 {
+		n.tracer.Warn("Shutdown deadline passed with ", left, " clients connected")
+	}
+	n.state.Delete(nodesBucket, nodeID)
+}
+
+// closeReason cuts reason to fit in a close frame.
+func closeReason(reason string) string {
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	cut := maxCloseReason
+	for cut > 0 && !utf8.RuneStart(reason[cut]) {
+		cut--
+	}
+	return reason[:cut]
+}
+
+// rebalance moves clients away if this server has more than its share of
+// the clients of the servers that are not draining.
+func (n *clusterNode) rebalance() {
+	nodes, err := liveNodes(n.state, n.now())
+	if err != nil {
+		n.tracer.Warn("Rebalance failed: ", err)
+		return
+	}
+	total, count := 0, 0
+	for _, node := range nodes {
+		if !node.Draining {
+			total += node.Clients
+			count++
+		}
+	}
+	if count == 0 || n.rooms.isDraining() {
+		return
+	}
+	share := (total + count - 1) / count
+	if excess := n.rooms.clientCount() - share; excess > 0 {
+		moved := n.rooms.shed(excess, &message{Type: msgTypeReconnect, Message: "Moving you to a less busy server."})
+		n.tracer.Trace("Rebalanced, moved ", moved, " clients")
+	}
+}
+
+// ServeHTTP is the admin API for running the cluster:
+//
+//	GET    /admin/cluster                    live servers and their clients
+//	POST   /admin/cluster/nodes/{id}/drain   drain a server, optionally telling
+//	                                         clients {"Reason", "Downtime"}
+//	DELETE /admin/cluster/nodes/{id}/drain   let a drained server take clients again
+//	POST   /admin/cluster/rebalance          even out clients across servers
+//	PUT    /admin/cluster/shutdown           what clients are told when a server
+//	                                         shuts down: {"Reason", "Downtime"}
+//	DELETE /admin/cluster/shutdown           go back to the -shutdown-* flags
+//
+// Commands are carried out on the next heartbeat of the servers concerned.
+func (n *clusterNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/cluster"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case r.Method == http.MethodGet && path == "":
+		nodes, err := liveNodes(n.state, n.now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(nodes)
+	case len(parts) == 3 && parts[0] == "nodes" && validID(parts[1]) && parts[2] == "drain" && r.Method == http.MethodPost:
+		cmd := clusterCommand{Drain: true, Requested: n.now()}
+		if r.ContentLength != 0 {
+			cmd.Notice = &shutdownNotice{}
+			if err := json.NewDecoder(r.Body).Decode(cmd.Notice); err != nil || cmd.Notice.Downtime < 0 {
+				http.Error(w, "body must be {\"Reason\": \"...\", \"Downtime\": seconds}", http.StatusBadRequest)
+				return
+			}
+		}
+		n.command(w, parts[1], cmd)
+	case len(parts) == 3 && parts[0] == "nodes" && validID(parts[1]) && parts[2] == "drain" && r.Method == http.MethodDelete:
+		if err := n.state.Delete(clusterCommandsBucket, parts[1]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPost && path == "rebalance":
+		n.command(w, rebalanceKey, clusterCommand{Requested: n.now()})
+	case r.Method == http.MethodPut && path == shutdownKey:
+		var notice shutdownNotice
+		if err := json.NewDecoder(r.Body).Decode(&notice); err != nil || notice.Reason == "" || notice.Downtime < 0 {
+			http.Error(w, "body must be {\"Reason\": \"...\", \"Downtime\": seconds}", http.StatusBadRequest)
+			return
+		}
+		if err := n.state.Put(clusterCommandsBucket, shutdownKey, notice); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && path == shutdownKey:
+		if err := n.state.Delete(clusterCommandsBucket, shutdownKey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (n *clusterNode) command(w http.ResponseWriter, key string, cmd clusterCommand) {
+	if err := n.state.Put(clusterCommandsBucket, key, cmd); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// resumeToken lets a client moved off this server pick up room where it
+// left off at since, on whichever server it reconnects to.
+func resumeToken(room string, since time.Time) string {
+	data := base64.RawURLEncoding.EncodeToString([]byte(room + "|" + strconv.FormatInt(since.UnixNano(), 10)))
+	return data + "." + authKeys.sign([]byte(data))
+}
+
+// readResumeToken returns the time a valid, recent token for room resumes from.
+func readResumeToken(token, room string, now time.Time) (time.Time, bool) {
+	data, sig, ok := strings.Cut(token, ".")
+	if !ok || !authKeys.verify([]byte(data), sig) {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return time.Time{}, false
+	}
+	tokenRoom, nanos, _ := strings.Cut(string(payload), "|")
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	since := time.Unix(0, n)
+	if err != nil || tokenRoom != room || now.Sub(since) > resumeTokenTTL {
+		return time.Time{}, false
+	}
+	return since, true
+}
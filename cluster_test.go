@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestResumeToken(t *testing.T) {
+	now := time.Now()
+	token := resumeToken("golang", now)
+	if since, ok := readResumeToken(token, "golang", now.Add(time.Minute)); !ok || !since.Equal(time.Unix(0, now.UnixNano())) {
+		t.Errorf("token should resume from %v, got %v %v", now, since, ok)
+	}
+	if _, ok := readResumeToken(token, "rust", now); ok {
+		t.Error("a token should only resume its own room")
+	}
+	if _, ok := readResumeToken(token, "golang", now.Add(resumeTokenTTL+time.Second)); ok {
+		t.Error("an old token should not be accepted")
+	}
+	if _, ok := readResumeToken(token+"x", "golang", now); ok {
+		t.Error("a tampered token should not be accepted")
+	}
+}
+
+func TestDrainCommand(t *testing.T) {
+	rooms := newRoomManager()
+	state := newFileState("")
+	n := newClusterNode(state, rooms)
+	c := &client{send: make(chan *message, messageBufferSize), room: rooms.get("golang")}
+	rooms.get("golang").join <- c
+
+	state.Put(clusterCommandsBucket, nodeID, clusterCommand{Drain: true, Requested: time.Now()})
+	n.heartbeat()
+	msg := receive(t, c)
+	if msg.Type != msgTypeReconnect || msg.Resume == "" {
+		t.Fatalf("client should be told to reconnect, got %+v", msg)
+	}
+	w := httptest.NewRecorder()
+	rooms.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/room/golang", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("a draining server should refuse new clients, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	newProbes(rooms, mapSecrets{}).ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "draining") {
+		t.Errorf("health check should fail while draining, got %d", w.Code)
+	}
+	var info nodeInfo
+	if state.Get(nodesBucket, nodeID, &info); !info.Draining {
+		t.Error("heartbeat should record that the server is draining")
+	}
+
+	state.Delete(clusterCommandsBucket, nodeID)
+	n.heartbeat()
+	if rooms.isDraining() {
+		t.Error("cancelling the drain should let clients in again")
+	}
+}
+
+func TestRebalanceShedsExcessClients(t *testing.T) {
+	rooms := newRoomManager()
+	state := newFileState("")
+	n := newClusterNode(state, rooms)
+	var clients []*client
+	for _, name := range []string{"golang", "golang", "rust"} {
+		c := &client{send: make(chan *message, messageBufferSize), room: rooms.get(name)}
+		c.room.join <- c
+		clients = append(clients, c)
+	}
+	for deadline := time.Now().Add(time.Second); rooms.clientCount() != 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	n.heartbeat()
+	state.Put(nodesBucket, "idle", nodeInfo{ID: "idle", Seen: time.Now()})
+	state.Put(clusterCommandsBucket, rebalanceKey, clusterCommand{Requested: time.Now()})
+	n.heartbeat()
+	// 3 clients over 2 servers: this one keeps 2
+	moved := 0
+	for _, c := range clients {
+		select {
+		case msg := <-c.send:
+			if msg.Type == msgTypeReconnect {
+				moved++
+			}
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if moved != 1 {
+		t.Errorf("expected 1 client to be moved, moved %d", moved)
+	}
+	n.heartbeat()
+	for _, c := range clients {
+		select {
+		case msg := <-c.send:
+			t.Errorf("a rebalance should only be carried out once, got %+v", msg)
+		default:
+		}
+	}
+}
+
+func TestShedDisconnectsSlowClients(t *testing.T) {
+	rooms := newRoomManager()
+	r := rooms.get("golang")
+	ann := &client{send: make(chan *message, messageBufferSize), room: r}
+	// bob's connection never reads
+	bob := &client{send: make(chan *message), room: r}
+	r.join <- ann
+	r.join <- bob
+	if n := rooms.shed(-1, &message{Type: msgTypeReconnect, Message: "Moving you."}); n != 2 {
+		t.Errorf("expected both clients to be shed, got %d", n)
+	}
+	if msg := receive(t, ann); msg.Type != msgTypeReconnect {
+		t.Errorf("expected a reconnect, got %+v", msg)
+	}
+	if _, ok := <-bob.send; ok {
+		t.Error("bob should have been disconnected")
+	}
+}
+
+func TestResumingClientGetsMissedMessages(t *testing.T) {
+	r := newRoom("golang")
+	go r.run()
+	left := time.Now()
+	r.store.Save(&message{ID: "before", Room: "golang", When: left.Add(-time.Minute)})
+	r.store.Save(&message{ID: "missed", Room: "golang", When: left.Add(time.Second)})
+	c := &client{send: make(chan *message, messageBufferSize), room: r, resumeSince: left}
+	r.join <- c
+	if msg := receive(t, c); msg.ID != "missed" {
+		t.Errorf("expected only the missed message, got %+v", msg)
+	}
+	select {
+	case msg := <-c.send:
+		t.Errorf("unexpected %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestShutdownNotice(t *testing.T) {
+	rooms := newRoomManager()
+	state := newFileState("")
+	n := newClusterNode(state, rooms)
+	r := rooms.get("golang")
+	c := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- c
+
+	w := httptest.NewRecorder()
+	n.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/cluster/shutdown", strings.NewReader(`{"Reason": "Upgrading", "Downtime": 300}`)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("setting the notice failed: %d %s", w.Code, w.Body)
+	}
+	done := make(chan struct{})
+	go func() {
+		n.shutdown(context.Background())
+		close(done)
+	}()
+	msg := receive(t, c)
+	if msg.Type != msgTypeShutdown || msg.Shutdown == nil || msg.Shutdown.Reason != "Upgrading" || msg.Shutdown.Downtime != 300 {
+		t.Errorf("client should be told why and for how long, got %+v", msg)
+	}
+	r.leave <- c
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown should finish once the clients are gone")
+	}
+	if !rooms.isDraining() {
+		t.Error("a server shutting down should refuse new clients")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	rooms := newRoomManager()
+	n := newClusterNode(newFileState(""), rooms)
+	r := rooms.get("golang")
+	// nothing reads from this client, so the room gets stuck sending to it
+	r.join <- &client{send: make(chan *message), room: r}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		n.shutdown(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown should give up at the deadline")
+	}
+}
+
+func TestDrainNotice(t *testing.T) {
+	rooms := newRoomManager()
+	state := newFileState("")
+	n := newClusterNode(state, rooms)
+	c := &client{send: make(chan *message, messageBufferSize), room: rooms.get("golang")}
+	rooms.get("golang").join <- c
+
+	w := httptest.NewRecorder()
+	n.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/cluster/nodes/"+nodeID+"/drain", strings.NewReader(`{"Reason": "Kernel update"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("drain failed: %d %s", w.Code, w.Body)
+	}
+	n.heartbeat()
+	if msg := receive(t, c); msg.Type != msgTypeReconnect || msg.Message != "Kernel update" || msg.Shutdown == nil {
+		t.Errorf("client should be told the drain reason, got %+v", msg)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	if got := closeReason("short"); got != "short" {
+		t.Errorf("got %q", got)
+	}
+	long := strings.Repeat("é", maxCloseReason)
+	if got := closeReason(long); len(got) > maxCloseReason || !utf8.ValidString(got) {
+		t.Errorf("reason should be cut at a character boundary, got %d bytes", len(got))
+	}
+}
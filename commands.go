@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandArg describes one positional argument of a slash command.
+type commandArg struct {
+	Name     string
+	Required bool
+}
+
+// slashCommand is a command registered by a bot. A message of the form
+// "/name arg1 arg2" sent to one of Rooms (or any room if Rooms is empty) is
+// not broadcast; it is POSTed to the bot's URL instead and whatever text the
+// bot answers with is posted into the room under the bot's name. Bot is the
+// userid of the bot account that registered the command, or the name an
+// admin gave it.
+type slashCommand struct {
+	Name        string
+	Description string
+	Args        []commandArg
+	Rooms       []string
+	URL         string
+	Bot         string
+}
+
+// inRoom reports whether the command is available in room.
+func (c *slashCommand) inRoom(room string) bool {
+	if len(c.Rooms) == 0 {
+		return true
+	}
+	for _, r := range c.Rooms {
+		if r == room {
+			return true
+		}
+	}
+	return false
+}
+
+// commandRequest is what a bot receives when one of its commands is used.
+type commandRequest struct {
+	Command string
+	Args    map[string]string
+	Room    string
+	UserID  string
+	Name    string
+}
+
+// commandResponse is what a bot answers with; an empty Text posts nothing.
+type commandResponse struct {
+	Text string
+}
+
+// commandDispatcher holds the registered slash commands and routes
+// command messages to the bots that own them. A registered command is
+// never changed, only replaced, so it may be read without holding mu once
+// it has been looked up.
+type commandDispatcher struct {
+	mu       sync.RWMutex
+	commands map[string]*slashCommand
+	client   *http.Client
+}
+
+func newCommandDispatcher() *commandDispatcher {
+	return &commandDispatcher{
+		commands: make(map[string]*slashCommand),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// register adds cmd, replacing an earlier registration of the same name.
+func (d *commandDispatcher) register(cmd *slashCommand) error {
+	if !validID(cmd.Name) {
+		return errors.New("command name must be letters, digits, '-' or '_'")
+	}
+	if u, err := url.Parse(cmd.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("command URL must be an http(s) URL")
+	}
+	if cmd.Bot == "" {
+		return errors.New("command needs a bot name")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.commands[cmd.Name] = cmd
+	return nil
+}
+
+// unregister removes the named command.
+func (d *commandDispatcher) unregister(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.commands[name]
+	delete(d.commands, name)
+	return ok
+}
+
+// install makes the command called name, if it is only available in some
+// rooms, available in room too. It reports whether there is such a command.
+func (d *commandDispatcher) install(name, room string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cmd, ok := d.commands[name]
+	if ok && !cmd.inRoom(room) {
+		installed := *cmd
+		installed.Rooms = append(cmd.Rooms[:len(cmd.Rooms):len(cmd.Rooms)], room)
+		d.commands[name] = &installed
+	}
+	return ok
+}
+
+// uninstall makes the command called name unavailable in room again. It
+// reports whether the command was installed there; a command available in
+// every room, or only in room, cannot be uninstalled from it.
+func (d *commandDispatcher) uninstall(name, room string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cmd, ok := d.commands[name]
+	if !ok || len(cmd.Rooms) < 2 {
+		return false
+	}
+	for i, r := range cmd.Rooms {
+		if r == room {
+			uninstalled := *cmd
+			uninstalled.Rooms = append(cmd.Rooms[:i:i], cmd.Rooms[i+1:]...)
+			d.commands[name] = &uninstalled
+			return true
+		}
+	}
+	return false
+}
+
+// lookup finds the command invoked by text in room. ok is false when text is
+// not a registered command, in which case it is treated as an ordinary message.
+func (d *commandDispatcher) lookup(room, text string) (cmd *slashCommand, args []string, ok bool) {
+	if !strings.HasPrefix(text, "/") {
+		return nil, nil, false
+	}
+	fields := strings.Fields(text[1:])
+	if len(fields) == 0 {
+		return nil, nil, false
+	}
+	d.mu.RLock()
+	cmd, ok = d.commands[fields[0]]
+	d.mu.RUnlock()
+	if !ok || !cmd.inRoom(room) {
+		return nil, nil, false
+	}
+	return cmd, fields[1:], true
+}
+
+// bindArgs matches positional args against the command's schema. Any extra
+// words are joined onto the last argument.
+func (c *slashCommand) bindArgs(args []string) (map[string]string, error) {
+	bound := make(map[string]string, len(c.Args))
+	for i, arg := range c.Args {
+		switch {
+		case i < len(args) && i == len(c.Args)-1:
+			bound[arg.Name] = strings.Join(args[i:], " ")
+		case i < len(args):
+			bound[arg.Name] = args[i]
+		case arg.Required:
+			return nil, fmt.Errorf("usage: %s", c.usage())
+		}
+	}
+	return bound, nil
+}
+
+func (c *slashCommand) usage() string {
+	usage := "/" + c.Name
+	for _, arg := range c.Args {
+		if arg.Required {
+			usage += " <" + arg.Name + ">"
+		} else {
+			usage += " [" + arg.Name + "]"
+		}
+	}
+	return usage
+}
+
+// dispatch sends the invocation to the bot and returns its reply text.
+func (d *commandDispatcher) dispatch(cmd *slashCommand, req commandRequest) (string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	resp, err := d.client.Post(cmd.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bot %s answered %s", cmd.Bot, resp.Status)
+	}
+	var reply commandResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return "", fmt.Errorf("bot %s: %w", cmd.Bot, err)
+	}
+	return reply.Text, nil
+}
+
+// ServeHTTP is the registration API bots use at runtime:
+//
+//	GET    /api/commands         list registered commands
+//	POST   /api/commands         register (or replace) a command
+//	DELETE /api/commands/{name}  remove a command
+//
+// Admins manage every command. A bot, signed in with its token, manages
+// only its own: Bot is set to its userid, and a bot scoped to some rooms may
+// only register commands for those.
+func (d *commandDispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	owner := ""
+	if isBot(user) {
+		owner = user.Get("userid").Str()
+	} else if !isAdmin(user.Get("email").Str()) {
+		http.Error(w, "only admins and bots may manage commands", http.StatusForbidden)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/commands"), "/")
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		d.mu.RLock()
+		commands := make([]*slashCommand, 0, len(d.commands))
+		for _, cmd := range d.commands {
+			if owner == "" || cmd.Bot == owner {
+				commands = append(commands, cmd)
+			}
+		}
+		d.mu.RUnlock()
+		sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(commands)
+	case r.Method == http.MethodPost && name == "":
+		var cmd slashCommand
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if owner != "" {
+			cmd.Bot = owner
+			scopes, _ := scopesOf(user)
+			if len(cmd.Rooms) == 0 {
+				cmd.Rooms = scopes.Rooms
+			}
+			for _, room := range cmd.Rooms {
+				if !scopes.inRoom(room) {
+					http.Error(w, "this bot may not enter "+room, http.StatusForbidden)
+					return
+				}
+			}
+			if !d.ownedBy(cmd.Name, owner) {
+				http.Error(w, "the command belongs to another bot", http.StatusForbidden)
+				return
+			}
+		}
+		if err := d.register(&cmd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete && name != "":
+		if owner != "" && !d.ownedBy(name, owner) {
+			http.Error(w, "the command belongs to another bot", http.StatusForbidden)
+			return
+		}
+		if !d.unregister(name) {
+			http.Error(w, "no such command", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// ownedBy reports whether the command called name, if there is one, is
+// bot's.
+func (d *commandDispatcher) ownedBy(name, bot string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	cmd, ok := d.commands[name]
+	return !ok || cmd.Bot == bot
+}
+
+// runCommand hands a slash command used by c to its bot and posts the reply
+// into the room, as the bot's message. Problems are only reported back to c.
+func (c *client) runCommand(cmd *slashCommand, args []string) {
+	bound, err := cmd.bindArgs(args)
+	var reply string
+	if err == nil {
+		reply, err = c.room.commands.dispatch(cmd, commandRequest{
+			Command: cmd.Name,
+			Args:    bound,
+			Room:    c.room.name,
+			UserID:  c.userID(),
+			Name:    c.name(),
+		})
+	}
+	if err != nil {
+		c.room.tracer.Warn("Command /", cmd.Name, " failed: ", err)
+		c.room.notice(c, err.Error())
+		return
+	}
+	if reply == "" {
+		return
+	}
+	msg := &message{ID: newID(), UserID: cmd.Bot, Name: cmd.Bot, Bot: true, Message: reply, When: time.Now()}
+	if bot, err := botAccounts.lookup(cmd.Bot); err == nil && bot != nil {
+		msg.Name, msg.AvatarURL = bot.Name, bot.AvatarURL
+	}
+	c.room.forward <- msg
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/objx"
+)
+
+func TestCommandDispatcher(t *testing.T) {
+	var got commandRequest
+	bot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		json.NewEncoder(w).Encode(commandResponse{Text: "deploying " + got.Args["service"]})
+	}))
+	defer bot.Close()
+	d := newCommandDispatcher()
+	if err := d.register(&slashCommand{Name: "deploy", URL: "ftp://nope", Bot: "deploybot"}); err == nil {
+		t.Error("register should reject non-http URLs")
+	}
+	err := d.register(&slashCommand{
+		Name:  "deploy",
+		Args:  []commandArg{{Name: "service", Required: true}, {Name: "note"}},
+		Rooms: []string{"ops"},
+		URL:   bot.URL,
+		Bot:   "deploybot",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := d.lookup("ops", "deploy api"); ok {
+		t.Error("text without a leading slash is not a command")
+	}
+	if _, _, ok := d.lookup("lobby", "/deploy api"); ok {
+		t.Error("command should only be available in its rooms")
+	}
+	cmd, args, ok := d.lookup("ops", "/deploy api after the standup")
+	if !ok {
+		t.Fatal("lookup should find the registered command")
+	}
+	if _, err := cmd.bindArgs(nil); err == nil || err.Error() != "usage: /deploy <service> [note]" {
+		t.Errorf("missing required argument should report usage, got %v", err)
+	}
+	bound, err := cmd.bindArgs(args)
+	if err != nil || bound["service"] != "api" || bound["note"] != "after the standup" {
+		t.Errorf("unexpected bound args %v, %v", bound, err)
+	}
+	reply, err := d.dispatch(cmd, commandRequest{Command: "deploy", Args: bound, Room: "ops"})
+	if err != nil || reply != "deploying api" {
+		t.Errorf("unexpected reply %q, %v", reply, err)
+	}
+	if got.Room != "ops" {
+		t.Errorf("bot should be told the room, got %+v", got)
+	}
+}
+
+func TestCommandLookupWhileInstalling(t *testing.T) {
+	d := newCommandDispatcher()
+	if err := d.register(&slashCommand{Name: "deploy", Rooms: []string{"ops"}, URL: "http://bot.example.com", Bot: "deploybot"}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			d.install("deploy", "golang")
+			d.uninstall("deploy", "golang")
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if _, _, ok := d.lookup("ops", "/deploy api"); !ok {
+			t.Fatal("the command should stay available in ops")
+		}
+	}
+	<-done
+}
+
+func TestCommandRegistrationByBots(t *testing.T) {
+	adminsMu.Lock()
+	saved := admins
+	admins = map[string]bool{"root@example.com": true}
+	adminsMu.Unlock()
+	t.Cleanup(func() {
+		adminsMu.Lock()
+		admins = saved
+		adminsMu.Unlock()
+	})
+	root := objx.New(map[string]interface{}{"userid": "root", "email": "root@example.com"})
+	ann := objx.New(map[string]interface{}{"userid": "ann", "email": "ann@example.com"})
+	ops := (&botAccount{UserID: "bot-ops", Scopes: botScopes{Rooms: []string{"ops"}}}).userData()
+	other := (&botAccount{UserID: "bot-other"}).userData()
+	d := newCommandDispatcher()
+	serve := func(method, path, body string, user objx.Map) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, withAuthCookie(method, path, strings.NewReader(body), user))
+		return w
+	}
+
+	if w := serve(http.MethodPost, "/api/commands", `{"Name": "deploy", "URL": "http://bot.example.com", "Bot": "deploybot"}`, root); w.Code != http.StatusCreated {
+		t.Fatalf("admins should register commands, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(http.MethodPost, "/api/commands", `{"Name": "status", "URL": "http://bot.example.com"}`, ann); w.Code != http.StatusForbidden {
+		t.Errorf("users should not register commands, got %d", w.Code)
+	}
+	if w := serve(http.MethodPost, "/api/commands", `{"Name": "status", "URL": "http://ops.example.com", "Bot": "someone"}`, ops); w.Code != http.StatusCreated {
+		t.Fatalf("bots should register their own commands, got %d: %s", w.Code, w.Body)
+	}
+	if cmd, _, ok := d.lookup("ops", "/status"); !ok || cmd.Bot != "bot-ops" || len(cmd.Rooms) != 1 {
+		t.Errorf("the command should be the bot's, in its rooms, got %+v", cmd)
+	}
+	for _, body := range []string{
+		`{"Name": "deploy", "URL": "http://ops.example.com"}`,
+		`{"Name": "page", "URL": "http://ops.example.com", "Rooms": ["golang"]}`,
+	} {
+		if w := serve(http.MethodPost, "/api/commands", body, ops); w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", body, w.Code)
+		}
+	}
+	var list []slashCommand
+	json.NewDecoder(serve(http.MethodGet, "/api/commands", "", other).Body).Decode(&list)
+	if len(list) != 0 {
+		t.Errorf("a bot should only see its own commands, got %+v", list)
+	}
+	if w := serve(http.MethodDelete, "/api/commands/status", "", other); w.Code != http.StatusForbidden {
+		t.Errorf("a bot should not remove another's command, got %d", w.Code)
+	}
+	if w := serve(http.MethodDelete, "/api/commands/status", "", ops); w.Code != http.StatusNoContent {
+		t.Errorf("a bot should remove its own command, got %d", w.Code)
+	}
+}
+
+func TestCommandRepliesAreTheBots(t *testing.T) {
+	withBots(t).state.Put(botsBucket, "bot-deploy", &botAccount{UserID: "bot-deploy", Name: "Deploy bot", AvatarURL: "/avatars/deploy.png"})
+	bot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(commandResponse{Text: "deploying"})
+	}))
+	defer bot.Close()
+	r := newRoomManager().get("ops")
+	c := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": "ann"}}
+	r.join <- c
+	waitMembers(t, r, 1)
+	c.runCommand(&slashCommand{Name: "deploy", URL: bot.URL, Bot: "bot-deploy"}, nil)
+	if msg := receiveChat(t, c); msg.Message != "deploying" || !msg.Bot || msg.UserID != "bot-deploy" || msg.Name != "Deploy bot" || msg.AvatarURL != "/avatars/deploy.png" {
+		t.Errorf("the reply should be the bot's message, got %+v", msg)
+	}
+}
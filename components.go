@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The kinds of component a bot's message may have.
+const (
+	// componentButton is a button; clicking it sends an interaction with
+	// no value.
+	componentButton = "button"
+	// componentSelect is a menu; choosing one of its Options sends an
+	// interaction with the option's value.
+	componentSelect = "select"
+)
+
+// maxComponents is the most components one message may have, and
+// maxComponentOptions the most options one menu may have.
+const (
+	maxComponents       = 10
+	maxComponentOptions = 25
+)
+
+// component is a button or menu on a bot's message, for users to answer it
+// with, such as "Approve" and "Reject" on a deploy request.
+type component struct {
+	// ID tells the bot which component was used; it is unique within the
+	// message.
+	ID   string
+	Type string
+	// Label is the text on the button or menu.
+	Label string
+	// Style is how a button looks: "primary", "danger" or, if empty, the
+	// default.
+	Style   string            `json:",omitempty"`
+	Options []componentOption `json:",omitempty"`
+}
+
+// componentOption is one of the choices of a menu.
+type componentOption struct {
+	Value string
+	Label string
+}
+
+// interaction is a user's use of a component, which goes to the bot that
+// posted the message.
+type interaction struct {
+	MessageID   string
+	ComponentID string
+	// Value is the value of the option chosen from a menu.
+	Value string `json:",omitempty"`
+}
+
+// validComponents reports what is wrong with components, if anything.
+func validComponents(components []component) error {
+	if len(components) > maxComponents {
+		return fmt.Errorf("a message may have at most %d components", maxComponents)
+	}
+	ids := make(map[string]bool)
+	for _, c := range components {
+		if !validID(c.ID) || ids[c.ID] {
+			return errors.New("each component needs an ID of its own, made of letters, digits, '-' or '_'")
+		}
+		ids[c.ID] = true
+		if c.Label == "" {
+			return errors.New("each component needs a label")
+		}
+		switch c.Type {
+		case componentButton:
+			if len(c.Options) > 0 {
+				return errors.New("a button has no options")
+			}
+			if c.Style != "" && c.Style != "primary" && c.Style != "danger" {
+				return fmt.Errorf("unknown button style %q", c.Style)
+			}
+		case componentSelect:
+			if len(c.Options) == 0 || len(c.Options) > maxComponentOptions {
+				return fmt.Errorf("a menu needs between 1 and %d options", maxComponentOptions)
+			}
+			for _, o := range c.Options {
+				if o.Value == "" || o.Label == "" {
+					return errors.New("each option needs a value and a label")
+				}
+			}
+		default:
+			return fmt.Errorf("unknown component type %q", c.Type)
+		}
+	}
+	return nil
+}
+
+// findComponent returns the component of components with id, if value is
+// one it may send, or nil.
+func findComponent(components []component, id, value string) *component {
+	for i, c := range components {
+		if c.ID != id {
+			continue
+		}
+		if c.Type == componentButton {
+			if value == "" {
+				return &components[i]
+			}
+			return nil
+		}
+		for _, o := range c.Options {
+			if o.Value == value {
+				return &components[i]
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// interact sends the interaction msg, read from c, to the bot that posted
+// the message it answers, on whichever servers it is connected to, and
+// acknowledges it. The client is told if there is no such component.
+func (c *client) interact(msg *message) {
+	in := msg.Interaction
+	original, err := findMessage(c.room.store, c.room.name, in.MessageID)
+	if err != nil {
+		c.room.tracer.Error("Failed to find the message interacted with: ", err)
+		c.room.notice(c, "The message could not be found.")
+		return
+	}
+	if original == nil || !original.Bot || !visibleTo(c.room.state, original, msg.UserID, make(map[string]time.Time)) ||
+		findComponent(original.Components, in.ComponentID, in.Value) == nil {
+		c.room.notice(c, "There is no such button or menu here.")
+		return
+	}
+	msg.Room = c.room.name
+	msg.To = original.UserID
+	msg.When = time.Now()
+	c.room.rooms.sendInteraction(msg)
+	c.room.direct <- &directMessage{to: c, msg: ackFor(msg)}
+}
+
+// sendInteraction hands the interaction msg to the connections of the bot
+// it is for, here and, through the broker, on the other servers. It is not
+// saved: a bot that is not connected misses it.
+func (m *roomManager) sendInteraction(msg *message) {
+	m.publish(msg)
+	m.deliverInteraction(msg)
+}
+
+// deliverInteraction hands an interaction to the rooms of this server.
+func (m *roomManager) deliverInteraction(msg *message) {
+	for _, r := range m.list() {
+		m.handDirect(r, &directMessage{userID: msg.To, msg: msg})
+	}
+}
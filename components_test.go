@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/objx"
+)
+
+func TestValidComponents(t *testing.T) {
+	approve := component{ID: "approve", Type: componentButton, Label: "Approve", Style: "primary"}
+	env := component{ID: "env", Type: componentSelect, Label: "Where", Options: []componentOption{{Value: "prod", Label: "Production"}}}
+	if err := validComponents([]component{approve, env}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	for _, bad := range [][]component{
+		{approve, approve},
+		{{ID: "x", Type: componentButton}},
+		{{ID: "x", Type: "slider", Label: "X"}},
+		{{ID: "x", Type: componentButton, Label: "X", Style: "blinking"}},
+		{{ID: "x", Type: componentSelect, Label: "X"}},
+		{{ID: "x", Type: componentSelect, Label: "X", Options: []componentOption{{Label: "No value"}}}},
+		make([]component, maxComponents+1),
+	} {
+		if validComponents(bad) == nil {
+			t.Errorf("%+v should not be valid", bad)
+		}
+	}
+	if findComponent([]component{approve, env}, "env", "prod") == nil || findComponent([]component{approve, env}, "env", "dev") != nil ||
+		findComponent([]component{approve, env}, "approve", "") == nil || findComponent([]component{approve, env}, "approve", "x") != nil {
+		t.Error("only the components' own values should be found")
+	}
+}
+
+func TestInteractionGoesToTheBot(t *testing.T) {
+	rooms := newRoomManager()
+	r := rooms.get("ops")
+	api := &roomSettingsAPI{state: r.state, rooms: rooms}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	bot := &botAccount{UserID: "bot-deploy", Name: "Deploy bot"}
+	b := &client{send: make(chan *message, messageBufferSize), room: r, userData: bot.userData()}
+	r.join <- b
+	ann := dialRoom(t, server, objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"}))
+	waitMembers(t, r, 2)
+	next := func(conn *websocket.Conn, types ...string) *message {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var msg message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			for _, typ := range types {
+				if msg.Type == typ {
+					return &msg
+				}
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, withAuthCookie(http.MethodPost, "/api/rooms/ops/messages", strings.NewReader(
+		`{"Text": "Deploy v1.2?", "Components": [{"ID": "approve", "Type": "button", "Label": "Approve"}]}`), bot.userData()))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body)
+	}
+	posted := next(ann, msgTypeMessage)
+	if len(posted.Components) != 1 || posted.Components[0].ID != "approve" {
+		t.Fatalf("the message should have its button, got %+v", posted)
+	}
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, withAuthCookie(http.MethodPost, "/api/rooms/ops/messages", strings.NewReader(
+		`{"Text": "x", "Components": [{"ID": "x", "Type": "slider", "Label": "X"}]}`), bot.userData()))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad component, got %d", w.Code)
+	}
+
+	ann.WriteJSON(&message{Type: msgTypeInteraction, Interaction: &interaction{MessageID: posted.ID, ComponentID: "reject"}})
+	if msg := next(ann, msgTypeNotice); msg.Message != "There is no such button or menu here." {
+		t.Errorf("unexpected notice %q", msg.Message)
+	}
+	ann.WriteJSON(&message{ID: "i1", Type: msgTypeInteraction, Interaction: &interaction{MessageID: posted.ID, ComponentID: "approve"}})
+	if msg := next(ann, msgTypeAck, msgTypeNotice); msg.Type != msgTypeAck || msg.ID != "i1" {
+		t.Errorf("the interaction should be acknowledged, got %+v", msg)
+	}
+	for {
+		msg := receive(t, b)
+		if msg.Type != msgTypeInteraction {
+			continue
+		}
+		if msg.UserID != "ann" || msg.To != "bot-deploy" || msg.Room != "ops" || msg.Interaction.ComponentID != "approve" {
+			t.Errorf("unexpected interaction %+v", msg)
+		}
+		break
+	}
+
+	// users' messages have no components
+	ann.WriteJSON(&message{ID: "m1", Message: "me too", Components: []component{{ID: "x", Type: componentButton, Label: "X"}}})
+	if msg := next(ann, msgTypeMessage); msg.ID != "m1" || len(msg.Components) != 0 {
+		t.Errorf("a user's message should lose its components, got %+v", msg)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/law-lee/chat_server/trace"
+)
+
+// serverConfig is what the server was configured with on the command line,
+// gathered so it can be checked before anything is started.
+type serverConfig struct {
+	dataDir         string
+	secretsSpec     string
+	storeSpec       string
+	encrypt         bool
+	sessionSpec     string
+	limiterSpec     string
+	brokerSpec      string
+	expandersFile   string
+	moderationFile  string
+	rateLimit       rateLimit
+	historySize     int
+	maxMessage      int
+	bandwidth       bandwidthCap
+	maxAttachment   int64
+	usageReporters  string
+	smtpAddr        string
+	mailFrom        string
+	publicURL       string
+	gitlabURL       string
+	microsoftTenant string
+	oidcIssuer      string
+	shutdownTimeout time.Duration
+	traceLevel      string
+	traceFormat     string
+	traceOutput     string
+	traceMaxBytes   int
+	traceRate       int
+	traceFile       string
+	traceFrames     string
+	traceFramesRate float64
+	tlsCert         string
+	tlsKey          string
+	autocert        string
+	acmeDirectory   string
+}
+
+// validate reports everything wrong with c that can be told without
+// connecting to anything: bad values, unknown backends, and rule files that
+// do not parse or have keys the server does not know.
+func (c *serverConfig) validate() []error {
+	var errs []error
+	bad := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if !validRateLimitPolicy(c.rateLimit.Policy) {
+		bad("-rate-policy: unknown policy %q", c.rateLimit.Policy)
+	}
+	if c.rateLimit.Rate < 0 || c.rateLimit.IPRate < 0 || c.rateLimit.BotRate < 0 {
+		bad("-rate, -ip-rate and -bot-rate may not be negative")
+	}
+	if c.rateLimit.Rate > 0 && c.rateLimit.Burst < 1 {
+		bad("-burst must be at least 1 when -rate is set")
+	}
+	if c.rateLimit.IPRate > 0 && c.rateLimit.IPBurst < 1 {
+		bad("-ip-burst must be at least 1 when -ip-rate is set")
+	}
+	if c.rateLimit.BotRate > 0 && c.rateLimit.BotBurst < 1 {
+		bad("-bot-burst must be at least 1 when -bot-rate is set")
+	}
+	if c.historySize < 0 {
+		bad("-history may not be negative")
+	}
+	if c.maxMessage < 0 {
+		bad("-max-message may not be negative")
+	}
+	if c.maxAttachment <= 0 {
+		bad("-max-attachment must be positive")
+	}
+	if c.bandwidth.Rate < 0 || c.bandwidth.Burst < 0 {
+		bad("-bandwidth and -bandwidth-burst must not be negative")
+	}
+	if c.shutdownTimeout <= 0 {
+		bad("-shutdown-timeout must be positive")
+	}
+	if _, err := trace.ParseLevel(c.traceLevel); err != nil {
+		bad("-trace-level: %v", err)
+	}
+	if c.traceFormat != "text" && c.traceFormat != "json" {
+		bad("-trace-format: unknown format %q", c.traceFormat)
+	}
+	switch c.traceOutput {
+	case traceOff, traceStdout, traceRing:
+	case traceFile:
+		if c.traceFile == "" {
+			bad("-trace-output file needs -trace-file")
+		}
+	default:
+		bad("-trace-output: unknown output %q", c.traceOutput)
+	}
+	if c.traceMaxBytes < 0 || c.traceRate < 0 {
+		bad("-trace-max-bytes and -trace-rate must not be negative")
+	}
+	if c.traceFramesRate < 0 || c.traceFramesRate > 1 {
+		bad("-trace-frames-rate must be from 0 to 1")
+	} else if c.traceFramesRate > 0 && c.traceFrames == "" {
+		bad("-trace-frames-rate needs -trace-frames")
+	}
+	if _, err := newSecretSource(c.secretsSpec); err != nil {
+		bad("-secrets: %v", err)
+	}
+	if kind, _, _ := strings.Cut(c.storeSpec, ":"); kind != "" && kind != "memory" && kind != "sqlite" && kind != "postgres" {
+		bad("-store: unknown message store %q", kind)
+	}
+	if _, err := newSessionStore(c.sessionSpec); err != nil {
+		bad("-sessions: %v", err)
+	}
+	if _, err := newRateLimiter(c.limiterSpec); err != nil {
+		bad("-rate-limiter: %v", err)
+	}
+	if _, err := newBroker(c.brokerSpec); err != nil {
+		bad("-broker: %v", err)
+	}
+	for _, spec := range strings.Split(c.usageReporters, ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			if _, err := newUsageReporter(spec, nil); err != nil {
+				bad("-usage-report: %v", err)
+			}
+		}
+	}
+	if c.smtpAddr != "" {
+		if _, _, err := net.SplitHostPort(c.smtpAddr); err != nil {
+			bad("-smtp: %v", err)
+		}
+		if _, err := mail.ParseAddress(c.mailFrom); err != nil {
+			bad("-mail-from: %v", err)
+		}
+	}
+	if c.publicURL != "" {
+		if u, err := url.Parse(c.publicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			bad("-public-url: %q is not an http or https URL", c.publicURL)
+		}
+	}
+	if u, err := url.Parse(c.gitlabURL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		bad("-gitlab-url: %q is not an http or https URL", c.gitlabURL)
+	}
+	if c.microsoftTenant == "" || strings.ContainsAny(c.microsoftTenant, "/?# ") {
+		bad("-microsoft-tenant: %q is not a tenant", c.microsoftTenant)
+	}
+	if c.oidcIssuer != "" {
+		if u, err := url.Parse(c.oidcIssuer); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			bad("-oidc-issuer: %q is not an issuer URL", c.oidcIssuer)
+		}
+	}
+	if (c.tlsCert == "") != (c.tlsKey == "") {
+		bad("-tls-cert and -tls-key go together")
+	}
+	if c.tlsCert != "" && c.autocert != "" {
+		bad("-tls-cert and -autocert are alternatives")
+	}
+	if c.tlsCert != "" && c.tlsKey != "" {
+		if _, err := tls.LoadX509KeyPair(c.tlsCert, c.tlsKey); err != nil {
+			bad("-tls-cert: %v", err)
+		}
+	}
+	if c.autocert != "" {
+		for _, domain := range strings.Split(c.autocert, ",") {
+			if domain == "" || strings.ContainsAny(domain, ":/ ") {
+				bad("-autocert: %q is not a domain", domain)
+			}
+		}
+		if u, err := url.Parse(c.acmeDirectory); err != nil || u.Scheme != "https" {
+			bad("-acme-directory: %q is not an https URL", c.acmeDirectory)
+		}
+	}
+	if c.moderationFile != "" {
+		if _, err := loadModerators(c.moderationFile); err != nil {
+			bad("-moderation: %v", err)
+		}
+	}
+	if c.expandersFile != "" {
+		if _, err := loadLinkExpander(c.expandersFile, nil); err != nil {
+			bad("-expanders: %v", err)
+		}
+	}
+	return errs
+}
+
+// check reports everything validate does, and then what is missing from
+// the secrets backend and which of the message store, session store, rate
+// limiter and broker cannot be reached before ctx is done.
+func (c *serverConfig) check(ctx context.Context) []error {
+	errs := c.validate()
+	if len(errs) > 0 {
+		// the backends can't be tried with a configuration that is wrong
+		return errs
+	}
+	source, _ := newSecretSource(c.secretsSpec)
+	secrets := &settingsSecrets{next: source}
+	store, err := newMessageStore(c.storeSpec, secrets)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("-store: %w", err))
+	} else {
+		// login providers may have been entered on the setup page
+		secrets.use(newStateStore(store, c.dataDir))
+	}
+	if err := (&probes{secrets: secrets}).checkAuth(); err != nil {
+		errs = append(errs, fmt.Errorf("secrets: %w; set <provider>_client_id and <provider>_client_sec for one of %s", err, strings.Join(authProviders, ", ")))
+	}
+	if _, err := secrets.Secret("security_key"); err != nil && c.brokerSpec != "" {
+		errs = append(errs, errors.New("secrets: security_key is needed when servers share rooms through -broker, so they all sign logins alike"))
+	}
+	if c.expandersFile != "" {
+		expander, _ := loadLinkExpander(c.expandersFile, nil)
+		for _, rule := range expander.rules {
+			if rule.Secret == "" {
+				continue
+			}
+			if _, err := secrets.Secret(rule.Secret); err != nil {
+				errs = append(errs, fmt.Errorf("secrets: %s is needed by expander %s", rule.Secret, rule.Name))
+			}
+		}
+	}
+	if c.encrypt {
+		if _, err := secrets.Secret("data_master_key"); err != nil {
+			errs = append(errs, errors.New("secrets: data_master_key is needed to -encrypt"))
+		}
+	}
+	if c.smtpAddr != "" {
+		if _, err := secrets.Secret("smtp_credentials"); err != nil {
+			errs = append(errs, errors.New("secrets: smtp_credentials is needed to send email through -smtp"))
+		}
+	}
+	sessionStore, _ := newSessionStore(c.sessionSpec)
+	limiter, _ := newRateLimiter(c.limiterSpec)
+	broker, _ := newBroker(c.brokerSpec)
+	for _, backend := range []struct {
+		flag    string
+		backend interface{}
+	}{{"-sessions", sessionStore}, {"-rate-limiter", limiter}, {"-broker", broker}} {
+		if pinger, ok := backend.backend.(Pinger); ok {
+			if err := pinger.Ping(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", backend.flag, err))
+			}
+		}
+	}
+	return errs
+}
+
+// decodeStrict decodes the JSON in data, read from path, into v, refusing
+// keys v has no field for so that a misspelt setting is not just ignored.
+func decodeStrict(path string, data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
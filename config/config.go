@@ -0,0 +1,148 @@
+// Package config fills in command line flags from the environment and from
+// a configuration file, so that every flag a program has can be set in
+// whichever of the three suits its deployment.
+//
+// The file is a flat TOML table keyed by flag name:
+//
+//	# chat.toml
+//	addr = ":8443"
+//	store = "postgres:"
+//	rate = 5
+//	metering = true
+//
+// A flag given on the command line wins over the environment, which wins
+// over the file.
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EnvName returns the environment variable that sets the flag called name:
+// prefix followed by the name upper-cased with dashes as underscores, so
+// that with the prefix CHAT_ the flag -rate-policy is CHAT_RATE_POLICY.
+func EnvName(prefix, name string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Load sets every flag in fs that was not given on the command line from
+// its environment variable, named by EnvName, or else from the file at
+// path. An empty path means there is no file. It is an error for the file
+// to have a key that is not a flag in fs, or for any value not to suit its
+// flag.
+func Load(fs *flag.FlagSet, path, prefix string) error {
+	settings := map[string]setting{}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if settings, err = parse(f); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for name, s := range settings {
+			if fs.Lookup(name) == nil {
+				return fmt.Errorf("%s:%d: unknown setting %q", path, s.line, name)
+			}
+		}
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] {
+			return
+		}
+		if value, ok := os.LookupEnv(EnvName(prefix, f.Name)); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %w", EnvName(prefix, f.Name), setErr)
+			}
+		} else if s, ok := settings[f.Name]; ok {
+			if setErr := fs.Set(f.Name, s.value); setErr != nil {
+				err = fmt.Errorf("%s:%d: %s: %w", path, s.line, f.Name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// setting is a value from the file and the line it is on.
+type setting struct {
+	value string
+	line  int
+}
+
+// parse reads key = value lines. Values are TOML strings, numbers or
+// booleans; blank lines and # comments are skipped.
+func parse(r io.Reader) (map[string]setting, error) {
+	settings := map[string]setting{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: want key = value", n)
+		}
+		if _, dup := settings[key]; dup {
+			return nil, fmt.Errorf("line %d: %s is set twice", n, key)
+		}
+		value, err := parseValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, key, err)
+		}
+		settings[key] = setting{value: value, line: n}
+	}
+	return settings, scanner.Err()
+}
+
+// parseValue returns the text of a TOML string, number or boolean,
+// dropping a trailing comment.
+func parseValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		end := 1
+		for end < len(raw) && raw[end] != '"' {
+			if raw[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(raw) {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if rest := strings.TrimSpace(raw[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after the string", rest)
+		}
+		return strconv.Unquote(raw[:end+1])
+	case strings.HasPrefix(raw, "'"):
+		end := strings.Index(raw[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if rest := strings.TrimSpace(raw[end+2:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after the string", rest)
+		}
+		return raw[1 : end+1], nil
+	}
+	if i := strings.Index(raw, "#"); i >= 0 {
+		raw = strings.TrimSpace(raw[:i])
+	}
+	if raw == "true" || raw == "false" {
+		return raw, nil
+	}
+	if _, err := strconv.ParseFloat(strings.ReplaceAll(raw, "_", ""), 64); err == nil {
+		return strings.ReplaceAll(raw, "_", ""), nil
+	}
+	return "", fmt.Errorf("%q is not a string, number or boolean", raw)
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "chat.toml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	fs := flag.NewFlagSet("chat", flag.ContinueOnError)
+	addr := fs.String("addr", ":8080", "")
+	store := fs.String("store", "memory", "")
+	rate := fs.Float64("rate", 2, "")
+	metering := fs.Bool("metering", false, "")
+	timeout := fs.Duration("shutdown-timeout", time.Second, "")
+	policy := fs.String("rate-policy", "drop", "")
+	if err := fs.Parse([]string{"-addr", ":9000"}); err != nil {
+		t.Fatal(err)
+	}
+	path := writeFile(t, `
+# the file
+addr = ":8443"
+store = "sqlite:/var/lib/chat/chat.db" # history
+rate = 5
+metering = true
+shutdown-timeout = '30s'
+rate-policy = "delay"
+`)
+	t.Setenv("CHAT_RATE_POLICY", "disconnect")
+	if err := Load(fs, path, "CHAT_"); err != nil {
+		t.Fatal(err)
+	}
+	if *addr != ":9000" {
+		t.Errorf("the command line should win, got addr %s", *addr)
+	}
+	if *policy != "disconnect" {
+		t.Errorf("the environment should win over the file, got rate-policy %s", *policy)
+	}
+	if *store != "sqlite:/var/lib/chat/chat.db" || *rate != 5 || !*metering || *timeout != 30*time.Second {
+		t.Errorf("the file should set the rest, got %s %g %v %s", *store, *rate, *metering, *timeout)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for content, want := range map[string]string{
+		`histroy = 50`:             `:1: unknown setting "histroy"`,
+		`history = "lots"`:         `:1: history: parse error`,
+		`history 50`:               `line 1: want key = value`,
+		`addr = ":80`:              `unterminated string`,
+		`addr = localhost:80`:      `is not a string, number or boolean`,
+		"history = 1\nhistory = 2": `history is set twice`,
+	} {
+		fs := flag.NewFlagSet("chat", flag.ContinueOnError)
+		fs.String("addr", ":8080", "")
+		fs.Int("history", 50, "")
+		err := Load(fs, writeFile(t, content), "CHAT_")
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want an error containing %q", content, err, want)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("CHAT_", "rate-policy"); got != "CHAT_RATE_POLICY" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig is a configuration that needs nothing outside the process.
+func validConfig() *serverConfig {
+	return &serverConfig{
+		secretsSpec:     "env",
+		storeSpec:       "memory",
+		sessionSpec:     "memory",
+		limiterSpec:     "memory",
+		rateLimit:       rateLimit{Rate: 2, Burst: 10, Policy: rateLimitDrop},
+		historySize:     defaultHistorySize,
+		maxMessage:      defaultMaxMessage,
+		maxAttachment:   defaultMaxAttachment,
+		shutdownTimeout: defaultShutdownTimeout,
+		gitlabURL:       "https://gitlab.com",
+		microsoftTenant: "common",
+		traceLevel:      "info",
+		traceFormat:     "text",
+		traceOutput:     "stdout",
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if errs := validConfig().validate(); len(errs) != 0 {
+		t.Fatalf("a valid configuration should pass, got %v", errs)
+	}
+	dir := t.TempDir()
+	moderation := filepath.Join(dir, "moderation.json")
+	if err := ioutil.WriteFile(moderation, []byte(`{"Wrods": {"Words": ["darn"]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := validConfig()
+	c.rateLimit.Policy = "ignore"
+	c.storeSpec = "mongodb:localhost"
+	c.brokerSpec = "nats://localhost"
+	c.publicURL = "chat.example.com"
+	c.gitlabURL = "gitlab.example.com"
+	c.oidcIssuer = "https://sso.example.com/?realm=chat"
+	c.moderationFile = moderation
+	c.traceFramesRate = 1.5
+	c.maxMessage = -1
+	var got []string
+	for _, err := range c.validate() {
+		got = append(got, err.Error())
+	}
+	for _, want := range []string{"-rate-policy", "-store", "-broker", "-public-url", "-gitlab-url", "-oidc-issuer", "-trace-frames-rate", "-max-message", `unknown field "Wrods"`} {
+		if !strings.Contains(strings.Join(got, "\n"), want) {
+			t.Errorf("missing an error about %s in %q", want, got)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	t.Setenv("GITHUB_CLIENT_ID", "id")
+	t.Setenv("GITHUB_CLIENT_SEC", "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if errs := validConfig().check(ctx); len(errs) != 0 {
+		t.Fatalf("a valid configuration should pass, got %v", errs)
+	}
+
+	// a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	t.Setenv("GITHUB_CLIENT_SEC", "")
+	c := validConfig()
+	c.sessionSpec = "redis://" + addr
+	var got []string
+	for _, err := range c.check(ctx) {
+		got = append(got, err.Error())
+	}
+	for _, want := range []string{"-sessions", "no login provider"} {
+		if !strings.Contains(strings.Join(got, "\n"), want) {
+			t.Errorf("missing an error about %s in %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import "net/http"
+
+const (
+	// csrfCookie holds a random ID per browser that its CSRF tokens are
+	// made from.
+	csrfCookie = "csrf"
+	// csrfField is the form field, and csrfHeader the header for scripts,
+	// that carry the token.
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken returns the token the forms of the page answering r must send
+// back, a signature of the browser's csrf cookie, which it sets if the
+// browser has none. Another site can't read it, so it can't make a form
+// that passes checkCSRF.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	var id string
+	if c, err := r.Cookie(csrfCookie); err == nil && validID(c.Value) {
+		id = c.Value
+	} else {
+		id = newID()
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    id,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return authKeys.sign([]byte("csrf:" + id))
+}
+
+// validCSRF reports whether r may change something: it is a GET, HEAD or
+// OPTIONS, it is authenticated with a bearer token rather than the cookies a
+// browser sends whichever site made the request, or it carries the token of
+// its csrf cookie.
+func validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if _, ok := bearerToken(r); ok {
+		return true
+	}
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || !validID(c.Value) {
+		return false
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue(csrfField)
+	}
+	return token != "" && authKeys.verify([]byte("csrf:"+c.Value), token)
+}
+
+// checkCSRF refuses requests to handler that fail validCSRF. Handlers of
+// multipart forms check validCSRF themselves instead, once they have read
+// the form within their own size limit.
+func checkCSRF(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validCSRF(r) {
+			http.Error(w, errCSRF, http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// errCSRF is what a request failing validCSRF is told.
+const errCSRF = "this form has expired; reload the page and try again"
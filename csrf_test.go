@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testCSRF returns a csrf cookie and the token that goes with it.
+func testCSRF() (*http.Cookie, string) {
+	w := httptest.NewRecorder()
+	token := csrfToken(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w.Result().Cookies()[0], token
+}
+
+func TestCSRFToken(t *testing.T) {
+	cookie, token := testCSRF()
+	// a browser that has the cookie keeps it and gets the same token
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	if got := csrfToken(w, r); got != token {
+		t.Errorf("token changed: %q, want %q", got, token)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("cookie set again: %v", cookies)
+	}
+}
+
+func TestCheckCSRF(t *testing.T) {
+	cookie, token := testCSRF()
+	otherCookie, otherToken := testCSRF()
+	handler := checkCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	form := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader(url.Values{csrfField: {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	withCookie := func(r *http.Request, c *http.Cookie) *http.Request {
+		r.AddCookie(c)
+		return r
+	}
+	header := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	header.Header.Set(csrfHeader, token)
+	bearer := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	bearer.Header.Set("Authorization", "Bearer abc")
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		code int
+	}{
+		{"get", httptest.NewRequest(http.MethodGet, "/logout", nil), http.StatusOK},
+		{"no token", withCookie(form(""), cookie), http.StatusForbidden},
+		{"no cookie", form(token), http.StatusForbidden},
+		{"form", withCookie(form(token), cookie), http.StatusOK},
+		{"header", withCookie(header, cookie), http.StatusOK},
+		{"another browser's token", withCookie(form(otherToken), cookie), http.StatusForbidden},
+		{"another browser's cookie", withCookie(form(token), otherCookie), http.StatusForbidden},
+		{"bearer", bearer, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, tc.r)
+		if w.Code != tc.code {
+			t.Errorf("%s: got %d %s, want %d", tc.name, w.Code, w.Body, tc.code)
+		}
+	}
+}
+
+func TestAttachmentNeedsCSRF(t *testing.T) {
+	s := &attachmentStore{dir: t.TempDir(), state: newFileState(""), maxSize: 1024}
+	r := uploadRequest(t, "ann", "notes.txt", []byte("hello"))
+	r.Header.Del(csrfHeader)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got %d %s, want 403", w.Code, w.Body)
+	}
+}
+
+func TestUploadNeedsCSRF(t *testing.T) {
+	s := newAvatarStore(dirBlobs(t.TempDir()), newFileState(""))
+	r := avatarRequest(t, "abc", "me.png", testPNG(t))
+	// the same upload, but from a browser that has no csrf cookie
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != csrfCookie {
+			r.AddCookie(c)
+		}
+	}
+	w := httptest.NewRecorder()
+	s.upload(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got %d %s, want 403", w.Code, w.Body)
+	}
+	if files, _ := s.blobs.List("abc"); len(files) != 0 {
+		t.Errorf("avatar saved: %v", files)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// roomKeysBucket holds the data key of each room, by room name, and
+	// fileKeysBucket that of each attachment file, by its hash. Both are
+	// wrapped by the master key.
+	roomKeysBucket = "room_keys"
+	fileKeysBucket = "file_keys"
+)
+
+// errNoDataKey is returned when opening something there is no data key for,
+// which was therefore stored before encryption was turned on.
+var errNoDataKey = errors.New("no data key")
+
+// dataKeys seals what is kept at rest with envelope encryption: each room,
+// and each attachment file, has a random data key of its own, kept in the
+// state store wrapped by the master key, which only the secrets backend
+// has. Attachments are uploaded before they are sent to a room, and a file
+// sent to several is kept once, so files have keys of their own rather than
+// their rooms'.
+type dataKeys struct {
+	master cipher.AEAD
+	state  StateStore
+	mu     sync.Mutex
+	// keys are the data keys used so far, unwrapped, by bucket and name.
+	keys map[string]cipher.AEAD
+}
+
+// newDataKeys makes the dataKeys whose master key is derived from secret,
+// the data_master_key secret, a long random value.
+func newDataKeys(secret string, state StateStore) (*dataKeys, error) {
+	if len(secret) < 16 {
+		return nil, errors.New("data_master_key must be at least 16 characters")
+	}
+	sum := sha256.Sum256([]byte(secret))
+	master, err := newGCM(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return &dataKeys{master: master, state: state, keys: make(map[string]cipher.AEAD)}, nil
+}
+
+// sealStore returns store wrapped in a sealedStore, with data keys kept in
+// state under the data_master_key secret of secrets.
+func sealStore(store MessageStore, state StateStore, secrets SecretSource) (*sealedStore, error) {
+	master, err := secrets.Secret("data_master_key")
+	if err != nil {
+		return nil, fmt.Errorf("data_master_key secret: %w", err)
+	}
+	keys, err := newDataKeys(master, state)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedStore{MessageStore: store, keys: keys}, nil
+}
+
+// newGCM returns AES-GCM under key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain under gcm. The output is the nonce followed by the
+// ciphertext.
+func seal(gcm cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+// open decrypts what seal returned.
+func open(gcm cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+// key returns the data key named name in bucket, made and stored first if
+// there is none and create is set; otherwise it is errNoDataKey.
+func (k *dataKeys) key(bucket, name string, create bool) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if gcm, ok := k.keys[bucket+"\x00"+name]; ok {
+		return gcm, nil
+	}
+	var wrapped []byte
+	err := k.state.Get(bucket, name, &wrapped)
+	if err == ErrNoState && create {
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		if wrapped, err = seal(k.master, key); err != nil {
+			return nil, err
+		}
+		var created bool
+		if created, err = k.state.Create(bucket, name, wrapped); err == nil && !created {
+			// another server made one first
+			err = k.state.Get(bucket, name, &wrapped)
+		}
+	}
+	if err == ErrNoState {
+		return nil, errNoDataKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := open(k.master, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("data key %s/%s: %w (was it wrapped with another data_master_key?)", bucket, name, err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	k.keys[bucket+"\x00"+name] = gcm
+	return gcm, nil
+}
+
+// seal encrypts plain with the data key named name in bucket.
+func (k *dataKeys) seal(bucket, name string, plain []byte) ([]byte, error) {
+	gcm, err := k.key(bucket, name, true)
+	if err != nil {
+		return nil, err
+	}
+	return seal(gcm, plain)
+}
+
+// open decrypts what seal returned.
+func (k *dataKeys) open(bucket, name string, sealed []byte) ([]byte, error) {
+	gcm, err := k.key(bucket, name, false)
+	if err != nil {
+		return nil, err
+	}
+	return open(gcm, sealed)
+}
+
+// forget deletes the data key named name in bucket, once nothing is sealed
+// with it any more. A nil *dataKeys has none to delete.
+func (k *dataKeys) forget(bucket, name string) error {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, bucket+"\x00"+name)
+	return k.state.Delete(bucket, name)
+}
+
+// sealedStore is a MessageStore that seals the content of messages with
+// their room's data key before handing them to the store it wraps, and
+// opens it again as they are read. The fields queries filter on, such as
+// the room, sender and time, are kept as they are.
+type sealedStore struct {
+	MessageStore
+	keys *dataKeys
+}
+
+// sealedContent is the part of a message sealedStore seals.
+type sealedContent struct {
+	Message     string
+	Links       []messageLink `json:",omitempty"`
+	Attachments []attachment  `json:",omitempty"`
+	Quote       *quote        `json:",omitempty"`
+}
+
+// seal returns a copy of msg with its content sealed.
+func (s *sealedStore) seal(msg *message) (*message, error) {
+	plain, err := json.Marshal(sealedContent{Message: msg.Message, Links: msg.Links, Attachments: msg.Attachments, Quote: msg.Quote})
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.keys.seal(roomKeysBucket, msg.Room, plain)
+	if err != nil {
+		return nil, err
+	}
+	c := *msg
+	c.Message, c.Links, c.Attachments, c.Quote, c.from = "", nil, nil, nil, nil
+	c.Sealed = sealed
+	return &c, nil
+}
+
+// open returns a copy of msg with its content opened. Messages stored
+// before encryption was turned on are returned as they are.
+func (s *sealedStore) open(msg *message) (*message, error) {
+	if msg.Sealed == nil {
+		return msg, nil
+	}
+	plain, err := s.keys.open(roomKeysBucket, msg.Room, msg.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	var content sealedContent
+	if err := json.Unmarshal(plain, &content); err != nil {
+		return nil, err
+	}
+	c := *msg
+	c.Message, c.Links, c.Attachments, c.Quote = content.Message, content.Links, content.Attachments, content.Quote
+	c.Sealed = nil
+	return &c, nil
+}
+
+func (s *sealedStore) Save(msg *message) error {
+	sealed, err := s.seal(msg)
+	if err != nil {
+		return err
+	}
+	return s.MessageStore.Save(sealed)
+}
+
+func (s *sealedStore) Get(room, id string) (*message, error) {
+	msg, err := s.MessageStore.Get(room, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(msg)
+}
+
+func (s *sealedStore) Query(q messageQuery) ([]*message, error) {
+	// the store cannot look into sealed content, so the filters on it
+	// are checked here, on all the messages the others select
+	inner := q
+	filtered := len(q.Text) > 0 || q.HasLink
+	if filtered {
+		inner.Text, inner.HasLink, inner.Limit = nil, false, 0
+	}
+	found, err := s.MessageStore.Query(inner)
+	if err != nil {
+		return nil, err
+	}
+	var opened []*message
+	for _, msg := range found {
+		if msg, err = s.open(msg); err != nil {
+			return nil, err
+		}
+		if !filtered || q.matches(msg) {
+			opened = append(opened, msg)
+		}
+	}
+	if q.Limit > 0 && len(opened) > q.Limit {
+		opened = opened[len(opened)-q.Limit:]
+	}
+	return opened, nil
+}
+
+func (s *sealedStore) SaveQueued(msg *message, node string) error {
+	sealed, err := s.seal(msg)
+	if err != nil {
+		return err
+	}
+	return s.MessageStore.(Outbox).SaveQueued(sealed, node)
+}
+
+func (s *sealedStore) Queued(node string, orphaned time.Time, limit int) ([]queuedMessage, error) {
+	queued, err := s.MessageStore.(Outbox).Queued(node, orphaned, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range queued {
+		if queued[i].Message, err = s.open(queued[i].Message); err != nil {
+			return nil, err
+		}
+	}
+	return queued, nil
+}
+
+func (s *sealedStore) Unqueue(room, id string) error {
+	return s.MessageStore.(Outbox).Unqueue(room, id)
+}
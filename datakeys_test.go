@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSealedStore(t *testing.T) {
+	state := newFileState("")
+	keys, err := newDataKeys("a long random master key", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := newMemoryStore()
+	s := &sealedStore{MessageStore: inner, keys: keys}
+	now := time.Now()
+	s.Save(&message{ID: "a", Room: "golang", UserID: "ann", Message: "the launch code is 1234", When: now})
+	s.Save(&message{ID: "b", Room: "rust", UserID: "ann", Message: "see https://example.com", When: now.Add(time.Second)})
+
+	stored, _ := inner.Get("golang", "a")
+	if data, _ := json.Marshal(stored); bytes.Contains(data, []byte("launch")) || stored.Sealed == nil {
+		t.Errorf("the store should only get the sealed content, got %s", data)
+	}
+	if msg, err := s.Get("golang", "a"); err != nil || msg.Message != "the launch code is 1234" || msg.Sealed != nil {
+		t.Errorf("messages should be opened as they are read, got %+v %v", msg, err)
+	}
+	if msgs, err := s.Query(messageQuery{Text: []string{"LAUNCH"}}); err != nil || len(msgs) != 1 || msgs[0].ID != "a" {
+		t.Errorf("searches should look into the sealed content, got %v %v", ids(msgs), err)
+	}
+	if msgs, _ := s.Query(messageQuery{HasLink: true, Limit: 1}); len(msgs) != 1 || msgs[0].ID != "b" {
+		t.Errorf("expected the message with a link, got %v", ids(msgs))
+	}
+	var golang, rust []byte
+	state.Get(roomKeysBucket, "golang", &golang)
+	state.Get(roomKeysBucket, "rust", &rust)
+	if len(golang) == 0 || bytes.Equal(golang, rust) {
+		t.Error("each room should have a data key of its own")
+	}
+
+	other, _ := newDataKeys("another master key, not the one", state)
+	if _, err := (&sealedStore{MessageStore: inner, keys: other}).Get("golang", "a"); err == nil {
+		t.Error("the data keys should not open without their master key")
+	}
+	inner.Save(&message{ID: "old", Room: "golang", Message: "from before", When: now})
+	if msg, err := s.Get("golang", "old"); err != nil || msg.Message != "from before" {
+		t.Errorf("messages saved before encryption should still be read, got %+v %v", msg, err)
+	}
+	if _, err := newDataKeys("short", state); err == nil {
+		t.Error("a short master key should be refused")
+	}
+}
+
+func TestSealedAttachments(t *testing.T) {
+	state := newFileState("")
+	keys, _ := newDataKeys("a long random master key", state)
+	s := &attachmentStore{dir: t.TempDir(), state: state, maxSize: 1024, keys: keys}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, uploadRequest(t, "ann", "notes.txt", []byte("secret plans")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+	var a attachment
+	json.NewDecoder(w.Body).Decode(&a)
+	stored, _ := lookupAttachment(state, a.ID)
+	if data, err := ioutil.ReadFile(filepath.Join(s.dir, stored.Hash)); err != nil || bytes.Contains(data, []byte("secret")) {
+		t.Errorf("the file should be kept sealed, got %q %v", data, err)
+	}
+	w = httptest.NewRecorder()
+	s.serveFile(w, httptest.NewRequest(http.MethodGet, a.URL, nil))
+	if body, _ := ioutil.ReadAll(w.Body); string(body) != "secret plans" {
+		t.Errorf("the file should be opened as it is downloaded, got %q", body)
+	}
+	if err := s.discard(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	var wrapped []byte
+	if err := state.Get(fileKeysBucket, stored.Hash, &wrapped); err != ErrNoState {
+		t.Errorf("the data key of a deleted file should be deleted, got %v", err)
+	}
+
+	// files kept before sealing are served as they are
+	plain := &attachmentStore{dir: s.dir, state: state, maxSize: 1024}
+	w = httptest.NewRecorder()
+	plain.ServeHTTP(w, uploadRequest(t, "ann", "old.txt", []byte("old notes")))
+	json.NewDecoder(w.Body).Decode(&a)
+	w = httptest.NewRecorder()
+	s.serveFile(w, httptest.NewRequest(http.MethodGet, a.URL, nil))
+	if body, _ := ioutil.ReadAll(w.Body); !strings.Contains(string(body), "old notes") {
+		t.Errorf("expected the old file, got %q", body)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// deactivationsBucket holds a deactivation per deactivated user, by userid.
+const deactivationsBucket = "deactivations"
+
+// deactivatedName is who the messages of a deactivated user are shown as.
+const deactivatedName = "Deactivated user"
+
+// errDeactivated is returned by authenticate for a user whose account is
+// deactivated, whatever their cookie or token.
+var errDeactivated = errors.New("chat: account deactivated")
+
+// deactivation records that a user's account is deactivated: they cannot
+// sign in or use their sessions and tokens, and are not listed anywhere,
+// but their messages are kept, shown as from deactivatedName. Unlike
+// deletion it can be undone. By is "self" if the user deactivated their
+// own account, which signing in again undoes; otherwise it is the admin
+// who did, and only an admin can undo it.
+type deactivation struct {
+	UserID      string
+	Name        string `json:",omitempty"`
+	By          string
+	Deactivated time.Time
+}
+
+// deactivatedBySelf is the By of a user's own deactivation.
+const deactivatedBySelf = "self"
+
+// accountStore keeps the deactivations in a StateStore. rooms, if set, is
+// where a deactivated user's connections are closed.
+type accountStore struct {
+	state StateStore
+	rooms *roomManager
+	audit *auditLog
+}
+
+// accounts are the accounts of this server's users. main replaces it with
+// one kept with the server's state.
+var accounts = &accountStore{state: newFileState("")}
+
+// deactivation returns the deactivation of the user with userID, or nil if
+// they are active.
+func (a *accountStore) deactivation(userID string) (*deactivation, error) {
+	if userID == "" {
+		return nil, nil
+	}
+	var d deactivation
+	switch err := a.state.Get(deactivationsBucket, userID, &d); err {
+	case nil:
+		return &d, nil
+	case ErrNoState:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// deactivate deactivates the user, by "self" or an admin's email, and
+// disconnects them.
+func (a *accountStore) deactivate(userID, name, by string) (*deactivation, error) {
+	d := &deactivation{UserID: userID, Name: name, By: by, Deactivated: time.Now()}
+	if err := a.state.Put(deactivationsBucket, userID, d); err != nil {
+		return nil, err
+	}
+	if a.rooms != nil {
+		a.rooms.disconnectUser(userID, "This account has been deactivated.")
+	}
+	return d, nil
+}
+
+// reactivate undoes the deactivation of the user.
+func (a *accountStore) reactivate(userID string) error {
+	return a.state.Delete(deactivationsBucket, userID)
+}
+
+// deactivated returns the userids of the deactivated users.
+func (a *accountStore) deactivated() (map[string]bool, error) {
+	docs, err := a.state.List(deactivationsBucket)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]bool, len(docs))
+	for userID := range docs {
+		users[userID] = true
+	}
+	return users, nil
+}
+
+// mask returns msgs with those of deactivated users shown as from
+// deactivatedName, without an avatar. The stored messages are shared, so
+// those are copied.
+func (a *accountStore) mask(msgs []*message) []*message {
+	users, err := a.deactivated()
+	if err != nil || len(users) == 0 {
+		return msgs
+	}
+	masked := make([]*message, len(msgs))
+	for i, msg := range msgs {
+		if users[msg.UserID] {
+			m := *msg
+			m.Name, m.AvatarURL = deactivatedName, ""
+			msg = &m
+		}
+		masked[i] = msg
+	}
+	return masked
+}
+
+// disconnectUser closes every connection of the user with userID to the
+// rooms of this server, telling them why.
+func (m *roomManager) disconnectUser(userID, reason string) {
+	for _, r := range m.list() {
+		r.direct <- &directMessage{userID: userID, msg: &message{ID: newID(), Type: msgTypeDisconnect, Room: r.name, Name: "system", Message: reason, When: time.Now()}}
+	}
+}
+
+// serveDeactivate lets a signed in user deactivate their own account,
+// POST /api/account/deactivate. They are signed out; signing in again
+// reactivates it.
+func (a *accountStore) serveDeactivate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := currentUser(r)
+	userID := user.Get("userid").Str()
+	if userID == "" {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	if _, err := a.deactivate(userID, user.Get("name").Str(), deactivatedBySelf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	endSession(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeHTTP is the admin API for deactivations:
+//
+//	GET    /admin/deactivations           deactivated users
+//	PUT    /admin/deactivations/{userid}  deactivate a user, {"Name": "..."} optional
+//	DELETE /admin/deactivations/{userid}  reactivate a user
+//
+// Changes are recorded in the audit log.
+func (a *accountStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/deactivations"), "/")
+	admin := currentUser(r).Get("email").Str()
+	switch {
+	case r.Method == http.MethodGet && userID == "":
+		docs, err := a.state.List(deactivationsBucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list := []*deactivation{}
+		for _, doc := range docs {
+			var d deactivation
+			if json.Unmarshal(doc, &d) == nil {
+				list = append(list, &d)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPut && userID != "":
+		var req struct{ Name string }
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "body must be {\"Name\": \"...\"} or empty", http.StatusBadRequest)
+				return
+			}
+		}
+		d, err := a.deactivate(userID, req.Name, admin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.record(r, "deactivate", userID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
+	case r.Method == http.MethodDelete && userID != "":
+		if err := a.reactivate(userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.record(r, "reactivate", userID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (a *accountStore) record(r *http.Request, action, userID string) {
+	if a.audit == nil {
+		return
+	}
+	if err := a.audit.record(r, action, userID); err != nil && a.rooms != nil {
+		a.rooms.tracer.Error("Failed to record ", action, " in the audit log: ", err)
+	}
+}
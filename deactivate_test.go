@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func withAccounts(t *testing.T) *accountStore {
+	saved := accounts
+	accounts = &accountStore{state: newFileState("")}
+	t.Cleanup(func() { accounts = saved })
+	return accounts
+}
+
+func TestDeactivateOwnAccount(t *testing.T) {
+	a := withAccounts(t)
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	r := withAuthCookie(http.MethodPost, "/api/account/deactivate", nil, ann)
+	w := httptest.NewRecorder()
+	a.serveDeactivate(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := authenticate(withAuthCookie(http.MethodGet, "/chat", nil, ann)); err != errDeactivated {
+		t.Errorf("a deactivated user's sessions should not authenticate, got %v", err)
+	}
+	d, err := a.deactivation("ann")
+	if err != nil || d == nil || d.By != deactivatedBySelf {
+		t.Fatalf("expected a self deactivation, got %+v, %v", d, err)
+	}
+	if err := a.reactivate("ann"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticate(withAuthCookie(http.MethodGet, "/chat", nil, ann)); err != nil {
+		t.Errorf("a reactivated user should authenticate, got %v", err)
+	}
+}
+
+func TestAdminDeactivations(t *testing.T) {
+	a := withAccounts(t)
+	admin := objx.New(map[string]interface{}{"userid": "root", "email": "root@example.com"})
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, withAuthCookie(method, path, strings.NewReader(body), admin))
+		return w
+	}
+	if w := serve(http.MethodPut, "/admin/deactivations/bob", `{"Name": "Bob"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	w := serve(http.MethodGet, "/admin/deactivations", "")
+	var list []deactivation
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].UserID != "bob" || list[0].By != "root@example.com" {
+		t.Errorf("expected bob deactivated by the admin, got %+v", list)
+	}
+	if w := serve(http.MethodDelete, "/admin/deactivations/bob", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if d, _ := a.deactivation("bob"); d != nil {
+		t.Errorf("bob should be active again, got %+v", d)
+	}
+}
+
+func TestDeactivatedUserIsMasked(t *testing.T) {
+	a := withAccounts(t)
+	if _, err := a.deactivate("bob", "Bob", deactivatedBySelf); err != nil {
+		t.Fatal(err)
+	}
+	stored := []*message{
+		{ID: "1", UserID: "ann", Name: "Ann", Message: "hi"},
+		{ID: "2", UserID: "bob", Name: "Bob", AvatarURL: "/avatars/bob.png", Message: "hello"},
+	}
+	masked := a.mask(stored)
+	if masked[0].Name != "Ann" || masked[1].Name != deactivatedName || masked[1].AvatarURL != "" || masked[1].Message != "hello" {
+		t.Errorf("expected bob's message kept but masked, got %+v", masked[1])
+	}
+	if stored[1].Name != "Bob" {
+		t.Error("the stored message should not change")
+	}
+
+	state := newFileState("")
+	now := time.Now()
+	for _, m := range []roomMember{{UserID: "ann", Name: "Ann", Since: now}, {UserID: "bob", Name: "Bob", Since: now}} {
+		if err := state.Put(presenceBucket, "lobby/"+m.UserID+"@"+nodeID, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := members(state, "lobby", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].UserID != "ann" {
+		t.Errorf("deactivated users should not be listed, got %+v", list)
+	}
+}
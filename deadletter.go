@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/law-lee/chat_server/trace"
+)
+
+// delivery is a single outbound event such as a webhook call, a push
+// notification or an email. Payload is handed to the Deliverer registered for
+// Kind untouched.
+type delivery struct {
+	ID          string
+	Kind        string
+	Target      string
+	Payload     []byte
+	Attempts    int
+	LastError   string
+	Created     time.Time
+	NextAttempt time.Time
+}
+
+// Deliverer is implemented by anything that can push a delivery to the
+// outside world. An error means the delivery should be tried again later.
+type Deliverer interface {
+	Deliver(d *delivery) error
+}
+
+// DelivererFunc adapts an ordinary function to the Deliverer interface.
+type DelivererFunc func(d *delivery) error
+
+func (f DelivererFunc) Deliver(d *delivery) error {
+	return f(d)
+}
+
+// deadLetterQueue sits in front of every Deliverer. Sends that fail are not
+// dropped; they are written to the dead-letter store (a JSON file, so they
+// survive restarts) and redelivered with exponential backoff until they succeed
+// or run out of attempts. Letters that ran out of attempts stay in the store
+// until an admin retries or purges them through the admin API.
+type deadLetterQueue struct {
+	mu         sync.Mutex
+	path       string
+	letters    map[string]*delivery
+	deliverers map[string]Deliverer
+	// baseDelay is the wait before the first redelivery; it doubles on every
+	// further attempt up to maxDelay.
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	maxAttempts int
+	tracer      trace.Tracer
+}
+
+// newDeadLetterQueue makes a queue persisted at path, loading any letters
+// left over from a previous run. An empty path keeps letters in memory only.
+func newDeadLetterQueue(path string) (*deadLetterQueue, error) {
+	q := &deadLetterQueue{
+		path:        path,
+		letters:     make(map[string]*delivery),
+		deliverers:  make(map[string]Deliverer),
+		baseDelay:   30 * time.Second,
+		maxDelay:    time.Hour,
+		maxAttempts: 10,
+		tracer:      trace.Off(),
+	}
+	if path == "" {
+		return q, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var letters []*delivery
+	if err := json.Unmarshal(data, &letters); err != nil {
+		return nil, fmt.Errorf("dead letters %s: %w", path, err)
+	}
+	for _, d := range letters {
+		q.letters[d.ID] = d
+	}
+	return q, nil
+}
+
+// register sets the Deliverer used for deliveries of the given kind.
+func (q *deadLetterQueue) register(kind string, d Deliverer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deliverers[kind] = d
+}
+
+// send attempts d straight away and stores it as a dead letter if that fails.
+func (q *deadLetterQueue) send(d *delivery) error {
+	if d.ID == "" {
+		d.ID = newID()
+	}
+	if d.Created.IsZero() {
+		d.Created = time.Now()
+	}
+	err := q.attempt(d)
+	if err != nil {
+		q.tracer.Warn("Delivery ", d.ID, " to ", d.Target, " failed: ", err)
+	}
+	return err
+}
+
+// attempt delivers d once, updating the store with the outcome.
+func (q *deadLetterQueue) attempt(d *delivery) error {
+	q.mu.Lock()
+	deliverer, ok := q.deliverers[d.Kind]
+	q.mu.Unlock()
+	var err error
+	if !ok {
+		err = fmt.Errorf("no deliverer for %q", d.Kind)
+	} else {
+		err = deliverer.Deliver(d)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err == nil {
+		if _, stored := q.letters[d.ID]; stored {
+			delete(q.letters, d.ID)
+			q.save()
+		}
+		return nil
+	}
+	d.Attempts++
+	d.LastError = err.Error()
+	d.NextAttempt = time.Now().Add(q.backoff(d.Attempts))
+	q.letters[d.ID] = d
+	q.save()
+	return err
+}
+
+// backoff returns how long to wait after the given number of failed attempts.
+func (q *deadLetterQueue) backoff(attempts int) time.Duration {
+	delay := q.baseDelay
+	for i := 1; i < attempts && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.maxDelay {
+		delay = q.maxDelay
+	}
+	return delay
+}
+
+// due returns the letters whose next attempt is at or before now and which
+// still have attempts left.
+func (q *deadLetterQueue) due(now time.Time) []*delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var due []*delivery
+	for _, d := range q.letters {
+		if d.Attempts < q.maxAttempts && !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	return due
+}
+
+// run redelivers due letters every interval until stop is closed.
+func (q *deadLetterQueue) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, d := range q.due(now) {
+				if err := q.attempt(d); err != nil {
+					q.tracer.Warn("Redelivery ", d.ID, " failed (attempt ", d.Attempts, "): ", err)
+				} else {
+					q.tracer.Trace("Redelivered ", d.ID)
+				}
+			}
+		}
+	}
+}
+
+// list returns a copy of every stored letter, oldest first.
+func (q *deadLetterQueue) list() []delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	letters := make([]delivery, 0, len(q.letters))
+	for _, d := range q.letters {
+		letters = append(letters, *d)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Created.Before(letters[j].Created) })
+	return letters
+}
+
+// retry attempts the letter with the given ID immediately, regardless of its
+// backoff or how many attempts it has used up.
+func (q *deadLetterQueue) retry(id string) error {
+	q.mu.Lock()
+	d, ok := q.letters[id]
+	q.mu.Unlock()
+	if !ok {
+		return errNoDeadLetter
+	}
+	return q.attempt(d)
+}
+
+// purge removes the letter with the given ID, or every letter if id is empty.
+func (q *deadLetterQueue) purge(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if id == "" {
+		q.letters = make(map[string]*delivery)
+	} else if _, ok := q.letters[id]; ok {
+		delete(q.letters, id)
+	} else {
+		return errNoDeadLetter
+	}
+	q.save()
+	return nil
+}
+
+// save writes the letters to disk. The caller must hold q.mu.
+func (q *deadLetterQueue) save() {
+	if q.path == "" {
+		return
+	}
+	letters := make([]*delivery, 0, len(q.letters))
+	for _, d := range q.letters {
+		letters = append(letters, d)
+	}
+	data, err := json.Marshal(letters)
+	if err == nil {
+		err = ioutil.WriteFile(q.path, data, 0600)
+	}
+	if err != nil {
+		q.tracer.Error("Failed to save dead letters: ", err)
+	}
+}
+
+var errNoDeadLetter = fmt.Errorf("chat: no such dead letter")
+
+// ServeHTTP is the admin API for the dead-letter store:
+//
+//	GET    /admin/deadletters            list letters
+//	POST   /admin/deadletters/{id}/retry redeliver a letter now
+//	DELETE /admin/deadletters/{id}       purge a letter
+//	DELETE /admin/deadletters            purge every letter
+func (q *deadLetterQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segs := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/deadletters"), "/"), "/")
+	id := segs[0]
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(q.list())
+	case r.Method == http.MethodPost && len(segs) == 2 && segs[1] == "retry":
+		if err := q.retry(id); err == errNoDeadLetter {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case r.Method == http.MethodDelete && len(segs) == 1:
+		if err := q.purge(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// webhookDeliverer POSTs the payload as JSON to the delivery target. Any
+// non-2xx response counts as a failure.
+var webhookDeliverer = DelivererFunc(func(d *delivery) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(d.Target, "application/json", bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s: %s", d.Target, resp.Status)
+	}
+	return nil
+})
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterQueueBackoff(t *testing.T) {
+	q, _ := newDeadLetterQueue("")
+	q.baseDelay = time.Second
+	q.maxDelay = 5 * time.Second
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, want := range expected {
+		if got := q.backoff(i + 1); got != want {
+			t.Errorf("backoff(%d) should be %s, not %s", i+1, want, got)
+		}
+	}
+}
+
+func TestDeadLetterQueueRedelivery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters.json")
+	q, err := newDeadLetterQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail := true
+	delivered := 0
+	q.register("webhook", DelivererFunc(func(d *delivery) error {
+		if fail {
+			return errors.New("target down")
+		}
+		delivered++
+		return nil
+	}))
+	if err := q.send(&delivery{Kind: "webhook", Target: "http://example.com/hook"}); err == nil {
+		t.Fatal("send should return the delivery error")
+	}
+	if len(q.list()) != 1 {
+		t.Fatal("failed delivery should be stored as a dead letter")
+	}
+	if len(q.due(time.Now())) != 0 {
+		t.Error("dead letter should not be due before its backoff has passed")
+	}
+	// dead letters survive a restart
+	q, err = newDeadLetterQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters := q.list()
+	if len(letters) != 1 || letters[0].Attempts != 1 || letters[0].LastError != "target down" {
+		t.Fatalf("dead letter was not reloaded correctly: %+v", letters)
+	}
+	fail = false
+	q.register("webhook", DelivererFunc(func(d *delivery) error {
+		delivered++
+		return nil
+	}))
+	if err := q.retry(letters[0].ID); err != nil {
+		t.Errorf("retry should succeed: %s", err)
+	}
+	if delivered != 1 || len(q.list()) != 0 {
+		t.Error("successful retry should remove the dead letter")
+	}
+	if err := q.retry(letters[0].ID); err != errNoDeadLetter {
+		t.Error("retrying a missing letter should return errNoDeadLetter")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxEmbedViewers is how many embedded views of one room a server
+	// streams at once; anyone may open one, without signing in.
+	maxEmbedViewers = 500
+	// embedPing is how often an idle stream is sent a comment, keeping
+	// proxies from closing it, and the room's settings checked again.
+	embedPing = 30 * time.Second
+)
+
+// embedMessage is what an embedded view shows of a message: no userids,
+// and no attachments, which need signing in to download.
+type embedMessage struct {
+	ID        string
+	Seq       uint64 `json:",omitempty"`
+	Name      string
+	AvatarURL string
+	Message   string
+	When      time.Time
+	Guest     bool `json:",omitempty"`
+	Bot       bool `json:",omitempty"`
+}
+
+// embedHandler serves the read-only view of the rooms that allow it, for
+// other sites to put in an iframe:
+//
+//	GET /embed/{name}         the page
+//	GET /embed/{name}/events  the room's messages as server-sent events
+//
+// Neither needs signing in. The stream starts with the history anyone who
+// never joined may see, then sends "message" events as messages are
+// broadcast and "delete" events, {"ID": "..."}, as they are deleted. It
+// ends when the room stops allowing it; browsers reconnect on their own,
+// passing the Seq of the last message they got as Last-Event-ID.
+type embedHandler struct {
+	rooms *roomManager
+
+	mu      sync.Mutex
+	viewers map[string]int
+
+	once  sync.Once
+	templ *template.Template
+}
+
+func newEmbedHandler(rooms *roomManager) *embedHandler {
+	return &embedHandler{rooms: rooms, viewers: make(map[string]int)}
+}
+
+// embeddable reports whether the room called name may be watched without
+// signing in: its owner allowed it, and it is neither private nor archived.
+func embeddable(state StateStore, name string) (bool, error) {
+	if !validRoomName(name) {
+		return false, nil
+	}
+	settings, err := loadRoomSettings(state, name)
+	if err != nil {
+		return false, err
+	}
+	return settings.Embed && !settings.Private && !settings.Archived, nil
+}
+
+func (h *embedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, part, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/embed"), "/"), "/")
+	if ok, err := embeddable(h.rooms.state, name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch part {
+	case "":
+		h.once.Do(func() {
+			h.templ = template.Must(template.ParseFiles(filepath.Join(templatesDir, "embed.html")))
+		})
+		w.Header().Set("Cache-Control", "no-cache")
+		h.templ.Execute(w, map[string]string{"Room": name})
+	case "events":
+		h.stream(w, r, name)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// stream sends the room's messages to an embedded view until it goes away
+// or the room stops allowing it. The view joins the room as a client
+// without a userid, so it counts among the room's connections but is
+// never shown among its members.
+func (h *embedHandler) stream(w http.ResponseWriter, r *http.Request, name string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	h.mu.Lock()
+	if h.viewers[name] >= maxEmbedViewers {
+		h.mu.Unlock()
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many viewers", http.StatusServiceUnavailable)
+		return
+	}
+	h.viewers[name]++
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		if h.viewers[name]--; h.viewers[name] == 0 {
+			delete(h.viewers, name)
+		}
+		h.mu.Unlock()
+	}()
+
+	room := h.rooms.get(name)
+	c := &client{id: newID(), send: make(chan *message, messageBufferSize), room: room, userData: map[string]interface{}{}, ip: clientIP(r)}
+	if seq, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		c.lastSeq = seq
+	}
+	room.join <- c
+	defer func() { room.leave <- c }()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+	ping := time.NewTicker(embedPing)
+	defer ping.Stop()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return
+			}
+			switch msg.Type {
+			case msgTypeMessage:
+				data, _ := json.Marshal(&embedMessage{ID: msg.ID, Seq: msg.Seq, Name: msg.Name, AvatarURL: msg.AvatarURL,
+					Message: msg.Message, When: msg.When, Guest: msg.Guest, Bot: msg.Bot})
+				if msg.Seq > 0 {
+					fmt.Fprintf(w, "id: %d\n", msg.Seq)
+				}
+				fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			case msgTypeDelete:
+				data, _ := json.Marshal(map[string]string{"ID": msg.Target})
+				fmt.Fprintf(w, "event: delete\ndata: %s\n\n", data)
+			case msgTypeReconnect, msgTypeShutdown, msgTypeDisconnect:
+				// the browser reconnects, to another server if need be
+				return
+			default:
+				continue
+			}
+			flusher.Flush()
+		case <-ping.C:
+			if ok, err := embeddable(h.rooms.state, name); err == nil && !ok {
+				return
+			}
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveEmbed is the embed part of the rooms API:
+//
+//	GET /api/rooms/{name}/embed  whether anyone may watch the room at /embed/{name}
+//	PUT /api/rooms/{name}/embed  change it: {"Allowed": true}
+//
+// Only the room's owner and the admins may change it, and private rooms
+// can't be embedded.
+func (a *roomSettingsAPI) serveEmbed(w http.ResponseWriter, r *http.Request, settings roomSettings, user map[string]interface{}) {
+	userID, _ := user["userid"].(string)
+	email, _ := user["email"].(string)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !isAdmin(email) && (userID == "" || userID != settings.Owner) {
+			http.Error(w, "only the room's owner may change whether it can be embedded", http.StatusForbidden)
+			return
+		}
+		var req struct{ Allowed *bool }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Allowed == nil {
+			http.Error(w, "body must be {\"Allowed\": true}", http.StatusBadRequest)
+			return
+		}
+		if *req.Allowed && settings.Private {
+			http.Error(w, "private rooms can't be embedded", http.StatusConflict)
+			return
+		}
+		settings.Embed = *req.Allowed
+		if settings.Created.IsZero() {
+			settings.Created = time.Now()
+		}
+		if err := a.state.Put(roomSettingsBucket, settings.Room, settings); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"Allowed": settings.Embed && !settings.Private, "URL": "/embed/" + settings.Room})
+}
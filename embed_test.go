@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestEmbedSetting(t *testing.T) {
+	rooms := newRoomManager()
+	rooms.state.Put(roomSettingsBucket, "golang", roomSettings{Room: "golang", Owner: "ann"})
+	rooms.state.Put(roomSettingsBucket, "secret", roomSettings{Room: "secret", Owner: "ann", Private: true})
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	embed := newEmbedHandler(rooms)
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})
+	serve := func(path, body string, user objx.Map) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(http.MethodPut, path, strings.NewReader(body), user))
+		return w
+	}
+	page := func(path string) int {
+		w := httptest.NewRecorder()
+		embed.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	if code := page("/embed/golang"); code != http.StatusNotFound {
+		t.Errorf("rooms are not embeddable until allowed, got %d", code)
+	}
+	if w := serve("/api/rooms/golang/embed", `{"Allowed": true}`, bob); w.Code != http.StatusForbidden {
+		t.Errorf("only the owner may allow embedding, got %d", w.Code)
+	}
+	if w := serve("/api/rooms/secret/embed", `{"Allowed": true}`, ann); w.Code != http.StatusConflict {
+		t.Errorf("private rooms can't be embedded, got %d", w.Code)
+	}
+	w := serve("/api/rooms/golang/embed", `{"Allowed": true}`, ann)
+	var resp struct {
+		Allowed bool
+		URL     string
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || !resp.Allowed || resp.URL != "/embed/golang" {
+		t.Fatalf("unexpected answer %d %+v %v", w.Code, resp, err)
+	}
+	if code := page("/embed/golang"); code != http.StatusOK {
+		t.Errorf("expected the page, got %d", code)
+	}
+	if code := page("/embed/secret"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a private room, got %d", code)
+	}
+}
+
+func TestEmbedStream(t *testing.T) {
+	rooms := newRoomManager()
+	rooms.state.Put(roomSettingsBucket, "golang", roomSettings{Room: "golang", Owner: "ann", Embed: true})
+	r := rooms.get("golang")
+	server := httptest.NewServer(newEmbedHandler(rooms))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/embed/golang/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	waitMembers(t, r, 1)
+	events := bufio.NewReader(resp.Body)
+	next := func() (string, string) {
+		t.Helper()
+		var event, data string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			case line == "" && event != "":
+				return event, data
+			}
+		}
+	}
+
+	r.forward <- &message{ID: "m1", Type: msgTypeMessage, UserID: "ann", Name: "Ann", Message: "hello", When: time.Now()}
+	event, data := next()
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &msg); err != nil || event != "message" || msg["Message"] != "hello" || msg["Name"] != "Ann" {
+		t.Fatalf("unexpected event %s %s", event, data)
+	}
+	if _, ok := msg["UserID"]; ok {
+		t.Errorf("embedded views should not see userids: %s", data)
+	}
+	r.forward <- &message{ID: "d1", Type: msgTypeDelete, UserID: "ann", Target: "m1", When: time.Now()}
+	if event, data := next(); event != "delete" || !strings.Contains(data, `"m1"`) {
+		t.Errorf("unexpected event %s %s", event, data)
+	}
+}
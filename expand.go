@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxLinksPerMessage caps how many references one message is expanded for.
+	maxLinksPerMessage = 5
+	// linkCacheTTL is how long a fetched title is reused; failed lookups
+	// are retried after linkFailureTTL.
+	linkCacheTTL   = 10 * time.Minute
+	linkFailureTTL = time.Minute
+	// maxCachedLinks bounds the cache; expired entries are dropped when it is full.
+	maxCachedLinks = 1000
+)
+
+// messageLink is an issue reference found in a message, with the title of
+// the issue it refers to.
+type messageLink struct {
+	Text  string
+	URL   string
+	Title string
+}
+
+// expanderRule finds issue references in messages. Kind says how they are
+// looked up:
+//
+//	jira    Pattern matches an issue key such as PROJ-123; BaseURL is the
+//	        Jira site and Secret holds "user:api-token"
+//	github  Pattern's first two groups are "owner/repo" and the number;
+//	        BaseURL defaults to https://api.github.com and Secret, if set,
+//	        holds a token
+type expanderRule struct {
+	Name    string
+	Kind    string
+	Pattern string
+	BaseURL string
+	Secret  string
+
+	re *regexp.Regexp
+}
+
+// defaultExpanderPatterns are used for rules without a Pattern.
+var defaultExpanderPatterns = map[string]string{
+	"jira":   `\b[A-Z][A-Z0-9]+-[0-9]+\b`,
+	"github": `\b([\w.-]+/[\w.-]+)#([0-9]+)\b`,
+}
+
+type cachedLink struct {
+	link    messageLink
+	ok      bool
+	expires time.Time
+}
+
+// linkExpander attaches issue links to messages according to its rules.
+// Titles are fetched from the issue tracker and cached.
+type linkExpander struct {
+	rules   []*expanderRule
+	secrets SecretSource
+	client  *http.Client
+	now     func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedLink
+}
+
+// loadLinkExpander reads a JSON list of expanderRules from path.
+func loadLinkExpander(path string, secrets SecretSource) (*linkExpander, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*expanderRule
+	if err := decodeStrict(path, data, &rules); err != nil {
+		return nil, err
+	}
+	return newLinkExpander(rules, secrets)
+}
+
+func newLinkExpander(rules []*expanderRule, secrets SecretSource) (*linkExpander, error) {
+	for _, rule := range rules {
+		if _, ok := defaultExpanderPatterns[rule.Kind]; !ok {
+			return nil, fmt.Errorf("expander %s: unknown kind %q", rule.Name, rule.Kind)
+		}
+		if rule.Pattern == "" {
+			rule.Pattern = defaultExpanderPatterns[rule.Kind]
+		}
+		var err error
+		if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("expander %s: %w", rule.Name, err)
+		}
+		if rule.Kind == "github" && rule.re.NumSubexp() < 2 {
+			return nil, fmt.Errorf("expander %s: a github pattern needs two groups", rule.Name)
+		}
+		if rule.Kind == "github" && rule.BaseURL == "" {
+			rule.BaseURL = "https://api.github.com"
+		}
+		rule.BaseURL = strings.TrimSuffix(rule.BaseURL, "/")
+	}
+	return &linkExpander{
+		rules:   rules,
+		secrets: secrets,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		now:     time.Now,
+		cache:   make(map[string]cachedLink),
+	}, nil
+}
+
+// expand returns links for the issue references in text. References whose
+// lookup fails are left out. A nil expander finds nothing.
+func (e *linkExpander) expand(text string) []messageLink {
+	if e == nil {
+		return nil
+	}
+	var links []messageLink
+	seen := make(map[string]bool)
+	for _, rule := range e.rules {
+		for _, match := range rule.re.FindAllStringSubmatch(text, maxLinksPerMessage) {
+			if len(links) == maxLinksPerMessage {
+				return links
+			}
+			if seen[match[0]] {
+				continue
+			}
+			seen[match[0]] = true
+			if link, ok := e.lookup(rule, match); ok {
+				links = append(links, link)
+			}
+		}
+	}
+	return links
+}
+
+// lookup returns the link for a match, from the cache if possible.
+func (e *linkExpander) lookup(rule *expanderRule, match []string) (messageLink, bool) {
+	key := rule.Name + "\x00" + match[0]
+	now := e.now()
+	e.mu.Lock()
+	cached, found := e.cache[key]
+	e.mu.Unlock()
+	if found && now.Before(cached.expires) {
+		return cached.link, cached.ok
+	}
+	link, err := e.fetch(rule, match)
+	cached = cachedLink{link: link, ok: err == nil, expires: now.Add(linkCacheTTL)}
+	if err != nil {
+		cached.expires = now.Add(linkFailureTTL)
+	}
+	e.mu.Lock()
+	if len(e.cache) >= maxCachedLinks {
+		for k, c := range e.cache {
+			if !now.Before(c.expires) {
+				delete(e.cache, k)
+			}
+		}
+		if len(e.cache) >= maxCachedLinks {
+			e.cache = make(map[string]cachedLink)
+		}
+	}
+	e.cache[key] = cached
+	e.mu.Unlock()
+	return cached.link, cached.ok
+}
+
+// fetch asks the issue tracker for the title of the referenced issue.
+func (e *linkExpander) fetch(rule *expanderRule, match []string) (messageLink, error) {
+	link := messageLink{Text: match[0]}
+	var apiURL string
+	switch rule.Kind {
+	case "jira":
+		apiURL = rule.BaseURL + "/rest/api/2/issue/" + url.PathEscape(match[0]) + "?fields=summary"
+		link.URL = rule.BaseURL + "/browse/" + url.PathEscape(match[0])
+	case "github":
+		apiURL = rule.BaseURL + "/repos/" + match[1] + "/issues/" + match[2]
+	}
+	req, err := http.NewRequest(http.MethodGet, apiURL, nil)
+	if err != nil {
+		return link, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if rule.Secret != "" {
+		secret, err := e.secrets.Secret(rule.Secret)
+		if err != nil {
+			return link, err
+		}
+		if rule.Kind == "jira" {
+			user, token, _ := strings.Cut(secret, ":")
+			req.SetBasicAuth(user, token)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return link, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return link, fmt.Errorf("%s answered %s", apiURL, resp.Status)
+	}
+	var issue struct {
+		Title   string
+		HTMLURL string `json:"html_url"`
+		Fields  struct{ Summary string }
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&issue); err != nil {
+		return link, err
+	}
+	if rule.Kind == "jira" {
+		link.Title = issue.Fields.Summary
+	} else {
+		link.Title, link.URL = issue.Title, issue.HTMLURL
+	}
+	return link, nil
+}
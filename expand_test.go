@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLinkExpander(t *testing.T) {
+	calls := 0
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/rest/api/2/issue/CHAT-42":
+			if user, token, _ := r.BasicAuth(); user != "bot@example.com" || token != "t0ken" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"key":"CHAT-42","fields":{"summary":"Rooms leak goroutines"}}`)
+		case "/repos/law-lee/chat_server/issues/7":
+			fmt.Fprint(w, `{"title":"Add rooms","html_url":"https://github.com/law-lee/chat_server/pull/7"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tracker.Close()
+	e, err := newLinkExpander([]*expanderRule{
+		{Name: "jira", Kind: "jira", BaseURL: tracker.URL, Secret: "jira_credentials"},
+		{Name: "github", Kind: "github", BaseURL: tracker.URL},
+	}, mapSecrets{"jira_credentials": "bot@example.com:t0ken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := e.expand("CHAT-42 is fixed by law-lee/chat_server#7, unlike CHAT-404")
+	if len(links) != 2 {
+		t.Fatalf("expected 2 links, got %+v", links)
+	}
+	if l := links[0]; l.Text != "CHAT-42" || l.Title != "Rooms leak goroutines" || l.URL != tracker.URL+"/browse/CHAT-42" {
+		t.Errorf("unexpected jira link %+v", l)
+	}
+	if l := links[1]; l.Title != "Add rooms" || l.URL != "https://github.com/law-lee/chat_server/pull/7" {
+		t.Errorf("unexpected github link %+v", l)
+	}
+	before := calls
+	e.expand("again: CHAT-42 and CHAT-404")
+	if calls != before {
+		t.Errorf("cached references should not be fetched again, made %d calls", calls-before)
+	}
+	var none *linkExpander
+	if links := none.expand("CHAT-42"); links != nil {
+		t.Error("a nil expander should find nothing")
+	}
+}
+
+func TestNewLinkExpanderValidatesRules(t *testing.T) {
+	for _, rule := range []*expanderRule{
+		{Name: "bad kind", Kind: "trello"},
+		{Name: "bad pattern", Kind: "jira", Pattern: "("},
+		{Name: "no groups", Kind: "github", Pattern: `#[0-9]+`},
+	} {
+		if _, err := newLinkExpander([]*expanderRule{rule}, nil); err == nil {
+			t.Errorf("rule %q should be rejected", rule.Name)
+		}
+	}
+}
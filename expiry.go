@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The things that can happen to a temporary room when it expires.
+const (
+	// expireArchive closes the room and keeps anyone from joining it
+	// again; its history stays searchable.
+	expireArchive = "archive"
+	// expireDelete closes the room and deletes its history and settings.
+	expireDelete = "delete"
+)
+
+// expiryWarning is how long before a room expires it is warned.
+const expiryWarning = time.Hour
+
+// roomExpiry makes a room temporary: it expires Idle seconds after its last
+// message, or TTL seconds after it was created, whichever is first, unless
+// its owner kept it until later.
+type roomExpiry struct {
+	// Action is expireArchive (the default) or expireDelete.
+	Action string `json:",omitempty"`
+	Idle   int64  `json:",omitempty"`
+	TTL    int64  `json:",omitempty"`
+	// Until is when the owner last extended the room to; it does not
+	// expire before then.
+	Until time.Time `json:",omitempty"`
+	// Warned is the expiry the room was last warned about.
+	Warned time.Time `json:",omitempty"`
+}
+
+// valid reports whether e makes sense.
+func (e *roomExpiry) valid() bool {
+	return (e.Action == "" || e.Action == expireArchive || e.Action == expireDelete) &&
+		e.Idle >= 0 && e.TTL >= 0 && e.Idle+e.TTL > 0
+}
+
+// expiresAt returns when a room created at created and last active at
+// active expires.
+func (e *roomExpiry) expiresAt(created, active time.Time) time.Time {
+	var at time.Time
+	if e.TTL > 0 {
+		at = created.Add(time.Duration(e.TTL) * time.Second)
+	}
+	if e.Idle > 0 {
+		idle := active.Add(time.Duration(e.Idle) * time.Second)
+		if at.IsZero() || idle.Before(at) {
+			at = idle
+		}
+	}
+	if e.Until.After(at) {
+		at = e.Until
+	}
+	return at
+}
+
+// lastActive returns when the room in settings last had a message, or was
+// created if it never had one.
+func lastActive(store MessageStore, settings roomSettings) time.Time {
+	if store == nil {
+		return settings.Created
+	}
+	last, err := store.Query(messageQuery{Room: settings.Room, Limit: 1})
+	if err == nil && len(last) == 1 && last[0].When.After(settings.Created) {
+		return last[0].When
+	}
+	return settings.Created
+}
+
+// expireRooms warns the temporary rooms that expire within expiryWarning of
+// now, and archives or deletes those that have expired. It is a scheduler
+// job; every server runs it, so each room is claimed before it is acted on.
+func (m *roomManager) expireRooms(now time.Time) {
+	docs, err := m.state.List(roomSettingsBucket)
+	if err != nil {
+		m.tracer.Warn("Failed to load room settings: ", err)
+		return
+	}
+	for _, doc := range docs {
+		var settings roomSettings
+		if json.Unmarshal(doc, &settings) != nil || settings.Expiry == nil || settings.Archived {
+			continue
+		}
+		e := settings.Expiry
+		at := e.expiresAt(settings.Created, lastActive(m.store, settings))
+		warn := now.Before(at) && !now.Before(at.Add(-expiryWarning)) && !e.Warned.Equal(at)
+		if !warn && now.Before(at) {
+			continue
+		}
+		claimed, err := m.state.Create(scheduleRunsBucket, "expiry/"+settings.Room+"@"+strconv.FormatInt(now.Unix(), 10), now)
+		if err != nil || !claimed {
+			continue
+		}
+		if warn {
+			e.Warned = at
+			if err := m.state.Put(roomSettingsBucket, settings.Room, settings); err != nil {
+				m.tracer.Error("Failed to save room settings: ", err)
+				continue
+			}
+			text := "This room will be archived at " + at.Format("15:04 MST") + " unless its owner extends it."
+			if e.Action == expireDelete {
+				text = "This room and its history will be deleted at " + at.Format("15:04 MST") + " unless its owner extends it."
+			}
+			m.get(settings.Room).do(controlNotice, "", &message{Type: msgTypeNotice, Message: text})
+			continue
+		}
+		if err := m.expire(settings); err != nil {
+			m.tracer.Error("Failed to expire room ", settings.Room, ": ", err)
+		}
+	}
+}
+
+// expire archives or deletes the room in settings, which has expired.
+func (m *roomManager) expire(settings roomSettings) error {
+	m.tracer.Trace("Room expired: ", settings.Room)
+	if settings.Expiry.Action != expireDelete {
+		settings.Archived = true
+		if err := m.state.Put(roomSettingsBucket, settings.Room, settings); err != nil {
+			return err
+		}
+		m.closeRoom(settings.Room, "This room has been archived.")
+		return nil
+	}
+	m.closeRoom(settings.Room, "This room has been deleted.")
+	msgs, err := m.store.Query(messageQuery{Room: settings.Room})
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := m.store.Delete(msg.Room, msg.ID); err != nil {
+			return err
+		}
+		if err := m.attachments.release(msg.Attachments); err != nil {
+			return err
+		}
+	}
+	for _, bucket := range []string{roomRolesBucket, roomBansBucket, roomMutesBucket, pinsBucket} {
+		keys, err := m.state.List(bucket)
+		if err != nil {
+			return err
+		}
+		for key := range keys {
+			if strings.HasPrefix(key, settings.Room+"/") {
+				m.state.Delete(bucket, key)
+			}
+		}
+	}
+	m.state.Delete(roomActivityBucket, settings.Room)
+	return m.state.Delete(roomSettingsBucket, settings.Room)
+}
+
+// serveExpiry is the expiry part of the rooms API:
+//
+//	GET  /api/rooms/{name}/expiry  the room's expiry, and when it expires
+//	PUT  /api/rooms/{name}/expiry  make it temporary: {"Action", "Idle", "TTL"}
+//	POST /api/rooms/{name}/expiry  extend it: {"Extend": seconds}
+//
+// Only the room's owner and the admins may change it.
+func (a *roomSettingsAPI) serveExpiry(w http.ResponseWriter, r *http.Request, settings roomSettings, user map[string]interface{}) {
+	userID, _ := user["userid"].(string)
+	email, _ := user["email"].(string)
+	if r.Method != http.MethodGet && !isAdmin(email) && (userID == "" || userID != settings.Owner) {
+		http.Error(w, "only the room's owner may change when it expires", http.StatusForbidden)
+		return
+	}
+	var store MessageStore
+	if a.rooms != nil {
+		store = a.rooms.store
+	}
+	now := time.Now()
+	switch r.Method {
+	case http.MethodGet:
+		if settings.Expiry == nil {
+			http.Error(w, "the room does not expire", http.StatusNotFound)
+			return
+		}
+	case http.MethodPut:
+		var e roomExpiry
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil || !e.valid() {
+			http.Error(w, "body must be {\"Action\": \"archive\" or \"delete\", \"Idle\": seconds, \"TTL\": seconds}", http.StatusBadRequest)
+			return
+		}
+		e.Until, e.Warned = time.Time{}, time.Time{}
+		settings.Expiry = &e
+	case http.MethodPost:
+		var req struct{ Extend int64 }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Extend <= 0 || settings.Expiry == nil {
+			http.Error(w, "body must be {\"Extend\": seconds}, for a room that expires", http.StatusBadRequest)
+			return
+		}
+		at := settings.Expiry.expiresAt(settings.Created, lastActive(store, settings))
+		if at.Before(now) {
+			at = now
+		}
+		settings.Expiry.Until = at.Add(time.Duration(req.Extend) * time.Second)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method != http.MethodGet {
+		if err := a.state.Put(roomSettingsBucket, settings.Room, settings); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*roomExpiry
+		Expires time.Time
+	}{settings.Expiry, settings.Expiry.expiresAt(settings.Created, lastActive(store, settings))})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestRoomExpiresAt(t *testing.T) {
+	created := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	active := created.Add(time.Hour)
+	e := &roomExpiry{Idle: 1800, TTL: 86400}
+	if at := e.expiresAt(created, active); !at.Equal(active.Add(30 * time.Minute)) {
+		t.Errorf("an idle room should expire after Idle, got %v", at)
+	}
+	e.Until = created.Add(48 * time.Hour)
+	if at := e.expiresAt(created, active); !at.Equal(e.Until) {
+		t.Errorf("an extended room should expire at Until, got %v", at)
+	}
+	if (&roomExpiry{Action: "shred", TTL: 60}).valid() || (&roomExpiry{}).valid() {
+		t.Error("an unknown action or no period should be invalid")
+	}
+}
+
+func TestRoomExpiry(t *testing.T) {
+	rooms := newRoomManager()
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})
+	serve := func(user objx.Map, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(method, path, strings.NewReader(body), user))
+		return w
+	}
+	if w := serve(ann, http.MethodPost, "/api/rooms", `{"Name": "inc-1", "Expiry": {"Action": "shred", "TTL": 60}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("an invalid expiry should be refused, got %d", w.Code)
+	}
+	if w := serve(ann, http.MethodPost, "/api/rooms", `{"Name": "inc-1", "Expiry": {"TTL": 7200}}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(bob, http.MethodPost, "/api/rooms/inc-1/expiry", `{"Extend": 3600}`); w.Code != http.StatusForbidden {
+		t.Errorf("only the owner should extend the room, got %d", w.Code)
+	}
+
+	r := rooms.get("inc-1")
+	c := &client{send: make(chan *message, messageBufferSize), room: r, userData: ann}
+	r.join <- c
+	waitMembers(t, r, 1)
+
+	settings, _ := loadRoomSettings(rooms.state, "inc-1")
+	created := settings.Created
+	rooms.expireRooms(created.Add(90 * time.Minute))
+	if msg := receiveChat(t, c); !strings.Contains(msg.Message, "will be archived") {
+		t.Errorf("expected a warning, got %q", msg.Message)
+	}
+	rooms.expireRooms(created.Add(91 * time.Minute))
+	select {
+	case msg := <-c.send:
+		t.Errorf("the room should be warned once, got %q", msg.Message)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w := serve(ann, http.MethodPost, "/api/rooms/inc-1/expiry", `{"Extend": 3600}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var got struct{ Expires time.Time }
+	json.NewDecoder(w.Body).Decode(&got)
+	if !got.Expires.Equal(created.Add(3 * time.Hour)) {
+		t.Errorf("expected the room extended by an hour, expires %v", got.Expires)
+	}
+	rooms.expireRooms(created.Add(150 * time.Minute))
+	if settings, _ := loadRoomSettings(rooms.state, "inc-1"); settings.Archived {
+		t.Fatal("an extended room should not expire")
+	}
+
+	rooms.expireRooms(created.Add(4 * time.Hour))
+	if settings, _ := loadRoomSettings(rooms.state, "inc-1"); !settings.Archived {
+		t.Fatal("the expired room should be archived")
+	}
+	w = httptest.NewRecorder()
+	rooms.get("inc-1").ServeHTTP(w, withAuthCookie(http.MethodGet, "/room?room=inc-1", nil, ann))
+	if w.Code != http.StatusGone {
+		t.Errorf("joining an archived room should be refused, got %d", w.Code)
+	}
+}
+
+func TestRoomExpiryDelete(t *testing.T) {
+	rooms := newRoomManager()
+	settings, err := createRoom(rooms.state, rooms, "inc-2", "ann", false, &roomExpiry{Action: expireDelete, Idle: 600}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rooms.store.Save(&message{ID: "m1", Room: "inc-2", UserID: "ann", Message: "all clear", When: settings.Created.Add(time.Minute)})
+	rooms.state.Put(roomRolesBucket, "inc-2/bob", roomRole{Room: "inc-2", UserID: "bob", Role: roleModerator})
+
+	rooms.expireRooms(settings.Created.Add(10 * time.Minute))
+	if settings, _ := loadRoomSettings(rooms.state, "inc-2"); settings.Owner != "ann" {
+		t.Fatal("the room was active a minute later, so should not expire yet")
+	}
+	rooms.expireRooms(settings.Created.Add(12 * time.Minute))
+	if msgs, _ := rooms.store.Query(messageQuery{Room: "inc-2"}); len(msgs) != 0 {
+		t.Errorf("the room's history should be deleted, got %v", msgs)
+	}
+	if role, _ := userRole(rooms.state, "inc-2", "bob"); role == roleModerator {
+		t.Error("the room's roles should be deleted")
+	}
+	if settings, _ := loadRoomSettings(rooms.state, "inc-2"); settings.Owner != "" {
+		t.Errorf("the room's settings should be deleted, got %+v", settings)
+	}
+}
+
+func TestRoomExpiryReleasesAttachments(t *testing.T) {
+	rooms := newRoomManager()
+	rooms.attachments = &attachmentStore{dir: t.TempDir(), state: rooms.state, maxSize: 1024}
+	settings, err := createRoom(rooms.state, rooms, "inc-3", "ann", false, &roomExpiry{Action: expireDelete, TTL: 600}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := rooms.attachments.save("ann", "graph.png", strings.NewReader("graph"))
+	msg := &message{ID: "m1", Room: "inc-3", UserID: "ann", Attachments: []attachment{*a}, When: settings.Created}
+	rooms.store.Save(msg)
+	rooms.attachments.claim(msg.Attachments)
+
+	if err := rooms.expire(settings); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(rooms.attachments.dir); len(files) != 0 {
+		t.Errorf("the files of a deleted room's messages should be deleted, found %d", len(files))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"time"
+)
+
+// quote is a message as it was when it was forwarded, so that the copy
+// keeps its text and where it came from even if the original is deleted.
+type quote struct {
+	Room      string
+	MessageID string
+	UserID    string `json:",omitempty"`
+	Name      string
+	Message   string
+	When      time.Time
+}
+
+// quoteOf returns a snapshot of m.
+func quoteOf(m *message) *quote {
+	return &quote{Room: m.Room, MessageID: m.ID, UserID: m.UserID, Name: m.Name, Message: m.Message, When: m.When}
+}
+
+// forwardMessage carries out msg, a forward request from c: it finds the
+// message msg.Target in c's room and posts a copy quoting it to the room
+// msg.Room, or sends it to the user msg.To, telling c why not if it cannot.
+func (c *client) forwardMessage(msg *message) {
+	if c.room.rooms == nil {
+		c.room.notice(c, "Messages cannot be forwarded from here.")
+		return
+	}
+	original, err := findMessage(c.room.store, c.room.name, msg.Target)
+	if err != nil {
+		c.room.tracer.Error("Failed to find the message to forward: ", err)
+		c.room.notice(c, "The message could not be forwarded.")
+		return
+	}
+	if original == nil || !visibleTo(c.room.state, original, msg.UserID, make(map[string]time.Time)) {
+		c.room.notice(c, "There is no message "+msg.Target+" in this room to forward.")
+		return
+	}
+	forward := &message{ID: msg.ID, Type: msgTypeForward, UserID: msg.UserID, Name: msg.Name, AvatarURL: msg.AvatarURL,
+		Message: msg.Message, When: msg.When, Links: c.room.expander.expand(msg.Message),
+		Quote: quoteOf(original)}
+	if original.Quote != nil && original.Message == "" {
+		// forwarding a forward passes on what it forwarded
+		forward.Quote = original.Quote
+	}
+	if msg.To != "" {
+		forward.To = msg.To
+		if !c.room.rooms.sendDirect(forward) {
+			c.room.notice(c, "That message ID is already taken; send the message with another.")
+			return
+		}
+		c.room.direct <- &directMessage{to: c, msg: ackFor(forward)}
+		return
+	}
+	if refused := c.canPostTo(msg.Room); refused != "" {
+		c.room.notice(c, refused)
+		return
+	}
+	req := &roomControl{op: controlForward, msg: forward, done: make(chan []clientInfo)}
+	c.room.rooms.get(msg.Room).control <- req
+	<-req.done
+	if req.refused != "" {
+		c.room.notice(c, req.refused)
+		return
+	}
+	c.room.direct <- &directMessage{to: c, msg: ackFor(forward)}
+}
+
+// canPostTo returns why c's user may not post to room, or "" if they may:
+// they must be able to enter it, and not be banned from it.
+func (c *client) canPostTo(room string) string {
+	if !validRoomName(room) || room == c.room.name {
+		return "Messages can only be forwarded to another room."
+	}
+	settings, err := loadRoomSettings(c.room.state, room)
+	if err == nil && settings.Archived {
+		return room + " is archived."
+	}
+	var ok bool
+	if err == nil {
+		ok, err = canEnter(c.room.state, room, c.userData)
+	}
+	if err == nil && ok {
+		var ban *roomBan
+		ban, err = banned(c.room.state, room, c.userID(), time.Now())
+		ok = ban == nil
+	}
+	if err != nil {
+		c.room.tracer.Error("Failed to check where a message is forwarded: ", err)
+		return "The message could not be forwarded."
+	}
+	if !ok {
+		return "You may not post to " + room + "."
+	}
+	return ""
+}
+
+// findMessage returns the message of room, which may hold direct messages,
+// with the given ID, or nil if there is none. Only messages, direct messages
+// and forwards are found.
+func findMessage(store MessageStore, room, id string) (*message, error) {
+	m, err := store.Get(room, id)
+	if err == ErrNoMessage {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Type != msgTypeMessage && m.Type != msgTypeDM && m.Type != msgTypeForward {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// postForward posts msg, forwarded from another room, unless its sender is
+// muted here or has not accepted the rules, returning why not. It runs
+// inside run.
+func (r *room) postForward(msg *message) string {
+	if until := r.mutedUntil(msg.UserID, time.Now()); !until.IsZero() {
+		return "You are muted in " + r.name + " until " + until.Format("15:04 MST") + "."
+	}
+	if !r.acceptedRules(msg.UserID) {
+		return "Please accept the rules of " + r.name + " before posting there."
+	}
+	r.accept(msg)
+	return ""
+}
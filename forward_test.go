@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestForwardMessage(t *testing.T) {
+	rooms := newRoomManager()
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})
+	createRoom(rooms.state, nil, "secret", "bob", true, nil, nil)
+
+	dev, ops := rooms.get("dev"), rooms.get("ops")
+	sender := &client{send: make(chan *message, messageBufferSize), room: dev, userData: ann}
+	reader := &client{send: make(chan *message, messageBufferSize), room: ops, userData: bob}
+	dev.join <- sender
+	ops.join <- reader
+	waitMembers(t, dev, 1)
+	waitMembers(t, ops, 1)
+	dev.forward <- &message{ID: "m1", Type: msgTypeMessage, UserID: "ann", Name: "Ann", Message: "the build is green", When: time.Now(), from: sender}
+	for receiveChat(t, sender).Type != msgTypeAck {
+	}
+
+	forward := func(id, room, to string) {
+		sender.forwardMessage(&message{ID: id, Type: msgTypeForward, UserID: "ann", Name: "Ann", Message: "FYI", When: time.Now(),
+			Target: "m1", Room: room, To: to})
+	}
+	forward("f1", "ops", "")
+	msg := receiveChat(t, reader)
+	for msg.Type == msgTypeAck || msg.ID != "f1" {
+		msg = receiveChat(t, reader)
+	}
+	if msg.Type != msgTypeForward || msg.Message != "FYI" || msg.Quote == nil ||
+		msg.Quote.Room != "dev" || msg.Quote.MessageID != "m1" || msg.Quote.Name != "Ann" || msg.Quote.Message != "the build is green" {
+		t.Errorf("expected the message forwarded with where it came from, got %+v %+v", msg, msg.Quote)
+	}
+	if ack := receiveChat(t, sender); ack.Type != msgTypeAck || ack.ID != "f1" || ack.Room != "ops" {
+		t.Errorf("the forward should be acknowledged, got %+v", ack)
+	}
+	saved, _ := rooms.store.Query(messageQuery{Room: "ops"})
+	if len(saved) != 1 || saved[0].Quote == nil {
+		t.Errorf("the forward should be saved with its quote, got %+v", saved)
+	}
+
+	forward("f2", "secret", "")
+	if msg := receiveChat(t, sender); !strings.Contains(msg.Message, "may not post") {
+		t.Errorf("forwarding to a private room should be refused, got %+v", msg)
+	}
+	sender.forwardMessage(&message{ID: "f3", Type: msgTypeForward, UserID: "ann", Name: "Ann", When: time.Now(), Target: "nope", Room: "ops"})
+	if msg := receiveChat(t, sender); !strings.Contains(msg.Message, "no message nope") {
+		t.Errorf("forwarding an unknown message should be refused, got %+v", msg)
+	}
+
+	forward("f4", "", "bob")
+	msg = receiveChat(t, reader)
+	for msg.ID != "f4" {
+		msg = receiveChat(t, reader)
+	}
+	if msg.Type != msgTypeForward || msg.To != "bob" || msg.Quote == nil || msg.Quote.MessageID != "m1" {
+		t.Errorf("expected a forwarded direct message, got %+v", msg)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// githubReposBucket maps "owner/repo" to the room its events go to.
+	githubReposBucket = "github_repos"
+	// githubAvatarURL is the avatar GitHub event messages are posted with.
+	githubAvatarURL = "https://github.githubassets.com/favicons/favicon.png"
+	// maxWebhookBody caps the size of webhook payloads we accept.
+	maxWebhookBody = 5 << 20
+)
+
+// githubIntegration accepts GitHub webhooks, checks their signature against
+// the github_webhook_secret secret and posts push, pull request and issue
+// events to the room mapped to the repository.
+type githubIntegration struct {
+	secrets SecretSource
+	state   StateStore
+	rooms   *roomManager
+}
+
+// githubEvent holds the parts of the push, pull_request and issues payloads
+// that we format.
+type githubEvent struct {
+	Action     string
+	Ref        string
+	Compare    string
+	Commits    []struct{ Message string }
+	HeadCommit *struct{ Message string } `json:"head_commit"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	}
+	Sender struct {
+		Login string
+	}
+	PullRequest *struct {
+		Number  int
+		Title   string
+		HTMLURL string `json:"html_url"`
+		Merged  bool
+	} `json:"pull_request"`
+	Issue *struct {
+		Number  int
+		Title   string
+		HTMLURL string `json:"html_url"`
+	}
+}
+
+func (g *githubIntegration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secret, err := g.secrets.Secret("github_webhook_secret")
+	if err != nil {
+		http.Error(w, "GitHub integration is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if !validGitHubSignature([]byte(secret), body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	kind := r.Header.Get("X-GitHub-Event")
+	if kind == "ping" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var event githubEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var room string
+	if err := g.state.Get(githubReposBucket, event.Repository.FullName, &room); err != nil {
+		http.Error(w, "repository is not mapped to a room", http.StatusNotFound)
+		return
+	}
+	text := formatGitHubEvent(kind, &event)
+	if text == "" {
+		// an event or action we don't announce
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	g.rooms.get(room).forward <- &message{
+		ID:        newID(),
+		Name:      "GitHub",
+		Message:   text,
+		When:      time.Now(),
+		AvatarURL: githubAvatarURL,
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validGitHubSignature checks the X-Hub-Signature-256 header, which is
+// "sha256=" followed by the hex HMAC-SHA256 of the body.
+func validGitHubSignature(secret, body []byte, header string) bool {
+	sig, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil || !strings.HasPrefix(header, "sha256=") {
+		return false
+	}
+	return hmac.Equal(sig, mac(secret, body))
+}
+
+// formatGitHubEvent turns an event into a one line message, or "" if the
+// event is not worth announcing.
+func formatGitHubEvent(kind string, e *githubEvent) string {
+	repo := e.Repository.FullName
+	switch {
+	case kind == "push" && len(e.Commits) > 0:
+		branch := strings.TrimPrefix(e.Ref, "refs/heads/")
+		commits := "1 commit"
+		if len(e.Commits) > 1 {
+			commits = fmt.Sprintf("%d commits", len(e.Commits))
+		}
+		summary := ""
+		if e.HeadCommit != nil {
+			summary = ": " + strings.SplitN(e.HeadCommit.Message, "\n", 2)[0]
+		}
+		return fmt.Sprintf("%s pushed %s to %s@%s%s %s", e.Sender.Login, commits, repo, branch, summary, e.Compare)
+	case kind == "pull_request" && e.PullRequest != nil:
+		action := e.Action
+		switch action {
+		case "opened", "reopened", "ready_for_review":
+		case "closed":
+			if e.PullRequest.Merged {
+				action = "merged"
+			}
+		default:
+			return ""
+		}
+		return fmt.Sprintf("%s %s pull request #%d in %s: %s %s", e.Sender.Login, strings.ReplaceAll(action, "_", " "),
+			e.PullRequest.Number, repo, e.PullRequest.Title, e.PullRequest.HTMLURL)
+	case kind == "issues" && e.Issue != nil:
+		switch e.Action {
+		case "opened", "closed", "reopened":
+		default:
+			return ""
+		}
+		return fmt.Sprintf("%s %s issue #%d in %s: %s %s", e.Sender.Login, e.Action,
+			e.Issue.Number, repo, e.Issue.Title, e.Issue.HTMLURL)
+	}
+	return ""
+}
+
+// repos is the admin API mapping repositories to rooms:
+//
+//	GET    /admin/integrations/github               list mappings
+//	PUT    /admin/integrations/github/{owner}/{repo} map a repo: {"Room": "dev"}
+//	DELETE /admin/integrations/github/{owner}/{repo} remove a mapping
+func (g *githubIntegration) repos(w http.ResponseWriter, r *http.Request) {
+	repo := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/integrations/github"), "/")
+	switch {
+	case r.Method == http.MethodGet && repo == "":
+		mappings, err := g.state.List(githubReposBucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mappings)
+	case r.Method == http.MethodPut && strings.Count(repo, "/") == 1:
+		var mapping struct{ Room string }
+		if err := json.NewDecoder(r.Body).Decode(&mapping); err != nil || !validRoomName(mapping.Room) {
+			http.Error(w, "body must be {\"Room\": \"name\"}", http.StatusBadRequest)
+			return
+		}
+		if err := g.state.Put(githubReposBucket, repo, mapping.Room); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && repo != "":
+		if err := g.state.Delete(githubReposBucket, repo); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGitHubWebhook(t *testing.T) {
+	rooms := newRoomManager()
+	state := newFileState("")
+	state.Put(githubReposBucket, "law-lee/chat_server", "dev")
+	g := &githubIntegration{secrets: mapSecrets{"github_webhook_secret": "s3cret"}, state: state, rooms: rooms}
+	c := &client{send: make(chan *message, messageBufferSize), room: rooms.get("dev")}
+	rooms.get("dev").join <- c
+
+	body := `{"action":"opened","repository":{"full_name":"law-lee/chat_server"},"sender":{"login":"alice"},
+		"pull_request":{"number":7,"title":"Add rooms","html_url":"https://github.com/law-lee/chat_server/pull/7"}}`
+	post := func(signature string) int {
+		req := httptest.NewRequest(http.MethodPost, "/integrations/github", strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", "pull_request")
+		req.Header.Set("X-Hub-Signature-256", signature)
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := post("sha256=" + hex.EncodeToString(mac([]byte("wrong"), []byte(body)))); code != http.StatusUnauthorized {
+		t.Errorf("badly signed webhook should be rejected, got %d", code)
+	}
+	if code := post("sha256=" + hex.EncodeToString(mac([]byte("s3cret"), []byte(body)))); code != http.StatusAccepted {
+		t.Fatalf("signed webhook should be accepted, got %d", code)
+	}
+	msg := receive(t, c)
+	want := "alice opened pull request #7 in law-lee/chat_server: Add rooms https://github.com/law-lee/chat_server/pull/7"
+	if msg.Name != "GitHub" || msg.Message != want {
+		t.Errorf("unexpected message %q from %s", msg.Message, msg.Name)
+	}
+}
+
+func TestFormatGitHubPush(t *testing.T) {
+	e := &githubEvent{Ref: "refs/heads/main", Compare: "https://github.com/o/r/compare/a...b"}
+	e.Repository.FullName = "o/r"
+	e.Sender.Login = "bob"
+	e.Commits = make([]struct{ Message string }, 2)
+	e.HeadCommit = &struct{ Message string }{Message: "Fix tests\n\nLonger description"}
+	want := "bob pushed 2 commits to o/r@main: Fix tests https://github.com/o/r/compare/a...b"
+	if got := formatGitHubEvent("push", e); got != want {
+		t.Errorf("got %q", got)
+	}
+	if got := formatGitHubEvent("issues", &githubEvent{Action: "labeled"}); got != "" {
+		t.Errorf("uninteresting events should not be announced, got %q", got)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// gravatarTTL is how long a fetched Gravatar picture, or the fact that
+	// there is none, is reused; failed fetches are retried after
+	// gravatarFailureTTL.
+	gravatarTTL        = 24 * time.Hour
+	gravatarFailureTTL = time.Minute
+	// maxCachedGravatars bounds the cache; expired entries are dropped when
+	// it is full.
+	maxCachedGravatars = 1000
+	// maxGravatarSize caps a fetched picture.
+	maxGravatarSize = 1 << 20
+)
+
+// gravatarProxy, if set, has GravatarAvatar point users at the server's own
+// /gravatar/ URLs, which it serves from its cache, rather than at Gravatar.
+var gravatarProxy *gravatarCache
+
+type cachedGravatar struct {
+	data        []byte
+	contentType string
+	// missing is set when Gravatar has no picture for the hash.
+	missing bool
+	failed  bool
+	expires time.Time
+}
+
+// gravatarCache fetches Gravatar pictures by the md5 hash of the user's
+// email and keeps them, so that each is fetched once a day at most rather
+// than by every browser for every message.
+type gravatarCache struct {
+	baseURL string
+	client  *http.Client
+	now     func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedGravatar
+}
+
+func newGravatarCache() *gravatarCache {
+	return &gravatarCache{
+		baseURL: "https://www.gravatar.com/avatar",
+		client:  &http.Client{Timeout: 5 * time.Second},
+		now:     time.Now,
+		cache:   make(map[string]cachedGravatar),
+	}
+}
+
+// validGravatarHash reports whether hash looks like the md5 hash of an
+// email, in hex.
+func validGravatarHash(hash string) bool {
+	if len(hash) != 32 {
+		return false
+	}
+	return strings.Trim(hash, "0123456789abcdef") == ""
+}
+
+// known reports whether the picture of hash is cached, and if so whether
+// Gravatar has one.
+func (g *gravatarCache) known(hash string) (found, missing bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cached, ok := g.cache[hash]
+	if !ok || !g.now().Before(cached.expires) {
+		return false, false
+	}
+	return true, cached.missing
+}
+
+// lookup returns the picture of hash, from the cache if possible.
+func (g *gravatarCache) lookup(hash string) cachedGravatar {
+	now := g.now()
+	g.mu.Lock()
+	cached, found := g.cache[hash]
+	g.mu.Unlock()
+	if found && now.Before(cached.expires) {
+		return cached
+	}
+	cached, err := g.fetch(hash)
+	cached.expires = now.Add(gravatarTTL)
+	if err != nil {
+		cached = cachedGravatar{failed: true, expires: now.Add(gravatarFailureTTL)}
+	}
+	g.mu.Lock()
+	if len(g.cache) >= maxCachedGravatars {
+		for k, c := range g.cache {
+			if !now.Before(c.expires) {
+				delete(g.cache, k)
+			}
+		}
+		if len(g.cache) >= maxCachedGravatars {
+			g.cache = make(map[string]cachedGravatar)
+		}
+	}
+	g.cache[hash] = cached
+	g.mu.Unlock()
+	return cached
+}
+
+// fetch asks Gravatar for the picture of hash, which it answers with a 404
+// if it has none.
+func (g *gravatarCache) fetch(hash string) (cachedGravatar, error) {
+	resp, err := g.client.Get(g.baseURL + "/" + hash + fmt.Sprintf("?s=%d&d=404", avatarSize))
+	if err != nil {
+		return cachedGravatar{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return cachedGravatar{missing: true}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return cachedGravatar{}, fmt.Errorf("gravatar %s: %s", hash, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxGravatarSize+1))
+	if err != nil {
+		return cachedGravatar{}, err
+	}
+	if len(data) > maxGravatarSize {
+		return cachedGravatar{}, fmt.Errorf("gravatar %s: picture too large", hash)
+	}
+	return cachedGravatar{data: data, contentType: resp.Header.Get("Content-Type")}, nil
+}
+
+// ServeHTTP serves GET /gravatar/{hash} from the cache, redirecting to the
+// default avatar when Gravatar has no picture or cannot be reached.
+func (g *gravatarCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/gravatar/")
+	if !validGravatarHash(hash) {
+		http.NotFound(w, r)
+		return
+	}
+	cached := g.lookup(hash)
+	if cached.missing || cached.failed {
+		http.Redirect(w, r, defaultAvatarURL, http.StatusFound)
+		return
+	}
+	if cached.contentType != "" {
+		w.Header().Set("Content-Type", cached.contentType)
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(gravatarTTL/time.Second)))
+	w.Write(cached.data)
+}
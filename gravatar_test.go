@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGravatarCache(t *testing.T) {
+	const found, missing = "0123456789abcdef0123456789abcdef", "ffffffffffffffffffffffffffffffff"
+	fetches := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.URL.Query().Get("d") != "404" || r.URL.Path != "/avatar/"+found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("jpeg"))
+	}))
+	defer upstream.Close()
+	now := time.Now()
+	g := newGravatarCache()
+	g.baseURL = upstream.URL + "/avatar"
+	g.now = func() time.Time { return now }
+	gravatarProxy = g
+	defer func() { gravatarProxy = nil }()
+
+	serve := func(hash string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/gravatar/"+hash, nil))
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := serve(found); w.Code != http.StatusOK || w.Body.String() != "jpeg" || w.Header().Get("Content-Type") != "image/jpeg" {
+			t.Errorf("expected the picture, got %d %q", w.Code, w.Body)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("the picture should be fetched once, got %d fetches", fetches)
+	}
+	if w := serve(missing); w.Code != http.StatusFound || w.Header().Get("Location") != defaultAvatarURL {
+		t.Errorf("expected a redirect to the default avatar, got %d", w.Code)
+	}
+	if w := serve("../../etc/passwd"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a bad hash, got %d", w.Code)
+	}
+
+	if url, err := UseGravatar.GetAvatarURL(&chatUser{uniqueID: found}); err != nil || url != "/gravatar/"+found {
+		t.Errorf("expected the proxied URL, got %q %v", url, err)
+	}
+	if _, err := UseGravatar.GetAvatarURL(&chatUser{uniqueID: missing}); err != ErrNoAvatarURL {
+		t.Errorf("a user without a Gravatar should get ErrNoAvatarURL, got %v", err)
+	}
+	now = now.Add(gravatarTTL)
+	serve(found)
+	if fetches != 3 {
+		t.Errorf("an expired picture should be fetched again, got %d fetches", fetches)
+	}
+	if !strings.HasPrefix(serve(found).Header().Get("Cache-Control"), "public") {
+		t.Error("browsers should be let cache the picture")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+// guestsAllowed lets visitors chat as guests without signing in with a
+// login provider; it is set with -guests.
+var guestsAllowed bool
+
+// guestIDPrefix starts the userid of every guest.
+const guestIDPrefix = "guest-"
+
+// isGuest reports whether userData is a guest's.
+func isGuest(userData map[string]interface{}) bool {
+	guest, _ := userData["guest"].(bool)
+	return guest
+}
+
+// guestHandler signs visitors in as guests, POST /guest: each gets a new
+// userid, a name like "Guest 4821" and an identicon, and is taken back to
+// the page they asked for. Nothing about a guest outlives their session.
+func guestHandler(w http.ResponseWriter, r *http.Request) {
+	if !guestsAllowed {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := guestIDPrefix + newID()
+	err := startSession(w, r, objx.New(map[string]interface{}{
+		"userid":     userID,
+		"name":       guestName(),
+		"avatar_url": fmt.Sprintf("//www.gravatar.com/avatar/%x?d=identicon&f=y", md5.Sum([]byte(userID))),
+		"guest":      true,
+	}))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error when trying to start session: %s", err), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, returnTo(w, r), http.StatusSeeOther)
+}
+
+// serveGuests is the guests part of the rooms API:
+//
+//	GET /api/rooms/{name}/guests  whether guests may enter the room
+//	PUT /api/rooms/{name}/guests  change it: {"Allowed": false}
+//
+// Only the room's owner and the admins may change it. Guests connected to
+// this server are disconnected when the room stops allowing them.
+func (a *roomSettingsAPI) serveGuests(w http.ResponseWriter, r *http.Request, settings roomSettings, user map[string]interface{}) {
+	userID, _ := user["userid"].(string)
+	email, _ := user["email"].(string)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !isAdmin(email) && (userID == "" || userID != settings.Owner) {
+			http.Error(w, "only the room's owner may change whether guests may enter it", http.StatusForbidden)
+			return
+		}
+		var req struct{ Allowed *bool }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Allowed == nil {
+			http.Error(w, "body must be {\"Allowed\": false}", http.StatusBadRequest)
+			return
+		}
+		settings.NoGuests = !*req.Allowed
+		if settings.Created.IsZero() {
+			settings.Created = time.Now()
+		}
+		if err := a.state.Put(roomSettingsBucket, settings.Room, settings); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if settings.NoGuests && a.rooms != nil {
+			if room, ok := a.rooms.lookup(settings.Room); ok {
+				for _, info := range room.do(controlList, "", nil) {
+					if strings.HasPrefix(info.UserID, guestIDPrefix) {
+						a.rooms.removeUser(settings.Room, info.UserID, "This room no longer allows guests.")
+					}
+				}
+			}
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"Allowed": !settings.NoGuests})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/objx"
+)
+
+func TestGuestHandler(t *testing.T) {
+	defer func(allowed bool) { guestsAllowed = allowed }(guestsAllowed)
+	guestsAllowed = false
+	w := httptest.NewRecorder()
+	guestHandler(w, httptest.NewRequest(http.MethodPost, "/guest", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("guests should be turned away unless allowed, got %d", w.Code)
+	}
+
+	guestsAllowed = true
+	w = httptest.NewRecorder()
+	guestHandler(w, httptest.NewRequest(http.MethodPost, "/guest", nil))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect, got %d: %s", w.Code, w.Body)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/chat", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	user, err := readAuthCookie(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGuest(user) || !strings.HasPrefix(user.Get("userid").Str(), guestIDPrefix) || !strings.HasPrefix(user.Get("name").Str(), "Guest ") ||
+		!strings.Contains(user.Get("avatar_url").Str(), "identicon") {
+		t.Errorf("unexpected guest %v", user)
+	}
+}
+
+func TestRoomWithoutGuests(t *testing.T) {
+	rooms := newRoomManager()
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	createRoom(rooms.state, nil, "hall", "ann", false, nil, nil)
+	server := httptest.NewServer(rooms.get("hall"))
+	defer server.Close()
+	guest := objx.New(map[string]interface{}{"userid": guestIDPrefix + "1", "name": "Guest 1234", "guest": true})
+
+	conn := dialRoom(t, server, guest)
+	conn.WriteJSON(&message{ID: "g1", Message: "hi all"})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID == "g1" && msg.Type == msgTypeMessage {
+			if !msg.Guest {
+				t.Error("a guest's message should be marked")
+			}
+			break
+		}
+	}
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, withAuthCookie(http.MethodPut, "/api/rooms/hall/guests", strings.NewReader(`{"Allowed": false}`), guest))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("only the owner should keep guests out, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, withAuthCookie(http.MethodPut, "/api/rooms/hall/guests", strings.NewReader(`{"Allowed": false}`),
+		objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Allowed":false`) {
+		t.Fatalf("expected guests to be kept out, got %d: %s", w.Code, w.Body)
+	}
+	// the guest in the room is removed
+	for {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			break
+		}
+	}
+
+	r := withAuthCookie(http.MethodGet, "/room", nil, guest)
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"Cookie": r.Header["Cookie"]})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("a guest should not enter the room again, got %v", err)
+	}
+}
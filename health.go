@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// defaultProbeTimeout bounds each health check.
+const defaultProbeTimeout = 2 * time.Second
+
+// authProviders are the login providers setupAuth configures; each needs
+// the <name>_client_id and <name>_client_sec secrets.
+var authProviders = []string{"facebook", "github", "google", "gitlab", "discord", "microsoft", "oidc"}
+
+// Pinger is implemented by backends whose connection can be checked.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// probes serves the liveness and readiness checks, for Kubernetes probes
+// and load balancers:
+//
+//	GET /healthz  every room's run loop is responding
+//	GET /readyz   the server is not draining, the message store, broker
+//	              and session store answer, and a login provider is set up
+//	              and not down
+//
+// Both answer 200, or 503 if a check failed, with the result of each check.
+// /readyz also reports each login provider that has been signed in with as
+// "login/<name>", without failing for one: users can use another.
+type probes struct {
+	rooms   *roomManager
+	secrets SecretSource
+	logins  *providerHealth
+	timeout time.Duration
+}
+
+func newProbes(rooms *roomManager, secrets SecretSource) *probes {
+	return &probes{rooms: rooms, secrets: secrets, logins: loginHealth, timeout: defaultProbeTimeout}
+}
+
+func (p *probes) live(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+	defer cancel()
+	checks := map[string]error{"rooms": p.checkRooms(ctx)}
+	writeChecks(w, checks, nil)
+}
+
+func (p *probes) ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+	defer cancel()
+	checks := map[string]error{"auth": p.checkAuth()}
+	if p.rooms.isDraining() {
+		checks["draining"] = errors.New("the server is draining")
+	}
+	for name, backend := range map[string]interface{}{"store": p.rooms.store, "broker": p.rooms.broker, "sessions": sessions} {
+		if pinger, ok := backend.(Pinger); ok {
+			checks[name] = pinger.Ping(ctx)
+		}
+	}
+	notes := make(map[string]string)
+	for name, status := range p.logins.status() {
+		notes["login/"+name] = status
+	}
+	writeChecks(w, checks, notes)
+}
+
+// checkRooms has every room's run loop answer a request.
+func (p *probes) checkRooms(ctx context.Context) error {
+	for _, r := range p.rooms.list() {
+		if err := r.alive(ctx); err != nil {
+			return errors.New("room " + r.name + " is not responding")
+		}
+	}
+	return nil
+}
+
+// checkAuth reports whether users have any way to sign in.
+func (p *probes) checkAuth() error {
+	down := 0
+	for _, name := range authProviders {
+		id, idErr := p.secrets.Secret(name + "_client_id")
+		secret, secretErr := p.secrets.Secret(name + "_client_sec")
+		if idErr == nil && secretErr == nil && id != "" && secret != "" {
+			if p.logins.down(name) == nil {
+				return nil
+			}
+			down++
+		}
+	}
+	if down > 0 {
+		return errors.New("every login provider configured is down")
+	}
+	return errors.New("no login provider is configured")
+}
+
+// writeChecks answers with the result of each check, "ok" or the error,
+// and notes, which don't change the status.
+func writeChecks(w http.ResponseWriter, checks map[string]error, notes map[string]string) {
+	results := make(map[string]string, len(checks)+len(notes))
+	for name, note := range notes {
+		results[name] = note
+	}
+	status := http.StatusOK
+	for name, err := range checks {
+		results[name] = "ok"
+		if err != nil {
+			results[name] = err.Error()
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// alive reports whether run answers a request before ctx is done.
+func (r *room) alive(ctx context.Context) error {
+	// done is buffered so that a late answer does not block run
+	req := &roomControl{op: controlList, done: make(chan []clientInfo, 1)}
+	select {
+	case r.control <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-req.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (b *redisBroker) Ping(ctx context.Context) error {
+	return b.client.ping(ctx)
+}
+
+func (r *redisSessions) Ping(ctx context.Context) error {
+	return r.client.ping(ctx)
+}
+
+func (l *redisLimiter) Ping(ctx context.Context) error {
+	return l.client.ping(ctx)
+}
+
+// ping checks the connection to Redis. A command stuck on the connection
+// holds it up to the client's timeout, so ping gives up at ctx instead.
+func (c *redisClient) ping(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.do("PING")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
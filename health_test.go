@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// downStore is a message store whose database has gone away.
+type downStore struct {
+	MessageStore
+}
+
+func (downStore) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+// hangingStore is a message store whose saves never finish until release
+// is closed.
+type hangingStore struct {
+	MessageStore
+	release chan struct{}
+}
+
+func (s hangingStore) Save(msg *message) error {
+	<-s.release
+	return s.MessageStore.Save(msg)
+}
+
+func TestProbes(t *testing.T) {
+	rooms := newRoomManager()
+	p := newProbes(rooms, mapSecrets{"github_client_id": "id", "github_client_sec": "sec"})
+	p.timeout = 100 * time.Millisecond
+	check := func(handler http.HandlerFunc, path string) (int, map[string]string) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var results map[string]string
+		json.NewDecoder(w.Body).Decode(&results)
+		return w.Code, results
+	}
+
+	rooms.get("golang")
+	if code, results := check(p.live, "/healthz"); code != http.StatusOK || results["rooms"] != "ok" {
+		t.Errorf("rooms should be live, got %d %v", code, results)
+	}
+	if code, results := check(p.ready, "/readyz"); code != http.StatusOK || results["auth"] != "ok" {
+		t.Errorf("server should be ready, got %d %v", code, results)
+	}
+
+	rooms.store = downStore{rooms.store}
+	if code, results := check(p.ready, "/readyz"); code != http.StatusServiceUnavailable || results["store"] != "connection refused" {
+		t.Errorf("a store that is down should fail readiness, got %d %v", code, results)
+	}
+	p.secrets = mapSecrets{"github_client_id": "id"}
+	if _, results := check(p.ready, "/readyz"); results["auth"] == "ok" {
+		t.Errorf("a provider without its secret should not count, got %v", results)
+	}
+
+	// the store never finishes saving, so the room gets stuck on it
+	release := make(chan struct{})
+	defer close(release)
+	rooms.store = hangingStore{rooms.store, release}
+	r := rooms.get("stuck")
+	r.forward <- &message{ID: "m1", Type: msgTypeMessage, UserID: "ann", Message: "hello", When: time.Now()}
+	if code, results := check(p.live, "/healthz"); code != http.StatusServiceUnavailable || results["rooms"] != "room stuck is not responding" {
+		t.Errorf("a stuck room should fail liveness, got %d %v", code, results)
+	}
+}
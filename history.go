@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// roomJoinsBucket holds, keyed by "room/userid", when each user first
+// joined each room.
+const roomJoinsBucket = "room_joins"
+
+// roomJoin is when a user first joined a room.
+type roomJoin struct {
+	Joined time.Time
+}
+
+// The history a room's members may see, for historyVisibility.Shown.
+const (
+	// historyAll shows everything, the default.
+	historyAll = "all"
+	// historyNone shows nothing from before the member first joined.
+	historyNone = "none"
+	// historyDays shows Days days from before the member first joined.
+	historyDays = "days"
+)
+
+// historyVisibility limits how much of a room's history from before they
+// joined its members may see, in the history sent when they join and
+// through search. The owner sees everything.
+type historyVisibility struct {
+	Shown string
+	Days  int `json:",omitempty"`
+}
+
+func (h *historyVisibility) valid() bool {
+	switch h.Shown {
+	case historyAll, historyNone:
+		return h.Days == 0
+	case historyDays:
+		return h.Days > 0
+	}
+	return false
+}
+
+// recordJoin saves now as when the user with userID first joined room,
+// unless they did before.
+func recordJoin(state StateStore, room, userID string, now time.Time) error {
+	if userID == "" {
+		return nil
+	}
+	_, err := state.Create(roomJoinsBucket, room+"/"+userID, roomJoin{Joined: now})
+	return err
+}
+
+// historyStart returns the time from which the user with userID may see the
+// history of the room settings are for, zero if they may see all of it.
+// Someone who never joined may only see what comes after now.
+func historyStart(state StateStore, settings roomSettings, userID string, now time.Time) (time.Time, error) {
+	h := settings.History
+	if h == nil || h.Shown == historyAll || userID != "" && userID == settings.Owner {
+		return time.Time{}, nil
+	}
+	join := roomJoin{Joined: now}
+	if userID != "" {
+		if err := state.Get(roomJoinsBucket, settings.Room+"/"+userID, &join); err != nil && err != ErrNoState {
+			return now, err
+		}
+	}
+	if h.Shown == historyDays {
+		return join.Joined.Add(-time.Duration(h.Days) * 24 * time.Hour), nil
+	}
+	return join.Joined, nil
+}
+
+// historyFrom records that c joined the room and returns the time from which
+// it may be sent the room's history. A failure to tell shows nothing older
+// than now. It runs inside run.
+func (r *room) historyFrom(c *client) time.Time {
+	now := time.Now()
+	if err := recordJoin(r.state, r.name, c.userID(), now); err != nil {
+		r.tracer.Warn("Failed to record the join: ", err)
+	}
+	settings, err := loadRoomSettings(r.state, r.name)
+	if err != nil {
+		r.tracer.Warn("Failed to load the room's settings: ", err)
+		return now
+	}
+	start, err := historyStart(r.state, settings, c.userID(), now)
+	if err != nil {
+		r.tracer.Warn("Failed to find when the client first joined: ", err)
+	}
+	return start
+}
+
+// visibleTo reports whether the user with userID may see msg, by the history
+// visibility of its room; starts caches each room's start for them. Direct
+// messages are always visible to those who may read them, and every message
+// is without a state store to tell.
+func visibleTo(state StateStore, msg *message, userID string, starts map[string]time.Time) bool {
+	if state == nil || !validRoomName(msg.Room) {
+		return true
+	}
+	start, ok := starts[msg.Room]
+	if !ok {
+		now := time.Now()
+		settings, err := loadRoomSettings(state, msg.Room)
+		if err == nil {
+			start, err = historyStart(state, settings, userID, now)
+		}
+		if err != nil {
+			start = now
+		}
+		starts[msg.Room] = start
+	}
+	return !msg.When.Before(start)
+}
+
+// serveHistory is the history part of the rooms API:
+//
+//	GET /api/rooms/{name}/history  what members see from before they joined
+//	PUT /api/rooms/{name}/history  change it: {"Shown": "all"}, {"Shown":
+//	                               "none"} or {"Shown": "days", "Days": 30}
+//
+// Only the room's owner and the admins may change it.
+func (a *roomSettingsAPI) serveHistory(w http.ResponseWriter, r *http.Request, settings roomSettings, user map[string]interface{}) {
+	userID, _ := user["userid"].(string)
+	email, _ := user["email"].(string)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !isAdmin(email) && (userID == "" || userID != settings.Owner) {
+			http.Error(w, "only the room's owner may change who sees its history", http.StatusForbidden)
+			return
+		}
+		var h historyVisibility
+		if err := json.NewDecoder(r.Body).Decode(&h); err != nil || !h.valid() {
+			http.Error(w, "body must be {\"Shown\": \"all\"}, {\"Shown\": \"none\"} or {\"Shown\": \"days\", \"Days\": 30}", http.StatusBadRequest)
+			return
+		}
+		settings.History = &h
+		if h.Shown == historyAll {
+			settings.History = nil
+		}
+		if settings.Created.IsZero() {
+			settings.Created = time.Now()
+		}
+		if err := a.state.Put(roomSettingsBucket, settings.Room, settings); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h := settings.History
+	if h == nil {
+		h = &historyVisibility{Shown: historyAll}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestHistoryVisibility(t *testing.T) {
+	rooms := newRoomManager()
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})
+	createRoom(rooms.state, nil, "ops", "ann", false, nil, nil)
+	setHistory := func(user objx.Map, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(http.MethodPut, "/api/rooms/ops/history", strings.NewReader(body), user))
+		return w
+	}
+	if w := setHistory(bob, `{"Shown": "none"}`); w.Code != http.StatusForbidden {
+		t.Errorf("only the owner should change the history shown, got %d", w.Code)
+	}
+	if w := setHistory(ann, `{"Shown": "days"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("days without a number should be refused, got %d", w.Code)
+	}
+	if w := setHistory(ann, `{"Shown": "none"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	rooms.store.Save(&message{ID: "old", Type: msgTypeMessage, Room: "ops", UserID: "ann", Name: "Ann", Message: "before bob", When: old, Seq: 1})
+	rooms.store.Save(&message{ID: "recent", Type: msgTypeMessage, Room: "ops", UserID: "ann", Name: "Ann", Message: "also before bob", When: time.Now().Add(-time.Minute), Seq: 2})
+
+	// history joins as user and returns the IDs of the history sent
+	history := func(user objx.Map) []string {
+		r := rooms.get("ops")
+		c := &client{send: make(chan *message, messageBufferSize), room: r, userData: user}
+		r.join <- c
+		marker := newID()
+		r.forward <- &message{ID: marker, Type: msgTypeMessage, UserID: "ann", Name: "Ann", Message: "marker", When: time.Now()}
+		var ids []string
+		for {
+			msg := receiveChat(t, c)
+			if msg.ID == marker {
+				return ids
+			}
+			if msg.Type == msgTypeMessage && msg.Message != "marker" {
+				ids = append(ids, msg.ID)
+			}
+		}
+	}
+	if ids := history(bob); len(ids) != 0 {
+		t.Errorf("bob should see nothing from before they joined, got %v", ids)
+	}
+	if ids := history(ann); len(ids) < 2 || ids[0] != "old" {
+		t.Errorf("the owner should see everything, got %v", ids)
+	}
+
+	// bob's join is kept, so a day's worth counts back from it
+	if w := setHistory(ann, `{"Shown": "days", "Days": 1}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if ids := history(bob); len(ids) != 1 || ids[0] != "recent" {
+		t.Errorf("bob should see the last day before they joined, got %v", ids)
+	}
+
+	search := &searchHandler{store: rooms.store, state: rooms.state}
+	w := httptest.NewRecorder()
+	search.ServeHTTP(w, withAuthCookie(http.MethodGet, "/api/search?q=before", nil, bob))
+	var results []searchResult
+	json.NewDecoder(w.Body).Decode(&results)
+	if len(results) != 1 || results[0].Message.ID != "recent" {
+		t.Errorf("search should hide what bob may not see, got %+v", results)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// roomWebhooksBucket holds the incoming webhooks of every room, by the
+// SHA-256 of their token; the tokens themselves are only shown once.
+const roomWebhooksBucket = "room_webhooks"
+
+// roomWebhook lets whoever knows its token post to Room, as Name, without
+// signing in.
+type roomWebhook struct {
+	// ID identifies the webhook to the room's owner; it is the start of
+	// the token's hash.
+	ID      string
+	Room    string
+	Name    string
+	By      string
+	Created time.Time
+}
+
+// webhookKey returns the key of the webhook with token.
+func webhookKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// roomWebhooks returns the incoming webhooks of room, by key.
+func roomWebhooks(state StateStore, room string) (map[string]*roomWebhook, error) {
+	docs, err := state.List(roomWebhooksBucket)
+	if err != nil {
+		return nil, err
+	}
+	hooks := make(map[string]*roomWebhook)
+	for key, doc := range docs {
+		var hook roomWebhook
+		if json.Unmarshal(doc, &hook) == nil && hook.Room == room {
+			hooks[key] = &hook
+		}
+	}
+	return hooks, nil
+}
+
+// incomingWebhooks accepts POST /integrations/webhook/{token} with
+// {"Text": "..."} and posts the text to the webhook's room.
+type incomingWebhooks struct {
+	state StateStore
+	rooms *roomManager
+}
+
+func (h *incomingWebhooks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/integrations/webhook/")
+	var hook roomWebhook
+	if err := h.state.Get(roomWebhooksBucket, webhookKey(token), &hook); err != nil || token == "" {
+		http.Error(w, "unknown webhook", http.StatusNotFound)
+		return
+	}
+	var body struct{ Text string }
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookBody)).Decode(&body); err != nil || strings.TrimSpace(body.Text) == "" {
+		http.Error(w, "body must be {\"Text\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	h.rooms.get(hook.Room).forward <- &message{
+		ID:      newID(),
+		Name:    hook.Name,
+		Message: body.Text,
+		When:    time.Now(),
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// roomIntegrations is what GET /api/rooms/{name}/integrations returns.
+type roomIntegrations struct {
+	Webhooks []*roomWebhook
+	// GitHub are the repositories whose events are posted to the room.
+	GitHub []string
+	// Bots are the slash commands installed in the room; commands that
+	// are available in every room are not listed.
+	Bots []string
+}
+
+// serveIntegrations is the integrations part of the rooms API:
+//
+//	GET    /api/rooms/{name}/integrations                       the room's integrations
+//	POST   /api/rooms/{name}/integrations/webhooks              add a webhook: {"Name": "CI"}
+//	DELETE /api/rooms/{name}/integrations/webhooks/{id}         remove one
+//	PUT    /api/rooms/{name}/integrations/github/{owner}/{repo} post the repo's events to the room
+//	DELETE /api/rooms/{name}/integrations/github/{owner}/{repo} stop
+//	PUT    /api/rooms/{name}/integrations/bots/{command}        install a bot's command
+//	DELETE /api/rooms/{name}/integrations/bots/{command}        uninstall it
+//
+// Only the room's owner and the admins may use it. A new webhook's token is
+// only returned when it is added. The owner may not take over a repository
+// that posts to another room; the admins can, with /admin/integrations/github.
+func (a *roomSettingsAPI) serveIntegrations(w http.ResponseWriter, r *http.Request, name, rest string, user map[string]interface{}) {
+	role, err := roleOf(a.state, name, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowed(role, permIntegrations) {
+		http.Error(w, "only the room's owner may manage its integrations", http.StatusForbidden)
+		return
+	}
+	kind, target, _ := strings.Cut(rest, "/")
+	switch {
+	case kind == "" && r.Method == http.MethodGet:
+		a.listIntegrations(w, name)
+	case kind == "webhooks":
+		a.serveWebhooks(w, r, name, target, user)
+	case kind == "github" && strings.Count(target, "/") == 1:
+		a.serveGitHubRepo(w, r, name, target)
+	case kind == "bots" && target != "" && a.rooms != nil:
+		a.serveBot(w, r, name, target)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (a *roomSettingsAPI) listIntegrations(w http.ResponseWriter, name string) {
+	list := roomIntegrations{Webhooks: []*roomWebhook{}, GitHub: []string{}, Bots: []string{}}
+	hooks, err := roomWebhooks(a.state, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, hook := range hooks {
+		list.Webhooks = append(list.Webhooks, hook)
+	}
+	sort.Slice(list.Webhooks, func(i, j int) bool { return list.Webhooks[i].Created.Before(list.Webhooks[j].Created) })
+	repos, err := a.state.List(githubReposBucket)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for repo, doc := range repos {
+		var room string
+		if json.Unmarshal(doc, &room) == nil && room == name {
+			list.GitHub = append(list.GitHub, repo)
+		}
+	}
+	sort.Strings(list.GitHub)
+	if a.rooms != nil {
+		d := a.rooms.commands
+		d.mu.RLock()
+		for _, cmd := range d.commands {
+			if len(cmd.Rooms) > 0 && cmd.inRoom(name) {
+				list.Bots = append(list.Bots, cmd.Name)
+			}
+		}
+		d.mu.RUnlock()
+		sort.Strings(list.Bots)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (a *roomSettingsAPI) serveWebhooks(w http.ResponseWriter, r *http.Request, name, id string, user map[string]interface{}) {
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		var req struct{ Name string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			http.Error(w, "body must be {\"Name\": \"...\"}", http.StatusBadRequest)
+			return
+		}
+		by, _ := user["userid"].(string)
+		token := newID()
+		key := webhookKey(token)
+		hook := &roomWebhook{ID: key[:12], Room: name, Name: strings.TrimSpace(req.Name), By: by, Created: time.Now()}
+		if err := a.state.Put(roomWebhooksBucket, key, hook); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			*roomWebhook
+			Token string
+			URL   string
+		}{hook, token, "/integrations/webhook/" + token})
+	case r.Method == http.MethodDelete && id != "":
+		hooks, err := roomWebhooks(a.state, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for key, hook := range hooks {
+			if hook.ID == id {
+				if err := a.state.Delete(roomWebhooksBucket, key); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "no such webhook", http.StatusNotFound)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (a *roomSettingsAPI) serveGitHubRepo(w http.ResponseWriter, r *http.Request, name, repo string) {
+	var room string
+	switch err := a.state.Get(githubReposBucket, repo, &room); {
+	case err != nil && err != ErrNoState:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case err == nil && room != name:
+		http.Error(w, "the repository posts to another room", http.StatusConflict)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if err := a.state.Put(githubReposBucket, repo, name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if room == "" {
+			http.Error(w, "the repository does not post to the room", http.StatusNotFound)
+			return
+		}
+		if err := a.state.Delete(githubReposBucket, repo); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *roomSettingsAPI) serveBot(w http.ResponseWriter, r *http.Request, name, command string) {
+	switch r.Method {
+	case http.MethodPut:
+		if !a.rooms.commands.install(command, name) {
+			http.Error(w, "no such command", http.StatusNotFound)
+			return
+		}
+	case http.MethodDelete:
+		if !a.rooms.commands.uninstall(command, name) {
+			http.Error(w, "the command is not installed in the room, or only an admin can remove it", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/objx"
+)
+
+func TestRoomIntegrations(t *testing.T) {
+	rooms := newRoomManager()
+	rooms.commands.register(&slashCommand{Name: "page", Rooms: []string{"ops"}, URL: "http://bot.example", Bot: "pager"})
+	rooms.state.Put(githubReposBucket, "acme/api", "ops")
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})
+	serve := func(user objx.Map, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(method, path, strings.NewReader(body), user))
+		return w
+	}
+	if _, err := createRoom(rooms.state, nil, "dev", "ann", false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(bob, http.MethodGet, "/api/rooms/dev/integrations", ""); w.Code != http.StatusForbidden {
+		t.Errorf("only the owner should manage integrations, got %d", w.Code)
+	}
+
+	w := serve(ann, http.MethodPost, "/api/rooms/dev/integrations/webhooks", `{"Name": "CI"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var hook struct{ ID, Token, URL string }
+	json.NewDecoder(w.Body).Decode(&hook)
+	if hook.Token == "" || hook.URL != "/integrations/webhook/"+hook.Token {
+		t.Fatalf("expected the webhook's token and URL, got %+v", hook)
+	}
+
+	r := rooms.get("dev")
+	c := &client{send: make(chan *message, messageBufferSize), room: r, userData: ann}
+	r.join <- c
+	waitMembers(t, r, 1)
+	hooks := &incomingWebhooks{state: rooms.state, rooms: rooms}
+	w = httptest.NewRecorder()
+	hooks.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/integrations/webhook/nope", strings.NewReader(`{"Text": "hi"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("an unknown token should be refused, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	hooks.ServeHTTP(w, httptest.NewRequest(http.MethodPost, hook.URL, strings.NewReader(`{"Text": "build passed"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body)
+	}
+	if msg := receiveChat(t, c); msg.Name != "CI" || msg.Message != "build passed" {
+		t.Errorf("expected the webhook's message, got %+v", msg)
+	}
+
+	if w := serve(ann, http.MethodPut, "/api/rooms/dev/integrations/github/acme/api", ""); w.Code != http.StatusConflict {
+		t.Errorf("a repository posting to another room should not be taken over, got %d", w.Code)
+	}
+	if w := serve(ann, http.MethodPut, "/api/rooms/dev/integrations/github/acme/web", ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(ann, http.MethodPut, "/api/rooms/dev/integrations/bots/page", ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(ann, http.MethodPut, "/api/rooms/dev/integrations/bots/nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("an unknown command should not be installed, got %d", w.Code)
+	}
+
+	var list roomIntegrations
+	json.NewDecoder(serve(ann, http.MethodGet, "/api/rooms/dev/integrations", "").Body).Decode(&list)
+	if len(list.Webhooks) != 1 || list.Webhooks[0].Name != "CI" || strings.Join(list.GitHub, ",") != "acme/web" || strings.Join(list.Bots, ",") != "page" {
+		t.Errorf("unexpected integrations %+v", list)
+	}
+
+	if w := serve(ann, http.MethodDelete, "/api/rooms/dev/integrations/bots/page", ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
+	}
+	if _, _, ok := rooms.commands.lookup("dev", "/page"); ok {
+		t.Error("the command should be uninstalled")
+	}
+	if _, _, ok := rooms.commands.lookup("ops", "/page"); !ok {
+		t.Error("the command should stay in its other rooms")
+	}
+	if w := serve(ann, http.MethodDelete, "/api/rooms/dev/integrations/webhooks/"+hook.ID, ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	hooks.ServeHTTP(w, httptest.NewRequest(http.MethodPost, hook.URL, strings.NewReader(`{"Text": "build passed"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("a removed webhook should stop working, got %d", w.Code)
+	}
+}
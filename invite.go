@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// invitesBucket holds a roomInvite per invite link, by token.
+	invitesBucket = "invites"
+	// inviteUsesBucket holds an inviteUse per redemption, under
+	// "token#n" for the nth use, which is also how servers agree on who
+	// got the last use of a link.
+	inviteUsesBucket = "invite_uses"
+	// roomMembersBucket holds a roomMembership per user who joined a
+	// room through an invite, under "room/userid". Only they may enter
+	// a private room.
+	roomMembersBucket = "room_members"
+	// maxInviteRetries is how often redeeming tries again when other
+	// servers take the use it was after.
+	maxInviteRetries = 10
+	// emailInviteTTL is how long emailed invites last unless the sender
+	// asks otherwise.
+	emailInviteTTL = 7 * 24 * time.Hour
+)
+
+// errInviteInvalid is returned for invites that do not exist, have expired,
+// were revoked or are used up.
+var errInviteInvalid = errors.New("this invite link is no longer valid")
+
+// roomInvite is a shareable link into a room. MaxUses of zero means
+// unlimited, as does a zero Expires. Email is set for invites mailed to
+// somebody; they are single use and pending until used.
+type roomInvite struct {
+	Token     string
+	Room      string
+	URL       string
+	MaxUses   int
+	Uses      int
+	Expires   time.Time `json:",omitempty"`
+	Email     string    `json:",omitempty"`
+	CreatedBy string
+	Created   time.Time
+}
+
+// usable reports whether the invite can still be used at now.
+func (i *roomInvite) usable(now time.Time) bool {
+	return (i.Expires.IsZero() || now.Before(i.Expires)) && (i.MaxUses == 0 || i.Uses < i.MaxUses)
+}
+
+// inviteUse records who used an invite, for auditing.
+type inviteUse struct {
+	Token    string
+	Room     string
+	UserID   string
+	Name     string
+	Email    string
+	Redeemed time.Time
+}
+
+// roomMembership records that a user joined a room, and through which
+// invite.
+type roomMembership struct {
+	Room   string
+	UserID string
+	Invite string
+	Joined time.Time
+}
+
+// invites creates, redeems and audits invite links. Emailed invites are
+// sent through queue, as "email" deliveries, with links to publicURL, or
+// to the host the request came to if that is empty.
+type invites struct {
+	state     StateStore
+	queue     *deadLetterQueue
+	publicURL string
+}
+
+// create stores a new invite to room by userID.
+func (s *invites) create(room, userID string, maxUses int, ttl time.Duration) (*roomInvite, error) {
+	if !validRoomName(room) {
+		return nil, errors.New("invalid room name")
+	}
+	if maxUses < 0 || ttl < 0 {
+		return nil, errors.New("max uses and expiry cannot be negative")
+	}
+	now := time.Now()
+	invite := &roomInvite{Token: newID(), Room: room, MaxUses: maxUses, CreatedBy: userID, Created: now}
+	invite.URL = "/invite/" + invite.Token
+	if ttl > 0 {
+		invite.Expires = now.Add(ttl)
+	}
+	return invite, s.state.Put(invitesBucket, invite.Token, invite)
+}
+
+// redeem uses the invite for user and makes them a member of its room. A
+// user who is already a member does not use the invite up.
+func (s *invites) redeem(token string, user map[string]interface{}) (*roomInvite, error) {
+	userID, _ := user["userid"].(string)
+	for i := 0; i < maxInviteRetries; i++ {
+		var invite roomInvite
+		if err := s.state.Get(invitesBucket, token, &invite); err != nil {
+			return nil, errInviteInvalid
+		}
+		now := time.Now()
+		var member roomMembership
+		if s.state.Get(roomMembersBucket, invite.Room+"/"+userID, &member) == nil {
+			return &invite, nil
+		}
+		if !invite.usable(now) {
+			return nil, errInviteInvalid
+		}
+		name, _ := user["name"].(string)
+		email, _ := user["email"].(string)
+		use := inviteUse{Token: token, Room: invite.Room, UserID: userID, Name: name, Email: email, Redeemed: now}
+		claimed, err := s.state.Create(inviteUsesBucket, token+"#"+strconv.Itoa(invite.Uses+1), use)
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			// another server took this use; look again
+			continue
+		}
+		invite.Uses++
+		if err := s.state.Put(invitesBucket, token, invite); err != nil {
+			return nil, err
+		}
+		member = roomMembership{Room: invite.Room, UserID: userID, Invite: token, Joined: now}
+		return &invite, s.state.Put(roomMembersBucket, invite.Room+"/"+userID, member)
+	}
+	return nil, errInviteInvalid
+}
+
+// uses returns who used the invite, in order.
+func (s *invites) uses(token string) ([]*inviteUse, error) {
+	docs, err := s.state.List(inviteUsesBucket)
+	if err != nil {
+		return nil, err
+	}
+	uses := []*inviteUse{}
+	for key, doc := range docs {
+		var use inviteUse
+		if strings.HasPrefix(key, token+"#") && json.Unmarshal(doc, &use) == nil {
+			uses = append(uses, &use)
+		}
+	}
+	sort.Slice(uses, func(i, j int) bool { return uses[i].Redeemed.Before(uses[j].Redeemed) })
+	return uses, nil
+}
+
+// redeemHandler serves the invite links, GET /invite/{token}: it redeems the
+// invite and sends the user on to the room.
+func (s *invites) redeemHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, "/invite"), "/")
+	invite, err := s.redeem(token, currentUser(r))
+	if err == errInviteInvalid {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/chat/"+invite.Room)
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// mail sends an emailed invite, from the user named from.
+func (s *invites) mail(r *http.Request, invite *roomInvite, from string) {
+	base := s.publicURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	if from == "" {
+		from = "Somebody"
+	}
+	payload, _ := json.Marshal(&mailMessage{
+		Subject: from + " invited you to #" + invite.Room,
+		Body: from + " invited you to chat in #" + invite.Room + ". Join here:\n\n" +
+			strings.TrimSuffix(base, "/") + invite.URL + "\n\nThe link works once and expires on " +
+			invite.Expires.UTC().Format("2 January 2006") + ".\n",
+	})
+	// a failed send is kept and retried by the queue
+	s.queue.send(&delivery{Kind: "email", Target: invite.Email, Payload: payload})
+}
+
+// ServeHTTP is the API for invite links. Users see and revoke the invites
+// they created; admins see and revoke all of them:
+//
+//	GET    /api/invites?room=    list invites
+//	POST   /api/invites          create one: {"Room", "MaxUses", "ExpiresIn": seconds}
+//	                             or email one: {"Room", "Email"}
+//	GET    /api/invites/{token}  who used an invite
+//	DELETE /api/invites/{token}  revoke an invite
+func (s *invites) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/invites"), "/")
+	user := currentUser(r)
+	userID := user.Get("userid").Str()
+	admin := isAdmin(user.Get("email").Str())
+	if r.Method == http.MethodPost && token == "" {
+		var req struct {
+			Room      string
+			MaxUses   int
+			ExpiresIn int
+			Email     string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok, err := canInvite(s.state, req.Room, userID, admin); err != nil || !ok {
+			http.Error(w, "only the room's owner may invite to a private room", http.StatusForbidden)
+			return
+		}
+		ttl := time.Duration(req.ExpiresIn) * time.Second
+		if req.Email != "" {
+			if s.queue == nil {
+				http.Error(w, "email is not configured", http.StatusServiceUnavailable)
+				return
+			}
+			address, err := mail.ParseAddress(req.Email)
+			if err != nil {
+				http.Error(w, "invalid email address", http.StatusBadRequest)
+				return
+			}
+			req.Email, req.MaxUses = address.Address, 1
+			if ttl == 0 {
+				ttl = emailInviteTTL
+			}
+		}
+		invite, err := s.create(req.Room, userID, req.MaxUses, ttl)
+		if err == nil && req.Email != "" {
+			invite.Email = req.Email
+			if err = s.state.Put(invitesBucket, invite.Token, invite); err == nil {
+				s.mail(r, invite, user.Get("name").Str())
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(invite)
+		return
+	}
+	if r.Method == http.MethodGet && token == "" {
+		docs, err := s.state.List(invitesBucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		room := r.URL.Query().Get("room")
+		list := []*roomInvite{}
+		for _, doc := range docs {
+			var invite roomInvite
+			if json.Unmarshal(doc, &invite) == nil && (admin || invite.CreatedBy == userID) && (room == "" || invite.Room == room) {
+				list = append(list, &invite)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	var invite roomInvite
+	if err := s.state.Get(invitesBucket, token, &invite); err != nil || (!admin && invite.CreatedBy != userID) {
+		http.Error(w, "no such invite", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		uses, err := s.uses(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(uses)
+	case http.MethodDelete:
+		// the uses stay, for the record
+		if err := s.state.Delete(invitesBucket, token); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestInviteLimits(t *testing.T) {
+	s := &invites{state: newFileState("")}
+	invite, err := s.create("golang", "ann", 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"bob", "bob", "cat"} {
+		if _, err := s.redeem(invite.Token, map[string]interface{}{"userid": user}); err != nil {
+			t.Fatalf("%s should get in: %v", user, err)
+		}
+	}
+	if _, err := s.redeem(invite.Token, map[string]interface{}{"userid": "dan"}); err != errInviteInvalid {
+		t.Errorf("the invite should be used up, got %v", err)
+	}
+	var member roomMembership
+	if err := s.state.Get(roomMembersBucket, "golang/cat", &member); err != nil || member.Invite != invite.Token {
+		t.Errorf("cat should be a member through the invite, got %+v %v", member, err)
+	}
+	uses, _ := s.uses(invite.Token)
+	if len(uses) != 2 || uses[0].UserID != "bob" || uses[1].UserID != "cat" {
+		t.Errorf("bob's second visit should not count, got %+v", uses)
+	}
+
+	expired, _ := s.create("golang", "ann", 0, time.Hour)
+	expired.Expires = time.Now().Add(-time.Minute)
+	s.state.Put(invitesBucket, expired.Token, expired)
+	if _, err := s.redeem(expired.Token, map[string]interface{}{"userid": "dan"}); err != errInviteInvalid {
+		t.Errorf("an expired invite should not work, got %v", err)
+	}
+	if _, err := s.redeem("nope", map[string]interface{}{"userid": "dan"}); err != errInviteInvalid {
+		t.Errorf("a made up invite should not work, got %v", err)
+	}
+}
+
+func TestInviteAPI(t *testing.T) {
+	s := &invites{state: newFileState("")}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann", "email": "ann@example.com"})
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob", "email": "bob@example.com"})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, withAuthCookie(http.MethodPost, "/api/invites", strings.NewReader(`{"Room": "golang", "MaxUses": 5}`), ann))
+	var invite roomInvite
+	if err := json.NewDecoder(w.Body).Decode(&invite); w.Code != http.StatusCreated || err != nil || invite.URL != "/invite/"+invite.Token {
+		t.Fatalf("creating an invite failed: %d %+v", w.Code, invite)
+	}
+
+	w = httptest.NewRecorder()
+	s.redeemHandler(w, withAuthCookie(http.MethodGet, invite.URL, nil, bob))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/chat/golang" {
+		t.Errorf("redeeming should lead into the room, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, withAuthCookie(http.MethodGet, "/api/invites/"+invite.Token, nil, ann))
+	if !strings.Contains(w.Body.String(), `"Email":"bob@example.com"`) {
+		t.Errorf("the creator should see who used the invite, got %s", w.Body)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, withAuthCookie(http.MethodDelete, "/api/invites/"+invite.Token, nil, bob))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("only the creator may revoke an invite, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, withAuthCookie(http.MethodDelete, "/api/invites/"+invite.Token, nil, ann))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("revoking failed: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.redeemHandler(w, withAuthCookie(http.MethodGet, invite.URL, nil, objx.New(map[string]interface{}{"userid": "cat"})))
+	if w.Code != http.StatusGone {
+		t.Errorf("a revoked invite should be gone, got %d", w.Code)
+	}
+}
+
+func TestEmailInvite(t *testing.T) {
+	queue, _ := newDeadLetterQueue("")
+	var sent []*delivery
+	queue.register("email", DelivererFunc(func(d *delivery) error {
+		sent = append(sent, d)
+		return nil
+	}))
+	s := &invites{state: newFileState(""), queue: queue, publicURL: "https://chat.example.com/"}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann", "email": "ann@example.com"})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, withAuthCookie(http.MethodPost, "/api/invites", strings.NewReader(`{"Room": "golang", "Email": "Bob <bob@example.com>"}`), ann))
+	var invite roomInvite
+	json.NewDecoder(w.Body).Decode(&invite)
+	if w.Code != http.StatusCreated || invite.Email != "bob@example.com" || invite.MaxUses != 1 || invite.Expires.IsZero() {
+		t.Fatalf("unexpected invite %d %+v", w.Code, invite)
+	}
+	if len(sent) != 1 || sent[0].Target != "bob@example.com" || !strings.Contains(string(sent[0].Payload), "https://chat.example.com/invite/"+invite.Token) {
+		t.Fatalf("the invite should be mailed with a link, got %+v", sent)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, withAuthCookie(http.MethodGet, "/api/invites?room=golang", nil, ann))
+	if !strings.Contains(w.Body.String(), `"Uses":0,`) {
+		t.Errorf("the invite should be listed as pending, got %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, withAuthCookie(http.MethodPost, "/api/invites", strings.NewReader(`{"Room": "golang", "Email": "not an address"}`), ann))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a bad address should be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+const (
+	// defaultTokenTTL and maxTokenTTL bound how long issued tokens last.
+	defaultTokenTTL = 24 * time.Hour
+	maxTokenTTL     = 90 * 24 * time.Hour
+)
+
+// errBadToken is returned for bearer tokens that are malformed, expired,
+// revoked or not signed by one of our keys.
+var errBadToken = errors.New("chat: invalid bearer token")
+
+// jwtHeader is the JOSE header of the tokens we issue. Kid names the key in
+// authKeys the token is signed with, so tokens survive key rotation just
+// like cookies do.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the claims we issue and read: sub is the userid, the rest
+// mirror the session user data.
+type jwtClaims struct {
+	Sub       string `json:"sub"`
+	Name      string `json:"name,omitempty"`
+	Email     string `json:"email,omitempty"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+	// Bot marks the tokens of bots an admin created, whose name and
+	// avatar come from the bot rather than the token.
+	Bot bool  `json:"bot,omitempty"`
+	Iat int64 `json:"iat"`
+	Exp int64 `json:"exp"`
+}
+
+// issueToken returns an HS256 JWT for the user that expires after ttl.
+func issueToken(user objx.Map, ttl time.Duration) (string, error) {
+	key := authKeys.current()
+	header, err := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims, err := json.Marshal(jwtClaims{
+		Sub:       user.Get("userid").Str(),
+		Name:      user.Get("name").Str(),
+		Email:     user.Get("email").Str(),
+		AvatarURL: user.Get("avatar_url").Str(),
+		Bot:       isBot(user),
+		Iat:       now.Unix(),
+		Exp:       now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac(key.Secret, []byte(input))), nil
+}
+
+// readToken verifies a JWT and returns its user data in the same shape as a
+// session's.
+func readToken(token string) (objx.Map, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errBadToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, errBadToken
+	}
+	if !authKeys.verify([]byte(parts[0]+"."+parts[1]), header.Kid+"."+parts[2]) {
+		return nil, errBadToken
+	}
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil || claims.Sub == "" {
+		return nil, errBadToken
+	}
+	if time.Now().Unix() >= claims.Exp {
+		return nil, errBadToken
+	}
+	if revoked, err := accounts.revoked(claims.Sub, time.Unix(claims.Iat, 0)); err != nil {
+		return nil, err
+	} else if revoked {
+		return nil, errBadToken
+	}
+	if claims.Bot {
+		// a deleted bot's tokens are no good
+		bot, err := botAccounts.lookup(claims.Sub)
+		if err != nil {
+			return nil, err
+		}
+		if bot == nil {
+			return nil, errBadToken
+		}
+		return bot.userData(), nil
+	}
+	return objx.New(map[string]interface{}{
+		"userid":     claims.Sub,
+		"name":       claims.Name,
+		"email":      claims.Email,
+		"avatar_url": claims.AvatarURL,
+	}), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len("Bearer "):]), true
+}
+
+// authenticate returns the user making the request, identified either by a
+// bearer token or by the auth cookie.
+func authenticate(r *http.Request) (objx.Map, error) {
+	var userData objx.Map
+	var err error
+	if token, ok := bearerToken(r); ok {
+		userData, err = readToken(token)
+	} else {
+		userData, err = readAuthCookie(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a deactivated user's sessions and tokens are no good
+	d, err := accounts.deactivation(userData.Get("userid").Str())
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		return nil, errDeactivated
+	}
+	return userData, nil
+}
+
+// tokenRequest asks for a token for the signed in user; bots get theirs
+// from their accounts instead.
+type tokenRequest struct {
+	// TTL is a duration such as "720h"; it defaults to defaultTokenTTL.
+	TTL string
+}
+
+// issueTokenHandler lets a signed in user create a token for their scripts:
+//
+//	POST /api/tokens  {"TTL": "720h"}  ->  {"Token": "...", "Expires": "..."}
+func issueTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := bearerToken(r); ok {
+		// otherwise a token could be used to renew itself forever
+		http.Error(w, "tokens can only be issued to signed in users", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl, err := tokenTTL(req.TTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := issueToken(currentUser(r), ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"Token": token, "Expires": time.Now().Add(ttl)})
+}
+
+// tokenTTL parses how long a token is asked to last, defaultTokenTTL if s
+// is empty.
+func tokenTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultTokenTTL, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 || ttl > maxTokenTTL {
+		return 0, errors.New("TTL must be a positive duration of at most " + maxTokenTTL.String())
+	}
+	return ttl, nil
+}
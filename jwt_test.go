@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestTokenRoundTrip(t *testing.T) {
+	token, err := issueToken(objx.New(map[string]interface{}{"userid": "abc", "name": "Ann"}), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := readToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Get("userid").Str() != "abc" || user.Get("name").Str() != "Ann" {
+		t.Errorf("unexpected user %v", user)
+	}
+
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","exp":9999999999}`))
+	expired, _ := issueToken(objx.New(map[string]interface{}{"userid": "abc"}), -time.Second)
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"x"}`))
+	for name, bad := range map[string]string{
+		"forged claims": parts[0] + "." + forged + "." + parts[2],
+		"expired":       expired,
+		"alg none":      none + "." + parts[1] + ".",
+		"garbage":       "not-a-token",
+	} {
+		if _, err := readToken(bad); err != errBadToken {
+			t.Errorf("%s token should be rejected, got %v", name, err)
+		}
+	}
+}
+
+func TestMustAuthAcceptsBearerToken(t *testing.T) {
+	h := MustAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(currentUser(r).Get("userid").Str()))
+	}))
+	token, _ := issueToken(objx.New(map[string]interface{}{"userid": "bot"}), time.Hour)
+	for auth, want := range map[string]int{
+		"Bearer " + token:       http.StatusOK,
+		"Bearer " + token + "x": http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/room", nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%q: expected %d, got %d", auth, want, w.Code)
+		}
+		if want == http.StatusOK && w.Body.String() != "bot" {
+			t.Errorf("handler should see the token's user, saw %q", w.Body)
+		}
+	}
+}
+
+func TestTokensCannotRenewThemselves(t *testing.T) {
+	token, _ := issueToken(objx.New(map[string]interface{}{"userid": "abc"}), time.Hour)
+	r := httptest.NewRequest(http.MethodPost, "/api/tokens", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	issueTokenHandler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	issueTokenHandler(w, withAuthCookie(http.MethodPost, "/api/tokens", strings.NewReader(`{"TTL":"1h"}`),
+		objx.New(map[string]interface{}{"userid": "abc"})))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Token"`) {
+		t.Errorf("signed in user should get a token, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signingKey is a single HMAC key held by a keyRing.
+type signingKey struct {
+	ID     string
+	Secret []byte `json:",omitempty"`
+	// Adopted keys came from the secrets backend. Their secrets are never
+	// written to disk; a loaded one has none until it is adopted again.
+	Adopted bool `json:",omitempty"`
+	Created time.Time
+	// Retired is when a newer key replaced this one; zero for the current key.
+	Retired time.Time
+}
+
+// keyRing holds every signing key that is still valid. New signatures are
+// always made with the newest key, but signatures made with an older key are
+// accepted until overlap has passed since that key was retired. Rotating the
+// keys therefore does not invalidate anything signed just before the rotation,
+// so nobody is logged out.
+//
+// The ring is kept in a file of one server's own, without the secrets of
+// adopted keys, which stay in the secrets backend. Servers sharing a broker
+// can only agree on their keys through the cookie_signing_key secret, so
+// when shared is set the admin API refuses to rotate them.
+type keyRing struct {
+	mu      sync.RWMutex
+	path    string
+	keys    []*signingKey // newest first
+	overlap time.Duration
+	now     func() time.Time
+	shared  bool
+}
+
+// newKeyRing loads the key ring persisted at path (or keeps it in memory if
+// path is empty), generating a first key if there is none.
+func newKeyRing(path string, overlap time.Duration) (*keyRing, error) {
+	k := &keyRing{path: path, overlap: overlap, now: time.Now}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &k.keys); err != nil {
+				return nil, fmt.Errorf("key ring %s: %w", path, err)
+			}
+		}
+	}
+	if len(k.keys) == 0 {
+		if _, err := k.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// rotate makes a new random key current and retires the previous one.
+func (k *keyRing) rotate() (*signingKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return k.add(secret, false)
+}
+
+// adopt makes secret the current key unless it already is, giving a loaded
+// current key its secret back. It lets keys rotated in the secrets backend
+// take over from the generated ones.
+func (k *keyRing) adopt(secret string) (*signingKey, error) {
+	k.mu.Lock()
+	if len(k.keys) > 0 {
+		current := k.keys[0]
+		if len(current.Secret) == 0 && current.ID == keyID([]byte(secret)) {
+			current.Secret = []byte(secret)
+		}
+		if hmac.Equal(current.Secret, []byte(secret)) {
+			k.mu.Unlock()
+			return current, nil
+		}
+	}
+	k.mu.Unlock()
+	return k.add([]byte(secret), true)
+}
+
+// fallBack makes a new generated key current if the current key was
+// adopted before the ring was loaded and has not been adopted again, as
+// when the secrets backend no longer has it, so nothing is ever signed
+// without a secret.
+func (k *keyRing) fallBack() error {
+	if len(k.current().Secret) > 0 {
+		return nil
+	}
+	_, err := k.rotate()
+	return err
+}
+
+// keyID is the ID of the key with secret.
+func keyID(secret []byte) string {
+	id := sha256.Sum256(secret)
+	return hex.EncodeToString(id[:4])
+}
+
+func (k *keyRing) add(secret []byte, adopted bool) (*signingKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.now()
+	key := &signingKey{ID: keyID(secret), Secret: secret, Adopted: adopted, Created: now}
+	keys := []*signingKey{key}
+	for _, old := range k.keys {
+		if old.Retired.IsZero() {
+			old.Retired = now
+		}
+		if now.Sub(old.Retired) <= k.overlap && old.ID != key.ID {
+			keys = append(keys, old)
+		}
+	}
+	k.keys = keys
+	return key, k.save()
+}
+
+// save writes the keys to disk, leaving out the secrets of adopted keys.
+// The caller must hold k.mu.
+func (k *keyRing) save() error {
+	if k.path == "" {
+		return nil
+	}
+	keys := make([]signingKey, len(k.keys))
+	for i, key := range k.keys {
+		keys[i] = *key
+		if key.Adopted {
+			keys[i].Secret = nil
+		}
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(k.path, data, 0600)
+}
+
+// current returns the key new signatures are made with.
+func (k *keyRing) current() *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[0]
+}
+
+// sign returns a signature for payload in the form "keyid.mac".
+func (k *keyRing) sign(payload []byte) string {
+	key := k.current()
+	return key.ID + "." + base64.RawURLEncoding.EncodeToString(mac(key.Secret, payload))
+}
+
+// verify reports whether sig is a signature of payload made with a key that
+// is current or retired within the overlap window.
+func (k *keyRing) verify(payload []byte, sig string) bool {
+	id, encoded, ok := strings.Cut(sig, ".")
+	if !ok {
+		return false
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.ID != id {
+			continue
+		}
+		if !key.Retired.IsZero() && k.now().Sub(key.Retired) > k.overlap || len(key.Secret) == 0 {
+			return false
+		}
+		return hmac.Equal(sum, mac(key.Secret, payload))
+	}
+	return false
+}
+
+func mac(secret, payload []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// ServeHTTP is the admin API for the key ring:
+//
+//	GET  /admin/keys         list key IDs and their age (never the secrets)
+//	POST /admin/keys/rotate  make a new key current, unless shared
+func (k *keyRing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	type keyInfo struct {
+		ID      string
+		Created time.Time
+		Retired time.Time
+	}
+	switch {
+	case r.Method == http.MethodGet && strings.TrimSuffix(r.URL.Path, "/") == "/admin/keys":
+		k.mu.RLock()
+		infos := make([]keyInfo, 0, len(k.keys))
+		for _, key := range k.keys {
+			infos = append(infos, keyInfo{ID: key.ID, Created: key.Created, Retired: key.Retired})
+		}
+		k.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	case r.Method == http.MethodPost && r.URL.Path == "/admin/keys/rotate":
+		if k.shared {
+			http.Error(w, "the servers share their keys; rotate the cookie_signing_key secret instead", http.StatusConflict)
+			return
+		}
+		key, err := k.rotate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keyInfo{ID: key.ID, Created: key.Created})
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyRingRotationOverlap(t *testing.T) {
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	k, err := newKeyRing(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.now = func() time.Time { return now }
+	payload := []byte("userid=abc")
+	oldSig := k.sign(payload)
+	if !k.verify(payload, oldSig) {
+		t.Fatal("signature should verify with the current key")
+	}
+	if k.verify([]byte("userid=xyz"), oldSig) {
+		t.Error("signature must not verify for a different payload")
+	}
+	if _, err := k.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	newSig := k.sign(payload)
+	if newSig == oldSig {
+		t.Error("rotation should change the signing key")
+	}
+	if !k.verify(payload, oldSig) || !k.verify(payload, newSig) {
+		t.Error("old and new signatures should both verify within the overlap")
+	}
+	// the ring is persisted, so a restart keeps both keys
+	k, err = newKeyRing(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if k.verify(payload, oldSig) {
+		t.Error("retired key should be rejected after the overlap window")
+	}
+	if !k.verify(payload, newSig) {
+		t.Error("current key should still verify after restart")
+	}
+}
+
+func TestKeyRingAdopt(t *testing.T) {
+	k, _ := newKeyRing("", time.Hour)
+	first, _ := k.adopt("from-secrets")
+	again, _ := k.adopt("from-secrets")
+	if first.ID != again.ID || len(k.keys) != 2 {
+		t.Error("adopting the current secret again should not rotate")
+	}
+}
+
+func TestSharedKeyRingRefusesRotation(t *testing.T) {
+	k, _ := newKeyRing("", time.Hour)
+	k.shared = true
+	before := k.current().ID
+	w := httptest.NewRecorder()
+	k.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/keys/rotate", nil))
+	if w.Code != http.StatusConflict || k.current().ID != before {
+		t.Errorf("a shared key ring should not be rotated, got %d", w.Code)
+	}
+}
+
+func TestKeyRingDoesNotPersistAdoptedSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	k, err := newKeyRing(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adopted, err := k.adopt("from-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("userid=abc")
+	sig := k.sign(payload)
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), base64.StdEncoding.EncodeToString([]byte("from-secrets"))) {
+		t.Fatalf("the adopted secret should not be written to disk: %s", data)
+	}
+
+	// after a restart the key is known but unusable until adopted again
+	k, err = newKeyRing(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.current().ID != adopted.ID || k.verify(payload, sig) {
+		t.Fatal("a key without its secret should not verify")
+	}
+	if again, _ := k.adopt("from-secrets"); again.ID != adopted.ID || len(k.keys) != 2 || !k.verify(payload, sig) {
+		t.Error("adopting the secret again should restore the key")
+	}
+
+	// when the secrets backend no longer has it, a new key is generated
+	k, _ = newKeyRing(path, time.Hour)
+	if err := k.fallBack(); err != nil || k.current().ID == adopted.ID || len(k.current().Secret) == 0 {
+		t.Errorf("expected a generated key, got %+v %v", k.current(), err)
+	}
+	if k.verify(payload, sig) {
+		t.Error("the key without its secret should still not verify")
+	}
+}
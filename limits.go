@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// defaultMaxMessage is the longest text, in bytes, a message may have
+// unless configured otherwise.
+const defaultMaxMessage = 64 << 10
+
+// serverLimits are the limits clients and bots must keep to, as the server
+// is running with them. Zero means no limit.
+type serverLimits struct {
+	// MaxMessage is the longest text, in bytes, of a message.
+	MaxMessage int
+	// MaxAttachment is the largest file, in bytes, and MaxAttachments
+	// how many of them one message may have.
+	MaxAttachment  int64
+	MaxAttachments int
+	// MaxAvatar is the largest picture, in bytes, users may upload.
+	MaxAvatar int64
+	// RateLimit is how fast each user and IP address may send messages,
+	// and what happens to those over it.
+	RateLimit rateLimit
+	// Bandwidth is how many bytes a second each user may send and be
+	// sent over their websockets.
+	Bandwidth bandwidthCap
+	// History is how many recent messages are sent on joining a room.
+	History int
+	// MaxTokenTTL is the longest, in seconds, a token may last.
+	MaxTokenTTL int64
+	// Room is how long the history of the room asked about is kept.
+	Room *roomRetention `json:",omitempty"`
+}
+
+// roomRetention says how long a room's messages are kept: until they are
+// deleted, unless the room expires, when it is archived or deleted.
+type roomRetention struct {
+	Name         string
+	Expires      *time.Time `json:",omitempty"`
+	ExpireAction string     `json:",omitempty"`
+}
+
+// limitsAPI tells clients the server's limits, so that they can keep to
+// them, for instance splitting a long paste, rather than find them out
+// from errors:
+//
+//	GET /api/v1/limits              the server's limits
+//	GET /api/v1/limits?room={name}  and how long the room keeps its history
+type limitsAPI struct {
+	rooms       *roomManager
+	attachments *attachmentStore
+	avatars     *avatarStore
+}
+
+func (a *limitsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limits := &serverLimits{
+		MaxMessage:     a.rooms.maxMessage,
+		MaxAttachments: maxAttachmentsPerMessage,
+		RateLimit:      a.rooms.rateLimit,
+		History:        a.rooms.historySize,
+		MaxTokenTTL:    int64(maxTokenTTL.Seconds()),
+	}
+	if a.rooms.bandwidth != nil {
+		limits.Bandwidth = a.rooms.bandwidth.limit
+	}
+	if a.attachments != nil {
+		limits.MaxAttachment = a.attachments.maxSize
+	}
+	if a.avatars != nil {
+		limits.MaxAvatar = a.avatars.maxSize
+	}
+	if name := r.URL.Query().Get("room"); name != "" {
+		ok, err := canEnter(a.rooms.state, name, currentUser(r))
+		if err != nil || !ok || !validRoomName(name) {
+			http.Error(w, "no such room", http.StatusNotFound)
+			return
+		}
+		settings, err := loadRoomSettings(a.rooms.state, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		limits.Room = &roomRetention{Name: name}
+		if e := settings.Expiry; e != nil && !settings.Archived {
+			at := e.expiresAt(settings.Created, lastActive(a.rooms.store, settings))
+			limits.Room.Expires = &at
+			limits.Room.ExpireAction = e.Action
+			if e.Action == "" {
+				limits.Room.ExpireAction = expireArchive
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestLimits(t *testing.T) {
+	rooms := newRoomManager()
+	rooms.rateLimit = rateLimit{Rate: 2, Burst: 10, Policy: rateLimitDelay}
+	rooms.bandwidth = newBandwidthMeter(bandwidthCap{Rate: 1 << 20})
+	api := &limitsAPI{rooms: rooms, attachments: &attachmentStore{maxSize: defaultMaxAttachment}, avatars: newAvatarStore(nil, rooms.state)}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	get := func(path string) (*httptest.ResponseRecorder, serverLimits) {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(http.MethodGet, path, nil, ann))
+		var limits serverLimits
+		json.NewDecoder(w.Body).Decode(&limits)
+		return w, limits
+	}
+
+	w, limits := get("/api/v1/limits")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if limits.MaxMessage != defaultMaxMessage || limits.MaxAttachment != defaultMaxAttachment || limits.MaxAttachments != maxAttachmentsPerMessage ||
+		limits.MaxAvatar != defaultMaxAvatar || limits.RateLimit != rooms.rateLimit || limits.Bandwidth.Burst != 1<<20 ||
+		limits.History != defaultHistorySize || limits.MaxTokenTTL != int64(maxTokenTTL.Seconds()) || limits.Room != nil {
+		t.Errorf("unexpected limits %+v", limits)
+	}
+
+	settings, err := createRoom(rooms.state, rooms, "inc-1", "ann", false, &roomExpiry{Action: expireDelete, TTL: 3600}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, limits = get("/api/v1/limits?room=inc-1")
+	if limits.Room == nil || limits.Room.ExpireAction != expireDelete || !limits.Room.Expires.Equal(settings.Created.Add(time.Hour)) {
+		t.Errorf("unexpected room retention %+v", limits.Room)
+	}
+	_, limits = get("/api/v1/limits?room=golang")
+	if limits.Room == nil || limits.Room.Name != "golang" || limits.Room.Expires != nil {
+		t.Errorf("a room that does not expire keeps its history, got %+v", limits.Room)
+	}
+	createRoom(rooms.state, rooms, "secret", "bob", true, nil, nil)
+	if w, _ := get("/api/v1/limits?room=secret"); w.Code != http.StatusNotFound {
+		t.Errorf("a private room ann is not in should be 404, got %d", w.Code)
+	}
+}
+
+func TestMessagesOverTheLimitAreRefused(t *testing.T) {
+	rooms := newRoomManager()
+	rooms.maxMessage = 10
+	server := httptest.NewServer(rooms.get("golang"))
+	defer server.Close()
+	conn := dialRoom(t, server, objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"}))
+	conn.WriteJSON(&message{Message: strings.Repeat("a", 11)})
+	conn.WriteJSON(&message{Message: strings.Repeat("b", 10)})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var got []string
+	for len(got) < 2 {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == msgTypeNotice || msg.Type == msgTypeMessage {
+			got = append(got, msg.Type+": "+msg.Message)
+		}
+	}
+	if got[0] != "notice: Messages may be at most 10 bytes; send a longer text in parts or as an attachment." || got[1] != "message: bbbbbbbbbb" {
+		t.Errorf("unexpected messages %q", got)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	gomniauthcommon "github.com/stretchr/gomniauth/common"
+)
+
+// providerIcons are the icons the login page shows next to the providers
+// that have one.
+var providerIcons = map[string]string{
+	"facebook": "https://cdn.simpleicons.org/facebook",
+	"github":   "https://cdn.simpleicons.org/github",
+	"google":   "https://cdn.simpleicons.org/google",
+	"gitlab":   "https://cdn.simpleicons.org/gitlab",
+	"discord":  "https://cdn.simpleicons.org/discord",
+}
+
+// oidcIcon is the icon of the oidc login provider, set with -oidc-icon.
+var oidcIcon string
+
+// loginOption is a login provider on the login page.
+type loginOption struct {
+	Name        string
+	DisplayName string
+	Icon        string
+	// Down, if set, explains why the provider can't be used right now.
+	Down string
+	// Last marks the provider the user signed in with last time.
+	Last bool
+}
+
+// loginOptions are the login providers that have credentials, in the order
+// setupAuth configured them, guarded by loginOptionsMu.
+var (
+	loginOptionsMu sync.Mutex
+	loginOptions   []loginOption
+)
+
+// setLoginOptions makes the providers that have a client ID and secret in
+// secrets the ones the login page offers.
+func setLoginOptions(providers []gomniauthcommon.Provider, secrets SecretSource) {
+	var options []loginOption
+	for _, p := range providers {
+		id, idErr := secrets.Secret(p.Name() + "_client_id")
+		secret, secretErr := secrets.Secret(p.Name() + "_client_sec")
+		if idErr != nil || secretErr != nil || id == "" || secret == "" {
+			continue
+		}
+		icon := providerIcons[p.Name()]
+		if p.Name() == "oidc" {
+			icon = oidcIcon
+		}
+		options = append(options, loginOption{Name: p.Name(), DisplayName: p.DisplayName(), Icon: icon})
+	}
+	loginOptionsMu.Lock()
+	defer loginOptionsMu.Unlock()
+	loginOptions = options
+}
+
+// loginPageOptions returns the providers the login page offers to the user
+// making r, with those that are down explained and the one they used last
+// marked.
+func loginPageOptions(r *http.Request) []loginOption {
+	loginOptionsMu.Lock()
+	options := append([]loginOption(nil), loginOptions...)
+	loginOptionsMu.Unlock()
+	down := loginHealth.downProviders()
+	last := lastProvider(r)
+	for i := range options {
+		options[i].Down = down[options[i].Name]
+		options[i].Last = options[i].Name == last
+	}
+	return options
+}
+
+// providerCookie keeps the login provider a browser last signed in with.
+const providerCookie = "provider"
+
+// rememberProvider keeps provider as the one the browser signed in with
+// last, for a year.
+func rememberProvider(w http.ResponseWriter, provider string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     providerCookie,
+		Value:    provider,
+		Path:     "/",
+		Expires:  time.Now().Add(365 * 24 * time.Hour),
+		HttpOnly: true,
+	})
+}
+
+// lastProvider returns the login provider the browser making r signed in
+// with last, if any.
+func lastProvider(r *http.Request) string {
+	c, err := r.Cookie(providerCookie)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// loginPage serves the login page, GET /login. /login?provider={name}
+// goes straight to signing in with the named provider, if the page offers
+// it and it is up.
+type loginPage struct {
+	page http.Handler
+}
+
+func (p *loginPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if name := r.URL.Query().Get("provider"); name != "" {
+		for _, option := range loginPageOptions(r) {
+			if option.Name == name && option.Down == "" {
+				http.Redirect(w, r, "/auth/login/"+name, http.StatusTemporaryRedirect)
+				return
+			}
+		}
+	}
+	p.page.ServeHTTP(w, r)
+}
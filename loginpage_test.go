@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gomniauthcommon "github.com/stretchr/gomniauth/common"
+)
+
+func TestLoginPageOptions(t *testing.T) {
+	defer func(options []loginOption, health *providerHealth) {
+		loginOptions, loginHealth = options, health
+	}(loginOptions, loginHealth)
+	loginHealth = newProviderHealth()
+	gitlab := newOAuthProvider(gitlabEndpoints("https://gitlab.com"), "", "", "")
+	discord := newOAuthProvider(discordEndpoints(), "", "", "")
+	sso := newOAuthProvider(oauthEndpoints{name: "oidc", displayName: "Acme SSO"}, "", "", "")
+	setLoginOptions([]gomniauthcommon.Provider{gitlab, discord, sso}, mapSecrets{
+		"gitlab_client_id": "id", "gitlab_client_sec": "sec",
+		"discord_client_id": "id",
+		"oidc_client_id":    "id", "oidc_client_sec": "sec",
+	})
+	for i := 0; i < providerFailureThreshold; i++ {
+		loginHealth.record(sso, time.Second, errors.New("timeout"))
+	}
+
+	w := httptest.NewRecorder()
+	(&templateHandler{filename: "login.html"}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	page := w.Body.String()
+	if !strings.Contains(page, `href="/auth/login/gitlab"`) || !strings.Contains(page, "https://cdn.simpleicons.org/gitlab") {
+		t.Errorf("the page should link to GitLab with its icon:\n%s", page)
+	}
+	if strings.Contains(page, "/auth/login/discord") {
+		t.Error("a provider without its secret should not be offered")
+	}
+	if strings.Contains(page, "/auth/login/oidc") || !strings.Contains(page, "Signing in with Acme SSO is not working") {
+		t.Error("a provider that is down should be explained instead of linked")
+	}
+
+	setLoginOptions(nil, mapSecrets{})
+	w = httptest.NewRecorder()
+	(&templateHandler{filename: "login.html"}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if !strings.Contains(w.Body.String(), "No way to sign in has been set up") {
+		t.Errorf("expected the page to say no provider is set up:\n%s", w.Body)
+	}
+}
+
+func TestLoginProviderPreference(t *testing.T) {
+	defer func(options []loginOption) { loginOptions = options }(loginOptions)
+	gitlab := newOAuthProvider(gitlabEndpoints("https://gitlab.com"), "", "", "")
+	discord := newOAuthProvider(discordEndpoints(), "", "", "")
+	setLoginOptions([]gomniauthcommon.Provider{gitlab, discord}, mapSecrets{
+		"gitlab_client_id": "id", "gitlab_client_sec": "sec",
+		"discord_client_id": "id", "discord_client_sec": "sec",
+	})
+	page := &loginPage{page: &templateHandler{filename: "login.html"}}
+
+	w := httptest.NewRecorder()
+	rememberProvider(w, "discord")
+	r := httptest.NewRequest(http.MethodGet, "/login", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	w = httptest.NewRecorder()
+	page.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "Discord</a>\n          <span class=\"text-muted\">(you used this last time)") {
+		t.Errorf("the provider used last should be marked:\n%s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	page.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login?provider=gitlab", nil))
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/auth/login/gitlab" {
+		t.Errorf("expected a redirect to sign in with GitLab, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	w = httptest.NewRecorder()
+	page.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login?provider=facebook", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("a provider the page doesn't offer should show the page, got %d", w.Code)
+	}
+}
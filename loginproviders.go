@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stretchr/gomniauth"
+	gomniauthcommon "github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/gomniauth/oauth2"
+	"github.com/stretchr/objx"
+)
+
+// gitlabURL is the GitLab the gitlab login provider signs users in with,
+// gitlab.com or a self-managed one; it is set with -gitlab-url.
+var gitlabURL = "https://gitlab.com"
+
+// microsoftTenant is the Microsoft Entra tenant the microsoft login provider
+// accepts accounts of: "common" for any work, school or personal account,
+// "organizations", "consumers" or a tenant ID. It is set with
+// -microsoft-tenant.
+var microsoftTenant = "common"
+
+// oauthEndpoints describes an OAuth2 login provider gomniauth has no
+// package for: where users authorize the server, where it gets a token, and
+// the profile it reads with the token.
+type oauthEndpoints struct {
+	name        string
+	displayName string
+	authURL     string
+	tokenURL    string
+	profileURL  string
+	scope       string
+	// profile maps the provider's profile to the fields of oauthUser.
+	profile func(data objx.Map) oauthProfile
+}
+
+// oauthProfile is what the server needs from a provider's profile.
+// emailVerified is whether the provider vouches that email is the user's;
+// users whose email it doesn't are known by their id with the provider
+// instead.
+type oauthProfile struct {
+	id, name, nickname, email, avatarURL string
+	emailVerified                        bool
+}
+
+// gitlabEndpoints are GitLab's, on gitlab.com or the instance at base.
+func gitlabEndpoints(base string) oauthEndpoints {
+	base = strings.TrimSuffix(base, "/")
+	return oauthEndpoints{
+		name:        "gitlab",
+		displayName: "GitLab",
+		authURL:     base + "/oauth/authorize",
+		tokenURL:    base + "/oauth/token",
+		profileURL:  base + "/api/v4/user",
+		scope:       "read_user",
+		profile: func(data objx.Map) oauthProfile {
+			// GitLab only lets a confirmed address be the primary one
+			return oauthProfile{id: profileID(data.Get("id").Data()), name: data.Get("name").Str(),
+				nickname: data.Get("username").Str(), email: data.Get("email").Str(), avatarURL: data.Get("avatar_url").Str(),
+				emailVerified: true}
+		},
+	}
+}
+
+// discordEndpoints are Discord's. Its profile has the hash of the user's
+// avatar rather than its URL, and says whether the email was verified.
+func discordEndpoints() oauthEndpoints {
+	return oauthEndpoints{
+		name:        "discord",
+		displayName: "Discord",
+		authURL:     "https://discord.com/oauth2/authorize",
+		tokenURL:    "https://discord.com/api/oauth2/token",
+		profileURL:  "https://discord.com/api/users/@me",
+		scope:       "identify email",
+		profile: func(data objx.Map) oauthProfile {
+			p := oauthProfile{id: data.Get("id").Str(), name: data.Get("global_name").Str(),
+				nickname: data.Get("username").Str(), email: data.Get("email").Str(), emailVerified: data.Get("verified").Bool()}
+			if p.name == "" {
+				p.name = p.nickname
+			}
+			if hash := data.Get("avatar").Str(); hash != "" && p.id != "" {
+				p.avatarURL = "https://cdn.discordapp.com/avatars/" + p.id + "/" + hash + ".png"
+			}
+			return p
+		},
+	}
+}
+
+// microsoftEndpoints are those of the Microsoft identity platform for
+// tenant, with the profile read from Microsoft Graph. Graph has no URL for
+// the user's photo that a browser could load, so users get another avatar.
+// The mail and sign-in address of an account are whatever its tenant's
+// admins made them, so they are only trusted when tenant is a single,
+// known one rather than common, organizations or consumers.
+func microsoftEndpoints(tenant string) oauthEndpoints {
+	shared := tenant == "common" || tenant == "organizations" || tenant == "consumers"
+	base := "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0"
+	return oauthEndpoints{
+		name:        "microsoft",
+		displayName: "Microsoft",
+		authURL:     base + "/authorize",
+		tokenURL:    base + "/token",
+		profileURL:  "https://graph.microsoft.com/v1.0/me",
+		scope:       "User.Read",
+		profile: func(data objx.Map) oauthProfile {
+			p := oauthProfile{id: data.Get("id").Str(), name: data.Get("displayName").Str(),
+				nickname: data.Get("userPrincipalName").Str(), email: data.Get("mail").Str(), emailVerified: !shared}
+			if p.email == "" {
+				// accounts without a mailbox sign in with an address
+				p.email = p.nickname
+			}
+			return p
+		},
+	}
+}
+
+// profileID formats a profile ID, which JSON decodes as a number for some
+// providers.
+func profileID(id interface{}) string {
+	switch id := id.(type) {
+	case string:
+		return id
+	case float64:
+		return strconv.FormatFloat(id, 'f', 0, 64)
+	}
+	return ""
+}
+
+// oauthProvider is a gomniauth provider for the OAuth2 login provider its
+// endpoints describe.
+type oauthProvider struct {
+	endpoints      oauthEndpoints
+	config         *gomniauthcommon.Config
+	tripperFactory gomniauthcommon.TripperFactory
+}
+
+func newOAuthProvider(endpoints oauthEndpoints, clientID, clientSecret, redirectURL string) *oauthProvider {
+	return &oauthProvider{endpoints: endpoints, config: &gomniauthcommon.Config{Map: objx.MSI(
+		oauth2.OAuth2KeyAuthURL, endpoints.authURL,
+		oauth2.OAuth2KeyTokenURL, endpoints.tokenURL,
+		oauth2.OAuth2KeyClientID, clientID,
+		oauth2.OAuth2KeySecret, clientSecret,
+		oauth2.OAuth2KeyRedirectUrl, redirectURL,
+		oauth2.OAuth2KeyScope, endpoints.scope,
+		oauth2.OAuth2KeyAccessType, oauth2.OAuth2AccessTypeOnline,
+		oauth2.OAuth2KeyApprovalPrompt, oauth2.OAuth2ApprovalPromptAuto,
+		oauth2.OAuth2KeyResponseType, oauth2.OAuth2KeyCode)}}
+}
+
+func (p *oauthProvider) TripperFactory() gomniauthcommon.TripperFactory {
+	if p.tripperFactory == nil {
+		p.tripperFactory = new(oauth2.OAuth2TripperFactory)
+	}
+	return p.tripperFactory
+}
+
+func (p *oauthProvider) PublicData(options map[string]interface{}) (interface{}, error) {
+	return gomniauth.ProviderPublicData(p, options)
+}
+
+func (p *oauthProvider) Name() string {
+	return p.endpoints.name
+}
+
+func (p *oauthProvider) DisplayName() string {
+	return p.endpoints.displayName
+}
+
+func (p *oauthProvider) GetBeginAuthURL(state *gomniauthcommon.State, options objx.Map) (string, error) {
+	return oauth2.GetBeginAuthURLWithBase(p.endpoints.authURL, state, p.config)
+}
+
+func (p *oauthProvider) CompleteAuth(data objx.Map) (*gomniauthcommon.Credentials, error) {
+	return oauth2.CompleteAuth(p.TripperFactory(), data, p.config, p)
+}
+
+func (p *oauthProvider) Get(creds *gomniauthcommon.Credentials, endpoint string) (objx.Map, error) {
+	return oauth2.Get(p, creds, endpoint)
+}
+
+func (p *oauthProvider) GetClient(creds *gomniauthcommon.Credentials) (*http.Client, error) {
+	return oauth2.GetClient(p.TripperFactory(), creds, p)
+}
+
+// GetUser reads the profile of the user creds were issued for.
+func (p *oauthProvider) GetUser(creds *gomniauthcommon.Credentials) (gomniauthcommon.User, error) {
+	data, err := p.Get(creds, p.endpoints.profileURL)
+	if err != nil {
+		return nil, err
+	}
+	profile := p.endpoints.profile(data)
+	creds.Set(gomniauthcommon.CredentialsKeyID, profile.id)
+	data[gomniauthcommon.UserKeyProviderCredentials] = map[string]*gomniauthcommon.Credentials{p.Name(): creds}
+	return &oauthUser{profile: profile, data: data}, nil
+}
+
+// oauthUser is a user signed in through an oauthProvider.
+type oauthUser struct {
+	profile oauthProfile
+	data    objx.Map
+}
+
+func (u *oauthUser) Email() string       { return u.profile.email }
+func (u *oauthUser) EmailVerified() bool { return u.profile.emailVerified }
+func (u *oauthUser) Name() string        { return u.profile.name }
+func (u *oauthUser) Nickname() string    { return u.profile.nickname }
+func (u *oauthUser) AvatarURL() string   { return u.profile.avatarURL }
+func (u *oauthUser) AuthCode() string    { return u.data.Get(gomniauthcommon.UserKeyAuthCode).Str() }
+func (u *oauthUser) Data() objx.Map      { return u.data }
+
+func (u *oauthUser) ProviderCredentials() map[string]*gomniauthcommon.Credentials {
+	creds, _ := u.data.Get(gomniauthcommon.UserKeyProviderCredentials).Data().(map[string]*gomniauthcommon.Credentials)
+	return creds
+}
+
+func (u *oauthUser) IDForProvider(provider string) string {
+	if creds := u.ProviderCredentials()[provider]; creds != nil {
+		return profileID(creds.Get(gomniauthcommon.CredentialsKeyID).Data())
+	}
+	return ""
+}
+
+// oidcIssuer is the OpenID Connect provider users may sign in with as the
+// oidc login provider, such as Keycloak, Okta or Auth0, and oidcName what
+// the login page calls it. The provider is left out unless oidcIssuer is set
+// with -oidc-issuer.
+var (
+	oidcIssuer string
+	oidcName   = "Single sign-on"
+	oidcClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// discoverOIDC reads the endpoints of the OpenID Connect provider issuer
+// from its discovery document. Users are read from its userinfo endpoint
+// with the access token, so no ID token needs verifying; their email is
+// only trusted if it says email_verified.
+func discoverOIDC(client *http.Client, issuer, displayName string) (oauthEndpoints, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	resp, err := client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return oauthEndpoints{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return oauthEndpoints{}, fmt.Errorf("%s: discovery answered %s", issuer, resp.Status)
+	}
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return oauthEndpoints{}, fmt.Errorf("%s: discovery: %w", issuer, err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		// the document must be the issuer's own
+		return oauthEndpoints{}, fmt.Errorf("%s: discovery is for issuer %q", issuer, doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.UserinfoEndpoint == "" {
+		return oauthEndpoints{}, fmt.Errorf("%s: discovery lacks the authorization, token or userinfo endpoint", issuer)
+	}
+	return oauthEndpoints{
+		name:        "oidc",
+		displayName: displayName,
+		authURL:     doc.AuthorizationEndpoint,
+		tokenURL:    doc.TokenEndpoint,
+		profileURL:  doc.UserinfoEndpoint,
+		scope:       "openid profile email",
+		profile: func(data objx.Map) oauthProfile {
+			p := oauthProfile{id: data.Get("sub").Str(), name: data.Get("name").Str(),
+				nickname: data.Get("preferred_username").Str(), email: data.Get("email").Str(), avatarURL: data.Get("picture").Str(),
+				emailVerified: data.Get("email_verified").Bool()}
+			if p.name == "" {
+				p.name = p.nickname
+			}
+			return p
+		},
+	}, nil
+}
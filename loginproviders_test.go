@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gomniauthcommon "github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/objx"
+)
+
+func TestGitLabProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/oauth/token":
+			if r.PostFormValue("code") != "the-code" || r.PostFormValue("client_id") != "id" {
+				http.Error(w, "bad grant", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"access_token": "the-token", "token_type": "Bearer"}`))
+		case "/api/v4/user":
+			if r.Header.Get("Authorization") != "Bearer the-token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"id": 42, "name": "Ann Lee", "username": "ann", "email": "ann@example.com", "avatar_url": "https://gitlab.example.com/ann.png"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	p := newOAuthProvider(gitlabEndpoints(server.URL+"/"), "id", "secret", "https://chat.example.com/auth/callback/gitlab")
+
+	begin, err := p.GetBeginAuthURL(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(begin, server.URL+"/oauth/authorize?") || !strings.Contains(begin, "client_id=id") || !strings.Contains(begin, "scope=read_user") {
+		t.Errorf("unexpected authorize URL %s", begin)
+	}
+	creds, err := p.CompleteAuth(objx.MSI("code", "the-code"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := p.GetUser(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email() != "ann@example.com" || user.Name() != "Ann Lee" || user.Nickname() != "ann" ||
+		user.AvatarURL() != "https://gitlab.example.com/ann.png" || user.IDForProvider("gitlab") != "42" {
+		t.Errorf("unexpected user %+v", user)
+	}
+}
+
+func TestProviderProfiles(t *testing.T) {
+	discord := discordEndpoints().profile(objx.MSI("id", "80351110224678912", "username", "nelly", "avatar", "8342729096ea3675442027381ff50dfe", "email", "nelly@example.com"))
+	if discord.name != "nelly" || discord.avatarURL != "https://cdn.discordapp.com/avatars/80351110224678912/8342729096ea3675442027381ff50dfe.png" {
+		t.Errorf("unexpected Discord profile %+v", discord)
+	}
+	if discord.emailVerified {
+		t.Error("a Discord email is only verified if the profile says so")
+	}
+	if discord := discordEndpoints().profile(objx.MSI("id", "1", "email", "nelly@example.com", "verified", true)); !discord.emailVerified {
+		t.Error("expected a verified Discord email")
+	}
+	microsoft := microsoftEndpoints("consumers").profile(objx.MSI("id", "abc", "displayName", "Bo Chen", "userPrincipalName", "bo@example.com"))
+	if microsoft.name != "Bo Chen" || microsoft.email != "bo@example.com" {
+		t.Errorf("a Microsoft account without a mailbox should use its sign-in address, got %+v", microsoft)
+	}
+	if microsoft.emailVerified {
+		t.Error("addresses from a shared Microsoft tenant should not be trusted")
+	}
+	if microsoft := microsoftEndpoints("0f3d1c4e-tenant").profile(objx.MSI("id", "abc", "mail", "bo@example.com")); !microsoft.emailVerified {
+		t.Error("addresses from a single Microsoft tenant should be trusted")
+	}
+	if got := microsoftEndpoints("consumers").authURL; got != "https://login.microsoftonline.com/consumers/oauth2/v2.0/authorize" {
+		t.Errorf("unexpected Microsoft authorize URL %s", got)
+	}
+}
+
+func TestUserIdentity(t *testing.T) {
+	user := func(email string, verified bool, id string) *oauthUser {
+		creds := &gomniauthcommon.Credentials{Map: objx.MSI()}
+		creds.Set(gomniauthcommon.CredentialsKeyID, id)
+		return &oauthUser{profile: oauthProfile{id: id, email: email, emailVerified: verified},
+			data: objx.MSI(gomniauthcommon.UserKeyProviderCredentials, map[string]*gomniauthcommon.Credentials{"discord": creds})}
+	}
+	verified, verifiedEmail, err := userIdentity("discord", user("Nelly@example.com", true, "1"))
+	if err != nil || verifiedEmail != "Nelly@example.com" {
+		t.Fatalf("unexpected identity %q %q %v", verified, verifiedEmail, err)
+	}
+	if other, _, _ := userIdentity("github", user("nelly@example.com", true, "2")); other != verified {
+		t.Error("a verified address should be the same user whichever provider vouches for it")
+	}
+	unverified, email, err := userIdentity("discord", user("nelly@example.com", false, "1"))
+	if err != nil || unverified == verified || email != "" {
+		t.Errorf("an unverified address should be neither the userid nor the email, got %q %q %v", unverified, email, err)
+	}
+	if other, _, _ := userIdentity("discord", user("", false, "3")); other == unverified {
+		t.Error("users without an address should not share a userid")
+	}
+	if _, _, err := userIdentity("discord", user("", false, "")); err != errNoIdentity {
+		t.Errorf("expected errNoIdentity, got %v", err)
+	}
+}
+
+func TestDiscoverOIDC(t *testing.T) {
+	var issuer string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/realms/chat/.well-known/openid-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"issuer": "` + issuer + `", "authorization_endpoint": "` + issuer + `/auth",
+			"token_endpoint": "` + issuer + `/token", "userinfo_endpoint": "` + issuer + `/userinfo"}`))
+	}))
+	defer server.Close()
+	issuer = server.URL + "/realms/chat"
+
+	endpoints, err := discoverOIDC(server.Client(), issuer+"/", "Keycloak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoints.name != "oidc" || endpoints.displayName != "Keycloak" || endpoints.authURL != issuer+"/auth" ||
+		endpoints.tokenURL != issuer+"/token" || endpoints.profileURL != issuer+"/userinfo" || !strings.Contains(endpoints.scope, "openid") {
+		t.Errorf("unexpected endpoints %+v", endpoints)
+	}
+	profile := endpoints.profile(objx.MSI("sub", "f1e2", "preferred_username", "ann", "email", "ann@example.com", "picture", "https://sso.example.com/ann.png"))
+	if profile.id != "f1e2" || profile.name != "ann" || profile.email != "ann@example.com" || profile.avatarURL != "https://sso.example.com/ann.png" || profile.emailVerified {
+		t.Errorf("unexpected profile %+v", profile)
+	}
+	if profile := endpoints.profile(objx.MSI("sub", "f1e2", "email", "ann@example.com", "email_verified", true)); !profile.emailVerified {
+		t.Error("expected a verified email")
+	}
+
+	if _, err := discoverOIDC(server.Client(), server.URL+"/realms/other", "Keycloak"); err == nil {
+		t.Error("expected an error for an issuer without a discovery document")
+	}
+	// a document naming another issuer is not trusted
+	issuer = "https://evil.example.com"
+	if _, err := discoverOIDC(server.Client(), server.URL+"/realms/chat", "Keycloak"); err == nil || !strings.Contains(err.Error(), "evil") {
+		t.Errorf("expected the issuer mismatch to be refused, got %v", err)
+	}
+}
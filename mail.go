@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// mailMessage is the payload of "email" deliveries; the delivery's Target
+// is the address it goes to.
+type mailMessage struct {
+	Subject string
+	Body    string
+}
+
+// smtpMailer delivers "email" deliveries through the SMTP server at addr.
+// If the smtp_credentials secret is set, "user:password", it signs in with
+// them.
+type smtpMailer struct {
+	addr    string
+	from    string
+	secrets SecretSource
+}
+
+func (m *smtpMailer) Deliver(d *delivery) error {
+	var msg mailMessage
+	if err := json.Unmarshal(d.Payload, &msg); err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if creds, err := m.secrets.Secret("smtp_credentials"); err == nil {
+		host, _, _ := net.SplitHostPort(m.addr)
+		user, password, _ := strings.Cut(creds, ":")
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{d.Target}, formatMail(m.from, d.Target, &msg, time.Now()))
+}
+
+// formatMail renders msg as a plain text email. The subject is encoded,
+// which also keeps line breaks in it from adding headers.
+func formatMail(from, to string, msg *mailMessage, now time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return b.Bytes()
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatMail(t *testing.T) {
+	msg := formatMail("chat@example.com", "bob@example.com", &mailMessage{Subject: "Hi\r\nBcc: eve@example.com", Body: "line 1\nline 2"}, time.Now())
+	headers, body, _ := strings.Cut(string(msg), "\r\n\r\n")
+	if strings.Contains(headers, "\r\nBcc:") {
+		t.Errorf("a line break in the subject should not add a header:\n%s", headers)
+	}
+	if body != "line 1\r\nline 2" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
@@ -1,29 +1,34 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
-	"github.com/stretchr/gomniauth"
-	"github.com/stretchr/gomniauth/providers/facebook"
-	"github.com/stretchr/gomniauth/providers/github"
-	"github.com/stretchr/gomniauth/providers/google"
-	"github.com/stretchr/objx"
-
+	"github.com/law-lee/chat_server/config"
 	"github.com/law-lee/chat_server/trace"
 )
 
-// set the active Avatar implementation
+// set the active Avatar implementation; main replaces it with the chain
+// -avatar-providers names
 var avatars Avatar = TryAvatars{
 	UseFileSystemAvatar,
 	UseAuthAvatar,
 	UseGravatar}
 
+// templatesDir is where the HTML templates are read from.
+var templatesDir = "templates"
+
 // templateHandler represents a single template
 type templateHandler struct {
 	once     sync.Once
@@ -36,73 +41,545 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	t.once.Do(func() {
 		t.templ = template.Must(
 			template.ParseFiles(
-				filepath.Join("templates", t.filename)))
+				filepath.Join(templatesDir, t.filename)))
 	})
 	//Instead of just passing the entire http.Request object to our template as data, we are
 	//creating a new map[string]interface{} definition for a data object that potentially has
 	//two fields: Host and UserData
 	data := map[string]interface{}{
-		"Host": r.Host,
+		"Host":      r.Host,
+		"CSRFToken": csrfToken(w, r),
+	}
+	if strings.HasPrefix(r.URL.Path, "/chat") {
+		data["Room"] = roomFromPath("/chat", r.URL.Path)
 	}
-	if authCookie, err := r.Cookie("auth"); err == nil {
-		data["UserData"] = objx.MustFromBase64(authCookie.Value)
+	if t.filename == "login.html" {
+		data["Providers"] = loginPageOptions(r)
+		data["Guests"] = guestsAllowed
 	}
-	t.templ.Execute(w, data)
+	if userData, err := readAuthCookie(r); err == nil {
+		data["UserData"] = userData
+	}
+	start := time.Now()
+	err := t.templ.Execute(w, data)
+	serverMetrics.observeRender(t.filename, time.Since(start), err)
 }
 
 func main() {
+	var configFile = flag.String("config", os.Getenv("CHAT_CONFIG"), "TOML file of settings, keyed by flag name; CHAT_<FLAG> environment variables and flags override it.")
 	var addr = flag.String("addr", ":8080", "The addr of the application.")
+	var adminList = flag.String("admins", "", "Comma separated emails of admin users.")
+	var dataDir = flag.String("data", "data", "Directory for persistent server state.")
+	var secretsSpec = flag.String("secrets", "env", "Secrets backend: env, file:<path> or vault:<mount>/<path>.")
+	var storeSpec = flag.String("store", "memory", "Message store: memory, sqlite:<path> or postgres:<dsn>.")
+	var encrypt = flag.Bool("encrypt", false, "Encrypt stored message bodies and attachments with per-room data keys wrapped by the data_master_key secret.")
+	var historySize = flag.Int("history", defaultHistorySize, "How many recent messages are sent to clients when they join a room.")
+	var sessionSpec = flag.String("sessions", "memory", "Session store: memory or redis://host:port.")
+	flag.DurationVar(&sessionTTL, "session-ttl", defaultSessionTTL, "How long users stay signed in.")
+	var expandersFile = flag.String("expanders", "", "JSON file of rules that link issue references such as PROJ-123 in messages.")
+	var moderationFile = flag.String("moderation", "", "JSON file of word filter and pattern rules messages are moderated with.")
+	var rate = flag.Float64("rate", 2, "Messages per second each user may send; 0 for no limit.")
+	var burst = flag.Int("burst", 10, "Messages a user may send at once before -rate applies.")
+	var ipRate = flag.Float64("ip-rate", 0, "Messages per second each IP address may send; 0 for no limit.")
+	var ipBurst = flag.Int("ip-burst", 50, "Messages an IP address may send at once before -ip-rate applies.")
+	var botRate = flag.Float64("bot-rate", 1, "Messages per second each bot may send, instead of -rate; 0 for no limit.")
+	var botBurst = flag.Int("bot-burst", 5, "Messages a bot may send at once before -bot-rate applies.")
+	var bandwidthRate = flag.Int64("bandwidth", 0, "Bytes per second each user may send, and be sent, over websockets on this server; 0 for no limit.")
+	var bandwidthBurst = flag.Int64("bandwidth-burst", 0, "Bytes a user may send or be sent at once before -bandwidth applies; at least -bandwidth.")
+	var limiterSpec = flag.String("rate-limiter", "memory", "Where rate limits are kept: memory, or redis://host:port to share them between servers.")
+	flag.StringVar(&realIPHeader, "real-ip-header", "", "Header a trusted proxy puts the client address in, e.g. X-Real-IP.")
+	var ratePolicy = flag.String("rate-policy", rateLimitDrop, "What to do with messages over the rate limit: drop, delay or disconnect.")
+	var brokerSpec = flag.String("broker", "", "Broker shared with other servers hosting the same rooms, e.g. redis://localhost:6379.")
+	var keyOverlap = flag.Duration("key-overlap", 24*time.Hour, "How long signatures made with a rotated-out key stay valid.")
+	var maxMessage = flag.Int("max-message", defaultMaxMessage, "Longest text, in bytes, of a message users send; 0 for no limit.")
+	var maxAttachment = flag.Int64("max-attachment", defaultMaxAttachment, "Largest file, in bytes, users may attach to messages.")
+	var maxAvatar = flag.Int64("max-avatar", defaultMaxAvatar, "Largest picture, in bytes, users may upload as their avatar.")
+	var metering = flag.Bool("metering", false, "Meter messages, storage and seats per workspace (email domain) and enforce quotas.")
+	var usageReporters = flag.String("usage-report", "", "Comma separated places usage is reported to hourly: log, or URLs it is POSTed to.")
+	var pushURL = flag.String("push-url", "", "URL mentions of users who are not connected are POSTed to, as JSON, for a push service to deliver.")
+	var smtpAddr = flag.String("smtp", "", "SMTP server, host:port, email is sent through; credentials are the smtp_credentials secret.")
+	var mailFrom = flag.String("mail-from", "chat@localhost", "Address email is sent from.")
+	var tlsCert = flag.String("tls-cert", "", "Certificate file, in PEM, to serve HTTPS with; needs -tls-key.")
+	var tlsKey = flag.String("tls-key", "", "Key file, in PEM, of -tls-cert.")
+	var autocertDomains = flag.String("autocert", "", "Comma separated domains to get a certificate for from Let's Encrypt and serve HTTPS with.")
+	var autocertEmail = flag.String("autocert-email", "", "Address the certificate authority may send expiry notices to.")
+	var acmeDirectory = flag.String("acme-directory", letsEncryptURL, "Directory URL of the ACME server -autocert gets certificates from.")
+	var httpAddr = flag.String("http-addr", ":80", "When serving HTTPS, the addr that redirects plain HTTP to it and answers ACME challenges; empty for none.")
+	flag.StringVar(&gitlabURL, "gitlab-url", gitlabURL, "GitLab users sign in with, gitlab.com or a self-managed instance.")
+	flag.StringVar(&microsoftTenant, "microsoft-tenant", microsoftTenant, "Microsoft tenant whose accounts may sign in: common, organizations, consumers or a tenant ID.")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "Issuer URL of an OpenID Connect provider, such as Keycloak, Okta or Auth0, users may sign in with.")
+	flag.StringVar(&oidcName, "oidc-name", oidcName, "What the login page calls the -oidc-issuer provider.")
+	flag.BoolVar(&guestsAllowed, "guests", false, "Let visitors chat as guests, with a random name, without signing in.")
+	flag.StringVar(&oidcIcon, "oidc-icon", "", "URL of the icon the login page shows for the -oidc-issuer provider.")
+	var collectOrphans = flag.Bool("collect-orphans", false, "Delete avatar and attachment files nothing refers to any more once a day; GET /admin/orphans lists them either way.")
+	var publicURL = flag.String("public-url", "", "URL users reach the server at, for links in email; by default the host requests come to.")
+	var shutdownTimeout = flag.Duration("shutdown-timeout", defaultShutdownTimeout, "How long shutting down may take before the server exits with clients still connected.")
+	var shutdownReason = flag.String("shutdown-reason", "The server is restarting.", "What clients are told when the server shuts down.")
+	var shutdownDowntime = flag.Duration("shutdown-downtime", 0, "How long clients are told the server will be away when it shuts down; 0 for unknown.")
+	var traceLevel = flag.String("trace-level", "info", "Least important events traced: debug (every message), info, warn or error.")
+	var traceFormat = flag.String("trace-format", "text", "How events are traced: text, or json for log aggregators.")
+	var traceOutput = flag.String("trace-output", traceStdout, "Where events are traced: off, stdout, file (-trace-file) or ring (kept in memory for the admin API). Admins can change it, and the level, at /admin/trace.")
+	var traceMaxBytes = flag.Int("trace-max-bytes", 4096, "Longest text of a traced event, in bytes; longer ones are cut. 0 for no limit.")
+	var traceRate = flag.Int("trace-rate", 1000, "Most events traced each second; more are dropped and counted. 0 for no limit.")
+	var traceFileName = flag.String("trace-file", "", "File events are appended to with -trace-output file.")
+	var traceFrames = flag.String("trace-frames", "", "File the websocket frames of sampled connections are recorded to, in full.")
+	var traceFramesRate = flag.Float64("trace-frames-rate", 0, "Share of connections, from 0 to 1, whose frames -trace-frames records.")
+	var traceFramesUsers = flag.String("trace-frames-users", "", "Comma separated userids whose connections -trace-frames always records.")
+	flag.StringVar(&templatesDir, "templates", templatesDir, "Directory the HTML templates are read from.")
+	flag.StringVar(&avatarDir, "avatars", avatarDir, "Directory uploaded avatars are kept in.")
+	var avatarStoreSpec = flag.String("avatar-store", "", "Where uploaded avatars are kept instead of -avatars: s3://bucket/prefix?endpoint=...&region=..., with the blob_store_credentials secret.")
+	var avatarProviderNames = flag.String("avatar-providers", defaultAvatarProviders, "Comma separated avatar providers to try in order: filesystem, auth, gravatar, default, or any other registered.")
+	var proxyGravatar = flag.Bool("gravatar-proxy", false, "Serve Gravatar pictures from the server's cache at /gravatar/ instead of having browsers fetch them.")
+	var assetsDir = flag.String("assets", "assets", "Directory of static files, such as the default avatar, served at /assets/.")
+	var secretsRefresh = flag.Duration("secrets-refresh", 5*time.Minute, "How often to re-read secrets to pick up rotations.")
 	flag.Parse() // parse the flags
-	// replace your own google client auth
-	clientID := os.Getenv("GOOGLE_CLIENT_ID")
-	clientSec := os.Getenv("GOOGLE_CLIENT_SEC")
-	// setup gomniauth
-	gomniauth.SetSecurityKey("AIzaSyA1p5cwIbIOk1Dnn9IrRRdTGjxwaqvw")
-	gomniauth.WithProviders(
-		facebook.New("key", "secret",
-			"http://localhost:8080/auth/callback/facebook"),
-		github.New("key", "secret",
-			"http://localhost:8080/auth/callback/github"),
-		google.New(clientID, clientSec, "http://localhost:8080/auth/callback/google"),
-	)
-	// options UseAuthAvatar/UseGravatarAvatar/UseFileSystemAvatar
-	r := newRoom()
-	r.tracer = trace.New(os.Stdout)
+	// flags not given on the command line come from the environment or
+	// the -config file
+	if err := config.Load(flag.CommandLine, *configFile, "CHAT_"); err != nil {
+		log.Fatal("Failed to load configuration: ", err)
+	}
+	cfg := &serverConfig{
+		dataDir:         *dataDir,
+		secretsSpec:     *secretsSpec,
+		storeSpec:       *storeSpec,
+		encrypt:         *encrypt,
+		sessionSpec:     *sessionSpec,
+		limiterSpec:     *limiterSpec,
+		brokerSpec:      *brokerSpec,
+		expandersFile:   *expandersFile,
+		moderationFile:  *moderationFile,
+		rateLimit:       rateLimit{Rate: *rate, Burst: *burst, IPRate: *ipRate, IPBurst: *ipBurst, BotRate: *botRate, BotBurst: *botBurst, Policy: *ratePolicy},
+		historySize:     *historySize,
+		maxMessage:      *maxMessage,
+		bandwidth:       bandwidthCap{Rate: *bandwidthRate, Burst: *bandwidthBurst},
+		maxAttachment:   *maxAttachment,
+		usageReporters:  *usageReporters,
+		smtpAddr:        *smtpAddr,
+		mailFrom:        *mailFrom,
+		publicURL:       *publicURL,
+		gitlabURL:       gitlabURL,
+		microsoftTenant: microsoftTenant,
+		oidcIssuer:      oidcIssuer,
+		tlsCert:         *tlsCert,
+		tlsKey:          *tlsKey,
+		autocert:        *autocertDomains,
+		acmeDirectory:   *acmeDirectory,
+		shutdownTimeout: *shutdownTimeout,
+		traceLevel:      *traceLevel,
+		traceFormat:     *traceFormat,
+		traceOutput:     *traceOutput,
+		traceMaxBytes:   *traceMaxBytes,
+		traceRate:       *traceRate,
+		traceFile:       *traceFileName,
+		traceFrames:     *traceFrames,
+		traceFramesRate: *traceFramesRate,
+	}
+	if flag.Arg(0) == "check-config" {
+		// check the flags, secrets and backends and exit non-zero if
+		// the server would not start or work
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		errs := cfg.check(ctx)
+		cancel()
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		return
+	}
+	if flag.Arg(0) == "encrypt-secrets" {
+		// seal a JSON file of secrets for use with -secrets file:...
+		if err := encryptSecrets(os.Stdin, os.Stdout); err != nil {
+			log.Fatal("encrypt-secrets:", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "replay" {
+		// send the frames in a capture to a server again
+		if err := replayCommand(flag.Args()[1:]); err != nil {
+			log.Fatal("replay: ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "anonymize" {
+		// copy the history to another store with made up people and
+		// text, for staging and load tests
+		n, err := anonymizeStore(cfg, flag.Arg(1))
+		if err != nil {
+			log.Fatal("anonymize: ", err)
+		}
+		fmt.Printf("Copied %d messages\n", n)
+		return
+	}
+	if errs := cfg.validate(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Println(err)
+		}
+		log.Fatal("Invalid configuration; see chat_server check-config")
+	}
+	setAdmins(*adminList)
+	if err := os.MkdirAll(*dataDir, 0700); err != nil {
+		log.Fatal("Failed to create data directory:", err)
+	}
+	// OAuth secrets and keys come from the configured secrets backend and are
+	// refreshed periodically, so they can be rotated without a restart
+	source, err := newSecretSource(*secretsSpec)
+	if err != nil {
+		log.Fatal("Failed to set up secrets:", err)
+	}
+	// login provider credentials entered during the first-run setup are
+	// used for any the secrets backend does not have
+	layered := &settingsSecrets{next: source}
+	secrets := newSecretCache(layered)
+	if *publicURL != "" {
+		setAuthBaseURL(*publicURL)
+	}
+	// a server terminating TLS itself has users come back over https
+	var domains []string
+	if *autocertDomains != "" {
+		domains = strings.Split(*autocertDomains, ",")
+		if *publicURL == "" {
+			setAuthBaseURL("https://" + domains[0])
+		}
+	}
+	if *tlsCert != "" || len(domains) > 0 {
+		useHTTPSCallbacks()
+	}
+	setupAuth(secrets)
+	secrets.watch(func() {
+		log.Println("Secrets rotated, reloading auth providers")
+		setupAuth(secrets)
+	})
+	// signing keys can be rotated by an admin or by changing the
+	// cookie_signing_key secret; old keys keep verifying for -key-overlap
+	keys, err := newKeyRing(filepath.Join(*dataDir, "keys.json"), *keyOverlap)
+	if err != nil {
+		log.Fatal("Failed to load signing keys:", err)
+	}
+	adoptSigningKey := func() {
+		if key, err := secrets.Secret("cookie_signing_key"); err == nil {
+			if _, err := keys.adopt(key); err != nil {
+				log.Println("Failed to adopt cookie_signing_key:", err)
+			}
+		}
+	}
+	adoptSigningKey()
+	if err := keys.fallBack(); err != nil {
+		log.Fatal("Failed to make a signing key:", err)
+	}
+	if *brokerSpec != "" {
+		// each server's generated keys would only be its own
+		if _, err := secrets.Secret("cookie_signing_key"); err != nil {
+			log.Fatal("Servers sharing a -broker need the same cookie_signing_key secret: ", err)
+		}
+		keys.shared = true
+	}
+	authKeys = keys
+	if sessions, err = newSessionStore(*sessionSpec); err != nil {
+		log.Fatal("Failed to set up session store:", err)
+	}
+	secrets.watch(adoptSigningKey)
+	http.Handle("/admin/keys", checkCSRF(MustAdmin(keys)))
+	http.Handle("/admin/keys/", checkCSRF(MustAdmin(keys)))
+	go secrets.run(*secretsRefresh, nil)
+	if avatars, err = avatarChain(*avatarProviderNames); err != nil {
+		log.Fatal("Failed to set up avatars:", err)
+	}
+	rooms := newRoomManager()
+	traces := newTraceControl(*traceFileName, nil)
+	if err := traces.set(traceSettings{Output: *traceOutput, Level: *traceLevel, Format: *traceFormat, MaxBytes: *traceMaxBytes, PerSecond: *traceRate}); err != nil {
+		log.Fatal("Failed to set up tracing:", err)
+	}
+	rooms.tracer = traces.sw
+	if *traceFrames != "" {
+		f, err := os.OpenFile(*traceFrames, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal("Failed to open frame trace:", err)
+		}
+		defer f.Close()
+		var users []string
+		if *traceFramesUsers != "" {
+			users = strings.Split(*traceFramesUsers, ",")
+		}
+		rooms.frames = trace.NewFrames(f, *traceFramesRate, users)
+	}
+	rooms.historySize = *historySize
+	rooms.maxMessage = *maxMessage
+	rooms.bandwidth = newBandwidthMeter(cfg.bandwidth)
+	rooms.rateLimit = cfg.rateLimit
+	if rooms.limiter, err = newRateLimiter(*limiterSpec); err != nil {
+		log.Fatal("Failed to set up rate limiter:", err)
+	}
+	if l, ok := rooms.limiter.(*redisLimiter); ok {
+		l.tracer = rooms.tracer
+	}
+	if rooms.store, err = newMessageStore(*storeSpec, secrets); err != nil {
+		log.Fatal("Failed to open message store:", err)
+	}
+	if *moderationFile != "" {
+		if rooms.moderators, err = loadModerators(*moderationFile); err != nil {
+			log.Fatal("Failed to load moderation rules:", err)
+		}
+	}
+	if *expandersFile != "" {
+		if rooms.expander, err = loadLinkExpander(*expandersFile, secrets); err != nil {
+			log.Fatal("Failed to load link expanders:", err)
+		}
+	}
+	if rooms.broker, err = newBroker(*brokerSpec); err != nil {
+		log.Fatal("Failed to set up broker:", err)
+	}
+	// server state lives next to the history when that is a shared database
+	state := newStateStore(rooms.store, *dataDir)
+	rooms.state = state
+	var sealKeys *dataKeys
+	if *encrypt {
+		sealed, err := sealStore(rooms.store, state, secrets)
+		if err != nil {
+			log.Fatal("Failed to set up -encrypt: ", err)
+		}
+		rooms.store, sealKeys = sealed, sealed.keys
+	}
+	if rooms.broker != nil {
+		go rooms.runBroker()
+		// publish what servers that stopped left in the outbox
+		rooms.startRelay()
+	}
+	// admins can change tracing while the server runs; the audit log
+	// records it
+	audit := newAuditLog(state)
+	traces.audit = audit
+	http.Handle("/admin/trace", checkCSRF(MustAdmin(traces)))
+	http.Handle("/admin/trace/", checkCSRF(MustAdmin(traces)))
+	http.Handle("/admin/audit", checkCSRF(MustAdmin(audit)))
+	accounts = &accountStore{state: state, rooms: rooms, audit: audit}
+	http.Handle("/admin/deactivations", checkCSRF(MustAdmin(accounts)))
+	http.Handle("/admin/deactivations/", checkCSRF(MustAdmin(accounts)))
+	http.Handle("/api/account/deactivate", checkCSRF(MustAuth(http.HandlerFunc(accounts.serveDeactivate))))
+	http.Handle("/admin/sessions/", checkCSRF(MustAdmin(http.HandlerFunc(accounts.serveRevoke))))
+	botAccounts = &botStore{state: state, rooms: rooms, audit: audit}
+	http.Handle("/admin/bots", checkCSRF(MustAdmin(botAccounts)))
+	http.Handle("/admin/bots/", checkCSRF(MustAdmin(botAccounts)))
+	twoFactor = &totpStore{state: state}
+	http.Handle("/login/2fa", checkCSRF(http.HandlerFunc(twoFactor.ServeLogin)))
+	http.Handle("/api/2fa", checkCSRF(MustAuth(twoFactor)))
+	http.Handle("/api/2fa/", checkCSRF(MustAuth(twoFactor)))
+	layered.use(state)
+	applySettings := func(settings *serverSettings) {
+		setAdmins(strings.Join(settings.Admins, ","))
+		if *publicURL == "" {
+			setAuthBaseURL(settings.PublicURL)
+		}
+		setupAuth(secrets)
+	}
+	baseURL := *publicURL
+	if settings, err := loadSettings(state); err == nil {
+		applySettings(settings)
+		if baseURL == "" {
+			baseURL = settings.PublicURL
+		}
+	} else if needsSetup(state) {
+		setup := newSetupWizard(state, keys, applySettings)
+		http.Handle("/setup", checkCSRF(setup))
+		log.Println("This server is not set up yet. Open /setup?token=" + setup.token + " to set it up.")
+	}
+	// failed webhook, push and email deliveries are parked here and retried
+	deadLetters, err := newDeadLetterQueue(filepath.Join(*dataDir, "deadletters.json"))
+	if err != nil {
+		log.Fatal("Failed to load dead letters:", err)
+	}
+	deadLetters.tracer = rooms.tracer
+	deadLetters.register("webhook", webhookDeliverer)
+	if *pushURL != "" {
+		deadLetters.register("push", webhookDeliverer)
+		rooms.push = &pushNotifier{queue: deadLetters, url: *pushURL}
+	}
+	http.Handle("/admin/deadletters", checkCSRF(MustAdmin(deadLetters)))
+	http.Handle("/admin/deadletters/", checkCSRF(MustAdmin(deadLetters)))
+	go deadLetters.run(10*time.Second, nil)
+	schedules := newScheduler(state, rooms)
+	schedules.tracer = rooms.tracer
+	// usage is metered per workspace for hosted use
+	if *metering {
+		rooms.meter = newUsageMeter(state)
+		rooms.meter.tracer = rooms.tracer
+		for _, spec := range strings.Split(*usageReporters, ",") {
+			if spec = strings.TrimSpace(spec); spec == "" {
+				continue
+			}
+			reporter, err := newUsageReporter(spec, deadLetters)
+			if err != nil {
+				log.Fatal("Failed to set up usage reporting:", err)
+			}
+			rooms.meter.reporters = append(rooms.meter.reporters, reporter)
+		}
+		rooms.meter.flush(time.Now())
+		schedules.jobs = append(schedules.jobs, rooms.meter.tick)
+		http.Handle("/admin/usage", checkCSRF(MustAdmin(rooms.meter)))
+		http.Handle("/admin/usage/", checkCSRF(MustAdmin(rooms.meter)))
+	}
+	http.Handle("/admin/schedules", checkCSRF(MustAdmin(schedules)))
+	http.Handle("/admin/schedules/", checkCSRF(MustAdmin(schedules)))
+	status := newStatusPage(state)
+	http.Handle("/status", status)
+	http.Handle("/status.json", status)
+	http.Handle("/embed/", newEmbedHandler(rooms))
+	http.Handle("/admin/status/banner", checkCSRF(MustAdmin(http.HandlerFunc(status.banner))))
+	cluster := newClusterNode(state, rooms)
+	cluster.tracer = rooms.tracer
+	cluster.notice = shutdownNotice{Reason: *shutdownReason, Downtime: int(shutdownDowntime.Seconds())}
+	http.Handle("/admin/cluster", checkCSRF(MustAdmin(cluster)))
+	http.Handle("/admin/cluster/", checkCSRF(MustAdmin(cluster)))
+	probes := newProbes(rooms, secrets)
+	http.HandleFunc("/healthz", probes.live)
+	http.HandleFunc("/readyz", probes.ready)
+	go cluster.run(nil)
+	events := &calendar{state: state, rooms: rooms}
+	schedules.jobs = append(schedules.jobs, events.remind)
+	schedules.jobs = append(schedules.jobs, rooms.expireRooms)
+	http.Handle("/api/events", checkCSRF(MustAuth(events)))
+	http.Handle("/api/events/", checkCSRF(MustAuth(events)))
+	github := &githubIntegration{secrets: secrets, state: state, rooms: rooms}
+	http.Handle("/integrations/github", github)
+	http.Handle("/admin/integrations/github", checkCSRF(MustAdmin(http.HandlerFunc(github.repos))))
+	http.Handle("/admin/integrations/github/", checkCSRF(MustAdmin(http.HandlerFunc(github.repos))))
+	http.Handle("/integrations/webhook/", &incomingWebhooks{state: state, rooms: rooms})
+	alerts := &alertmanagerIntegration{secrets: secrets, state: state, rooms: rooms}
+	http.Handle("/integrations/alertmanager/", alerts)
+	http.Handle("/admin/integrations/alertmanager", checkCSRF(MustAdmin(http.HandlerFunc(alerts.mentionRules))))
+	http.Handle("/admin/integrations/alertmanager/", checkCSRF(MustAdmin(http.HandlerFunc(alerts.mentionRules))))
 	http.Handle("/chat", MustAuth(&templateHandler{filename: "chat.html"}))
-	http.Handle("/login", &templateHandler{filename: "login.html"})
+	http.Handle("/chat/", MustAuth(&templateHandler{filename: "chat.html"}))
+	http.Handle("/login", &loginPage{page: &templateHandler{filename: "login.html"}})
 	http.HandleFunc("/auth/", loginHandler)
-	http.Handle("/room", r)
+	http.Handle("/guest", checkCSRF(http.HandlerFunc(guestHandler)))
+	http.Handle("/api/commands", checkCSRF(MustAuth(rooms.commands)))
+	http.Handle("/api/commands/", checkCSRF(MustAuth(rooms.commands)))
+	attachments := &attachmentStore{dir: filepath.Join(*dataDir, "attachments"), state: state, maxSize: *maxAttachment, meter: rooms.meter, metrics: serverMetrics, keys: sealKeys}
+	if err := os.MkdirAll(attachments.dir, 0700); err != nil {
+		log.Fatal("Failed to create attachments directory:", err)
+	}
+	rooms.attachments = attachments
+	http.Handle("/api/attachments", MustAuth(attachments))
+	http.Handle("/attachments/", MustAuth(http.HandlerFunc(attachments.serveFile)))
+	http.Handle("/admin/rooms", checkCSRF(MustAdmin(http.HandlerFunc(rooms.serveAdmin))))
+	http.Handle("/admin/rooms/", checkCSRF(MustAdmin(http.HandlerFunc(rooms.serveAdmin))))
+	http.Handle("/admin/notice", checkCSRF(MustAdmin(http.HandlerFunc(rooms.serveAdmin))))
+	flags := &moderationFlags{state: state}
+	http.Handle("/admin/moderation/flags", checkCSRF(MustAdmin(flags)))
+	http.Handle("/admin/moderation/flags/", checkCSRF(MustAdmin(flags)))
+	roomInvites := &invites{state: state, publicURL: baseURL}
+	if *smtpAddr != "" {
+		deadLetters.register("email", &smtpMailer{addr: *smtpAddr, from: *mailFrom, secrets: secrets})
+		roomInvites.queue = deadLetters
+	}
+	http.Handle("/api/invites", checkCSRF(MustAuth(roomInvites)))
+	http.Handle("/api/invites/", checkCSRF(MustAuth(roomInvites)))
+	http.Handle("/invite/", checkCSRF(MustAuth(http.HandlerFunc(roomInvites.redeemHandler))))
+	roomSettings := &roomSettingsAPI{state: state, rooms: rooms}
+	roomTemplates := &roomTemplatesAPI{state: state}
+	http.Handle("/admin/room-templates", checkCSRF(MustAdmin(roomTemplates)))
+	http.Handle("/admin/room-templates/", checkCSRF(MustAdmin(roomTemplates)))
+	http.Handle("/api/rooms", checkCSRF(MustAuth(roomSettings)))
+	http.Handle("/api/rooms/", checkCSRF(MustAuth(roomSettings)))
+	http.Handle("/api/search", checkCSRF(MustAuth(&searchHandler{store: rooms.store, state: state})))
+	http.Handle("/api/tokens", checkCSRF(MustAuth(http.HandlerFunc(issueTokenHandler))))
+	http.Handle("/rooms/", checkCSRF(MustAuth(http.HandlerFunc(rooms.serveMembers))))
+	http.Handle("/room", rooms)
+	http.Handle("/room/", rooms)
 	//If we build and run our application having logged in with a previous version, you will find
 	//that the auth cookie that doesn't contain the avatar URL is still there. We are not asked to
 	//authenticate again (since we are already logged in), and the code that adds the avatar_url
 	//field never gets a chance to run. We could delete our cookie and refresh the page, but we
 	//would have to keep doing this whenever we make changes during development. Let's solve
 	//this problem properly by adding a logout feature
-	http.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
-		http.SetCookie(w, &http.Cookie{
-			Name:   "auth",
-			Value:  "",
-			Path:   "/",
-			MaxAge: -1,
-		})
+	http.Handle("/logout", checkCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//Signing out is posted from a form, so that another site can't
+		//sign users out with a link
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := endSession(w, r); err != nil {
+			log.Println("Failed to end session:", err)
+		}
 		w.Header().Set("Location", "/chat")
-		w.WriteHeader(http.StatusTemporaryRedirect)
-	})
-	http.Handle("/upload", &templateHandler{filename: "upload.html"})
-	http.HandleFunc("/uploader", uploaderHandler)
-	//If we didn't strip the /avatars/ prefix from the requests with
-	//http.StripPrefix, the file server would look for another folder called
-	//avatars inside the actual avatars folder, that is,
-	///avatars/avatars/filename instead of /avatars/filename.
-	http.Handle("/avatars/",
-		http.StripPrefix("/avatars/",
-			http.FileServer(http.Dir("./avatars"))))
-	// get the room going
-	go r.run()
+		w.WriteHeader(http.StatusSeeOther)
+	})))
+	if *avatarStoreSpec == "" {
+		*avatarStoreSpec = avatarDir
+	}
+	if avatarBlobs, err = newBlobStore(*avatarStoreSpec, secrets); err != nil {
+		log.Fatal("Failed to open avatar store:", err)
+	}
+	avatarFiles := newAvatarStore(avatarBlobs, state)
+	avatarFiles.maxSize = *maxAvatar
+	http.Handle("/api/v1/limits", checkCSRF(MustAuth(&limitsAPI{rooms: rooms, attachments: attachments, avatars: avatarFiles})))
+	orphans := newOrphanCollector(avatarFiles, attachments, rooms.store)
+	orphans.tracer = rooms.tracer
+	if *collectOrphans {
+		schedules.jobs = append(schedules.jobs, orphans.tick)
+	}
+	http.Handle("/admin/orphans", checkCSRF(MustAdmin(orphans)))
+	//The scheduler starts once every job has been added
+	go schedules.run(nil)
+	http.Handle("/upload", MustAuth(&templateHandler{filename: "upload.html"}))
+	http.Handle("/uploader", MustAuth(http.HandlerFunc(avatarFiles.upload)))
+	//Removed avatars redirect to the default one rather than being
+	//not found, since sessions keep pointing at them.
+	http.HandleFunc("/avatars/", avatarFiles.serveFile)
+	http.Handle("/admin/avatars", checkCSRF(MustAdmin(avatarFiles)))
+	http.Handle("/admin/avatars/", checkCSRF(MustAdmin(avatarFiles)))
+	if *proxyGravatar {
+		gravatarProxy = newGravatarCache()
+		http.Handle("/gravatar/", gravatarProxy)
+	}
+	// assets bundled with the server, such as the default avatar
+	http.Handle("/assets/",
+		http.StripPrefix("/assets/",
+			http.FileServer(http.Dir(*assetsDir))))
 	// start the web server
 	log.Println("Starting web server on", *addr)
 
-	if err := http.ListenAndServe(*addr, nil); err != nil {
+	serverMetrics.secrets = secrets
+	http.Handle("/metrics", serverMetrics)
+	server := &http.Server{Addr: *addr, Handler: serverMetrics.instrument(http.DefaultServeMux)}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		// tell clients why they are being disconnected before we go
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		cluster.shutdown(ctx)
+		server.Shutdown(ctx)
+	}()
+	switch {
+	case len(domains) > 0:
+		certs := newAutocert(domains, *autocertEmail, filepath.Join(*dataDir, "autocert"), *acmeDirectory)
+		server.TLSConfig = certs.TLSConfig()
+		// the certificate authority checks the challenges over plain HTTP
+		go func() {
+			log.Fatal("ListenAndServe ", *httpAddr, ": ", http.ListenAndServe(*httpAddr, certs.HTTPHandler(http.HandlerFunc(redirectHTTPS))))
+		}()
+		err = server.ListenAndServeTLS("", "")
+	case *tlsCert != "":
+		if *httpAddr != "" {
+			go func() {
+				log.Println("ListenAndServe", *httpAddr+":", http.ListenAndServe(*httpAddr, http.HandlerFunc(redirectHTTPS)))
+			}()
+		}
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	default:
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe:", err)
 	}
+	<-stopped
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// mentioned is a user whose name a message mentions.
+type mentioned struct {
+	UserID string
+	Name   string
+}
+
+// mentionsIn returns the users in candidates whose name follows an '@' in
+// text, ignoring case. Names may have spaces in them, so rather than
+// splitting text into words each name is looked for, longest first, and
+// must not run on into a longer word.
+func mentionsIn(text string, candidates []mentioned) []mentioned {
+	if !strings.Contains(text, "@") {
+		return nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return len(candidates[i].Name) > len(candidates[j].Name) })
+	lower := strings.ToLower(text)
+	seen := make(map[string]bool)
+	var found []mentioned
+	for _, c := range candidates {
+		if c.Name == "" || seen[c.UserID] {
+			continue
+		}
+		token := "@" + strings.ToLower(c.Name)
+		for i := 0; ; {
+			j := strings.Index(lower[i:], token)
+			if j < 0 {
+				break
+			}
+			end := i + j + len(token)
+			if next, _ := utf8.DecodeRuneInString(lower[end:]); end == len(lower) || !unicode.IsLetter(next) && !unicode.IsDigit(next) {
+				seen[c.UserID] = true
+				found = append(found, c)
+				// the text of a longer name is not another mention
+				lower = lower[:i+j] + strings.Repeat(" ", len(token)) + lower[end:]
+				break
+			}
+			i = end
+		}
+	}
+	return found
+}
+
+// mention sends a mention event to each user msg mentions who is in the
+// room, and has the push service tell those who are not connected anywhere.
+// Only the server that accepted msg pushes; the others just tell their own
+// clients. It runs inside run.
+func (r *room) mention(msg *message, push bool) {
+	if msg.Type != msgTypeMessage || !strings.Contains(msg.Message, "@") {
+		return
+	}
+	var candidates []mentioned
+	online := make(map[string]bool)
+	for client := range r.clients {
+		if userID := client.userID(); userID != "" {
+			candidates = append(candidates, mentioned{UserID: userID, Name: client.name()})
+			online[userID] = true
+		}
+	}
+	if push && r.push != nil {
+		// users who have read the room before may be mentioned while away
+		if cursors, err := readCursors(r.state, r.name); err == nil {
+			for _, cursor := range cursors {
+				candidates = append(candidates, mentioned{UserID: cursor.UserID, Name: cursor.Name})
+			}
+		}
+		if list, err := members(r.state, r.name, time.Now()); err == nil {
+			for _, m := range list {
+				online[m.UserID] = true
+			}
+		}
+	}
+	for _, m := range mentionsIn(msg.Message, candidates) {
+		if m.UserID == msg.UserID {
+			continue
+		}
+		event := &message{ID: newID(), Type: msgTypeMention, Room: r.name, UserID: msg.UserID, Name: msg.Name,
+			To: m.UserID, Message: msg.Message, Target: msg.ID, When: msg.When}
+		for client := range r.clients {
+			if client.userID() != m.UserID {
+				continue
+			}
+			select {
+			case client.send <- event:
+			default:
+			}
+		}
+		if push && !online[m.UserID] {
+			r.push.notify(event)
+		}
+	}
+}
+
+// pushNotifier hands mentions of users who are not connected to a push
+// service, POSTing them as JSON to url through the delivery queue, so they
+// are retried if the service is down. A nil *pushNotifier pushes nothing.
+type pushNotifier struct {
+	queue *deadLetterQueue
+	url   string
+}
+
+// pushMention is what the push service is sent: who was mentioned, by whom,
+// where and in what message.
+type pushMention struct {
+	UserID    string
+	Room      string
+	From      string
+	FromName  string
+	MessageID string
+	Message   string
+	When      time.Time
+}
+
+func (p *pushNotifier) notify(event *message) {
+	if p == nil {
+		return
+	}
+	payload, _ := json.Marshal(pushMention{UserID: event.To, Room: event.Room, From: event.UserID, FromName: event.Name,
+		MessageID: event.Target, Message: event.Message, When: event.When})
+	// failures are kept and retried by the queue
+	go p.queue.send(&delivery{Kind: "push", Target: p.url, Payload: payload})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMentionsIn(t *testing.T) {
+	users := []mentioned{{"1", "Ann"}, {"2", "Ann Lee"}, {"3", "Bob"}, {"4", "Guest 1234"}}
+	for text, want := range map[string][]string{
+		"no mentions here":           nil,
+		"hi @ann":                    {"1"},
+		"@Ann Lee, and @bob!":        {"2", "3"},
+		"@annie is not ann":          nil,
+		"ask @Guest 1234 about it":   {"4"},
+		"@bob @bob twice counts one": {"3"},
+		"email bob@example.com":      nil,
+	} {
+		var got []string
+		for _, m := range mentionsIn(text, append([]mentioned(nil), users...)) {
+			got = append(got, m.UserID)
+		}
+		if len(got) != len(want) {
+			t.Errorf("%q: expected %v, got %v", text, want, got)
+			continue
+		}
+		seen := map[string]bool{}
+		for _, id := range got {
+			seen[id] = true
+		}
+		for _, id := range want {
+			if !seen[id] {
+				t.Errorf("%q: expected %v, got %v", text, want, got)
+			}
+		}
+	}
+}
+
+func TestMentionEvents(t *testing.T) {
+	pushed := make(chan pushMention, 1)
+	queue, _ := newDeadLetterQueue("")
+	queue.register("push", DelivererFunc(func(d *delivery) error {
+		var p pushMention
+		json.Unmarshal(d.Payload, &p)
+		pushed <- p
+		return nil
+	}))
+	r := newRoom("golang")
+	r.push = &pushNotifier{queue: queue, url: "http://push.example"}
+	r.state.Put(readCursorsBucket, "golang/carol", readCursor{UserID: "carol", Name: "Carol", Seq: 1})
+	go r.run()
+	join := func(userID, name string) *client {
+		c := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": userID, "name": name}}
+		r.join <- c
+		return c
+	}
+	ann, bob := join("ann", "Ann"), join("bob", "Bob")
+	waitMembers(t, r, 2)
+	r.forward <- &message{ID: "m1", UserID: "ann", Name: "Ann", Message: "@bob and @carol, look", When: time.Now()}
+	for {
+		msg := receiveChat(t, bob)
+		if msg.Type == msgTypeMention {
+			if msg.Target != "m1" || msg.To != "bob" || msg.UserID != "ann" {
+				t.Errorf("unexpected mention %+v", msg)
+			}
+			break
+		}
+	}
+	select {
+	case p := <-pushed:
+		if p.UserID != "carol" || p.MessageID != "m1" || p.FromName != "Ann" {
+			t.Errorf("unexpected push %+v", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("carol, who is away, should have been pushed the mention")
+	}
+	// ann gets her own message but no mention
+	for {
+		msg := receiveChat(t, ann)
+		if msg.Type == msgTypeMention {
+			t.Fatalf("ann was not mentioned, got %+v", msg)
+		}
+		if msg.ID == "m1" {
+			break
+		}
+	}
+}
@@ -1,13 +1,238 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"time"
 )
 
 // message represents a single message
 type message struct {
+	// ID identifies the message for deduplication. Clients may choose it
+	// themselves so that a resend after a reconnect keeps the same ID;
+	// otherwise the server assigns one.
+	ID string
+	// Type says what kind of message this is, see the msgType constants.
+	Type string `json:",omitempty"`
+	// Room is the name of the room the message was sent to.
+	Room string
+	// UserID identifies the sender.
+	UserID string `json:",omitempty"`
+	// To is the userid a direct message is addressed to.
+	To        string `json:",omitempty"`
 	Name      string
 	Message   string
 	When      time.Time
 	AvatarURL string
+	// Guest marks messages from guests, who did not sign in with a login
+	// provider.
+	Guest bool `json:",omitempty"`
+	// Bot marks messages from bots an admin created.
+	Bot bool `json:",omitempty"`
+	// Event is the calendar event an event message announces.
+	Event *calendarEvent `json:",omitempty"`
+	// Links are the issues the message refers to.
+	Links []messageLink `json:",omitempty"`
+	// Resume is the token a client told to reconnect passes back as the
+	// resume query parameter.
+	Resume string `json:",omitempty"`
+	// Shutdown says why a server is going away and for how long, on
+	// shutdown and reconnect messages.
+	Shutdown *shutdownNotice `json:",omitempty"`
+	// Attachments are the files attached to the message.
+	Attachments []attachment `json:",omitempty"`
+	// Reaction is the reaction a reaction message adds or removes.
+	Reaction *reaction `json:",omitempty"`
+	// Reactions counts the reactions to the message by emoji; it is set
+	// on the history sent to a joining client.
+	Reactions map[string]int `json:",omitempty"`
+	// Receipt is how far the sender of a read message has read.
+	Receipt *receipt `json:",omitempty"`
+	// Target is the ID of the message a pin, unpin or delete message acts
+	// on, or the userid of the user a kick, mute or unmute message is for.
+	Target string `json:",omitempty"`
+	// Duration is how many seconds a mute lasts.
+	Duration int64 `json:",omitempty"`
+	// Hello is the capability exchange of a hello message.
+	Hello *hello `json:",omitempty"`
+	// ReplyTo is the ID of the message a message or direct message
+	// replies to, which the server copies into Quote.
+	ReplyTo string `json:",omitempty"`
+	// Quote is the message a forward message forwards, or a reply
+	// replies to, as it was then.
+	Quote *quote `json:",omitempty"`
+	// Components are the buttons and menus of a bot's message.
+	Components []component `json:",omitempty"`
+	// Interaction is the component an interaction message used.
+	Interaction *interaction `json:",omitempty"`
+	// Sealed is the content of a stored message, encrypted with its
+	// room's data key, while it is at rest; see sealedStore.
+	Sealed []byte `json:",omitempty"`
+	// Seq numbers the saved messages of a room in the order they were
+	// broadcast. A reconnecting client passes the last one it saw as the
+	// since query parameter to get those it missed.
+	Seq uint64 `json:",omitempty"`
+	// from is the client that sent the message to this server, to be
+	// acknowledged once the room accepts it; nil for other messages.
+	from *client
+}
+
+// The message types. Clients may send msgTypeMessage (the default when Type
+// is empty), msgTypeDM, msgTypeTyping, msgTypeReaction, msgTypeRead,
+// msgTypePin, msgTypeUnpin, msgTypeDelete, msgTypeKick, msgTypeMute,
+// msgTypeUnmute, msgTypeAcceptRules, msgTypeForward, msgTypeInteraction and
+// msgTypeHello; the others only come
+// from the server.
+const (
+	// msgTypeMessage is an ordinary message broadcast to the room.
+	msgTypeMessage = "message"
+	// msgTypeDM is a direct message delivered only to the To user
+	// (and the sender's own connections).
+	msgTypeDM = "dm"
+	// msgTypeTyping says the sender is typing. It is broadcast, at most
+	// every typingInterval per user, but not saved.
+	msgTypeTyping = "typing"
+	// msgTypeReaction adds an emoji to the message Reaction.MessageID, or
+	// removes it. It is broadcast with the new count but not saved.
+	msgTypeReaction = "reaction"
+	// msgTypeRead says the sender has read the room up to the message in
+	// Receipt. It is broadcast, if it moves the sender's read cursor
+	// forward, and the cursor is saved rather than the message.
+	msgTypeRead = "read"
+	// msgTypePin and msgTypeUnpin pin and unpin the message Target, for
+	// the room's moderators and owner. They are broadcast, and the pins
+	// saved rather than the messages.
+	msgTypePin   = "pin"
+	msgTypeUnpin = "unpin"
+	// msgTypeDelete deletes the message Target, by its sender or one of
+	// the room's moderators or owner. It is broadcast but not saved.
+	msgTypeDelete = "delete"
+	// msgTypeKick disconnects the user Target from the room, by one of
+	// the room's moderators or owner who outranks them. It is broadcast
+	// but not saved.
+	msgTypeKick = "kick"
+	// msgTypeMute keeps the user Target from sending messages to the room
+	// for Duration seconds, and msgTypeUnmute lets them again, by one of
+	// the room's moderators or owner who outranks them. They are broadcast,
+	// and the mutes saved rather than the messages.
+	msgTypeMute   = "mute"
+	msgTypeUnmute = "unmute"
+	// msgTypeRules sends a user who has not accepted the room's rules the
+	// rules, in Message, and msgTypeAcceptRules is their answer. Until
+	// they accept, their messages to the room are refused. Neither is
+	// broadcast or saved.
+	msgTypeRules       = "rules"
+	msgTypeAcceptRules = "accept_rules"
+	// msgTypeForward asks for the message Target of the sender's room to
+	// be copied to the room Room, or to the user To as a direct message,
+	// with Message as the sender's comment. What is saved and broadcast
+	// there is a msgTypeForward message with the original in Quote.
+	msgTypeForward = "forward"
+	// msgTypeInteraction says the sender used the component of a bot's
+	// message in Interaction. It goes only to the connections of the bot,
+	// To, with the room in Room, and is not saved.
+	msgTypeInteraction = "interaction"
+	// msgTypePresence says UserID "joined" or "left" the room, in Message.
+	msgTypePresence = "presence"
+	// msgTypeNotice is a message from the server to a single client, or
+	// from an admin to a room. It is not saved.
+	msgTypeNotice = "notice"
+	// msgTypeEvent announces a calendar event, which is in Event.
+	msgTypeEvent = "event"
+	// msgTypeReconnect tells a client to reconnect, which gets it moved
+	// to another server, and to pass Resume when it does.
+	msgTypeReconnect = "reconnect"
+	// msgTypeShutdown tells a client the server is going away, with the
+	// reason and expected downtime in Shutdown. The connection is closed
+	// right after it.
+	msgTypeShutdown = "shutdown"
+	// msgTypeDisconnect tells a client an admin disconnected it, or closed
+	// the room, and why, in Message. The connection is closed right after
+	// it and the client should not reconnect by itself.
+	msgTypeDisconnect = "disconnect"
+	// msgTypeHello is sent by a client, usually first, with the protocol
+	// versions and capabilities it supports in Hello, and answered by the
+	// server with those it chose. It is not broadcast.
+	msgTypeHello = "hello"
+	// msgTypeAck tells the client that sent a message or a direct message
+	// that the server accepted it. ID is the ID of that message, which
+	// the server chose if the client did not, and Seq its sequence number.
+	// Only the sender's connection gets it, and it is not saved.
+	msgTypeAck = "ack"
+	// msgTypeMention tells the user To that the message Target, sent by
+	// UserID and repeated in Message, mentions them. Only that user's
+	// connections get it, and it is not saved.
+	msgTypeMention = "mention"
+	// msgTypeSignOut is only passed between servers, through the broker:
+	// the connections of the user UserID, or those opened with the session
+	// Target, are to be disconnected, with Message as the reason.
+	msgTypeSignOut = "sign_out"
+)
+
+// newID returns a random 128-bit identifier encoded as hex.
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("chat: unable to read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// maxIDLength caps client chosen message IDs.
+const maxIDLength = 64
+
+// validID reports whether id is acceptable as a client chosen message ID:
+// non-empty, not too long and made only of letters, digits, '-' and '_'.
+func validID(id string) bool {
+	if id == "" || len(id) > maxIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// recentIDs remembers the last size message IDs seen, so that a message
+// resent by a client (at-least-once delivery) is only broadcast once.
+// It is not safe for concurrent use; each room owns its own.
+type recentIDs struct {
+	ring []string
+	next int
+	seen map[string]bool
+}
+
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{ring: make([]string, size), seen: make(map[string]bool, size)}
+}
+
+// add records id and reports whether it was new.
+func (r *recentIDs) add(id string) bool {
+	if r.seen[id] {
+		return false
+	}
+	if old := r.ring[r.next]; old != "" {
+		delete(r.seen, old)
+	}
+	r.ring[r.next] = id
+	r.next = (r.next + 1) % len(r.ring)
+	r.seen[id] = true
+	return true
+}
+
+// forget removes id, so that it is new again.
+func (r *recentIDs) forget(id string) {
+	if !r.seen[id] {
+		return
+	}
+	delete(r.seen, id)
+	for i, seen := range r.ring {
+		if seen == id {
+			r.ring[i] = ""
+		}
+	}
 }
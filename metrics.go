@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// sizeBuckets are the upper bounds, in bytes, of the upload size histogram.
+var sizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+
+// histogram counts observations into buckets, latencyBuckets unless set.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.buckets == nil {
+		h.buckets = latencyBuckets
+	}
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metrics records how long handlers and template renders take and how
+// often they fail, by route and by template, and serves them at /metrics in
+// the Prometheus text format. Routes are the patterns handlers are
+// registered with, so request paths can't blow up the number of series.
+// It also counts what the rooms do: connected clients and messages
+// broadcast and dropped, by room, websocket errors and bytes, upload sizes,
+// and sign-ins by login provider. A nil *metrics records nothing.
+type metrics struct {
+	// secrets, if set, holds the metrics_token scrapers must send as
+	// their bearer token; without one /metrics is open.
+	secrets SecretSource
+
+	mu           sync.Mutex
+	requests     map[string]*histogram
+	errors       map[string]map[string]uint64
+	renders      map[string]*histogram
+	renderErrors map[string]uint64
+	clients      map[string]int64
+	broadcasts   map[string]uint64
+	dropped      map[string]uint64
+	socketErrors map[string]uint64
+	socketBytes  map[string]uint64
+	uploads      map[string]*histogram
+	logins       map[string]*histogram
+	loginResults map[string]map[string]uint64
+	loginDown    map[string]bool
+}
+
+// serverMetrics are the metrics of this server.
+var serverMetrics = newMetrics()
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:     make(map[string]*histogram),
+		errors:       make(map[string]map[string]uint64),
+		renders:      make(map[string]*histogram),
+		renderErrors: make(map[string]uint64),
+		clients:      make(map[string]int64),
+		broadcasts:   make(map[string]uint64),
+		dropped:      make(map[string]uint64),
+		socketErrors: make(map[string]uint64),
+		socketBytes:  make(map[string]uint64),
+		uploads:      make(map[string]*histogram),
+		logins:       make(map[string]*histogram),
+		loginResults: make(map[string]map[string]uint64),
+		loginDown:    make(map[string]bool),
+	}
+}
+
+// observeRequest records a request to route that was answered with status
+// after d. Responses of 400 and up count as errors, by class ("4xx", "5xx").
+func (m *metrics) observeRequest(route string, d time.Duration, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.requests[route]
+	if !ok {
+		h = &histogram{}
+		m.requests[route] = h
+	}
+	h.observe(d.Seconds())
+	if status >= 400 {
+		if m.errors[route] == nil {
+			m.errors[route] = make(map[string]uint64)
+		}
+		m.errors[route][fmt.Sprintf("%dxx", status/100)]++
+	}
+}
+
+// observeRender records a render of template that took d and failed if err
+// is not nil.
+func (m *metrics) observeRender(template string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.renders[template]
+	if !ok {
+		h = &histogram{}
+		m.renders[template] = h
+	}
+	h.observe(d.Seconds())
+	if err != nil {
+		m.renderErrors[template]++
+	}
+}
+
+// addClients changes the number of clients connected to room by delta.
+func (m *metrics) addClients(room string, delta int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clients[room] += delta
+}
+
+// countBroadcast records a message broadcast to room that was dropped for
+// dropped of its clients, whose send channels were full.
+func (m *metrics) countBroadcast(room string, dropped int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.broadcasts[room]++
+	if dropped > 0 {
+		m.dropped[room] += uint64(dropped)
+	}
+}
+
+// countSocketBytes records n bytes of websocket frames going in dir, "in"
+// or "out".
+func (m *metrics) countSocketBytes(dir string, n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.socketBytes[dir] += uint64(n)
+}
+
+// countSocketError records a websocket that failed while doing op, "read",
+// "write", "ping" or "timeout".
+func (m *metrics) countSocketError(op string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.socketErrors[op]++
+}
+
+// observeUpload records an upload of size bytes of kind, "attachment" or
+// "avatar".
+func (m *metrics) observeUpload(kind string, size int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.uploads[kind]
+	if !ok {
+		h = &histogram{buckets: sizeBuckets}
+		m.uploads[kind] = h
+	}
+	h.observe(float64(size))
+}
+
+// observeLogin records a callback from the login provider whose token
+// exchange and profile request took d and failed if err is not nil.
+func (m *metrics) observeLogin(provider string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.logins[provider]
+	if !ok {
+		h = &histogram{}
+		m.logins[provider] = h
+	}
+	h.observe(d.Seconds())
+	if m.loginResults[provider] == nil {
+		m.loginResults[provider] = make(map[string]uint64)
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.loginResults[provider][result]++
+}
+
+// setLoginDown records whether the login provider is down.
+func (m *metrics) setLoginDown(provider string, down bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loginDown[provider] = down
+}
+
+// instrument records every request handled by mux under the pattern it
+// matched. Websocket connections, which are hijacked, are left out: how
+// long they last says nothing about latency.
+func (m *metrics) instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		mux.ServeHTTP(rec, r)
+		if !rec.hijacked {
+			m.observeRequest(route, time.Since(start), rec.status)
+		}
+	})
+}
+
+// statusRecorder remembers the status a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack lets the websocket upgrader take over the connection.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T cannot be hijacked", w.ResponseWriter)
+	}
+	w.hijacked = true
+	return h.Hijack()
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ServeHTTP answers GET /metrics.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.secrets != nil {
+		if token, err := m.secrets.Secret("metrics_token"); err == nil {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeHistograms(w, "chat_http_request_duration_seconds", "How long handlers took to answer, by route.", "route", m.requests)
+	fmt.Fprintln(w, "# HELP chat_http_errors_total Responses with an error status, by route and class.")
+	fmt.Fprintln(w, "# TYPE chat_http_errors_total counter")
+	for _, route := range sortedKeys(m.errors) {
+		for _, class := range sortedKeys(m.errors[route]) {
+			fmt.Fprintf(w, "chat_http_errors_total{route=%s,code=%q} %d\n", labelValue(route), class, m.errors[route][class])
+		}
+	}
+	writeHistograms(w, "chat_template_render_seconds", "How long templates took to render, by template.", "template", m.renders)
+	fmt.Fprintln(w, "# HELP chat_template_render_errors_total Template renders that failed, by template.")
+	fmt.Fprintln(w, "# TYPE chat_template_render_errors_total counter")
+	for _, name := range sortedKeys(m.renderErrors) {
+		fmt.Fprintf(w, "chat_template_render_errors_total{template=%s} %d\n", labelValue(name), m.renderErrors[name])
+	}
+	fmt.Fprintln(w, "# HELP chat_clients Clients connected, by room.")
+	fmt.Fprintln(w, "# TYPE chat_clients gauge")
+	for _, room := range sortedKeys(m.clients) {
+		fmt.Fprintf(w, "chat_clients{room=%s} %d\n", labelValue(room), m.clients[room])
+	}
+	fmt.Fprintln(w, "# HELP chat_messages_broadcast_total Messages broadcast, by room.")
+	fmt.Fprintln(w, "# TYPE chat_messages_broadcast_total counter")
+	for _, room := range sortedKeys(m.broadcasts) {
+		fmt.Fprintf(w, "chat_messages_broadcast_total{room=%s} %d\n", labelValue(room), m.broadcasts[room])
+	}
+	fmt.Fprintln(w, "# HELP chat_messages_dropped_total Messages not sent to a client whose send buffer was full, by room.")
+	fmt.Fprintln(w, "# TYPE chat_messages_dropped_total counter")
+	for _, room := range sortedKeys(m.dropped) {
+		fmt.Fprintf(w, "chat_messages_dropped_total{room=%s} %d\n", labelValue(room), m.dropped[room])
+	}
+	fmt.Fprintln(w, "# HELP chat_websocket_errors_total Websockets that failed, by operation.")
+	fmt.Fprintln(w, "# TYPE chat_websocket_errors_total counter")
+	for _, op := range sortedKeys(m.socketErrors) {
+		fmt.Fprintf(w, "chat_websocket_errors_total{op=%s} %d\n", labelValue(op), m.socketErrors[op])
+	}
+	fmt.Fprintln(w, "# HELP chat_websocket_bytes_total Bytes of websocket frames, by direction.")
+	fmt.Fprintln(w, "# TYPE chat_websocket_bytes_total counter")
+	for _, dir := range sortedKeys(m.socketBytes) {
+		fmt.Fprintf(w, "chat_websocket_bytes_total{dir=%s} %d\n", labelValue(dir), m.socketBytes[dir])
+	}
+	writeHistograms(w, "chat_upload_size_bytes", "Sizes of uploaded files, by kind.", "kind", m.uploads)
+	writeHistograms(w, "chat_login_callback_seconds", "How long login providers took to complete sign-ins, by provider.", "provider", m.logins)
+	fmt.Fprintln(w, "# HELP chat_login_callbacks_total Sign-ins completed with login providers, by provider and result.")
+	fmt.Fprintln(w, "# TYPE chat_login_callbacks_total counter")
+	for _, provider := range sortedKeys(m.loginResults) {
+		for _, result := range sortedKeys(m.loginResults[provider]) {
+			fmt.Fprintf(w, "chat_login_callbacks_total{provider=%s,result=%q} %d\n", labelValue(provider), result, m.loginResults[provider][result])
+		}
+	}
+	fmt.Fprintln(w, "# HELP chat_login_provider_down Whether a login provider is off the login page for failing, by provider.")
+	fmt.Fprintln(w, "# TYPE chat_login_provider_down gauge")
+	for _, provider := range sortedKeys(m.loginDown) {
+		down := 0
+		if m.loginDown[provider] {
+			down = 1
+		}
+		fmt.Fprintf(w, "chat_login_provider_down{provider=%s} %d\n", labelValue(provider), down)
+	}
+}
+
+func writeHistograms(w io.Writer, name, help, label string, histograms map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, key := range sortedKeys(histograms) {
+		h := histograms[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s=%s,le=\"%g\"} %d\n", name, label, labelValue(key), bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%s,le=\"+Inf\"} %d\n", name, label, labelValue(key), h.count)
+		fmt.Fprintf(w, "%s_sum{%s=%s} %g\n", name, label, labelValue(key), h.sum)
+		fmt.Fprintf(w, "%s_count{%s=%s} %d\n", name, label, labelValue(key), h.count)
+	}
+}
+
+// labelValue quotes a label value as the text format wants.
+func labelValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
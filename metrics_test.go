@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstrumentRecordsRoutes(t *testing.T) {
+	m := newMetrics()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "provider failed", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	h := m.instrument(mux)
+	for _, path := range []string{"/auth/callback/github", "/auth/callback/google", "/chat", "/nowhere"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	m.observeRender("chat.html", 30*time.Millisecond, nil)
+	m.observeRender("chat.html", time.Second, errors.New("boom"))
+
+	var out strings.Builder
+	m.write(&out)
+	for _, want := range []string{
+		`chat_http_request_duration_seconds_count{route="/auth/"} 2`,
+		`chat_http_request_duration_seconds_count{route="/chat"} 1`,
+		`chat_http_request_duration_seconds_count{route="unmatched"} 1`,
+		`chat_http_errors_total{route="/auth/",code="5xx"} 2`,
+		`chat_http_errors_total{route="unmatched",code="4xx"} 1`,
+		`chat_template_render_seconds_bucket{template="chat.html",le="0.05"} 1`,
+		`chat_template_render_seconds_bucket{template="chat.html",le="+Inf"} 2`,
+		`chat_template_render_errors_total{template="chat.html"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %s in\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "/auth/callback") {
+		t.Error("series should be by route pattern, not path")
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	m := newMetrics()
+	m.secrets = mapSecrets{"metrics_token": "s3cret"}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("scrapes without the token should be refused, got %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("scrapes with the token should be allowed, got %d", w.Code)
+	}
+}
+
+func TestRoomMetrics(t *testing.T) {
+	rooms := newRoomManager()
+	rooms.metrics = newMetrics()
+	r := rooms.get("golang")
+	fast := &client{id: "fast", send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{}}
+	slow := &client{id: "slow", send: make(chan *message, 1), room: r, userData: map[string]interface{}{}}
+	r.join <- fast
+	r.join <- slow
+	r.forward <- &message{ID: "m1", Message: "one"}
+	r.forward <- &message{ID: "m2", Message: "two"}
+	if msg := receive(t, fast); msg.ID != "m1" {
+		t.Fatalf("got %s, want m1", msg.ID)
+	}
+	if msg := receive(t, fast); msg.ID != "m2" {
+		t.Fatalf("got %s, want m2", msg.ID)
+	}
+	if msg := receive(t, slow); msg.ID != "m1" {
+		t.Fatalf("got %s, want m1", msg.ID)
+	}
+	r.leave <- slow
+	rooms.metrics.observeUpload("attachment", 3000)
+	rooms.metrics.countSocketError("write")
+	// the room has handled the leave once it answers a liveness check
+	if err := r.alive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	rooms.metrics.write(&out)
+	for _, want := range []string{
+		`chat_clients{room="golang"} 1`,
+		`chat_messages_broadcast_total{room="golang"} 2`,
+		`chat_messages_dropped_total{room="golang"} 1`,
+		`chat_websocket_errors_total{op="write"} 1`,
+		`chat_upload_size_bytes_bucket{kind="attachment",le="1024"} 0`,
+		`chat_upload_size_bytes_bucket{kind="attachment",le="4096"} 1`,
+		`chat_upload_size_bytes_sum{kind="attachment"} 3000`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %s in\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The moderation actions, i.e. what happens to a message a moderator
+// objects to.
+const (
+	// moderationAllow lets the message through, possibly rewritten.
+	moderationAllow = "allow"
+	// moderationFlag lets it through but keeps it for admins to review.
+	moderationFlag = "flag"
+	// moderationReject drops it and tells the sender why.
+	moderationReject = "reject"
+	// moderationMask and moderationReplace, used in rules, rewrite what
+	// the rule matched and then allow the message.
+	moderationMask    = "mask"
+	moderationReplace = "replace"
+)
+
+// moderationFlagsBucket holds a flaggedMessage per flagged message, by ID.
+const moderationFlagsBucket = "moderation_flags"
+
+// verdict is what a Moderator decided about a message. Reason is shown to
+// the sender of a rejected message and to admins reviewing a flagged one.
+type verdict struct {
+	Action string
+	Reason string
+}
+
+// Moderator checks messages in a room's forward loop before they are
+// broadcast.
+type Moderator interface {
+	// Moderate may rewrite msg.Message and decides whether the message
+	// is allowed, flagged or rejected.
+	Moderate(msg *message) verdict
+}
+
+// moderate runs msg through moderators in order and returns the combined
+// verdict: the first rejection, otherwise a flag with every reason given,
+// otherwise allow.
+func moderate(moderators []Moderator, msg *message) verdict {
+	var reasons []string
+	for _, m := range moderators {
+		v := m.Moderate(msg)
+		switch v.Action {
+		case moderationReject:
+			return v
+		case moderationFlag:
+			reasons = append(reasons, v.Reason)
+		}
+	}
+	if len(reasons) > 0 {
+		return verdict{Action: moderationFlag, Reason: strings.Join(reasons, "; ")}
+	}
+	return verdict{Action: moderationAllow}
+}
+
+// wordFilter is a profanity filter. It finds Words as whole words, ignoring
+// case, and masks them with asterisks, or rejects or flags the message,
+// according to Action (mask by default).
+type wordFilter struct {
+	Words  []string
+	Action string
+
+	re *regexp.Regexp
+}
+
+func newWordFilter(f *wordFilter) (*wordFilter, error) {
+	if f.Action == "" {
+		f.Action = moderationMask
+	}
+	if f.Action != moderationMask && f.Action != moderationReject && f.Action != moderationFlag {
+		return nil, fmt.Errorf("word filter: unknown action %q", f.Action)
+	}
+	quoted := make([]string, 0, len(f.Words))
+	for _, word := range f.Words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil, fmt.Errorf("word filter: no words")
+	}
+	f.re = regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	return f, nil
+}
+
+func (f *wordFilter) Moderate(msg *message) verdict {
+	if !f.re.MatchString(msg.Message) {
+		return verdict{Action: moderationAllow}
+	}
+	if f.Action == moderationMask {
+		msg.Message = f.re.ReplaceAllStringFunc(msg.Message, mask)
+		return verdict{Action: moderationAllow}
+	}
+	return verdict{Action: f.Action, Reason: "Please mind your language."}
+}
+
+// mask replaces every character of s with an asterisk.
+func mask(s string) string {
+	return strings.Repeat("*", len([]rune(s)))
+}
+
+// patternRule blocks or rewrites messages matching a regular expression.
+// Action is reject, flag, mask or replace, the last rewriting matches to
+// Replacement (which may refer to groups as $1).
+type patternRule struct {
+	Name        string
+	Pattern     string
+	Action      string
+	Reason      string
+	Replacement string
+
+	re *regexp.Regexp
+}
+
+func newPatternRule(rule *patternRule) (*patternRule, error) {
+	switch rule.Action {
+	case moderationReject, moderationFlag, moderationMask, moderationReplace:
+	default:
+		return nil, fmt.Errorf("pattern %s: unknown action %q", rule.Name, rule.Action)
+	}
+	var err error
+	if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+		return nil, fmt.Errorf("pattern %s: %w", rule.Name, err)
+	}
+	if rule.Reason == "" {
+		rule.Reason = "Your message was blocked by the " + rule.Name + " rule."
+	}
+	return rule, nil
+}
+
+func (p *patternRule) Moderate(msg *message) verdict {
+	if !p.re.MatchString(msg.Message) {
+		return verdict{Action: moderationAllow}
+	}
+	switch p.Action {
+	case moderationMask:
+		msg.Message = p.re.ReplaceAllStringFunc(msg.Message, mask)
+	case moderationReplace:
+		msg.Message = p.re.ReplaceAllString(msg.Message, p.Replacement)
+	default:
+		return verdict{Action: p.Action, Reason: p.Reason}
+	}
+	return verdict{Action: moderationAllow}
+}
+
+// moderationConfig is the file given with -moderation:
+//
+//	{
+//	  "Words": {"Words": ["darn", "heck"], "Action": "mask"},
+//	  "Patterns": [
+//	    {"Name": "spam", "Pattern": "(?i)buy now", "Action": "reject", "Reason": "No ads, please."},
+//	    {"Name": "cards", "Pattern": "\\b\\d{4}( ?\\d{4}){3}\\b", "Action": "replace", "Replacement": "[card number]"}
+//	  ]
+//	}
+//
+// The word filter runs first, then the patterns in order.
+type moderationConfig struct {
+	Words    *wordFilter
+	Patterns []*patternRule
+}
+
+// loadModerators reads a moderationConfig from path.
+func loadModerators(path string) ([]Moderator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config moderationConfig
+	if err := decodeStrict(path, data, &config); err != nil {
+		return nil, err
+	}
+	return config.moderators()
+}
+
+// moderators returns the Moderators the config describes, in order.
+func (config *moderationConfig) moderators() ([]Moderator, error) {
+	var moderators []Moderator
+	if config.Words != nil {
+		f, err := newWordFilter(config.Words)
+		if err != nil {
+			return nil, err
+		}
+		moderators = append(moderators, f)
+	}
+	for _, rule := range config.Patterns {
+		p, err := newPatternRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		moderators = append(moderators, p)
+	}
+	return moderators, nil
+}
+
+// flaggedMessage is a message kept for admins to review.
+type flaggedMessage struct {
+	Message *message
+	Reason  string
+	Flagged time.Time
+}
+
+// moderate applies the room's moderators to a message from one of its
+// users and reports whether to broadcast it. The sender is told when a
+// message is rejected. It runs inside run.
+func (r *room) moderate(msg *message) bool {
+	v := moderate(r.moderators, msg)
+	if v.Action == moderationAllow {
+		// then the room's own filters
+		v = moderate(r.roomFilters(), msg)
+	}
+	switch v.Action {
+	case moderationReject:
+		r.tracer.Trace("Message rejected: ", msg.ID, " ", v.Reason)
+		notice := &message{ID: newID(), Type: msgTypeNotice, Room: r.name, Name: "system", Message: v.Reason, When: time.Now()}
+		for client := range r.clients {
+			if client.userID() == msg.UserID {
+				// dropped for a client that is not reading
+				r.sendDirect(client, notice)
+			}
+		}
+		return false
+	case moderationFlag:
+		r.tracer.Trace("Message flagged: ", msg.ID, " ", v.Reason)
+		flagged := flaggedMessage{Message: msg, Reason: v.Reason, Flagged: time.Now()}
+		if err := r.state.Put(moderationFlagsBucket, msg.ID, flagged); err != nil {
+			r.tracer.Error("Failed to keep flagged message: ", err)
+		}
+	}
+	return true
+}
+
+// moderationFlags is the admin API for reviewing flagged messages:
+//
+//	GET    /admin/moderation/flags       flagged messages, newest first
+//	DELETE /admin/moderation/flags/{id}  dismiss a flag
+type moderationFlags struct {
+	state StateStore
+}
+
+func (f *moderationFlags) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/moderation/flags"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		docs, err := f.state.List(moderationFlagsBucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		flags := make([]*flaggedMessage, 0, len(docs))
+		for _, doc := range docs {
+			var flagged flaggedMessage
+			if json.Unmarshal(doc, &flagged) == nil {
+				flags = append(flags, &flagged)
+			}
+		}
+		sort.Slice(flags, func(i, j int) bool { return flags[i].Flagged.After(flags[j].Flagged) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(flags)
+	case r.Method == http.MethodDelete && id != "":
+		if err := f.state.Delete(moderationFlagsBucket, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
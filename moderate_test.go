@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestModerators(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moderation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "moderation.json")
+	config := `{
+		"Words": {"Words": ["darn"]},
+		"Patterns": [
+			{"Name": "spam", "Pattern": "(?i)buy now", "Action": "reject", "Reason": "No ads, please."},
+			{"Name": "shouting", "Pattern": "^[A-Z !]{10,}$", "Action": "flag"},
+			{"Name": "cards", "Pattern": "\\b\\d{4}( ?\\d{4}){3}\\b", "Action": "replace", "Replacement": "[card number]"}
+		]
+	}`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	moderators, err := loadModerators(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		text, want, action string
+	}{
+		{"hello", "hello", moderationAllow},
+		{"Darn it, darning socks", "**** it, darning socks", moderationAllow},
+		{"BUY NOW while stocks last", "BUY NOW while stocks last", moderationReject},
+		{"STOP THAT NOW!", "STOP THAT NOW!", moderationFlag},
+		{"mine is 1234 5678 9012 3456", "mine is [card number]", moderationAllow},
+	} {
+		msg := &message{Message: test.text}
+		if v := moderate(moderators, msg); v.Action != test.action || msg.Message != test.want {
+			t.Errorf("%q: got %q %+v, want %q %s", test.text, msg.Message, v, test.want, test.action)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"Words": {"Words": []}}`,
+		`{"Words": {"Words": ["x"], "Action": "shout"}}`,
+		`{"Patterns": [{"Name": "bad", "Pattern": "(", "Action": "reject"}]}`,
+		`{"Patterns": [{"Name": "bad", "Pattern": "x"}]}`,
+	} {
+		ioutil.WriteFile(path, []byte(bad), 0600)
+		if _, err := loadModerators(path); err == nil {
+			t.Errorf("%s should not load", bad)
+		}
+	}
+}
+
+func TestRoomModeration(t *testing.T) {
+	r := newRoom("golang")
+	spam, _ := newPatternRule(&patternRule{Name: "spam", Pattern: "buy now", Action: moderationReject, Reason: "No ads."})
+	shouting, _ := newPatternRule(&patternRule{Name: "shouting", Pattern: "^[A-Z ]+$", Action: moderationFlag, Reason: "Shouting."})
+	r.moderators = []Moderator{spam, shouting}
+	go r.run()
+	ann := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": "ann"}}
+	bob := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": "bob"}}
+	r.join <- ann
+	r.join <- bob
+
+	r.forward <- &message{ID: "m1", UserID: "ann", Message: "buy now"}
+	if msg := receiveChat(t, ann); msg.Type != msgTypeNotice || msg.Message != "No ads." {
+		t.Errorf("the sender should be told why, got %+v", msg)
+	}
+	r.forward <- &message{ID: "m2", UserID: "ann", Message: "HELLO THERE"}
+	if msg := receiveChat(t, bob); msg.ID != "m2" {
+		t.Errorf("only the flagged message should reach bob, got %+v", msg)
+	}
+
+	flags := &moderationFlags{state: r.state}
+	w := httptest.NewRecorder()
+	flags.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/moderation/flags", nil))
+	if !strings.Contains(w.Body.String(), `"Reason":"Shouting."`) || strings.Contains(w.Body.String(), "buy now") {
+		t.Errorf("unexpected flags %s", w.Body)
+	}
+	w = httptest.NewRecorder()
+	flags.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/moderation/flags/m2", nil))
+	if docs, _ := r.state.List(moderationFlagsBucket); w.Code != http.StatusNoContent || len(docs) != 0 {
+		t.Errorf("dismissing should remove the flag, got %d %v", w.Code, docs)
+	}
+}
+
+func TestRejectionDoesNotWaitForTheSender(t *testing.T) {
+	r := newRoom("golang")
+	spam, _ := newPatternRule(&patternRule{Name: "spam", Pattern: "buy now", Action: moderationReject, Reason: "No ads."})
+	r.moderators = []Moderator{spam}
+	go r.run()
+	ann := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": "ann"}}
+	// mallory's connection never reads
+	mallory := &client{send: make(chan *message), room: r, userData: map[string]interface{}{"userid": "mallory"}}
+	r.join <- ann
+	r.join <- mallory
+	r.forward <- &message{ID: "m1", UserID: "mallory", Message: "buy now"}
+	r.forward <- &message{ID: "m2", UserID: "ann", Message: "still here"}
+	if msg := receiveChat(t, ann); msg.ID != "m2" {
+		t.Errorf("the room should not wait for mallory, got %+v", msg)
+	}
+}
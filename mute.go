@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// roomMutesBucket holds the users muted in each room, by room/userid.
+const roomMutesBucket = "room_mutes"
+
+// defaultMuteDuration is how long a mute without a Duration lasts.
+const defaultMuteDuration = 10 * time.Minute
+
+// roomMute keeps a user from sending messages to a room until Until.
+type roomMute struct {
+	Room   string
+	UserID string
+	By     string
+	Until  time.Time
+}
+
+// muteUntil returns when the mute msg asks for ends.
+func muteUntil(msg *message) time.Time {
+	d := time.Duration(msg.Duration) * time.Second
+	if d <= 0 {
+		d = defaultMuteDuration
+	}
+	return msg.When.Add(d)
+}
+
+// loadMutes reads the room's mutes from the state store the first time
+// they are needed. It runs inside run.
+func (r *room) loadMutes() {
+	if r.mutes != nil {
+		return
+	}
+	r.mutes = make(map[string]time.Time)
+	docs, err := r.state.List(roomMutesBucket)
+	if err != nil {
+		r.tracer.Warn("Failed to load mutes: ", err)
+		return
+	}
+	for key, doc := range docs {
+		var m roomMute
+		if strings.HasPrefix(key, r.name+"/") && json.Unmarshal(doc, &m) == nil {
+			r.mutes[m.UserID] = m.Until
+		}
+	}
+}
+
+// mutedUntil returns when the mute of the user with userID ends, or the
+// zero time if they are not muted at now. It runs inside run.
+func (r *room) mutedUntil(userID string, now time.Time) time.Time {
+	if userID == "" {
+		return time.Time{}
+	}
+	r.loadMutes()
+	until, ok := r.mutes[userID]
+	if !ok {
+		return time.Time{}
+	}
+	if !now.Before(until) {
+		delete(r.mutes, userID)
+		r.state.Delete(roomMutesBucket, r.name+"/"+userID)
+		return time.Time{}
+	}
+	return until
+}
+
+// saveMute records the mute or unmute msg asks for, returning why not if it
+// cannot. It runs inside run.
+func (r *room) saveMute(msg *message) string {
+	var err error
+	key := r.name + "/" + msg.Target
+	if msg.Type == msgTypeMute {
+		err = r.state.Put(roomMutesBucket, key, roomMute{Room: r.name, UserID: msg.Target, By: msg.UserID, Until: muteUntil(msg)})
+	} else {
+		err = r.state.Delete(roomMutesBucket, key)
+	}
+	if err != nil {
+		r.tracer.Error("Failed to save the mute: ", err)
+		return "The mute could not be saved."
+	}
+	return ""
+}
+
+// applyMute brings the room's mutes up to date with the mute or unmute msg,
+// accepted by this or another server, and tells the user. It runs inside
+// run.
+func (r *room) applyMute(msg *message) {
+	r.loadMutes()
+	text := "You can send messages to this room again."
+	if msg.Type == msgTypeMute {
+		until := muteUntil(msg)
+		r.mutes[msg.Target] = until
+		text = fmt.Sprintf("You have been muted in this room until %s.", until.Format("15:04 MST"))
+	} else {
+		delete(r.mutes, msg.Target)
+	}
+	for client := range r.clients {
+		if client.userID() == msg.Target {
+			r.refuse(client, text)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMutedUserIsSilenced(t *testing.T) {
+	r := newRoom("golang")
+	r.state.Put(roomSettingsBucket, "golang", roomSettings{Room: "golang", Owner: "ann"})
+	go r.run()
+	join := func(userID string) *client {
+		c := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": userID, "name": userID}}
+		r.join <- c
+		return c
+	}
+	ann, bob := join("ann"), join("bob")
+	send := func(from *client, msg *message) {
+		msg.ID, msg.UserID, msg.Name, msg.When, msg.from = newID(), from.userID(), from.userID(), time.Now(), from
+		r.forward <- msg
+	}
+	until := func(c *client, typ string) *message {
+		t.Helper()
+		for {
+			if msg := receiveChat(t, c); msg.Type == typ {
+				return msg
+			}
+		}
+	}
+
+	send(bob, &message{Type: msgTypeMute, Target: "ann", Duration: 60})
+	if msg := until(bob, msgTypeNotice); msg.Message == "" {
+		t.Error("a member may not mute the owner")
+	}
+	send(ann, &message{Type: msgTypeMute, Target: "bob", Duration: 60})
+	until(bob, msgTypeNotice) // bob is told he is muted
+	until(ann, msgTypeMute)
+	send(bob, &message{Message: "let me speak"})
+	if msg := until(bob, msgTypeNotice); msg.Message == "" {
+		t.Error("expected bob told he is muted")
+	}
+	send(ann, &message{Message: "hello"})
+	if msg := until(ann, msgTypeMessage); msg.Message != "hello" {
+		t.Errorf("bob's message should have been dropped, got %q", msg.Message)
+	}
+	send(ann, &message{Type: msgTypeUnmute, Target: "bob"})
+	until(ann, msgTypeUnmute)
+	send(bob, &message{Message: "thanks"})
+	if msg := until(ann, msgTypeMessage); msg.Message != "thanks" {
+		t.Errorf("bob should be able to speak again, got %q", msg.Message)
+	}
+}
+
+func TestMuteExpires(t *testing.T) {
+	r := newRoom("golang")
+	now := time.Now()
+	r.state.Put(roomMutesBucket, "golang/bob", roomMute{Room: "golang", UserID: "bob", Until: now.Add(time.Minute)})
+	if until := r.mutedUntil("bob", now); until.IsZero() {
+		t.Fatal("bob should be muted for a minute")
+	}
+	if until := r.mutedUntil("bob", now.Add(2*time.Minute)); !until.IsZero() {
+		t.Error("the mute should have expired")
+	}
+	var m roomMute
+	if err := r.state.Get(roomMutesBucket, "golang/bob", &m); err != ErrNoState {
+		t.Errorf("the expired mute should be forgotten, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxNameLength caps display names, in characters.
+const maxNameLength = 32
+
+// reservedNames may not be used as display names, since users would take
+// them for the server or its staff. They are compared by skeleton, so
+// "ADMIN" and "Аdmin" with a Cyrillic A are reserved too.
+var reservedNames = []string{"admin", "administrator", "system", "server", "moderator", "mod", "root", "support", "staff"}
+
+// homoglyphs maps characters that look like a lowercase ASCII letter to it,
+// for skeleton. It covers the Cyrillic and Greek letters most used to
+// impersonate, and digits and symbols used as letters.
+var homoglyphs = map[rune]rune{
+	'а': 'a', 'е': 'e', 'о': 'o', 'р': 'p', 'с': 'c', 'х': 'x', 'у': 'y',
+	'і': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'һ': 'h', 'ӏ': 'l', 'к': 'k',
+	'м': 'm', 'т': 't', 'в': 'b', 'н': 'h', 'ɡ': 'g', 'ⅼ': 'l',
+	'α': 'a', 'ε': 'e', 'ο': 'o', 'ρ': 'p', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'β': 'b', 'η': 'n', 'μ': 'u', 'ω': 'w',
+	'0': 'o', '1': 'l', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b',
+	'@': 'a', '$': 's', '|': 'l', '!': 'l', 'i': 'l',
+}
+
+// skeleton reduces name to what it looks like, so that names that would be
+// mistaken for each other have the same skeleton: letters are lowercased
+// and look-alikes replaced, "rn" becomes "m" and "vv" "w", and everything
+// but letters and digits, including spaces and accents, is dropped.
+func skeleton(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if g, ok := homoglyphs[c]; ok {
+			c = g
+		}
+		if c > unicode.MaxASCII {
+			// fold accented Latin letters to their base letter
+			c = foldAccent(c)
+		}
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			b.WriteRune(c)
+		}
+	}
+	return strings.NewReplacer("rn", "m", "vv", "w").Replace(b.String())
+}
+
+// foldAccent returns the unaccented letter of the common accented Latin
+// letters, and other characters unchanged.
+func foldAccent(c rune) rune {
+	for base, accented := range map[rune]string{
+		'a': "àáâãäåāăą", 'c': "çćĉċč", 'e': "èéêëēĕėęě", 'i': "ìíîïĩīĭįı",
+		'n': "ñńņňŉ", 'o': "òóôõöøōŏő", 'u': "ùúûüũūŭůűų", 'y': "ýÿŷ",
+		's': "śŝşš", 'z': "źżž", 'l': "ĺļľŀł", 'g': "ĝğġģ", 'd': "ďđ",
+	} {
+		if strings.ContainsRune(accented, c) {
+			return base
+		}
+	}
+	return c
+}
+
+// reservedName reports whether name looks like one of reservedNames.
+func reservedName(name string) bool {
+	s := skeleton(name)
+	for _, r := range reservedNames {
+		if s == skeleton(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanName returns name without control and invisible characters, with
+// runs of spaces made one, trimmed and cut to maxNameLength characters.
+func cleanName(name string) string {
+	name = strings.Map(func(c rune) rune {
+		switch {
+		case unicode.IsSpace(c):
+			return ' '
+		case unicode.IsControl(c), unicode.In(c, unicode.Cf, unicode.Mn):
+			return -1
+		}
+		return c
+	}, name)
+	name = strings.Join(strings.Fields(name), " ")
+	if r := []rune(name); len(r) > maxNameLength {
+		name = strings.TrimSpace(string(r[:maxNameLength]))
+	}
+	return name
+}
+
+// guestName returns a name for a user who has none, such as "Guest 4821".
+func guestName() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(9000))
+	if err != nil {
+		panic("chat: unable to read random bytes: " + err.Error())
+	}
+	return fmt.Sprintf("Guest %d", 1000+n.Int64())
+}
+
+// uniqueName returns the name c is shown by in the room. A user already in
+// the room, on any server, keeps the name they have there. Otherwise their
+// name is cleaned; a missing or reserved name is replaced by a guest name;
+// and a name that looks like another member's gets a number, "Ann 2", until
+// it doesn't. It runs inside run.
+func (r *room) uniqueName(c *client, now time.Time) string {
+	userID := c.userID()
+	list, err := members(r.state, r.name, now)
+	if err != nil {
+		r.tracer.Warn("Failed to list members for names: ", err)
+	}
+	taken := make(map[string]bool, len(list))
+	for _, m := range list {
+		if m.UserID == userID {
+			return m.Name
+		}
+		taken[skeleton(m.Name)] = true
+	}
+	name := cleanName(c.name())
+	if skeleton(name) == "" || reservedName(name) {
+		name = guestName()
+	}
+	base := name
+	for i := 2; taken[skeleton(name)]; i++ {
+		suffix := " " + strconv.Itoa(i)
+		if r := []rune(base); len(r)+len(suffix) > maxNameLength {
+			base = string(r[:maxNameLength-len(suffix)])
+		}
+		name = base + suffix
+	}
+	return name
+}
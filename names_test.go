@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSkeleton(t *testing.T) {
+	for _, same := range [][2]string{
+		{"Ann", "ann"},
+		{"Аnn", "Ann"}, // Cyrillic A
+		{"Ánn", "Ann"},
+		{"A n-n.", "Ann"},
+		{"pau1", "Paul"},
+		{"Bill", "BiII"},
+		{"Mary", "rnary"},
+		{"Ann​", "Ann"},
+	} {
+		if skeleton(same[0]) != skeleton(same[1]) {
+			t.Errorf("%q and %q should have the same skeleton, got %q and %q", same[0], same[1], skeleton(same[0]), skeleton(same[1]))
+		}
+	}
+	if skeleton("Ann") == skeleton("Bob") {
+		t.Error("different names should have different skeletons")
+	}
+}
+
+func TestReservedName(t *testing.T) {
+	for _, name := range []string{"admin", "ADMIN", "Аdmin", "Sy5tem", "root"} {
+		if !reservedName(name) {
+			t.Errorf("%q should be reserved", name)
+		}
+	}
+	if reservedName("Adminah") {
+		t.Error("a name merely starting with admin is not reserved")
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	if got := cleanName("  Ann\t​ Lee\n"); got != "Ann Lee" {
+		t.Errorf("unexpected clean name %q", got)
+	}
+	if got := cleanName(strings.Repeat("a", 50)); len(got) != maxNameLength {
+		t.Errorf("names should be cut to %d characters, got %d", maxNameLength, len(got))
+	}
+}
+
+func TestRoomGivesUniqueNames(t *testing.T) {
+	r := newRoom("golang")
+	go r.run()
+	join := func(userID, name string) string {
+		c := &client{send: make(chan *message, messageBufferSize), room: r, named: make(chan struct{}),
+			userData: map[string]interface{}{"userid": userID, "name": name}}
+		r.join <- c
+		<-c.named
+		return c.name()
+	}
+	for _, tc := range []struct{ userID, name, want string }{
+		{"ann", "Ann", "Ann"},
+		{"ann", "Ann", "Ann"}, // a second connection of the same user
+		{"ann2", "Ann", "Ann 2"},
+		{"ann3", "Аnn", "Аnn 3"},
+		{"bob", "Bob", "Bob"},
+	} {
+		if got := join(tc.userID, tc.name); got != tc.want {
+			t.Errorf("%s joining as %q should be %q, got %q", tc.userID, tc.name, tc.want, got)
+		}
+	}
+	for _, name := range []string{"System", ""} {
+		if got := join("x"+name, name); !strings.HasPrefix(got, "Guest ") {
+			t.Errorf("%q should be replaced by a guest name, got %q", name, got)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/law-lee/chat_server/trace"
+)
+
+// orphanGrace is how old a file must be before it can be an orphan, so
+// that uploads still being recorded, and attachments not sent yet, are
+// left alone.
+const orphanGrace = 24 * time.Hour
+
+// Why files are orphans.
+const (
+	orphanNoRecord   = "no upload record"
+	orphanUnsent     = "not in any message"
+	orphanNoFile     = "upload record without a file"
+	orphanReplaced   = "replaced by a newer avatar"
+	orphanNoOriginal = "still version of a removed avatar"
+)
+
+// orphan is an avatar or attachment file nothing refers to any more, or
+// an attachment record whose file is gone.
+type orphan struct {
+	// Kind is "avatar" or "attachment".
+	Kind     string
+	Name     string
+	Reason   string
+	Modified time.Time `json:",omitempty"`
+}
+
+// orphanCollector finds and deletes orphans: files left behind by uploads
+// that failed half way, attachments that were never sent or whose
+// messages and rooms were deleted, and avatars that were replaced or
+// removed without their files. It is the admin API for them:
+//
+//	GET  /admin/orphans  the orphans, without deleting them
+//	POST /admin/orphans  delete the orphans, answering with what was deleted
+//
+// and, with -collect-orphans, a scheduler job deleting them once a day.
+type orphanCollector struct {
+	avatars     *avatarStore
+	attachments *attachmentStore
+	// store holds the messages attachments are sent in; if nil, sent
+	// attachments can't be told from unsent ones and are all kept.
+	store  MessageStore
+	tracer trace.Tracer
+	now    func() time.Time
+}
+
+func newOrphanCollector(avatars *avatarStore, attachments *attachmentStore, store MessageStore) *orphanCollector {
+	return &orphanCollector{avatars: avatars, attachments: attachments, store: store, tracer: trace.Off(), now: time.Now}
+}
+
+// find returns the orphans, attachments first, each sorted by name.
+func (c *orphanCollector) find() ([]orphan, error) {
+	attachments, err := c.findAttachments()
+	if err != nil {
+		return nil, err
+	}
+	avatars, err := c.findAvatars()
+	if err != nil {
+		return nil, err
+	}
+	return append(attachments, avatars...), nil
+}
+
+func (c *orphanCollector) findAttachments() ([]orphan, error) {
+	if c.attachments == nil {
+		return nil, nil
+	}
+	cutoff := c.now().Add(-orphanGrace)
+	var sent map[string]bool
+	if c.store != nil {
+		msgs, err := c.store.Query(messageQuery{})
+		if err != nil {
+			return nil, err
+		}
+		sent = make(map[string]bool)
+		for _, msg := range msgs {
+			for _, a := range msg.Attachments {
+				sent[a.ID] = true
+			}
+		}
+	}
+	docs, err := c.attachments.state.List(attachmentsBucket)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]*storedAttachment, len(docs))
+	recorded := make(map[string]bool, len(docs))
+	for id, doc := range docs {
+		var a storedAttachment
+		if json.Unmarshal(doc, &a) == nil {
+			records[id] = &a
+			recorded[a.file()] = true
+		}
+	}
+	files, err := ioutil.ReadDir(c.attachments.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	onDisk := make(map[string]bool, len(files))
+	var orphans []orphan
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		onDisk[file.Name()] = true
+		if !recorded[file.Name()] && file.ModTime().Before(cutoff) {
+			orphans = append(orphans, orphan{Kind: "attachment", Name: file.Name(), Reason: orphanNoRecord, Modified: file.ModTime()})
+		}
+	}
+	for id, a := range records {
+		if !a.Uploaded.Before(cutoff) {
+			continue
+		}
+		switch {
+		case !onDisk[a.file()]:
+			orphans = append(orphans, orphan{Kind: "attachment", Name: id, Reason: orphanNoFile})
+		case sent != nil && !sent[id]:
+			orphans = append(orphans, orphan{Kind: "attachment", Name: id, Reason: orphanUnsent, Modified: a.Uploaded})
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Name < orphans[j].Name })
+	return orphans, nil
+}
+
+func (c *orphanCollector) findAvatars() ([]orphan, error) {
+	if c.avatars == nil {
+		return nil, nil
+	}
+	cutoff := c.now().Add(-orphanGrace)
+	names, err := c.avatars.blobs.List("")
+	if err != nil {
+		return nil, err
+	}
+	var orphans []orphan
+	for _, name := range names {
+		static := strings.HasSuffix(name, staticAvatarSuffix)
+		userID := strings.TrimSuffix(name, path.Ext(name))
+		if static {
+			userID = strings.TrimSuffix(name, staticAvatarSuffix)
+		}
+		var upload avatarUpload
+		var reason string
+		switch err := c.avatars.state.Get(avatarUploadsBucket, userID, &upload); {
+		case err == ErrNoState:
+			reason = orphanNoRecord
+		case err != nil:
+			return nil, err
+		case static && !upload.Animated:
+			reason = orphanNoOriginal
+		case !static && upload.URL != "/avatars/"+name:
+			reason = orphanReplaced
+		default:
+			continue
+		}
+		_, modified, err := c.avatars.blobs.Get(name)
+		if err == ErrNoBlob {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if modified.Before(cutoff) {
+			orphans = append(orphans, orphan{Kind: "avatar", Name: name, Reason: reason, Modified: modified})
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Name < orphans[j].Name })
+	return orphans, nil
+}
+
+// remove deletes o: an avatar or attachment file, or an attachment's
+// record, along with the file once nothing else refers to it.
+func (c *orphanCollector) remove(o orphan) error {
+	var err error
+	switch {
+	case o.Kind == "avatar":
+		err = c.avatars.blobs.Delete(o.Name)
+	case o.Reason == orphanNoRecord:
+		if err = os.Remove(filepath.Join(c.attachments.dir, o.Name)); err == nil || os.IsNotExist(err) {
+			err = c.attachments.keys.forget(fileKeysBucket, o.Name)
+		}
+		if err == nil {
+			err = c.attachments.state.Delete(attachmentRefsBucket, o.Name)
+		}
+	case o.Reason == orphanNoFile:
+		err = c.attachments.state.Delete(attachmentsBucket, o.Name)
+	default:
+		err = c.attachments.discard(o.Name)
+	}
+	if err == ErrNoBlob || err == ErrNoState {
+		err = nil
+	}
+	return err
+}
+
+// collect deletes the orphans, returning those it did.
+func (c *orphanCollector) collect() ([]orphan, error) {
+	orphans, err := c.find()
+	if err != nil {
+		return nil, err
+	}
+	deleted := make([]orphan, 0, len(orphans))
+	for _, o := range orphans {
+		if err := c.remove(o); err != nil {
+			return deleted, err
+		}
+		c.tracer.Trace("Deleted orphaned ", o.Kind, " ", o.Name, ": ", o.Reason)
+		deleted = append(deleted, o)
+	}
+	return deleted, nil
+}
+
+// tick collects the orphans at 04:00 every day. It is a scheduler job;
+// the server that claims the run does it.
+func (c *orphanCollector) tick(now time.Time) {
+	if now.Hour() != 4 || now.Minute() != 0 {
+		return
+	}
+	claimed, err := c.attachments.state.Create(scheduleRunsBucket, "orphans@"+strconv.FormatInt(now.Unix(), 10), now)
+	if err != nil || !claimed {
+		return
+	}
+	deleted, err := c.collect()
+	if err != nil {
+		c.tracer.Error("Failed to collect orphaned files: ", err)
+	}
+	if len(deleted) > 0 {
+		c.tracer.Info("Deleted ", len(deleted), " orphaned files")
+	}
+}
+
+func (c *orphanCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var orphans []orphan
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		orphans, err = c.find()
+	case http.MethodPost:
+		orphans, err = c.collect()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if orphans == nil {
+		orphans = []orphan{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orphans)
+}
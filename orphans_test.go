@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrphanCollector(t *testing.T) {
+	state := newFileState("")
+	attachments := &attachmentStore{dir: t.TempDir(), state: state, maxSize: defaultMaxAttachment}
+	avatars := newAvatarStore(dirBlobs(t.TempDir()), state)
+	store := newMemoryStore()
+	c := newOrphanCollector(avatars, attachments, store)
+
+	sent, err := attachments.save("abc", "sent.txt", strings.NewReader("sent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Save(&message{ID: newID(), Room: "lobby", UserID: "abc", Attachments: []attachment{*sent}, When: time.Now()})
+	unsent, _ := attachments.save("abc", "unsent.txt", strings.NewReader("unsent"))
+	noFile, _ := attachments.save("abc", "gone.txt", strings.NewReader("gone"))
+	gone, _ := lookupAttachment(state, noFile.ID)
+	os.Remove(filepath.Join(attachments.dir, gone.Hash))
+	// a file whose upload failed before it was recorded
+	noRecord := newID()
+	os.WriteFile(filepath.Join(attachments.dir, noRecord), []byte("half"), 0600)
+
+	w := httptest.NewRecorder()
+	avatars.upload(w, avatarRequest(t, "abc", "me.png", testPNG(t)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d %s", w.Code, w.Body)
+	}
+	avatars.blobs.Put("abc.gif", []byte("old"))
+	avatars.blobs.Put("def.png", []byte("unrecorded"))
+
+	// nothing is an orphan while it is new
+	if orphans, err := c.find(); err != nil || len(orphans) != 0 {
+		t.Fatalf("new files found as orphans: %v %v", orphans, err)
+	}
+
+	c.now = func() time.Time { return time.Now().Add(orphanGrace + time.Hour) }
+	want := map[string]string{
+		unsent.ID: orphanUnsent,
+		noFile.ID: orphanNoFile,
+		noRecord:  orphanNoRecord,
+		"abc.gif": orphanReplaced,
+		"def.png": orphanNoRecord,
+	}
+	get := func(method string) []orphan {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(method, "/admin/orphans", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", method, w.Code, w.Body)
+		}
+		var orphans []orphan
+		json.NewDecoder(w.Body).Decode(&orphans)
+		return orphans
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		orphans := get(method)
+		if len(orphans) != len(want) {
+			t.Errorf("%s: got %v, want %v", method, orphans, want)
+		}
+		for _, o := range orphans {
+			if want[o.Name] != o.Reason {
+				t.Errorf("%s: %s is an orphan because %q, want %q", method, o.Name, o.Reason, want[o.Name])
+			}
+		}
+	}
+	if orphans := get(http.MethodGet); len(orphans) != 0 {
+		t.Errorf("orphans left after collecting: %v", orphans)
+	}
+	kept, err := lookupAttachment(state, sent.ID)
+	if err != nil {
+		t.Fatalf("sent attachment deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(attachments.dir, kept.Hash)); err != nil {
+		t.Errorf("sent attachment's file deleted: %v", err)
+	}
+	if _, err := lookupAttachment(state, unsent.ID); err != ErrNoState {
+		t.Errorf("unsent attachment kept: %v", err)
+	}
+	if files, _ := avatars.blobs.List(""); len(files) != 1 || files[0] != "abc.png" {
+		t.Errorf("want only abc.png, got %v", files)
+	}
+}
+
+func TestOrphanCollectorTick(t *testing.T) {
+	state := newFileState("")
+	attachments := &attachmentStore{dir: t.TempDir(), state: state, maxSize: defaultMaxAttachment}
+	c := newOrphanCollector(nil, attachments, nil)
+	c.now = func() time.Time { return time.Now().Add(orphanGrace + time.Hour) }
+	name := filepath.Join(attachments.dir, newID())
+	os.WriteFile(name, []byte("half"), 0600)
+
+	c.tick(time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC))
+	if _, err := os.Stat(name); err != nil {
+		t.Fatalf("collected at 03:00: %v", err)
+	}
+	at := time.Date(2026, 1, 2, 4, 0, 0, 0, time.UTC)
+	// another server claimed the run
+	state.Create(scheduleRunsBucket, "orphans@"+strconv.FormatInt(at.Unix(), 10), at)
+	c.tick(at)
+	if _, err := os.Stat(name); err != nil {
+		t.Fatalf("collected a run another server claimed: %v", err)
+	}
+	c.tick(at.Add(24 * time.Hour))
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("orphan not collected: %v", err)
+	}
+}
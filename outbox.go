@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// relayInterval is how often the relay looks for queued messages it was not
+// told about, such as those it failed to publish, and relayBatch how many it
+// takes at a time.
+const (
+	relayInterval = 5 * time.Second
+	relayBatch    = 100
+)
+
+// orphanedAfter is how long a message may stay queued by another server
+// before the relay takes it over: that server stopped before publishing it.
+const orphanedAfter = time.Minute
+
+// Outbox is implemented by message stores that queue messages to be
+// published to the other servers in the same transaction that saves them,
+// so that a message is never published without being saved, nor saved
+// without being published.
+type Outbox interface {
+	// SaveQueued saves msg, as Save does, queued to be published by node.
+	SaveQueued(msg *message, node string) error
+	// Queued returns up to limit queued messages, oldest first: those of
+	// node, and those other nodes queued before orphaned.
+	Queued(node string, orphaned time.Time, limit int) ([]queuedMessage, error)
+	// Unqueue removes the published message of room with the given ID
+	// from the queue.
+	Unqueue(room, id string) error
+}
+
+// queuedMessage is a message in an Outbox, with the node that queued it
+// and when.
+type queuedMessage struct {
+	Node    string
+	Queued  time.Time
+	Message *message
+}
+
+func (s *memoryStore) SaveQueued(msg *message, node string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	s.byID[memoryKey(msg.Room, msg.ID)] = msg
+	s.queued = append(s.queued, queuedMessage{Node: node, Queued: time.Now(), Message: msg})
+	return nil
+}
+
+func (s *memoryStore) Queued(node string, orphaned time.Time, limit int) ([]queuedMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found []queuedMessage
+	for _, q := range s.queued {
+		if len(found) == limit {
+			break
+		}
+		if q.Node == node || q.Queued.Before(orphaned) {
+			found = append(found, q)
+		}
+	}
+	return found, nil
+}
+
+func (s *memoryStore) Unqueue(room, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unqueue(room, id)
+	return nil
+}
+
+// unqueue removes the message of room with the given ID from the outbox.
+// The caller holds mu.
+func (s *memoryStore) unqueue(room, id string) {
+	for i, q := range s.queued {
+		if q.Message.Room == room && q.Message.ID == id {
+			s.queued = append(s.queued[:i], s.queued[i+1:]...)
+			return
+		}
+	}
+}
+
+// startRelay starts the relay, if the store has an outbox and it is not
+// running yet.
+func (m *roomManager) startRelay() {
+	if _, ok := m.store.(Outbox); !ok || m.broker == nil {
+		return
+	}
+	m.relayOnce.Do(func() { go m.runRelay() })
+}
+
+// relaySoon tells the relay a message was queued.
+func (m *roomManager) relaySoon() {
+	m.startRelay()
+	select {
+	case m.relayNow <- struct{}{}:
+	default:
+	}
+}
+
+// runRelay publishes the messages queued in the store's outbox, and
+// delivers those taken over from stopped servers here as well. Rooms call
+// relaySoon as they queue them; it also looks every relayInterval, for
+// those it failed to publish and those orphaned.
+func (m *roomManager) runRelay() {
+	ticker := time.NewTicker(relayInterval)
+	defer ticker.Stop()
+	for {
+		m.relayQueued()
+		select {
+		case <-m.relayNow:
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayQueued publishes what is queued until the outbox is empty or
+// publishing fails.
+func (m *roomManager) relayQueued() {
+	outbox := m.store.(Outbox)
+	for {
+		queued, err := outbox.Queued(m.node, time.Now().Add(-m.orphanedAfter), relayBatch)
+		if err != nil {
+			m.tracer.Error("Failed to read the outbox: ", err)
+			return
+		}
+		for _, q := range queued {
+			if err := m.broker.Publish(q.Message); err != nil {
+				m.tracer.Warn("Failed to publish message, will retry: ", err)
+				return
+			}
+			if q.Node != m.node {
+				// the server that accepted it stopped before
+				// publishing it; rooms here drop it if they have it
+				m.receive(q.Message)
+			}
+			if err := outbox.Unqueue(q.Message.Room, q.Message.ID); err != nil {
+				m.tracer.Error("Failed to unqueue message: ", err)
+				return
+			}
+		}
+		if len(queued) < relayBatch {
+			return
+		}
+	}
+}
+
+func (s *sqlStore) SaveQueued(msg *message, node string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.insert(tx, msg); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("INSERT INTO outbox (room, id, node, queued_at) VALUES (%s, %s, %s, %s)",
+		s.dialect.placeholder(1), s.dialect.placeholder(2), s.dialect.placeholder(3), s.dialect.placeholder(4)),
+		msg.Room, msg.ID, node, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Queued(node string, orphaned time.Time, limit int) ([]queuedMessage, error) {
+	rows, err := s.db.Query(fmt.Sprintf(`SELECT o.node, o.queued_at, m.data FROM outbox o
+		JOIN room_messages m ON m.room = o.room AND m.id = o.id
+		WHERE o.node = %s OR o.queued_at < %s ORDER BY o.queued_at LIMIT %d`,
+		s.dialect.placeholder(1), s.dialect.placeholder(2), limit), node, orphaned.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []queuedMessage
+	for rows.Next() {
+		var q queuedMessage
+		var data string
+		if err := rows.Scan(&q.Node, &q.Queued, &data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &q.Message); err != nil {
+			return nil, err
+		}
+		found = append(found, q)
+	}
+	return found, rows.Err()
+}
+
+func (s *sqlStore) Unqueue(room, id string) error {
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM outbox WHERE room = %s AND id = %s",
+		s.dialect.placeholder(1), s.dialect.placeholder(2)), room, id)
+	return err
+}
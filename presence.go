@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// presenceBucket holds a roomMember per room, user and server, keyed
+// "{room}/{userid}@{node id}", so that a room's members can be listed
+// whichever server they are connected to.
+const presenceBucket = "presence"
+
+// roomMember is a user in a room, as listed by /rooms/{name}/members.
+type roomMember struct {
+	UserID    string
+	Name      string
+	AvatarURL string `json:",omitempty"`
+	Since     time.Time
+	// Node is the server the user is connected to; it is part of the key.
+	Node string `json:"-"`
+}
+
+func presenceKey(room, userID, node string) string {
+	return room + "/" + userID + "@" + node
+}
+
+// presence records that c's user joined or left the room and tells the
+// room. Only the first connection of a user to join and the last to leave
+// count. It runs inside run.
+func (r *room) presence(c *client, joined bool) {
+	userID := c.userID()
+	if userID == "" {
+		return
+	}
+	if joined {
+		r.roster[userID]++
+		if r.roster[userID] > 1 {
+			return
+		}
+	} else {
+		r.roster[userID]--
+		if r.roster[userID] > 0 {
+			return
+		}
+		delete(r.roster, userID)
+	}
+	now := time.Now()
+	avatarURL, _ := c.userData["avatar_url"].(string)
+	key := presenceKey(r.name, userID, nodeID)
+	var err error
+	if joined {
+		err = r.state.Put(presenceBucket, key, roomMember{UserID: userID, Name: c.name(), AvatarURL: avatarURL, Since: now})
+	} else {
+		err = r.state.Delete(presenceBucket, key)
+	}
+	if err != nil {
+		r.tracer.Warn("Failed to record presence: ", err)
+	}
+	event := &message{ID: newID(), Type: msgTypePresence, Room: r.name, UserID: userID, Name: c.name(), Message: "left", When: now, AvatarURL: avatarURL}
+	if joined {
+		event.Message = "joined"
+	}
+	if r.rooms != nil {
+		r.rooms.publish(event)
+	}
+	r.broadcast(event)
+}
+
+// members lists the users in a room on every live server, by name.
+func members(state StateStore, room string, now time.Time) ([]*roomMember, error) {
+	docs, err := state.List(presenceBucket)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := liveNodes(state, now)
+	if err != nil {
+		return nil, err
+	}
+	live := map[string]bool{nodeID: true}
+	for _, node := range nodes {
+		live[node.ID] = true
+	}
+	// deactivated users are not listed, even while their last
+	// connections close
+	deactivated, err := accounts.deactivated()
+	if err != nil {
+		return nil, err
+	}
+	byUser := make(map[string]*roomMember)
+	for key, doc := range docs {
+		if !strings.HasPrefix(key, room+"/") {
+			continue
+		}
+		var m roomMember
+		if json.Unmarshal(doc, &m) != nil {
+			continue
+		}
+		_, m.Node, _ = strings.Cut(key, "@")
+		if !live[m.Node] || deactivated[m.UserID] {
+			continue
+		}
+		// a user connected to several servers is listed once, since
+		// their first connection
+		if seen, ok := byUser[m.UserID]; !ok || m.Since.Before(seen.Since) {
+			byUser[m.UserID] = &m
+		}
+	}
+	list := make([]*roomMember, 0, len(byUser))
+	for _, m := range byUser {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// prunePresence forgets the members of servers that are no longer running.
+func prunePresence(state StateStore, nodes []nodeInfo) {
+	docs, err := state.List(presenceBucket)
+	if err != nil {
+		return
+	}
+	live := map[string]bool{nodeID: true}
+	for _, node := range nodes {
+		live[node.ID] = true
+	}
+	for key := range docs {
+		if _, node, _ := strings.Cut(key, "@"); !live[node] {
+			state.Delete(presenceBucket, key)
+		}
+	}
+}
+
+// serveMembers answers GET /rooms/{name}/members with the room's members.
+func (m *roomManager) serveMembers(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/")
+	if rest != "members" || !validRoomName(name) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ok, err := canEnter(m.state, name, currentUser(r)); err != nil || !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	list, err := members(m.state, name, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
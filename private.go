@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// roomSettingsBucket holds the roomSettings of the rooms that have any, by
+// room name. Rooms without settings are public and have no owner.
+const roomSettingsBucket = "room_settings"
+
+// roomSettings are what a room's owner decides about it. Only the members of
+// a private room, the users who joined it through an invite, may enter it,
+// besides its owner and the admins.
+type roomSettings struct {
+	Room    string
+	Private bool
+	Owner   string
+	Created time.Time
+	// Template is the template the room was created from, if any, and
+	// Filters the moderation rules it gave the room.
+	Template string            `json:",omitempty"`
+	Filters  *moderationConfig `json:",omitempty"`
+	// Expiry makes the room temporary; Archived is set once it expired
+	// and was archived, after which nobody may join it.
+	Expiry   *roomExpiry `json:",omitempty"`
+	Archived bool        `json:",omitempty"`
+	// Welcome is sent to users the first time they join.
+	Welcome *roomWelcome `json:",omitempty"`
+	// Rules must be accepted before posting to the room.
+	Rules *roomRules `json:",omitempty"`
+	// History limits what members see from before they joined.
+	History *historyVisibility `json:",omitempty"`
+	// NoGuests keeps guests out of the room.
+	NoGuests bool `json:",omitempty"`
+	// Embed lets anyone watch the room, read-only, at /embed/{name},
+	// unless it is private.
+	Embed bool `json:",omitempty"`
+}
+
+// loadRoomSettings returns the settings of room; a room without any gets
+// the zero settings, a public room with no owner.
+func loadRoomSettings(state StateStore, room string) (roomSettings, error) {
+	settings := roomSettings{Room: room}
+	if err := state.Get(roomSettingsBucket, room, &settings); err != nil && err != ErrNoState {
+		return settings, err
+	}
+	return settings, nil
+}
+
+// isRoomMember reports whether the user with userID joined room through an
+// invite.
+func isRoomMember(state StateStore, room, userID string) (bool, error) {
+	var member roomMembership
+	err := state.Get(roomMembersBucket, room+"/"+userID, &member)
+	if err == ErrNoState {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// canEnter reports whether the signed in user in userData may enter room:
+// anyone may enter a public room, but only the members, the owner and the
+// admins a private one, guests none that keeps them out, and bots only those
+// their scopes name.
+func canEnter(state StateStore, room string, userData map[string]interface{}) (bool, error) {
+	if scopes, bot := scopesOf(userData); bot && !scopes.inRoom(room) {
+		return false, nil
+	}
+	settings, err := loadRoomSettings(state, room)
+	if err == nil && settings.NoGuests && isGuest(userData) {
+		return false, nil
+	}
+	if err != nil || !settings.Private {
+		return err == nil, err
+	}
+	userID, _ := userData["userid"].(string)
+	email, _ := userData["email"].(string)
+	if userID != "" && userID == settings.Owner || isAdmin(email) {
+		return true, nil
+	}
+	if userID == "" {
+		return false, nil
+	}
+	return isRoomMember(state, room, userID)
+}
+
+// canInvite reports whether the user with userID may create invites to a
+// room: anyone may to a public room, but only the owner and the admins to a
+// private one.
+func canInvite(state StateStore, room, userID string, admin bool) (bool, error) {
+	settings, err := loadRoomSettings(state, room)
+	if err != nil || !settings.Private || admin {
+		return err == nil, err
+	}
+	return userID != "" && userID == settings.Owner, nil
+}
+
+// roomSettingsAPI lets users create rooms they own and owners change them:
+//
+//	GET  /api/rooms          the rooms the user may enter, see listRooms
+//	POST /api/rooms          create a room: {"Name", "Private", "Template", "Expiry"}
+//	GET  /api/rooms/{name}   a room's settings
+//	PUT  /api/rooms/{name}   change them: {"Private"}, by the owner or an admin
+//
+// and its roles, bans, expiry, integrations, welcome message, rules, history,
+// guests, embedding and bots' messages, see serveRoles, serveBans,
+// serveExpiry, serveIntegrations, serveWelcome, serveRules, serveHistory,
+// serveGuests, serveEmbed and serveMessages.
+//
+// Rooms nobody created are public and have no owner; an admin may make one
+// private, and then only admins and its members may enter.
+type roomSettingsAPI struct {
+	state StateStore
+	// rooms, if set, is where banned users are disconnected and bots'
+	// messages are posted.
+	rooms *roomManager
+}
+
+func (a *roomSettingsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/rooms"), "/")
+	user := currentUser(r)
+	userID := user.Get("userid").Str()
+	admin := isAdmin(user.Get("email").Str())
+	if r.Method == http.MethodGet && name == "" {
+		a.listRooms(w, r, user)
+		return
+	}
+	if r.Method == http.MethodPost && name == "" {
+		var req struct {
+			Name     string
+			Private  bool
+			Template string
+			Expiry   *roomExpiry
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validRoomName(req.Name) || req.Expiry != nil && !req.Expiry.valid() {
+			http.Error(w, "body must be {\"Name\": \"...\", \"Private\": true} with a valid room name", http.StatusBadRequest)
+			return
+		}
+		var template *roomTemplate
+		if req.Template != "" {
+			var err error
+			if template, err = loadRoomTemplate(a.state, req.Template); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if template == nil || a.rooms == nil {
+				http.Error(w, "no such template", http.StatusBadRequest)
+				return
+			}
+		}
+		settings, err := createRoom(a.state, a.rooms, req.Name, userID, req.Private, req.Expiry, template)
+		if err == errRoomExists || err == errRoomInUse {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(settings)
+		return
+	}
+	name, rest, _ := strings.Cut(name, "/")
+	if !validRoomName(name) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	settings, err := loadRoomSettings(a.state, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ok, err := canEnter(a.state, name, user); err != nil || !ok {
+		// a private room is not there for those who may not enter it
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if rest != "" {
+		switch part, target, _ := strings.Cut(rest, "/"); part {
+		case "roles":
+			a.serveRoles(w, r, name, target, user)
+		case "bans":
+			a.serveBans(w, r, name, target, user)
+		case "expiry":
+			a.serveExpiry(w, r, settings, user)
+		case "integrations":
+			a.serveIntegrations(w, r, name, target, user)
+		case "welcome":
+			a.serveWelcome(w, r, settings, user)
+		case "rules":
+			a.serveRules(w, r, settings, user)
+		case "history":
+			a.serveHistory(w, r, settings, user)
+		case "guests":
+			a.serveGuests(w, r, settings, user)
+		case "embed":
+			a.serveEmbed(w, r, settings, user)
+		case "messages":
+			a.serveMessages(w, r, name, user)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !admin && (userID == "" || userID != settings.Owner) {
+			http.Error(w, "only the room's owner may change it", http.StatusForbidden)
+			return
+		}
+		var req struct{ Private bool }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "body must be {\"Private\": true}", http.StatusBadRequest)
+			return
+		}
+		settings.Private = req.Private
+		if settings.Created.IsZero() {
+			settings.Created = time.Now()
+		}
+		if err := a.state.Put(roomSettingsBucket, name, settings); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/objx"
+)
+
+func TestRoomsInUseCannotBeClaimed(t *testing.T) {
+	rooms := newRoomManager()
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	guest := objx.New(map[string]interface{}{"userid": guestIDPrefix + "1", "name": "Guest 1", "guest": true})
+	rooms.get("golang")
+	rooms.store.Save(&message{ID: "m1", Type: msgTypeMessage, Room: "old", Message: "hi", When: time.Now()})
+	for _, name := range []string{defaultRoom, "golang", "old"} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(http.MethodPost, "/api/rooms", strings.NewReader(`{"Name": "`+name+`", "Private": true}`), guest))
+		if w.Code != http.StatusConflict {
+			t.Errorf("%s: expected 409, got %d: %s", name, w.Code, w.Body)
+		}
+		if settings, err := loadRoomSettings(rooms.state, name); err != nil || settings.Owner != "" || settings.Private {
+			t.Errorf("%s should have no owner, got %+v %v", name, settings, err)
+		}
+	}
+}
+
+func TestPrivateRoom(t *testing.T) {
+	state := newFileState("")
+	api := &roomSettingsAPI{state: state}
+	s := &invites{state: state}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})
+	serve := func(h http.Handler, method, path, body string, user objx.Map) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, withAuthCookie(method, path, strings.NewReader(body), user))
+		return w
+	}
+
+	if w := serve(api, http.MethodPost, "/api/rooms", `{"Name": "secret", "Private": true}`, ann); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(api, http.MethodPost, "/api/rooms", `{"Name": "secret"}`, bob); w.Code != http.StatusConflict {
+		t.Errorf("a room can only be created once, got %d", w.Code)
+	}
+	if w := serve(api, http.MethodGet, "/api/rooms/secret", "", bob); w.Code != http.StatusNotFound {
+		t.Errorf("bob should not see the private room, got %d", w.Code)
+	}
+	if w := serve(s, http.MethodPost, "/api/invites", `{"Room": "secret"}`, bob); w.Code != http.StatusForbidden {
+		t.Errorf("only the owner may invite, got %d", w.Code)
+	}
+
+	r := newRoom("secret")
+	r.state = state
+	go r.run()
+	server := httptest.NewServer(r)
+	defer server.Close()
+	dial := func(user objx.Map) (*websocket.Conn, *http.Response, error) {
+		req := withAuthCookie(http.MethodGet, "/room", nil, user)
+		return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"Cookie": req.Header["Cookie"]})
+	}
+	if _, resp, err := dial(bob); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bob should be refused before the upgrade, got %v", err)
+	}
+	conn, _, err := dial(ann)
+	if err != nil {
+		t.Fatalf("the owner should get in: %v", err)
+	}
+	conn.Close()
+
+	w := serve(s, http.MethodPost, "/api/invites", `{"Room": "secret"}`, ann)
+	var invite roomInvite
+	if err := json.NewDecoder(w.Body).Decode(&invite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.redeem(invite.Token, bob); err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err = dial(bob)
+	if err != nil {
+		t.Fatalf("bob should get in with the invite: %v", err)
+	}
+	conn.Close()
+	if w := serve(api, http.MethodPut, "/api/rooms/secret", `{"Private": false}`, bob); w.Code != http.StatusForbidden {
+		t.Errorf("only the owner may change the room, got %d", w.Code)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// protocol is a version of the websocket protocol, chosen by the client as
+// a websocket subprotocol when it connects.
+type protocol struct {
+	// name is the subprotocol, such as "chat.v1".
+	name    string
+	version int
+	codec   codec
+	// batching is set if the protocol always sends what is waiting for
+	// the client in one frame, without it being asked for in a hello.
+	batching bool
+	// deprecated, if set, is the notice sent to clients still using the
+	// protocol while they are given time to move to a newer one.
+	deprecated string
+}
+
+// codec decodes and encodes the frames of a protocol.
+type codec interface {
+	// decode returns the messages in a frame from the client.
+	decode(frame []byte) ([]*message, error)
+	// encode returns the frame sending msgs to the client.
+	encode(msgs []*message) ([]byte, error)
+}
+
+// protocols are the protocols this server speaks, oldest first. Clients that
+// ask for none of them get the first, which is what clients spoke before
+// subprotocols were introduced.
+var protocols = []*protocol{
+	{name: "chat.v1", version: 1, codec: objectCodec{}},
+	{name: "chat.v2", version: 2, codec: arrayCodec{}, batching: true},
+}
+
+// subprotocols are the names of protocols, for the upgrader to advertise.
+func subprotocols() []string {
+	names := make([]string, len(protocols))
+	for i, p := range protocols {
+		names[i] = p.name
+	}
+	return names
+}
+
+// protocolNamed returns the protocol called name, or the first protocol if
+// there is none.
+func protocolNamed(name string) *protocol {
+	for _, p := range protocols {
+		if p.name == name {
+			return p
+		}
+	}
+	return protocols[0]
+}
+
+// objectCodec is the codec of chat.v1: the client sends one message per
+// frame, as a JSON object, and the server does too unless batching was
+// agreed, when several messages come as a JSON array.
+type objectCodec struct{}
+
+func (objectCodec) decode(frame []byte) ([]*message, error) {
+	var msg *message
+	if err := json.Unmarshal(frame, &msg); err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, nil
+	}
+	return []*message{msg}, nil
+}
+
+func (objectCodec) encode(msgs []*message) ([]byte, error) {
+	if len(msgs) == 1 {
+		return json.Marshal(msgs[0])
+	}
+	return json.Marshal(msgs)
+}
+
+// errBatchTooLarge is returned for a frame with more than maxBatch messages.
+var errBatchTooLarge = errors.New("too many messages in one frame")
+
+// arrayCodec is the codec of chat.v2: every frame, either way, is a JSON
+// array of messages.
+type arrayCodec struct{}
+
+func (arrayCodec) decode(frame []byte) ([]*message, error) {
+	var msgs []*message
+	if err := json.Unmarshal(frame, &msgs); err != nil {
+		return nil, err
+	}
+	if len(msgs) > maxBatch {
+		return nil, errBatchTooLarge
+	}
+	kept := msgs[:0]
+	for _, msg := range msgs {
+		if msg != nil {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, nil
+}
+
+func (arrayCodec) encode(msgs []*message) ([]byte, error) {
+	return json.Marshal(msgs)
+}
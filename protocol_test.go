@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/objx"
+
+	"github.com/law-lee/chat_server/trace"
+)
+
+func TestProtocolNamed(t *testing.T) {
+	if p := protocolNamed("chat.v2"); p.version != 2 {
+		t.Errorf("chat.v2 should be version 2, got %d", p.version)
+	}
+	if p := protocolNamed(""); p != protocols[0] {
+		t.Errorf("a client asking for no protocol should get %s, got %s", protocols[0].name, p.name)
+	}
+}
+
+func TestSubprotocolV2(t *testing.T) {
+	r := newRoomManager().get("golang")
+	server := httptest.NewServer(r)
+	defer server.Close()
+	req := withAuthCookie(http.MethodGet, "/room", nil, objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"}))
+	dialer := websocket.Dialer{Subprotocols: []string{"chat.v2"}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"Cookie": req.Header["Cookie"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "chat.v2" {
+		t.Fatalf("the server should accept chat.v2, chose %q", conn.Subprotocol())
+	}
+	// every frame is an array, either way
+	conn.WriteJSON([]*message{
+		{Type: msgTypeHello, Hello: &hello{Versions: []int{1}}},
+		{ID: "one", Message: "one"},
+	})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var gotHello, gotMessage bool
+	for !gotHello || !gotMessage {
+		var batch []message
+		if err := conn.ReadJSON(&batch); err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range batch {
+			switch msg.Type {
+			case msgTypeHello:
+				if msg.Hello.Version != 2 {
+					t.Errorf("the hello should answer with the version of the connection, got %d", msg.Hello.Version)
+				}
+				gotHello = true
+			case msgTypeMessage:
+				if msg.Message != "one" {
+					t.Errorf("unexpected message %q", msg.Message)
+				}
+				gotMessage = true
+			}
+		}
+	}
+}
+
+func TestSampledConnectionIsRecorded(t *testing.T) {
+	var buf syncBuffer
+	r := newRoomManager().get("golang")
+	r.frames = trace.NewFrames(&buf, 0, []string{"ann"})
+	server := httptest.NewServer(r)
+	defer server.Close()
+	conn := dialRoom(t, server, objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"}))
+	conn.WriteJSON(&message{ID: "one", Message: "recorded"})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == msgTypeAck {
+			break
+		}
+	}
+	var in, out int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var event map[string]string
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event["user"] != "ann" || event["room"] != "golang" {
+			t.Errorf("unexpected event %v", event)
+		}
+		switch event["dir"] {
+		case trace.In:
+			in++
+		case trace.Out:
+			out++
+		}
+	}
+	if in != 1 || out == 0 {
+		t.Errorf("expected 1 frame in and some out, got %d and %d", in, out)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
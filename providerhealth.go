@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	gomniauthcommon "github.com/stretchr/gomniauth/common"
+)
+
+const (
+	// providerFailureThreshold is how many sign-ins in a row may fail at a
+	// login provider before it is taken off the login page.
+	providerFailureThreshold = 5
+	// providerCooldown is how long a failing login provider stays off the
+	// login page before users may try it again.
+	providerCooldown = 2 * time.Minute
+)
+
+// providerHealth is a circuit breaker for each login provider. Callbacks
+// whose token exchange or profile request fails count against the provider;
+// after providerFailureThreshold failures in a row it is down for
+// providerCooldown, hidden from the login page with an explanation. After
+// that the next sign-in tries it again, and one more failure takes it down
+// again until a sign-in succeeds. A nil *providerHealth has every provider
+// up.
+type providerHealth struct {
+	mu        sync.Mutex
+	providers map[string]*providerState
+	// now is time.Now, replaced by tests.
+	now func() time.Time
+}
+
+type providerState struct {
+	displayName string
+	failures    int
+	lastErr     error
+	// downUntil is when the provider comes back after failing.
+	downUntil time.Time
+}
+
+// loginHealth tracks the login providers of this server.
+var loginHealth = newProviderHealth()
+
+func newProviderHealth() *providerHealth {
+	return &providerHealth{providers: make(map[string]*providerState), now: time.Now}
+}
+
+// record records a callback from provider whose calls to it took d and
+// failed with err if it is not nil.
+func (h *providerHealth) record(provider gomniauthcommon.Provider, d time.Duration, err error) {
+	name := provider.Name()
+	serverMetrics.observeLogin(name, d, err)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.providers[name]
+	if !ok {
+		s = &providerState{}
+		h.providers[name] = s
+	}
+	if err == nil {
+		*s = providerState{displayName: provider.DisplayName()}
+		serverMetrics.setLoginDown(name, false)
+		return
+	}
+	s.displayName = provider.DisplayName()
+	s.failures++
+	s.lastErr = err
+	if s.failures >= providerFailureThreshold {
+		s.downUntil = h.now().Add(providerCooldown)
+		serverMetrics.setLoginDown(name, true)
+	}
+}
+
+// down returns the error provider is down with, or nil if users may sign
+// in with it.
+func (h *providerHealth) down(provider string) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.providers[provider]
+	if !ok || !h.now().Before(s.downUntil) {
+		return nil
+	}
+	return fmt.Errorf("%d sign-ins in a row failed, the last with: %v", s.failures, s.lastErr)
+}
+
+// downProviders returns what the login page says about each provider that is
+// down, by name.
+func (h *providerHealth) downProviders() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	down := make(map[string]string)
+	for name, s := range h.providers {
+		if !h.now().Before(s.downUntil) {
+			continue
+		}
+		down[name] = fmt.Sprintf("Signing in with %s is not working right now. Please try again in a few minutes or use another service.", s.displayName)
+	}
+	return down
+}
+
+// status returns, for the readiness check, each provider that has been
+// used and whether it is "ok", failing or down.
+func (h *providerHealth) status() map[string]string {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status := make(map[string]string, len(h.providers))
+	for name, s := range h.providers {
+		switch {
+		case h.now().Before(s.downUntil):
+			status[name] = fmt.Sprintf("down until %s: %v", s.downUntil.Format(time.RFC3339), s.lastErr)
+		case s.failures > 0:
+			status[name] = fmt.Sprintf("%d failed: %v", s.failures, s.lastErr)
+		default:
+			status[name] = "ok"
+		}
+	}
+	return status
+}
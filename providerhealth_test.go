@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProviderHealth(t *testing.T) {
+	h := newProviderHealth()
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	discord := newOAuthProvider(discordEndpoints(), "id", "secret", "https://chat.example.com/auth/callback/discord")
+	failed := errors.New("token endpoint answered 502")
+
+	for i := 0; i < providerFailureThreshold-1; i++ {
+		h.record(discord, time.Second, failed)
+	}
+	if err := h.down("discord"); err != nil {
+		t.Fatalf("a provider should stay up until %d failures, got %v", providerFailureThreshold, err)
+	}
+	h.record(discord, time.Second, failed)
+	if err := h.down("discord"); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("expected the provider to be down with its last error, got %v", err)
+	}
+	if msg := h.downProviders()["discord"]; !strings.Contains(msg, "Discord is not working") {
+		t.Errorf("the login page should explain the provider is gone, got %q", msg)
+	}
+	if status := h.status()["discord"]; !strings.HasPrefix(status, "down until") {
+		t.Errorf("unexpected status %q", status)
+	}
+
+	// after the cooldown it is tried again, and one more failure takes it down
+	now = now.Add(providerCooldown)
+	if err := h.down("discord"); err != nil {
+		t.Errorf("the provider should be tried again after the cooldown, got %v", err)
+	}
+	h.record(discord, time.Second, failed)
+	if h.down("discord") == nil {
+		t.Error("a failure after the cooldown should take the provider down again")
+	}
+	now = now.Add(providerCooldown)
+	h.record(discord, time.Second, nil)
+	if err := h.down("discord"); err != nil || h.status()["discord"] != "ok" {
+		t.Errorf("a sign-in should bring the provider back, got %v %q", err, h.status()["discord"])
+	}
+
+	var b bytes.Buffer
+	serverMetrics.write(&b)
+	for _, want := range []string{`chat_login_callbacks_total{provider="discord",result="error"} 6`, `chat_login_callbacks_total{provider="discord",result="ok"} 1`,
+		`chat_login_callback_seconds_count{provider="discord"} 7`, `chat_login_provider_down{provider="discord"} 0`} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
+
+func TestReadinessWithProviderDown(t *testing.T) {
+	p := newProbes(newRoomManager(), mapSecrets{"github_client_id": "id", "github_client_sec": "sec"})
+	p.logins = newProviderHealth()
+	github := newOAuthProvider(oauthEndpoints{name: "github", displayName: "GitHub"}, "id", "secret", "")
+	for i := 0; i < providerFailureThreshold; i++ {
+		p.logins.record(github, time.Second, errors.New("timeout"))
+	}
+	w := httptest.NewRecorder()
+	p.ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "every login provider configured is down") ||
+		!strings.Contains(w.Body.String(), `"login/github":"down until`) {
+		t.Errorf("with its only provider down the server should not be ready, got %d %s", w.Code, w.Body)
+	}
+
+	p.secrets = mapSecrets{"github_client_id": "id", "github_client_sec": "sec", "google_client_id": "id", "google_client_sec": "sec"}
+	w = httptest.NewRecorder()
+	p.ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("another provider should keep the server ready, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/law-lee/chat_server/trace"
+)
+
+// The rate limit policies, i.e. what happens to a message sent by a client
+// that is over its limit.
+const (
+	// rateLimitDrop discards the message.
+	rateLimitDrop = "drop"
+	// rateLimitDelay holds the message back until the client is within
+	// its limit again, which also stops reading from the client meanwhile.
+	rateLimitDelay = "delay"
+	// rateLimitDisconnect closes the connection.
+	rateLimitDisconnect = "disconnect"
+)
+
+// rateLimit configures how fast users may send messages. Each user may send
+// Burst messages at once and then Rate per second, whichever connections
+// and servers they use; likewise each IP address with IPBurst and IPRate.
+// Bots are a class of their own, held to BotBurst and BotRate instead and to
+// no IP limit, since many may run on one host. A zero rate means no limit
+// of that kind.
+type rateLimit struct {
+	Rate     float64
+	Burst    int
+	IPRate   float64
+	IPBurst  int
+	BotRate  float64
+	BotBurst int
+	Policy   string
+}
+
+// forUser returns the limit for the user in userData: l for users, and the
+// bot limit for bots.
+func (l rateLimit) forUser(userData map[string]interface{}) rateLimit {
+	if !isBot(userData) {
+		return l
+	}
+	return rateLimit{Rate: l.BotRate, Burst: l.BotBurst, Policy: l.Policy}
+}
+
+// validRateLimitPolicy reports whether policy is one of the policies above.
+func validRateLimitPolicy(policy string) bool {
+	return policy == rateLimitDrop || policy == rateLimitDelay || policy == rateLimitDisconnect
+}
+
+// take takes a token for a message from userID at ip from the buckets in
+// limiter. If one of them is empty it reports how long until it is not.
+func (l rateLimit) take(limiter RateLimiter, userID, ip string, now time.Time) (ok bool, wait time.Duration) {
+	if l.Rate > 0 {
+		if ok, wait := limiter.Take("user:"+userID, l.Rate, l.Burst, now); !ok {
+			return false, wait
+		}
+	}
+	if l.IPRate > 0 && ip != "" {
+		return limiter.Take("ip:"+ip, l.IPRate, l.IPBurst, now)
+	}
+	return true, 0
+}
+
+// RateLimiter keeps token buckets by key.
+type RateLimiter interface {
+	// Take takes a token from the bucket for key, which holds at most
+	// burst tokens and gains rate tokens a second. If the bucket is empty
+	// it reports how long until it is not.
+	Take(key string, rate float64, burst int, now time.Time) (ok bool, wait time.Duration)
+}
+
+// newRateLimiter returns the RateLimiter described by spec:
+//
+//	memory                                 buckets of this server only
+//	redis://[:password@]host[:port][/db]   Redis, shared between servers
+func newRateLimiter(spec string) (RateLimiter, error) {
+	switch {
+	case spec == "" || spec == "memory":
+		return newLocalLimiter(), nil
+	case strings.HasPrefix(spec, "redis://"):
+		client, err := newRedisClient(spec)
+		if err != nil {
+			return nil, err
+		}
+		return &redisLimiter{client: client, fallback: newLocalLimiter(), tracer: trace.Off()}, nil
+	}
+	return nil, fmt.Errorf("unknown rate limiter %q", spec)
+}
+
+// maxLocalBuckets is how many buckets a localLimiter keeps before it
+// forgets those that have filled up again.
+const maxLocalBuckets = 10000
+
+// localLimiter keeps its buckets in memory, so limits only hold per server.
+type localLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newLocalLimiter() *localLimiter {
+	return &localLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *localLimiter) Take(key string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxLocalBuckets {
+			l.prune(now)
+		}
+		b = newTokenBucket(rate, burst)
+		l.buckets[key] = b
+	}
+	l.mu.Unlock()
+	return b.take(now)
+}
+
+// prune forgets the buckets that are full again, which behave just like
+// new ones. The caller must hold l.mu.
+func (l *localLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		b.mu.Lock()
+		full := now.Sub(b.last).Seconds()*b.rate+b.tokens >= b.burst
+		b.mu.Unlock()
+		if full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// redisRateScript is a token bucket kept in a Redis hash, which expires
+// once the bucket would be full again. It answers {allowed, wait in ms}.
+const redisRateScript = `
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens, last = tonumber(b[1]) or burst, tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) / 1000 * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`
+
+// redisRatePrefix is prepended to bucket keys to make their Redis keys.
+const redisRatePrefix = "chat:rate:"
+
+// redisLimiter keeps the buckets in Redis so that a user is held to one
+// limit across all servers. While Redis can't be reached it falls back to
+// buckets of its own, so limits still hold per server.
+type redisLimiter struct {
+	client   *redisClient
+	fallback *localLimiter
+	tracer   trace.Tracer
+	// failing is set while Redis is failing, so that is traced once.
+	failing int32
+}
+
+func (l *redisLimiter) Take(key string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	if burst < 1 {
+		burst = 1
+	}
+	reply, err := l.client.do("EVAL", redisRateScript, "1", redisRatePrefix+key,
+		strconv.FormatFloat(rate, 'g', -1, 64), strconv.Itoa(burst), strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10))
+	values, ok := reply.([]interface{})
+	if err == nil && (!ok || len(values) != 2) {
+		err = fmt.Errorf("redis: unexpected rate limit reply %v", reply)
+	}
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&l.failing, 0, 1) {
+			l.tracer.Warn("Rate limiting locally, Redis failed: ", err)
+		}
+		return l.fallback.Take(key, rate, burst, now)
+	}
+	if atomic.CompareAndSwapInt32(&l.failing, 1, 0) {
+		l.tracer.Trace("Rate limiting through Redis again")
+	}
+	allowed, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond
+}
+
+// newTokenBucket returns a full token bucket.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// tokenBucket is a token bucket rate limiter.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // most tokens the bucket holds
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token if there is one. Otherwise it reports how long it will
+// be until there is.
+func (b *tokenBucket) take(now time.Time) (ok bool, wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// realIPHeader, if set, is the header a trusted proxy in front of the
+// servers puts the client's address in, such as X-Real-IP.
+var realIPHeader string
+
+// clientIP returns the address a request came from, for per-IP limits.
+func clientIP(r *http.Request) string {
+	if realIPHeader != "" {
+		if ip := strings.TrimSpace(r.Header.Get(realIPHeader)); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// throttle applies the room's rate limit to a message just read from c and
+// reports whether to handle it. The client is told the first time it goes
+// over the limit; under the disconnect policy its connection is closed and
+// read should return.
+func (c *client) throttle() (handle, disconnect bool) {
+	limit := c.room.rateLimit.forUser(c.userData)
+	ok, wait := limit.take(c.room.limiter, c.userID(), c.ip, time.Now())
+	if ok {
+		c.throttled = false
+		return true, false
+	}
+	policy := limit.Policy
+	if !c.throttled || policy == rateLimitDisconnect {
+		c.room.notice(c, fmt.Sprintf("You are sending messages too fast; at most %g per second, please.", limit.Rate))
+	}
+	c.throttled = true
+	switch policy {
+	case rateLimitDelay:
+		time.Sleep(wait)
+		limit.take(c.room.limiter, c.userID(), c.ip, time.Now())
+		return true, false
+	case rateLimitDisconnect:
+		c.room.tracer.Trace("Client disconnected for exceeding the rate limit: ", c.userID())
+		c.socket.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+			time.Now().Add(time.Second))
+		return false, true
+	}
+	return false, false
+}
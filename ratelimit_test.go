@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("message %d should fit in the burst", i+1)
+		}
+	}
+	ok, wait := b.take(now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("bucket should be empty for 500ms, got %v %v", ok, wait)
+	}
+	if ok, _ := b.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Error("a token should have been added after 500ms")
+	}
+	if ok, _ := b.take(now.Add(time.Hour)); !ok {
+		t.Error("bucket should have refilled")
+	}
+	if ok, _ := (rateLimit{}).take(nil, "ann", "10.0.0.1", now); !ok {
+		t.Error("a zero rate should mean no limit")
+	}
+}
+
+func TestThrottleDropsAndNoticesOnce(t *testing.T) {
+	r := newRoom(defaultRoom)
+	r.rateLimit = rateLimit{Rate: 0.001, Burst: 1, Policy: rateLimitDrop}
+	go r.run()
+	c := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- c
+	if handle, _ := c.throttle(); !handle {
+		t.Fatal("first message should be handled")
+	}
+	for i := 0; i < 3; i++ {
+		if handle, disconnect := c.throttle(); handle || disconnect {
+			t.Fatalf("messages over the limit should be dropped, got %v %v", handle, disconnect)
+		}
+	}
+	if msg := receive(t, c); msg.Type != msgTypeNotice {
+		t.Errorf("expected a notice, got %+v", msg)
+	}
+	select {
+	case msg := <-c.send:
+		t.Errorf("the client should be told only once, also got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestThrottleDelays(t *testing.T) {
+	r := newRoom(defaultRoom)
+	r.rateLimit = rateLimit{Rate: 20, Burst: 1, Policy: rateLimitDelay}
+	go r.run()
+	c := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- c
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if handle, _ := c.throttle(); !handle {
+			t.Fatal("delayed messages should still be handled")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("two messages over the limit should wait about 100ms, waited %v", elapsed)
+	}
+}
+
+func TestLimitsHoldPerUserAndIP(t *testing.T) {
+	l := rateLimit{Rate: 1, Burst: 2, IPRate: 1, IPBurst: 3}
+	limiter := newLocalLimiter()
+	now := time.Now()
+	// two connections of ann, maybe on two servers sharing limiter
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take(limiter, "ann", "10.0.0.1", now); !ok {
+			t.Fatalf("message %d should fit in ann's burst", i+1)
+		}
+	}
+	if ok, _ := l.take(limiter, "ann", "10.0.0.2", now); ok {
+		t.Error("ann should be over her limit from any address")
+	}
+	if ok, _ := l.take(limiter, "bob", "10.0.0.1", now); !ok {
+		t.Error("bob should fit in what is left for the address")
+	}
+	if ok, wait := l.take(limiter, "carol", "10.0.0.1", now); ok || wait != time.Second {
+		t.Errorf("the address should be over its limit for a second, got %v %v", ok, wait)
+	}
+}
+
+func TestRedisLimiterFallsBack(t *testing.T) {
+	limiter, err := newRateLimiter("redis://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.(*redisLimiter).client.timeout = 100 * time.Millisecond
+	now := time.Now()
+	if ok, _ := limiter.Take("user:ann", 1, 1, now); !ok {
+		t.Fatal("the first message should be allowed")
+	}
+	if ok, _ := limiter.Take("user:ann", 1, 1, now); ok {
+		t.Error("without Redis the limit should still hold on this server")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/room", nil)
+	r.RemoteAddr = "192.0.2.1:4321"
+	r.Header.Set("X-Real-IP", "203.0.113.9")
+	if ip := clientIP(r); ip != "192.0.2.1" {
+		t.Errorf("headers should be ignored unless trusted, got %s", ip)
+	}
+	realIPHeader = "X-Real-IP"
+	defer func() { realIPHeader = "" }()
+	if ip := clientIP(r); ip != "203.0.113.9" {
+		t.Errorf("expected the address from the trusted header, got %s", ip)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// reactionsBucket holds who reacted to a message with what, keyed
+	// "{room}/{message id}", as a map from emoji to userids.
+	reactionsBucket = "reactions"
+	// maxEmojiLength caps the bytes of a reaction; some emoji take
+	// several code points.
+	maxEmojiLength = 32
+	// maxReactionsPerMessage is how many different emoji a message can
+	// be reacted to with.
+	maxReactionsPerMessage = 20
+)
+
+// reaction is a user adding an emoji to a message, or removing it. In the
+// reaction messages the room broadcasts Count is how many users have reacted
+// to the message with Emoji since the change.
+type reaction struct {
+	MessageID string
+	Emoji     string
+	Removed   bool `json:",omitempty"`
+	Count     int  `json:",omitempty"`
+}
+
+// validEmoji reports whether s is acceptable as a reaction: a short run of
+// characters without spaces or control characters.
+func validEmoji(s string) bool {
+	if s == "" || len(s) > maxEmojiLength || !utf8.ValidString(s) {
+		return false
+	}
+	return strings.IndexFunc(s, func(c rune) bool { return unicode.IsSpace(c) || unicode.IsControl(c) }) < 0
+}
+
+func reactionsKey(room, messageID string) string {
+	return room + "/" + messageID
+}
+
+// react records a reaction message from one of the room's clients and
+// broadcasts it with the new count. Reactions that change nothing are
+// dropped. It runs inside run.
+func (r *room) react(msg *message) {
+	re := msg.Reaction
+	key := reactionsKey(r.name, re.MessageID)
+	users := make(map[string][]string)
+	if err := r.state.Get(reactionsBucket, key, &users); err != nil && err != ErrNoState {
+		r.tracer.Warn("Failed to load reactions: ", err)
+		return
+	}
+	list := users[re.Emoji]
+	i := indexOf(list, msg.UserID)
+	switch {
+	case re.Removed == (i < 0):
+		return
+	case re.Removed:
+		list = append(list[:i], list[i+1:]...)
+	case len(list) == 0 && len(users) >= maxReactionsPerMessage:
+		return
+	default:
+		list = append(list, msg.UserID)
+	}
+	if len(list) > 0 {
+		users[re.Emoji] = list
+	} else {
+		delete(users, re.Emoji)
+	}
+	var err error
+	if len(users) > 0 {
+		err = r.state.Put(reactionsBucket, key, users)
+	} else {
+		err = r.state.Delete(reactionsBucket, key)
+	}
+	if err != nil {
+		r.tracer.Error("Failed to save reactions: ", err)
+		return
+	}
+	re.Count = len(list)
+	msg.Room = r.name
+	if r.rooms != nil {
+		r.rooms.publish(msg)
+	}
+	r.broadcast(msg)
+}
+
+// reactionCounts returns how many users reacted to a message of the room
+// with each emoji, or nil if none did.
+func reactionCounts(state StateStore, room, messageID string) map[string]int {
+	var users map[string][]string
+	if state.Get(reactionsBucket, reactionsKey(room, messageID), &users) != nil || len(users) == 0 {
+		return nil
+	}
+	counts := make(map[string]int, len(users))
+	for emoji, list := range users {
+		counts[emoji] = len(list)
+	}
+	return counts
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
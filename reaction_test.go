@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestReactions(t *testing.T) {
+	r := newRoom("golang")
+	go r.run()
+	c := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- c
+	r.forward <- &message{ID: "m1", Message: "hello"}
+	receive(t, c)
+
+	react := func(userID, emoji string, removed bool) {
+		r.forward <- &message{ID: newID(), Type: msgTypeReaction, UserID: userID, Reaction: &reaction{MessageID: "m1", Emoji: emoji, Removed: removed}}
+	}
+	react("ann", "👍", false)
+	if msg := receive(t, c); msg.Reaction == nil || msg.Reaction.Count != 1 || msg.Reaction.Removed {
+		t.Fatalf("expected a reaction with count 1, got %+v", msg)
+	}
+	react("ann", "👍", false) // no change, not broadcast
+	react("bob", "👍", false)
+	if msg := receive(t, c); msg.UserID != "bob" || msg.Reaction.Count != 2 {
+		t.Errorf("a second user should make it 2, got %+v", msg)
+	}
+	react("ann", "👍", true)
+	if msg := receive(t, c); !msg.Reaction.Removed || msg.Reaction.Count != 1 {
+		t.Errorf("removing should make it 1 again, got %+v", msg)
+	}
+	if counts := reactionCounts(r.state, "golang", "m1"); counts["👍"] != 1 || len(counts) != 1 {
+		t.Errorf("unexpected counts %v", counts)
+	}
+
+	late := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- late
+	if msg := receive(t, late); msg.ID != "m1" || msg.Reactions["👍"] != 1 {
+		t.Errorf("history should carry the reaction counts, got %+v", msg)
+	}
+	if msgs, _ := r.store.Query(messageQuery{Room: "golang"}); len(msgs) != 1 || msgs[0].Reactions != nil {
+		t.Errorf("reactions should not be saved as messages or change the stored message, got %+v", msgs)
+	}
+}
+
+func TestValidEmoji(t *testing.T) {
+	for _, ok := range []string{"👍", "👨‍👩‍👧", ":+1:"} {
+		if !validEmoji(ok) {
+			t.Errorf("%q should be valid", ok)
+		}
+	}
+	for _, bad := range []string{"", "a b", "\n", "👍👍👍👍👍👍👍👍👍"} {
+		if validEmoji(bad) {
+			t.Errorf("%q should not be valid", bad)
+		}
+	}
+}
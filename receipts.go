@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// readCursorsBucket holds how far each user has read in each room, keyed
+// "{room}/{userid}", as a readCursor.
+const readCursorsBucket = "read_cursors"
+
+// receipt says a user has read a room up to the message MessageID, whose
+// sequence number is Seq. Clients send it in read messages; the room
+// broadcasts it with the reader's UserID and Name.
+type receipt struct {
+	MessageID string `json:",omitempty"`
+	Seq       uint64
+}
+
+// readCursor is the high-water mark of a user in a room.
+type readCursor struct {
+	UserID    string
+	Name      string
+	MessageID string `json:",omitempty"`
+	Seq       uint64
+	Read      time.Time
+}
+
+func readCursorKey(room, userID string) string {
+	return room + "/" + userID
+}
+
+// markRead records a read message from one of the room's clients and
+// broadcasts it. A receipt that does not move the user's cursor forward, or
+// that is for a message the room has not sent yet, is dropped. It runs
+// inside run.
+func (r *room) markRead(msg *message) {
+	r.loadSeq()
+	re := msg.Receipt
+	if re.Seq > r.seq {
+		return
+	}
+	key := readCursorKey(r.name, msg.UserID)
+	var cursor readCursor
+	if err := r.state.Get(readCursorsBucket, key, &cursor); err != nil && err != ErrNoState {
+		r.tracer.Warn("Failed to load read cursor: ", err)
+		return
+	}
+	if re.Seq <= cursor.Seq {
+		return
+	}
+	cursor = readCursor{UserID: msg.UserID, Name: msg.Name, MessageID: re.MessageID, Seq: re.Seq, Read: msg.When}
+	if err := r.state.Put(readCursorsBucket, key, cursor); err != nil {
+		r.tracer.Error("Failed to save read cursor: ", err)
+		return
+	}
+	msg.Room = r.name
+	if r.rooms != nil {
+		r.rooms.publish(msg)
+	}
+	r.broadcast(msg)
+}
+
+// readCursors returns the read cursors of everyone who has read some of the
+// room, in the order they read up to.
+func readCursors(state StateStore, room string) ([]*readCursor, error) {
+	docs, err := state.List(readCursorsBucket)
+	if err != nil {
+		return nil, err
+	}
+	var cursors []*readCursor
+	for key, doc := range docs {
+		if !strings.HasPrefix(key, room+"/") {
+			continue
+		}
+		var cursor readCursor
+		if err := json.Unmarshal(doc, &cursor); err != nil {
+			continue
+		}
+		cursors = append(cursors, &cursor)
+	}
+	sort.Slice(cursors, func(i, j int) bool { return cursors[i].Seq < cursors[j].Seq })
+	return cursors, nil
+}
+
+// replayReceipts sends a joining client where everyone has read up to, as
+// read messages, after its history. It runs inside run and sends no more
+// than fit in what is left of the client's send buffer, keeping those who
+// read furthest.
+func (r *room) replayReceipts(c *client) {
+	cursors, err := readCursors(r.state, r.name)
+	if err != nil {
+		r.tracer.Warn("Failed to load read cursors: ", err)
+		return
+	}
+	if room := cap(c.send) - len(c.send); len(cursors) > room {
+		cursors = cursors[len(cursors)-room:]
+	}
+	for _, cursor := range cursors {
+		c.send <- &message{ID: newID(), Type: msgTypeRead, Room: r.name, UserID: cursor.UserID, Name: cursor.Name,
+			When: cursor.Read, Receipt: &receipt{MessageID: cursor.MessageID, Seq: cursor.Seq}}
+	}
+}
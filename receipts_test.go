@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReadReceipts(t *testing.T) {
+	r := newRoom("golang")
+	go r.run()
+	ann := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": "ann", "name": "Ann"}}
+	r.join <- ann
+	for _, text := range []string{"one", "two"} {
+		r.forward <- &message{ID: text, Message: text}
+		receiveChat(t, ann)
+	}
+	read := func(seq uint64) {
+		r.forward <- &message{ID: newID(), Type: msgTypeRead, UserID: "bob", Name: "Bob", Receipt: &receipt{MessageID: "two", Seq: seq}}
+	}
+	read(3) // not sent yet
+	read(2)
+	read(1) // behind the cursor
+	if msg := receiveChat(t, ann); msg.Type != msgTypeRead || msg.UserID != "bob" || msg.Receipt.Seq != 2 {
+		t.Fatalf("expected bob's receipt for 2, got %q %+v", msg.Type, msg.Receipt)
+	}
+
+	// the cursor is kept and given to those who join
+	cursors, err := readCursors(r.state, "golang")
+	if err != nil || len(cursors) != 1 || cursors[0].Seq != 2 {
+		t.Fatalf("expected bob's cursor at 2, got %v, %v", cursors, err)
+	}
+	carol := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- carol
+	for {
+		msg := receiveChat(t, carol)
+		if msg.Type == msgTypeRead {
+			if msg.Name != "Bob" || msg.Receipt.Seq != 2 {
+				t.Errorf("unexpected receipt %q %+v", msg.Name, msg.Receipt)
+			}
+			break
+		}
+	}
+}
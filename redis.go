@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisError is an error reply from the Redis server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisClient is a minimal Redis client speaking RESP over a single
+// connection, which is all the broker, session store and rate limiter need.
+// Commands are serialized on that connection; it is re-dialed after any I/O
+// error. Pub/sub uses a dedicated connection, see psubscribe.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisClient parses a redis://[:password@]host[:port][/db] URL.
+// No connection is made until the first command.
+func newRedisClient(rawurl string) (*redisClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("redis URL %q must start with redis://", rawurl)
+	}
+	c := &redisClient{addr: u.Host, timeout: 5 * time.Second}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis URL %q: bad database number", rawurl)
+		}
+	}
+	return c, nil
+}
+
+// dial opens a connection, authenticating and selecting the database.
+func (c *redisClient) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if err := writeCommand(conn, args); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if _, err := readReply(r); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, r, nil
+}
+
+// do runs a single command and returns its reply: a string, int64, nil,
+// []interface{} or a redisError.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, r, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.r = conn, r
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	err := writeCommand(c.conn, args)
+	var reply interface{}
+	if err == nil {
+		reply, err = readReply(c.r)
+	}
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// the connection is in an unknown state; start afresh next time
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// psubscribe subscribes to channels matching pattern on a dedicated
+// connection and calls handle for every message until the connection fails.
+func (c *redisClient) psubscribe(pattern string, handle func(channel, payload string)) error {
+	conn, r, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := writeCommand(conn, []string{"PSUBSCRIBE", pattern}); err != nil {
+		return err
+	}
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return err
+		}
+		// ["pmessage", pattern, channel, payload]; skip the subscribe confirmation
+		if parts, ok := reply.([]interface{}); ok && len(parts) == 4 && parts[0] == "pmessage" {
+			channel, _ := parts[2].(string)
+			payload, _ := parts[3].(string)
+			handle(channel, payload)
+		}
+	}
+}
+
+// writeCommand writes args as a RESP array of bulk strings.
+func writeCommand(w io.Writer, args []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// readReply reads one RESP value.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
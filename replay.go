@@ -0,0 +1,149 @@
+package main
+
+import "time"
+
+// replayBufferSize is how many recent messages each room keeps in memory
+// for clients catching up after a reconnect.
+const replayBufferSize = messageBufferSize
+
+// replayBuffer holds the most recent sequenced messages of a room, oldest
+// first once it wraps. It is not safe for concurrent use; each room owns
+// its own and only uses it inside run.
+type replayBuffer struct {
+	ring []*message
+	next int
+	full bool
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{ring: make([]*message, size)}
+}
+
+// add records msg, forgetting the oldest message if the buffer is full.
+func (b *replayBuffer) add(msg *message) {
+	b.ring[b.next] = msg
+	b.next = (b.next + 1) % len(b.ring)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// since returns the messages after seq, oldest first. ok is false unless
+// the buffer holds every message after seq, as it does not once they were
+// forgotten or, after a restart, were never in it; the caller must then
+// look further back.
+func (b *replayBuffer) since(seq uint64) (msgs []*message, ok bool) {
+	start, n := 0, b.next
+	if b.full {
+		start, n = b.next, len(b.ring)
+	}
+	newest := uint64(0)
+	for i := 0; i < n; i++ {
+		msg := b.ring[(start+i)%len(b.ring)]
+		newest = msg.Seq
+		if msg.Seq <= seq {
+			continue
+		}
+		if len(msgs) == 0 && msg.Seq > seq+1 {
+			// the buffer starts after what the client missed
+			return nil, false
+		}
+		msgs = append(msgs, msg)
+	}
+	// an empty buffer, or one behind seq, knows nothing of what came after
+	return msgs, len(msgs) > 0 || n > 0 && newest == seq
+}
+
+// drop replaces the message with id, if the buffer has it, by a delete
+// message with its sequence number, so that it is not replayed but a client
+// that saw it learns it is gone.
+func (b *replayBuffer) drop(id string) {
+	for i, msg := range b.ring {
+		if msg != nil && msg.ID == id {
+			b.ring[i] = &message{ID: newID(), Type: msgTypeDelete, Room: msg.Room, Target: id, When: msg.When, Seq: msg.Seq}
+			return
+		}
+	}
+}
+
+// loadSeq makes sure r.seq is at least the sequence number of the last
+// message stored for the room, so that numbers keep increasing across
+// restarts. It runs inside run.
+func (r *room) loadSeq() {
+	if r.seqLoaded {
+		return
+	}
+	r.seqLoaded = true
+	last, err := r.store.Query(messageQuery{Room: r.name, Limit: 1})
+	if err != nil {
+		r.tracer.Warn("Failed to load the last sequence number: ", err)
+		return
+	}
+	if len(last) == 1 && last[0].Seq > r.seq {
+		r.seq = last[0].Seq
+	}
+}
+
+// sequence numbers msg and remembers it for replay. It runs inside run.
+func (r *room) sequence(msg *message) {
+	r.number(msg)
+	r.replay.add(msg)
+}
+
+// number gives msg the room's next sequence number. A message that already
+// has one, accepted by another server, keeps it. Servers number messages
+// without agreeing first, so two of them can give different messages the
+// same number. It runs inside run.
+func (r *room) number(msg *message) {
+	r.loadSeq()
+	if msg.Seq == 0 {
+		r.seq++
+		msg.Seq = r.seq
+	} else if msg.Seq > r.seq {
+		r.seq = msg.Seq
+	}
+}
+
+// replayMissed sends c the messages after c.lastSeq, from the replay
+// buffer if it still has them all and otherwise from the store. It never
+// sends more than fit in the client's send buffer: if c missed more, it is
+// sent a notice saying so, then the most recent. It runs inside run.
+func (r *room) replayMissed(c *client) {
+	r.loadSeq()
+	if c.lastSeq >= r.seq {
+		return
+	}
+	missed, ok := r.replay.since(c.lastSeq)
+	if !ok {
+		// one more than fit, to tell whether some are left out
+		stored, err := r.store.Query(messageQuery{Room: r.name, Limit: cap(c.send) + 1})
+		if err != nil {
+			r.tracer.Warn("Failed to load missed messages: ", err)
+			return
+		}
+		missed = missed[:0]
+		for _, msg := range stored {
+			if msg.Seq > c.lastSeq {
+				missed = append(missed, msg)
+			}
+		}
+	}
+	if !c.historyFrom.IsZero() {
+		visible := make([]*message, 0, len(missed))
+		for _, msg := range missed {
+			if !msg.When.Before(c.historyFrom) {
+				visible = append(visible, msg)
+			}
+		}
+		missed = visible
+	}
+	if len(missed) > cap(c.send) {
+		// leave room for the notice
+		missed = missed[len(missed)-cap(c.send)+1:]
+		c.send <- &message{ID: newID(), Type: msgTypeNotice, Room: r.name, Name: "system", When: time.Now(),
+			Message: "You missed more messages than can be replayed; search the room's history for those before these."}
+	}
+	for _, msg := range accounts.mask(missed) {
+		c.send <- r.withReactions(msg)
+	}
+}
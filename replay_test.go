@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplayBuffer(t *testing.T) {
+	b := newReplayBuffer(3)
+	for seq := uint64(1); seq <= 4; seq++ {
+		b.add(&message{Seq: seq})
+	}
+	msgs, ok := b.since(2)
+	if !ok || len(msgs) != 2 || msgs[0].Seq != 3 || msgs[1].Seq != 4 {
+		t.Errorf("since(2) = %v, %v; want 3 and 4", msgs, ok)
+	}
+	if msgs, ok := b.since(4); !ok || len(msgs) != 0 {
+		t.Errorf("since(4) = %v, %v; want nothing", msgs, ok)
+	}
+	if _, ok := b.since(0); ok {
+		t.Error("since(0) should say message 1 was forgotten")
+	}
+	// after a restart the buffer starts with the first new message
+	b = newReplayBuffer(3)
+	if _, ok := b.since(2); ok {
+		t.Error("an empty buffer should send the caller to the store")
+	}
+	b.add(&message{Seq: 5})
+	if _, ok := b.since(2); ok {
+		t.Error("since(2) should say messages 3 and 4 are not in the buffer")
+	}
+}
+
+func TestRoomNumbersMessages(t *testing.T) {
+	r := newRoom("golang")
+	r.store.Save(&message{ID: "old", Room: "golang", Message: "old", Seq: 7})
+	go r.run()
+	c := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- c
+	receiveChat(t, c) // history
+	r.forward <- &message{ID: "new", Message: "new"}
+	if msg := receiveChat(t, c); msg.Seq != 8 {
+		t.Errorf("expected sequence number 8, got %d", msg.Seq)
+	}
+}
+
+func TestRoomReplaysMissedMessages(t *testing.T) {
+	for _, size := range []int{replayBufferSize, 1} {
+		r := newRoom("golang")
+		r.replay = newReplayBuffer(size)
+		go r.run()
+		for _, text := range []string{"one", "two", "three"} {
+			r.forward <- &message{ID: text, Message: text}
+		}
+		c := &client{send: make(chan *message, messageBufferSize), room: r, lastSeq: 1}
+		r.join <- c
+		r.forward <- &message{ID: "live", Message: "live"}
+		for _, want := range []string{"two", "three", "live"} {
+			if msg := receiveChat(t, c); msg.Message != want {
+				t.Errorf("buffer of %d: expected %q, got %q", size, want, msg.Message)
+			}
+		}
+	}
+}
+
+func TestRestartedRoomReplaysFromTheStore(t *testing.T) {
+	r := newRoom("golang")
+	for seq := uint64(1); seq <= 8; seq++ {
+		r.store.Save(&message{ID: fmt.Sprint("m", seq), Type: msgTypeMessage, Room: "golang", Message: fmt.Sprint(seq), Seq: seq, When: time.Now()})
+	}
+	go r.run()
+	c := &client{send: make(chan *message, messageBufferSize), room: r, lastSeq: 1}
+	r.join <- c
+	for seq := 2; seq <= 8; seq++ {
+		if msg := receiveChat(t, c); msg.Message != fmt.Sprint(seq) {
+			t.Fatalf("expected message %d, got %q", seq, msg.Message)
+		}
+	}
+
+	// a client that missed more than fit is told so
+	few := &client{send: make(chan *message, 3), room: r, lastSeq: 1}
+	r.join <- few
+	if msg := receiveChat(t, few); msg.Type != msgTypeNotice {
+		t.Fatalf("expected a notice of the messages left out, got %+v", msg)
+	}
+	for _, want := range []string{"7", "8"} {
+		if msg := receiveChat(t, few); msg.Message != want {
+			t.Errorf("expected the most recent messages, got %q", msg.Message)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// capturedFrame is a frame a client sent, read from a capture.
+type capturedFrame struct {
+	Time time.Time
+	// Session says which connection sent the frame; frames of the same
+	// session are replayed over the same connection.
+	Session string
+	Room    string
+	Frame   []byte
+}
+
+// readCapture reads the frames clients sent from a capture, oldest first.
+// A capture is JSON lines, either frames recorded with -trace-frames, of
+// which those going in are replayed, or messages, such as a copy of a
+// room's history, each sent by its sender over a connection of their own.
+func readCapture(r io.Reader) ([]capturedFrame, error) {
+	var frames []capturedFrame
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		var recorded struct {
+			Time    time.Time
+			Dir     string
+			Frame   *string
+			Session string
+			Room    string
+		}
+		if err := json.Unmarshal(line, &recorded); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if recorded.Frame != nil {
+			if recorded.Dir == "in" {
+				frames = append(frames, capturedFrame{Time: recorded.Time, Session: recorded.Session, Room: recorded.Room, Frame: []byte(*recorded.Frame)})
+			}
+			continue
+		}
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if msg.Room == "" || strings.HasPrefix(msg.Room, "dm:") {
+			continue
+		}
+		frame, _ := json.Marshal(&message{ID: msg.ID, Type: msg.Type, To: msg.To, Message: msg.Message})
+		frames = append(frames, capturedFrame{Time: msg.When, Session: msg.Room + "/" + msg.UserID, Room: msg.Room, Frame: frame})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(frames, func(i, j int) bool { return frames[i].Time.Before(frames[j].Time) })
+	return frames, nil
+}
+
+// replayCapture sends frames to the server at baseURL, each session over a
+// websocket of its own authenticated with token, keeping the time between
+// frames divided by speed; a speed of 0 sends them as fast as it can. It
+// returns how many frames it sent.
+func replayCapture(ctx context.Context, frames []capturedFrame, baseURL, token string, speed float64) (int, error) {
+	wsURL := "ws" + strings.TrimPrefix(strings.TrimSuffix(baseURL, "/"), "http")
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	conns := make(map[string]*websocket.Conn)
+	defer func() {
+		for _, conn := range conns {
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			conn.Close()
+		}
+	}()
+	var start time.Time
+	sent := 0
+	for _, f := range frames {
+		if speed > 0 && !f.Time.IsZero() {
+			if start.IsZero() {
+				start = f.Time
+			}
+			wait := time.Duration(float64(f.Time.Sub(start)) / speed)
+			start = f.Time
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return sent, ctx.Err()
+			}
+		}
+		conn, ok := conns[f.Session]
+		if !ok {
+			// batches of frames need the protocol that sent them
+			dialer := *websocket.DefaultDialer
+			dialer.Subprotocols = []string{"chat.v1"}
+			if strings.HasPrefix(strings.TrimSpace(string(f.Frame)), "[") {
+				dialer.Subprotocols = []string{"chat.v2"}
+			}
+			var err error
+			conn, _, err = dialer.DialContext(ctx, wsURL+"/room/"+f.Room, header)
+			if err != nil {
+				return sent, fmt.Errorf("session %s: %w", f.Session, err)
+			}
+			conns[f.Session] = conn
+			// what the server sends back is not needed, but must be
+			// read for the connection to keep working
+			go func() {
+				for {
+					if _, _, err := conn.NextReader(); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, f.Frame); err != nil {
+			return sent, fmt.Errorf("session %s: %w", f.Session, err)
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// replayCommand runs the replay subcommand:
+//
+//	chat replay [-speed 1] [-token ...] capture.jsonl http://localhost:8080
+func replayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := fs.Float64("speed", 1, "How much faster than captured to replay; 0 for as fast as possible.")
+	token := fs.String("token", os.Getenv("CHAT_REPLAY_TOKEN"), "API token the connections are made with, from /api/tokens.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 || *speed < 0 {
+		return errors.New("usage: chat replay [-speed 1] [-token ...] <capture> <server URL>")
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	frames, err := readCapture(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+	sent, err := replayCapture(context.Background(), frames, fs.Arg(1), *token, *speed)
+	fmt.Printf("Replayed %d of %d frames\n", sent, len(frames))
+	return err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestReadCapture(t *testing.T) {
+	capture := `{"time":"2024-05-01T12:00:02Z","dir":"in","frame":"{\"Message\":\"second\"}","session":"s1","room":"golang","user":"ann"}
+{"time":"2024-05-01T12:00:01Z","dir":"out","frame":"{\"Message\":\"echo\"}","session":"s1","room":"golang","user":"ann"}
+{"ID":"m1","Room":"golang","UserID":"bob","Name":"Bob","Message":"first","When":"2024-05-01T12:00:00Z"}
+{"ID":"m2","Room":"dm:ann:bob","UserID":"bob","To":"ann","Message":"private","When":"2024-05-01T12:00:03Z"}
+`
+	frames, err := readCapture(strings.NewReader(capture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("expected the frame going in and the room message, got %+v", frames)
+	}
+	if !strings.Contains(string(frames[0].Frame), "first") || frames[0].Session != "golang/bob" {
+		t.Errorf("expected bob's message first, got %s in %s", frames[0].Frame, frames[0].Session)
+	}
+	if string(frames[1].Frame) != `{"Message":"second"}` || frames[1].Room != "golang" {
+		t.Errorf("expected the recorded frame, got %s", frames[1].Frame)
+	}
+	if _, err := readCapture(strings.NewReader("not json\n")); err == nil {
+		t.Error("expected an error for a bad line")
+	}
+}
+
+func TestReplayCapture(t *testing.T) {
+	rooms := newRoomManager()
+	server := httptest.NewServer(rooms)
+	defer server.Close()
+	token, _ := issueToken(objx.New(map[string]interface{}{"userid": "replayer", "name": "Replayer"}), time.Hour)
+	now := time.Now()
+	frames := []capturedFrame{
+		{Time: now, Session: "a", Room: "golang", Frame: []byte(`{"ID":"1","Message":"one"}`)},
+		{Time: now.Add(100 * time.Millisecond), Session: "b", Room: "golang", Frame: []byte(`{"ID":"2","Message":"two"}`)},
+		{Time: now.Add(200 * time.Millisecond), Session: "a", Room: "golang", Frame: []byte(`{"ID":"3","Message":"three"}`)},
+	}
+	start := time.Now()
+	sent, err := replayCapture(context.Background(), frames, server.URL, token, 2)
+	if err != nil || sent != 3 {
+		t.Fatalf("expected 3 frames sent, got %d, %v", sent, err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("at double speed 200ms of traffic should take 100ms, took %v", elapsed)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stored, _ := rooms.store.Query(messageQuery{Room: "golang"})
+		if len(stored) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the 3 messages stored, got %d", len(stored))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
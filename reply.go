@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// quoteReply returns the quote of the message msg replies to, which must be
+// in c's room, or in the direct messages between the sender and msg.To for
+// a direct message. The quote is a copy, so the reply still shows what it
+// answered once the original is deleted.
+func (c *client) quoteReply(msg *message) (*quote, error) {
+	if !validID(msg.ReplyTo) {
+		return nil, errors.New("a reply needs the ID of the message it replies to")
+	}
+	room := c.room.name
+	if msg.Type == msgTypeDM {
+		if msg.To == "" {
+			return nil, errors.New("a direct message needs a recipient")
+		}
+		room = dmRoom(msg.UserID, msg.To)
+	}
+	original, err := findMessage(c.room.store, room, msg.ReplyTo)
+	if err != nil {
+		c.room.tracer.Error("Failed to find the message replied to: ", err)
+		return nil, errors.New("the message replied to could not be found")
+	}
+	if original == nil || !visibleTo(c.room.state, original, msg.UserID, make(map[string]time.Time)) {
+		return nil, errors.New("there is no message " + msg.ReplyTo + " here to reply to")
+	}
+	return quoteOf(original), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestQuoteReply(t *testing.T) {
+	rooms := newRoomManager()
+	r := rooms.get("golang")
+	server := httptest.NewServer(r)
+	defer server.Close()
+	conn := dialRoom(t, server, objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"}))
+	next := func(want func(*message) bool) *message {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var msg message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if want(&msg) {
+				return &msg
+			}
+		}
+	}
+	conn.WriteJSON(&message{ID: "m1", Message: "shall we ship?"})
+	next(func(m *message) bool { return m.ID == "m1" && m.Type == msgTypeMessage })
+
+	// a quote made up by the client is replaced by the server's copy
+	conn.WriteJSON(&message{ID: "m2", Message: "yes", ReplyTo: "m1", Quote: &quote{Message: "made up"}})
+	reply := next(func(m *message) bool { return m.ID == "m2" && m.Type == msgTypeMessage })
+	if reply.ReplyTo != "m1" || reply.Quote == nil || reply.Quote.MessageID != "m1" || reply.Quote.Message != "shall we ship?" || reply.Quote.Name != "Ann" {
+		t.Errorf("expected the reply to quote m1, got %+v %+v", reply, reply.Quote)
+	}
+
+	conn.WriteJSON(&message{ID: "m3", Message: "hm", ReplyTo: "gone"})
+	if msg := next(func(m *message) bool { return m.Type == msgTypeNotice }); !strings.Contains(msg.Message, "no message gone") {
+		t.Errorf("a reply to an unknown message should be refused, got %+v", msg)
+	}
+
+	// the quote outlives the original
+	rooms.store.Delete("golang", "m1")
+	saved, _ := rooms.store.Query(messageQuery{Room: "golang"})
+	if len(saved) != 1 || saved[0].Quote == nil || saved[0].Quote.Message != "shall we ship?" {
+		t.Errorf("expected the saved reply to keep its quote, got %+v", saved)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// revocationsBucket holds, by userid, when every session and token of the
+// user was last revoked.
+const revocationsBucket = "revocations"
+
+// revocation ends every session and token a user had at Revoked; they can
+// sign in again right away.
+type revocation struct {
+	UserID  string
+	By      string
+	Revoked time.Time
+}
+
+// revoke ends every session and token of the user, by an admin's email,
+// and disconnects them from the rooms of every server.
+func (a *accountStore) revoke(userID, by string) (*revocation, error) {
+	rev := &revocation{UserID: userID, By: by, Revoked: time.Now()}
+	if err := a.state.Put(revocationsBucket, userID, rev); err != nil {
+		return nil, err
+	}
+	if a.rooms != nil {
+		a.rooms.signOut(userID, "", "Your sessions were ended; sign in again.")
+	}
+	return rev, nil
+}
+
+// revoked reports whether what was issued to the user at issued, a session
+// or a token, has been revoked since. Revocations are kept to the second,
+// like tokens' times are, so one made in the same second is not revoked.
+func (a *accountStore) revoked(userID string, issued time.Time) (bool, error) {
+	if userID == "" {
+		return false, nil
+	}
+	var rev revocation
+	switch err := a.state.Get(revocationsBucket, userID, &rev); err {
+	case nil:
+		return issued.Before(rev.Revoked.Truncate(time.Second)), nil
+	case ErrNoState:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// signedOut disconnects the connections opened with the session with the
+// given ID, which has ended, from the rooms of every server.
+func (a *accountStore) signedOut(sessionID string) {
+	if a.rooms != nil {
+		a.rooms.signOut("", sessionID, "You signed out.")
+	}
+}
+
+// serveRevoke is the admin API for ending a user's sessions:
+//
+//	GET    /admin/sessions/{userid}  when they were last revoked
+//	DELETE /admin/sessions/{userid}  end every session and token of the user
+//
+// Revoking is recorded in the audit log.
+func (a *accountStore) serveRevoke(w http.ResponseWriter, r *http.Request) {
+	userID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/sessions"), "/")
+	if !validID(userID) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var rev *revocation
+	switch r.Method {
+	case http.MethodGet:
+		rev = &revocation{}
+		if err := a.state.Get(revocationsBucket, userID, rev); err == ErrNoState {
+			http.Error(w, "the user's sessions have not been revoked", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		var err error
+		if rev, err = a.revoke(userID, currentUser(r).Get("email").Str()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.record(r, "revoke_sessions", userID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rev)
+}
+
+// signOut disconnects the connections of the user with userID, or those
+// opened with the session with sessionID, from the rooms of this server
+// and, through the broker, of the others, telling them why.
+func (m *roomManager) signOut(userID, sessionID, reason string) {
+	msg := &message{ID: newID(), Type: msgTypeSignOut, UserID: userID, Target: sessionID, Message: reason, When: time.Now()}
+	m.publish(msg)
+	m.disconnect(msg)
+}
+
+// disconnect closes the connections a msgTypeSignOut message names.
+func (m *roomManager) disconnect(signOut *message) {
+	for _, r := range m.list() {
+		r.direct <- &directMessage{userID: signOut.UserID, session: signOut.Target,
+			msg: &message{ID: newID(), Type: msgTypeDisconnect, Room: r.name, Name: "system", Message: signOut.Message, When: signOut.When}}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestRevokeSessions(t *testing.T) {
+	a := withAccounts(t)
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	admin := objx.New(map[string]interface{}{"userid": "root", "email": "root@example.com"})
+	cookie := withAuthCookie(http.MethodGet, "/chat", nil, ann)
+	token, _ := issueToken(ann, time.Hour)
+	// what was issued before the revocation's second is revoked
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	serve := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.serveRevoke(w, withAuthCookie(method, "/admin/sessions/ann", nil, admin))
+		return w
+	}
+	if w := serve(http.MethodGet); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 before revoking, got %d", w.Code)
+	}
+	if w := serve(http.MethodDelete); w.Code != http.StatusOK {
+		t.Fatalf("revoke failed: %d %s", w.Code, w.Body)
+	}
+	var rev revocation
+	if err := json.NewDecoder(serve(http.MethodGet).Body).Decode(&rev); err != nil || rev.UserID != "ann" || rev.By != "root@example.com" {
+		t.Errorf("unexpected revocation %+v %v", rev, err)
+	}
+	if _, err := authenticate(cookie); err != errBadAuthCookie {
+		t.Errorf("a revoked session should not authenticate, got %v", err)
+	}
+	if _, err := readToken(token); err != errBadToken {
+		t.Errorf("a revoked token should not authenticate, got %v", err)
+	}
+
+	// signing in again works right away
+	if _, err := authenticate(withAuthCookie(http.MethodGet, "/chat", nil, ann)); err != nil {
+		t.Errorf("a new session should authenticate, got %v", err)
+	}
+	token, _ = issueToken(ann, time.Hour)
+	if _, err := readToken(token); err != nil {
+		t.Errorf("a new token should authenticate, got %v", err)
+	}
+}
+
+func TestSignOutDisconnects(t *testing.T) {
+	a := withAccounts(t)
+	m := newRoomManager()
+	a.rooms = m
+	r := m.get("golang")
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	phoneCookie := withAuthCookie(http.MethodGet, "/room", nil, ann)
+	session, _ := sessionCookieID(phoneCookie)
+	phone := &client{id: "c1", send: make(chan *message, messageBufferSize), room: r, userData: ann, session: session}
+	laptop := &client{id: "c2", send: make(chan *message, messageBufferSize), room: r, userData: ann, session: "other"}
+	bob := &client{id: "c3", send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": "bob"}}
+	r.join <- phone
+	r.join <- laptop
+	r.join <- bob
+
+	if err := endSession(httptest.NewRecorder(), phoneCookie); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveChat(t, phone); msg.Type != msgTypeDisconnect || msg.Message != "You signed out." {
+		t.Errorf("the session signed out of should be disconnected, got %+v", msg)
+	}
+	if _, err := readAuthCookie(phoneCookie); err != errBadAuthCookie {
+		t.Errorf("a copy of the cookie should not work after signing out, got %v", err)
+	}
+
+	if _, err := a.revoke("ann", "root@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// the laptop's first message is the revocation, so signing out of the
+	// phone left it connected
+	if msg := receiveChat(t, laptop); msg.Type != msgTypeDisconnect || msg.Message != "Your sessions were ended; sign in again." {
+		t.Errorf("revoking should disconnect every connection of the user, got %+v", msg)
+	}
+
+	// another server asks for bob to be disconnected
+	m.receive(&message{Type: msgTypeSignOut, UserID: "bob", Message: "Your sessions were ended; sign in again."})
+	if msg := receiveChat(t, bob); msg.Type != msgTypeDisconnect {
+		t.Errorf("a sign out from another server should disconnect bob, got %+v", msg)
+	}
+}
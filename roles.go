@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// roomRolesBucket holds the roles granted in each room, by room/userid.
+// A room's owner is the Owner of its roomSettings rather than a role stored
+// here, and users without a role are members.
+const roomRolesBucket = "room_roles"
+
+// The roles a user may have in a room, from least to most trusted.
+const (
+	roleMember    = "member"
+	roleModerator = "moderator"
+	roleOwner     = "owner"
+)
+
+// roleRank orders the roles; nobody may act against a user of their own
+// rank or above.
+var roleRank = map[string]int{roleMember: 0, roleModerator: 1, roleOwner: 2}
+
+// permission is something only some roles may do in a room.
+type permission string
+
+const (
+	// permPin is pinning and unpinning messages.
+	permPin permission = "pin"
+	// permDelete is deleting other users' messages; anyone may delete
+	// their own.
+	permDelete permission = "delete"
+	// permKick is disconnecting another user from the room.
+	permKick permission = "kick"
+	// permMute is keeping another user from sending messages for a while.
+	permMute permission = "mute"
+	// permRoles is granting and revoking the moderator role.
+	permRoles permission = "roles"
+	// permIntegrations is managing the room's webhooks, GitHub
+	// repositories and bots.
+	permIntegrations permission = "integrations"
+)
+
+// rolePermissions says what each role may do. Admins count as owners of
+// every room.
+var rolePermissions = map[string][]permission{
+	roleModerator: {permPin, permDelete, permKick, permMute},
+	roleOwner:     {permPin, permDelete, permKick, permMute, permRoles, permIntegrations},
+}
+
+// allowed reports whether role has permission p.
+func allowed(role string, p permission) bool {
+	for _, q := range rolePermissions[role] {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+// roomRole is a role granted to a user in a room.
+type roomRole struct {
+	Room    string
+	UserID  string
+	Role    string
+	By      string `json:",omitempty"`
+	Granted time.Time
+}
+
+// roleOf returns the role in room of the signed in user in userData.
+func roleOf(state StateStore, room string, userData map[string]interface{}) (string, error) {
+	userID, _ := userData["userid"].(string)
+	email, _ := userData["email"].(string)
+	if isAdmin(email) {
+		return roleOwner, nil
+	}
+	return userRole(state, room, userID)
+}
+
+// userRole returns the role in room of the user with userID.
+func userRole(state StateStore, room, userID string) (string, error) {
+	if userID == "" {
+		return roleMember, nil
+	}
+	settings, err := loadRoomSettings(state, room)
+	if err != nil {
+		return roleMember, err
+	}
+	if userID == settings.Owner {
+		return roleOwner, nil
+	}
+	var granted roomRole
+	switch err := state.Get(roomRolesBucket, room+"/"+userID, &granted); err {
+	case nil:
+		return granted.Role, nil
+	case ErrNoState:
+		return roleMember, nil
+	default:
+		return roleMember, err
+	}
+}
+
+// roomRoles returns the roles granted in room, by userid.
+func roomRoles(state StateStore, room string) ([]*roomRole, error) {
+	docs, err := state.List(roomRolesBucket)
+	if err != nil {
+		return nil, err
+	}
+	roles := []*roomRole{}
+	for key, doc := range docs {
+		if !strings.HasPrefix(key, room+"/") {
+			continue
+		}
+		var role roomRole
+		if json.Unmarshal(doc, &role) == nil {
+			roles = append(roles, &role)
+		}
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].UserID < roles[j].UserID })
+	return roles, nil
+}
+
+// serveRoles is the roles part of the rooms API:
+//
+//	GET    /api/rooms/{name}/roles           the roles granted in the room
+//	PUT    /api/rooms/{name}/roles/{userid}  grant one: {"Role": "moderator"}
+//	DELETE /api/rooms/{name}/roles/{userid}  make the user a member again
+//
+// Anyone who may enter the room may see its roles; only its owner and the
+// admins may change them. Ownership itself is the room's Owner setting.
+func (a *roomSettingsAPI) serveRoles(w http.ResponseWriter, r *http.Request, name, userID string, user map[string]interface{}) {
+	if r.Method == http.MethodGet && userID == "" {
+		roles, err := roomRoles(a.state, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(roles)
+		return
+	}
+	if userID == "" || (r.Method != http.MethodPut && r.Method != http.MethodDelete) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	role, err := roleOf(a.state, name, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowed(role, permRoles) {
+		http.Error(w, "only the room's owner may change its roles", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if err := a.state.Delete(roomRolesBucket, name+"/"+userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var req struct{ Role string }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Role != roleModerator {
+		http.Error(w, "body must be {\"Role\": \"moderator\"}", http.StatusBadRequest)
+		return
+	}
+	by, _ := user["userid"].(string)
+	granted := &roomRole{Room: name, UserID: userID, Role: req.Role, By: by, Granted: time.Now()}
+	if err := a.state.Put(roomRolesBucket, name+"/"+userID, granted); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(granted)
+}
+
+// pinsBucket holds the pinned messages of each room, by room/message ID.
+const pinsBucket = "pins"
+
+// pin is a pinned message.
+type pin struct {
+	MessageID string
+	By        string
+	Pinned    time.Time
+}
+
+// act carries out a pin, unpin, delete, kick, mute or unmute message from
+// one of the room's clients, if the sender's role allows it, and broadcasts
+// it. The sender is told when it does not. It runs inside run.
+func (r *room) act(msg *message) {
+	from := msg.from
+	msg.from = nil
+	msg.Room = r.name
+	var userData map[string]interface{}
+	if from != nil {
+		userData = from.userData
+	}
+	role, err := roleOf(r.state, r.name, userData)
+	if err != nil {
+		r.tracer.Warn("Failed to load the sender's role: ", err)
+		return
+	}
+	var refused string
+	switch msg.Type {
+	case msgTypePin, msgTypeUnpin:
+		if !allowed(role, permPin) {
+			refused = "Only the room's moderators may pin messages."
+		} else {
+			refused = r.pin(msg)
+		}
+	case msgTypeDelete:
+		refused = r.delete(msg, allowed(role, permDelete))
+	case msgTypeKick, msgTypeMute, msgTypeUnmute:
+		target, err := userRole(r.state, r.name, msg.Target)
+		if err != nil {
+			r.tracer.Warn("Failed to load the role of ", msg.Target, ": ", err)
+			return
+		}
+		switch {
+		case msg.Type == msgTypeKick && (!allowed(role, permKick) || roleRank[target] >= roleRank[role]):
+			refused = "Only the room's moderators may remove someone, and only those below them."
+		case msg.Type != msgTypeKick && (!allowed(role, permMute) || roleRank[target] >= roleRank[role]):
+			refused = "Only the room's moderators may mute someone, and only those below them."
+		case msg.Type != msgTypeKick:
+			refused = r.saveMute(msg)
+		}
+	}
+	if refused != "" {
+		r.refuse(from, refused)
+		return
+	}
+	if r.rooms != nil {
+		r.rooms.publish(msg)
+	}
+	r.applyAction(msg)
+}
+
+// pin saves or removes the pin msg asks for, returning why not if it
+// cannot.
+func (r *room) pin(msg *message) string {
+	var err error
+	key := r.name + "/" + msg.Target
+	if msg.Type == msgTypePin {
+		err = r.state.Put(pinsBucket, key, pin{MessageID: msg.Target, By: msg.UserID, Pinned: msg.When})
+	} else {
+		err = r.state.Delete(pinsBucket, key)
+	}
+	if err != nil {
+		r.tracer.Error("Failed to save the pin: ", err)
+		return "The pin could not be saved."
+	}
+	return ""
+}
+
+// delete deletes the message msg targets, if it was sent to this room by the
+// sender of msg or others is true, returning why not if it cannot.
+func (r *room) delete(msg *message, others bool) string {
+	m, err := r.store.Get(r.name, msg.Target)
+	if err != nil && err != ErrNoMessage {
+		r.tracer.Error("Failed to find the message to delete: ", err)
+		return "The message could not be deleted."
+	}
+	if m == nil || !others && m.UserID != msg.UserID {
+		return "Only the room's moderators may delete other people's messages."
+	}
+	if err := r.store.Delete(r.name, m.ID); err != nil {
+		r.tracer.Error("Failed to delete message: ", err)
+		return "The message could not be deleted."
+	}
+	r.state.Delete(pinsBucket, r.name+"/"+m.ID)
+	if err := r.attachments.release(m.Attachments); err != nil {
+		r.tracer.Error("Failed to release attachments: ", err)
+	}
+	return ""
+}
+
+// applyAction broadcasts a pin, unpin, delete, kick, mute or unmute message
+// accepted by this or another server, forgetting a deleted message,
+// disconnecting a removed user and silencing a muted one. It runs inside
+// run.
+func (r *room) applyAction(msg *message) {
+	switch msg.Type {
+	case msgTypeMute, msgTypeUnmute:
+		r.applyMute(msg)
+	case msgTypeDelete:
+		r.replay.drop(msg.Target)
+	case msgTypeKick:
+		reason := msg.Message
+		if reason == "" {
+			reason = "You were removed from the room."
+		}
+		for client := range r.clients {
+			if client.userID() == msg.Target {
+				// write closes the connection after sending this, or
+				// once remove closes send if it had no room for it
+				select {
+				case client.send <- &message{ID: newID(), Type: msgTypeDisconnect, Room: r.name, Name: "system",
+					Message: reason, When: time.Now()}:
+				default:
+				}
+				r.remove(client)
+			}
+		}
+	}
+	r.broadcast(msg)
+}
+
+// refuse tells c, if it is still in the room, why the room did not do what
+// it asked. Like broadcast, it does not wait for a client that cannot keep
+// up. It runs inside run.
+func (r *room) refuse(c *client, text string) {
+	if c == nil || !r.clients[c] {
+		return
+	}
+	select {
+	case c.send <- &message{ID: newID(), Type: msgTypeNotice, Room: r.name, Name: "system", Message: text, When: time.Now()}:
+	default:
+	}
+}
+
+// replayPins sends a joining client the room's pinned messages, as pin
+// messages. It runs inside run, after replayHistory.
+func (r *room) replayPins(c *client) {
+	docs, err := r.state.List(pinsBucket)
+	if err != nil {
+		r.tracer.Warn("Failed to load pins: ", err)
+		return
+	}
+	for key, doc := range docs {
+		var p pin
+		if !strings.HasPrefix(key, r.name+"/") || json.Unmarshal(doc, &p) != nil {
+			continue
+		}
+		select {
+		case c.send <- &message{ID: newID(), Type: msgTypePin, Room: r.name, UserID: p.By, Target: p.MessageID, When: p.Pinned}:
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/objx"
+)
+
+func TestRoomRolesAPI(t *testing.T) {
+	state := newFileState("")
+	api := &roomSettingsAPI{state: state}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})
+	serve := func(method, path, body string, user objx.Map) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(method, path, strings.NewReader(body), user))
+		return w
+	}
+	if w := serve(http.MethodPost, "/api/rooms", `{"Name": "golang"}`, ann); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(http.MethodPut, "/api/rooms/golang/roles/carol", `{"Role": "moderator"}`, bob); w.Code != http.StatusForbidden {
+		t.Errorf("only the owner may grant roles, got %d", w.Code)
+	}
+	if w := serve(http.MethodPut, "/api/rooms/golang/roles/bob", `{"Role": "owner"}`, ann); w.Code != http.StatusBadRequest {
+		t.Errorf("ownership is not a role to grant, got %d", w.Code)
+	}
+	if w := serve(http.MethodPut, "/api/rooms/golang/roles/bob", `{"Role": "moderator"}`, ann); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	for userID, want := range map[string]string{"ann": roleOwner, "bob": roleModerator, "carol": roleMember} {
+		if role, err := userRole(state, "golang", userID); err != nil || role != want {
+			t.Errorf("expected %s to be %s, got %q, %v", userID, want, role, err)
+		}
+	}
+	if w := serve(http.MethodGet, "/api/rooms/golang/roles", "", bob); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"moderator"`) {
+		t.Errorf("expected the roles, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(http.MethodDelete, "/api/rooms/golang/roles/bob", "", ann); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if role, _ := userRole(state, "golang", "bob"); role != roleMember {
+		t.Errorf("bob should be a member again, got %q", role)
+	}
+}
+
+func TestRoomActionsNeedRoles(t *testing.T) {
+	r := newRoom("golang")
+	r.state.Put(roomSettingsBucket, "golang", roomSettings{Room: "golang", Owner: "ann"})
+	r.state.Put(roomRolesBucket, "golang/bob", roomRole{Room: "golang", UserID: "bob", Role: roleModerator})
+	go r.run()
+	join := func(userID string) *client {
+		c := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": userID, "name": userID}}
+		r.join <- c
+		return c
+	}
+	ann, bob, carol := join("ann"), join("bob"), join("carol")
+	act := func(from *client, typ, target string) {
+		r.forward <- &message{ID: newID(), Type: typ, UserID: from.userID(), Name: from.userID(), Target: target, from: from}
+	}
+	r.forward <- &message{ID: "1", UserID: "ann", Name: "ann", Message: "hi"}
+	r.forward <- &message{ID: "2", UserID: "carol", Name: "carol", Message: "hello"}
+	receiveChat(t, carol)
+	receiveChat(t, carol)
+
+	act(carol, msgTypePin, "1")
+	if msg := receiveChat(t, carol); msg.Type != msgTypeNotice {
+		t.Errorf("a member may not pin, got %q", msg.Type)
+	}
+	act(bob, msgTypePin, "1")
+	if msg := receiveChat(t, carol); msg.Type != msgTypePin || msg.Target != "1" {
+		t.Errorf("a moderator may pin, got %q %q", msg.Type, msg.Target)
+	}
+
+	act(carol, msgTypeDelete, "1")
+	if msg := receiveChat(t, carol); msg.Type != msgTypeNotice {
+		t.Errorf("a member may not delete others' messages, got %q", msg.Type)
+	}
+	act(carol, msgTypeDelete, "2")
+	if msg := receiveChat(t, carol); msg.Type != msgTypeDelete || msg.Target != "2" {
+		t.Errorf("anyone may delete their own messages, got %q", msg.Type)
+	}
+	if stored, _ := r.store.Query(messageQuery{Room: "golang"}); len(stored) != 1 || stored[0].ID != "1" {
+		t.Errorf("expected only message 1 left, got %v", stored)
+	}
+
+	act(bob, msgTypeKick, "ann")
+	for {
+		msg := receiveChat(t, bob)
+		if msg.Type == msgTypeKick {
+			t.Fatal("a moderator may not remove the owner")
+		}
+		if msg.Type == msgTypeNotice {
+			break
+		}
+	}
+	act(ann, msgTypeKick, "carol")
+	for {
+		if msg := receiveChat(t, carol); msg.Type == msgTypeDisconnect {
+			break
+		}
+	}
+	for {
+		if msg := receiveChat(t, ann); msg.Type == msgTypeKick {
+			break
+		}
+	}
+}
+
+func TestKickDoesNotWaitForTheClient(t *testing.T) {
+	r := newRoom("golang")
+	r.state.Put(roomSettingsBucket, "golang", roomSettings{Room: "golang", Owner: "ann"})
+	go r.run()
+	ann := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": "ann", "name": "ann"}}
+	// dave's connection never reads
+	dave := &client{send: make(chan *message), room: r, userData: map[string]interface{}{"userid": "dave", "name": "dave"}}
+	r.join <- ann
+	r.join <- dave
+	r.forward <- &message{ID: newID(), Type: msgTypeKick, UserID: "ann", Name: "ann", Target: "dave", from: ann}
+	for {
+		if msg := receiveChat(t, ann); msg.Type == msgTypeKick {
+			break
+		}
+	}
+	if _, ok := <-dave.send; ok {
+		t.Error("dave should have been removed")
+	}
+}
+
+func TestDeleteOnlyReachesItsRoom(t *testing.T) {
+	rooms := newRoomManager()
+	mine, theirs := rooms.get("mine"), rooms.get("theirs")
+	rooms.state.Put(roomRolesBucket, "mine/mallory", roomRole{Room: "mine", UserID: "mallory", Role: roleModerator})
+	join := func(r *room, userID string) *client {
+		c := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": userID, "name": userID}}
+		r.join <- c
+		return c
+	}
+	ann, mallory := join(theirs, "ann"), join(mine, "mallory")
+	next := func(c *client) *message {
+		t.Helper()
+		for {
+			if msg := receiveChat(t, c); msg.Type != msgTypeAck {
+				return msg
+			}
+		}
+	}
+	theirs.forward <- &message{ID: "v1", UserID: "ann", Name: "ann", Message: "mine", from: ann}
+	next(ann)
+
+	// the ID may be reused in another room, but deleting it there leaves
+	// the original alone
+	mine.forward <- &message{ID: "v1", UserID: "mallory", Name: "mallory", Message: "decoy", from: mallory}
+	next(mallory)
+	mine.forward <- &message{ID: newID(), Type: msgTypeDelete, UserID: "mallory", Name: "mallory", Target: "v1", from: mallory}
+	if msg := next(mallory); msg.Type != msgTypeDelete {
+		t.Fatalf("expected the decoy to be deleted, got %+v", msg)
+	}
+	if _, err := rooms.store.Get("theirs", "v1"); err != nil {
+		t.Errorf("the message of the other room should be kept, got %v", err)
+	}
+
+	// in the same room the ID is taken, also once recent IDs are forgotten
+	// as they are on a restart
+	restarted := newRoom("theirs")
+	restarted.store, restarted.state = rooms.store, rooms.state
+	go restarted.run()
+	spy := join(restarted, "mallory")
+	restarted.forward <- &message{ID: "v1", UserID: "mallory", Name: "mallory", Message: "forged", from: spy}
+	// after the history, which has the original
+	for msg := next(spy); msg.Type != msgTypeNotice; msg = next(spy) {
+		if msg.Message == "forged" {
+			t.Fatal("a message with a taken ID should be refused")
+		}
+	}
+	if stored, _ := rooms.store.Get("theirs", "v1"); stored == nil || stored.Message != "mine" {
+		t.Errorf("the original should be kept, got %+v", stored)
+	}
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
-	"log"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/stretchr/objx"
 
 	"github.com/law-lee/chat_server/trace"
 )
 
 type room struct {
+	// name is the name the room is known by in URLs.
+	name string
 	// forward is a channel that holds incoming messages
 	// that should be forwarded to the other clients.
 	forward chan *message
@@ -18,13 +21,98 @@ type room struct {
 	join chan *client
 	// leave is a channel for clients wishing to leave the room.
 	leave chan *client
+	// remote is a channel for messages already accepted by another
+	// server, which only need broadcasting to the clients here.
+	remote chan *message
+	// direct is a channel for messages meant for a single client
+	// or for every connection of a single user.
+	direct chan *directMessage
+	// shed is a channel for requests to move clients to another server
+	// or tell them the server is going away.
+	shed chan *shedRequest
+	// control is a channel for admin requests about the clients.
+	control chan *roomControl
+	// rooms is the manager this room belongs to, if any.
+	rooms *roomManager
 	// clients holds all current clients in this room.
 	clients map[*client]bool
+	// members is len(clients), for reading outside run.
+	members int64
 	// tracer will receive trace information of activity
 	// in the room.
 	tracer trace.Tracer
+	// frames records the frames of the connections sampled for tracing;
+	// nil if none are.
+	frames *trace.Frames
 	// avatar is how avatar information will be obtained.
 	//avatar Avatar
+	// commands routes slash commands to the bots that registered them.
+	commands *commandDispatcher
+	// expander finds issue references in messages; nil if not configured.
+	expander *linkExpander
+	// moderators check messages from users before they are broadcast.
+	moderators []Moderator
+	// meter counts messages and seats against workspace quotas; nil if
+	// not metering.
+	meter *usageMeter
+	// metrics counts the clients and messages of the room; nil if not
+	// recorded.
+	metrics *metrics
+	// store keeps the history of the room.
+	store MessageStore
+	// attachments counts the references stored messages hold to files;
+	// nil if there are none.
+	attachments *attachmentStore
+	// rateLimit limits how fast each user may send, using the buckets
+	// in limiter.
+	rateLimit rateLimit
+	limiter   RateLimiter
+	// historySize is how many recent messages are replayed to
+	// a client when it joins.
+	historySize int
+	// pongWait is how long a client's peer may stay silent before it is
+	// taken for dead, and pingPeriod how often it is pinged.
+	pongWait   time.Duration
+	pingPeriod time.Duration
+	// maxMessage is the longest text, in bytes, clients may send; 0 for
+	// no limit.
+	maxMessage int
+	// bandwidth caps how fast users' frames go; nil for no cap.
+	bandwidth *bandwidthMeter
+	// push tells users mentioned while away; nil for nobody.
+	push *pushNotifier
+	// recent holds the IDs of recently broadcast messages so that
+	// a message resent by its client is not delivered twice.
+	recent *recentIDs
+	// state is where the room records who is in it and the reactions
+	// to its messages.
+	state StateStore
+	// roster counts the connections of each userid in the room; it is
+	// only used inside run.
+	roster map[string]int
+	// lastTyping is when a typing event was last broadcast for each
+	// userid; it is only used inside run.
+	lastTyping map[string]time.Time
+	// seq is the sequence number of the last message of the room, and
+	// replay holds the most recent messages for clients that reconnect.
+	// seqLoaded is set once seq has been read from the store. They are
+	// only used inside run.
+	seq       uint64
+	seqLoaded bool
+	replay    *replayBuffer
+	// mutes is when the mute of each muted userid ends, loaded from the
+	// state store when first needed; it is only used inside run.
+	mutes map[string]time.Time
+	// filters are the room's own moderators, from its settings, loaded
+	// when filtersLoaded is false; they are only used inside run.
+	filters       []Moderator
+	filtersLoaded bool
+	// rules are the room's rules, loaded when rulesLoaded is false, and
+	// accepted the userids known to have accepted them; they are only
+	// used inside run.
+	rules       *roomRules
+	rulesLoaded bool
+	accepted    map[string]bool
 }
 
 //We can use select statements whenever we need to synchronize or modify
@@ -39,61 +127,482 @@ func (r *room) run() {
 		case client := <-r.join:
 			// joining
 			r.clients[client] = true
+			client.joined = time.Now()
+			if client.userID() != "" {
+				client.display = r.uniqueName(client, client.joined)
+			}
+			if client.named != nil {
+				close(client.named)
+			}
+			atomic.AddInt64(&r.members, 1)
+			r.metrics.addClients(r.name, 1)
 			r.tracer.Trace("New client joined")
+			client.historyFrom = r.historyFrom(client)
+			r.replayHistory(client)
+			r.replayReceipts(client)
+			r.replayPins(client)
+			r.welcome(client)
+			r.promptRules(client)
+			r.presence(client, true)
 		case client := <-r.leave:
-			// leaving
-			delete(r.clients, client)
-			close(client.send)
-			r.tracer.Trace("Client left")
+			// leaving, unless it was removed already
+			if r.clients[client] {
+				r.remove(client)
+			}
+		case d := <-r.direct:
+			// only deliver to clients still in the room; the send
+			// channel of a client that left has been closed
+			if d.to != nil && r.clients[d.to] {
+				r.sendDirect(d.to, d.msg)
+			}
+			if d.userID != "" || d.session != "" {
+				for client := range r.clients {
+					if d.userID != "" && client.userID() == d.userID || d.session != "" && client.session == d.session {
+						r.sendDirect(client, d.msg)
+					}
+				}
+			}
 		case msg := <-r.forward:
-			r.tracer.Trace("Message received: ", msg.Message)
-			// forward message to all clients
-			for client := range r.clients {
-				client.send <- msg
-				r.tracer.Trace(" -- sent to client")
+			if msg.Type == msgTypeTyping {
+				r.typing(msg)
+				continue
+			}
+			if msg.Type == msgTypeReaction {
+				r.react(msg)
+				continue
+			}
+			if msg.Type == msgTypeRead {
+				r.markRead(msg)
+				continue
+			}
+			if msg.Type == msgTypePin || msg.Type == msgTypeUnpin || msg.Type == msgTypeDelete || msg.Type == msgTypeKick ||
+				msg.Type == msgTypeMute || msg.Type == msgTypeUnmute {
+				r.act(msg)
+				continue
+			}
+			if msg.Type == msgTypeAcceptRules {
+				r.acceptRules(msg)
+				continue
+			}
+			if until := r.mutedUntil(msg.UserID, time.Now()); !until.IsZero() {
+				r.tracer.Debug("Message from muted user dropped: ", msg.UserID)
+				r.refuse(msg.from, "You are muted in this room until "+until.Format("15:04 MST")+".")
+				msg.from = nil
+				continue
+			}
+			if msg.from != nil && !r.acceptedRules(msg.UserID) {
+				r.refuse(msg.from, "Please accept the room's rules before posting.")
+				r.promptRules(msg.from)
+				msg.from = nil
+				continue
+			}
+			r.accept(msg)
+		case req := <-r.shed:
+			req.done <- r.shedClients(req.n, req.msg)
+		case req := <-r.control:
+			req.done <- r.applyControl(req)
+		case msg := <-r.remote:
+			// typing events are throttled, and reactions and receipts
+			// recorded, by the server that accepted them
+			if msg.Type == msgTypeTyping || msg.Type == msgTypeReaction || msg.Type == msgTypeRead || msg.Type == msgTypePin || msg.Type == msgTypeUnpin {
+				r.broadcast(msg)
+			} else if msg.Type == msgTypeDelete || msg.Type == msgTypeKick || msg.Type == msgTypeMute || msg.Type == msgTypeUnmute {
+				r.applyAction(msg)
+			} else if r.recent.add(msg.ID) {
+				if msg.Seq != 0 {
+					r.sequence(msg)
+				}
+				r.broadcast(msg)
+				r.mention(msg, false)
+			}
+		}
+	}
+}
+
+// accept saves and broadcasts msg, a message the room takes, unless it is a
+// duplicate or moderation stops it, and acknowledges it to its sender. A
+// message that cannot be saved is not broadcast; its sender is told to send
+// it again. It runs inside run.
+func (r *room) accept(msg *message) {
+	if !r.recent.add(msg.ID) {
+		r.tracer.Debug("Duplicate message dropped: ", msg.ID)
+		// the sender is resending one it has no ack for
+		r.ack(msg)
+		return
+	}
+	// clients choose message IDs, so one already stored is either a
+	// resend older than recent remembers or someone else's message
+	if stored, err := r.store.Get(r.name, msg.ID); err == nil {
+		// it may still come through the outbox of a server that
+		// stopped before publishing it, and must be broadcast then
+		r.recent.forget(msg.ID)
+		if stored.UserID == msg.UserID {
+			r.ack(msg)
+		} else {
+			r.tracer.Debug("Message with a taken ID dropped: ", msg.ID)
+			r.refuse(msg.from, "That message ID is already taken; send the message with another.")
+		}
+		return
+	}
+	r.tracer.Debug("Message received: ", msg.Message)
+	msg.Room = r.name
+	if msg.Type == "" {
+		msg.Type = msgTypeMessage
+	}
+	if msg.UserID != "" && !r.moderate(msg) {
+		return
+	}
+	r.number(msg)
+	if err := r.save(msg); err != nil {
+		r.tracer.Error("Failed to save message: ", err)
+		// the resend must not be taken for a duplicate
+		r.recent.forget(msg.ID)
+		r.refuse(msg.from, "The message could not be saved; send it again.")
+		return
+	}
+	r.replay.add(msg)
+	r.recordActivity(msg)
+	if err := r.attachments.claim(msg.Attachments); err != nil {
+		r.tracer.Error("Failed to count attachments: ", err)
+	}
+	r.broadcast(msg)
+	r.mention(msg, true)
+	r.ack(msg)
+}
+
+// save saves msg. When other servers share the room it is queued in the
+// store's outbox as well, for the relay to publish, or, if the store has
+// none, published once saved. It runs inside run.
+func (r *room) save(msg *message) error {
+	if r.rooms == nil || r.rooms.broker == nil {
+		return r.store.Save(msg)
+	}
+	outbox, ok := r.store.(Outbox)
+	if !ok {
+		if err := r.store.Save(msg); err != nil {
+			return err
+		}
+		r.rooms.publish(msg)
+		return nil
+	}
+	if err := outbox.SaveQueued(msg, r.rooms.node); err != nil {
+		return err
+	}
+	r.rooms.relaySoon()
+	return nil
+}
+
+// typing broadcasts a typing event, unless one was broadcast for the same
+// user within typingInterval. Typing events are not saved. It runs inside run.
+func (r *room) typing(msg *message) {
+	now := time.Now()
+	if last, ok := r.lastTyping[msg.UserID]; ok && now.Sub(last) < typingInterval {
+		return
+	}
+	if len(r.lastTyping) >= maxTypingUsers {
+		for userID, last := range r.lastTyping {
+			if now.Sub(last) >= typingInterval {
+				delete(r.lastTyping, userID)
+			}
+		}
+	}
+	r.lastTyping[msg.UserID] = now
+	msg.Room = r.name
+	if r.rooms != nil {
+		r.rooms.publish(msg)
+	}
+	r.broadcast(msg)
+}
+
+// shedRequest asks a room to send msg, a reconnect or shutdown message, to n
+// of its clients, or all of them if n is negative. The number sent is sent
+// on done.
+type shedRequest struct {
+	n    int
+	msg  *message
+	done chan int
+}
+
+// shedClients sends a copy of msg to up to n clients and disconnects them
+// after reconnectGrace if they have not gone by then. A client with no room
+// for msg is disconnected at once. A reconnect message gets a resume token.
+// It runs inside run.
+func (r *room) shedClients(n int, msg *message) int {
+	now := time.Now()
+	token := ""
+	if msg.Type == msgTypeReconnect {
+		token = resumeToken(r.name, now)
+	}
+	shed := 0
+	for client := range r.clients {
+		if n >= 0 && shed == n {
+			break
+		}
+		m := *msg
+		m.ID, m.Room, m.Name, m.When, m.Resume = newID(), r.name, "system", now, token
+		select {
+		case client.send <- &m:
+		default:
+			// remove closes send, and write then closes the connection
+			r.remove(client)
+			shed++
+			continue
+		}
+		c := client
+		time.AfterFunc(reconnectGrace, func() {
+			if c.socket != nil {
+				c.socket.Close()
 			}
+		})
+		shed++
+	}
+	return shed
+}
+
+// broadcast sends msg to every client in the room. A client too slow to
+// keep up, whose send channel is full, misses the message rather than
+// holding up the room.
+func (r *room) broadcast(msg *message) {
+	dropped := 0
+	for client := range r.clients {
+		select {
+		case client.send <- msg:
+			r.tracer.Debug(" -- sent to client")
+		default:
+			dropped++
+			r.tracer.Debug(" -- dropped for slow client")
 		}
 	}
+	r.metrics.countBroadcast(r.name, dropped)
 }
 
 const (
 	socketBufferSize  = 1024
 	messageBufferSize = 256
+	// directBufferSize is how many direct messages a room holds while
+	// busy before deliverDirect drops those for it.
+	directBufferSize = 256
+	// defaultHistorySize is how many messages are replayed on join
+	// unless configured otherwise.
+	defaultHistorySize = 50
+	// recentIDsSize is how many message IDs each room remembers
+	// for deduplication.
+	recentIDsSize = 1024
+	// typingInterval is the least time between two typing events
+	// broadcast for the same user.
+	typingInterval = 2 * time.Second
+	// maxTypingUsers is how many users' typing times a room keeps
+	// before forgetting the stale ones.
+	maxTypingUsers = 256
 )
 
 var upgrader = &websocket.Upgrader{ReadBufferSize: socketBufferSize,
-	WriteBufferSize: socketBufferSize}
+	WriteBufferSize: socketBufferSize, EnableCompression: true,
+	Subprotocols: subprotocols()}
 
 func (r *room) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	socket, err := upgrader.Upgrade(w, req, nil)
+	// check the cookie or token before upgrading, while we can still
+	// answer with an error
+	userData, err := authenticate(req)
 	if err != nil {
-		log.Fatal("ServeHTTP websocket:", err)
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	// a private room is only for its members
+	if ok, err := canEnter(r.state, r.name, userData); err != nil || !ok {
+		if scopes, bot := scopesOf(userData); bot && !scopes.inRoom(r.name) {
+			http.Error(w, "this bot may not enter this room", http.StatusForbidden)
+			return
+		}
+		if settings, err := loadRoomSettings(r.state, r.name); err == nil && settings.NoGuests && isGuest(userData) {
+			http.Error(w, "this room does not allow guests; sign in to enter it", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "this room is private; you need an invite", http.StatusForbidden)
+		return
+	}
+	if settings, err := loadRoomSettings(r.state, r.name); err != nil || settings.Archived {
+		http.Error(w, "this room has been archived", http.StatusGone)
+		return
+	}
+	if ban, err := banned(r.state, r.name, userData.Get("userid").Str(), time.Now()); err != nil || ban != nil {
+		http.Error(w, "you are banned from this room", http.StatusForbidden)
+		return
+	}
+	// connecting takes a seat
+	if _, err := r.meter.allow(workspaceOf(userData), userData.Get("userid").Str(), 0, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
-	authCookie, err := req.Cookie("auth")
+	socket, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
-		log.Fatal("Failed to get auth cookie:", err)
+		// Upgrade has answered already; a plain GET must not take the
+		// server down
+		r.tracer.Warn("Failed to open websocket: ", err)
 		return
 	}
+	// compression is only used once the client asks for it in its hello
+	socket.EnableWriteCompression(false)
 	client := &client{
+		id:       newID(),
 		socket:   socket,
+		protocol: protocolNamed(socket.Subprotocol()),
 		send:     make(chan *message, messageBufferSize),
 		room:     r,
-		userData: objx.MustFromBase64(authCookie.Value),
+		userData: userData,
+		ip:       clientIP(req),
+		named:    make(chan struct{}),
+	}
+	if _, ok := bearerToken(req); !ok {
+		client.session, _ = sessionCookieID(req)
+	}
+	if since, ok := readResumeToken(req.URL.Query().Get("resume"), r.name, time.Now()); ok {
+		client.resumeSince = since
+	}
+	if r.frames.Sample(client.userID()) {
+		client.frames = r.frames
+	}
+	if seq, err := strconv.ParseUint(req.URL.Query().Get("since"), 10, 64); err == nil {
+		client.lastSeq = seq
 	}
 	r.join <- client
 	defer func() { r.leave <- client }()
+	// messages go out under the name the room gives the client
+	<-client.named
 	go client.write()
+	if client.protocol.deprecated != "" {
+		r.notice(client, client.protocol.deprecated)
+	}
 	client.read()
 }
 
-// newRoom makes a new room.
-func newRoom() *room {
+// remove takes client out of the room and closes its send channel, so that
+// write closes the connection once it has sent what is queued. It runs
+// inside run.
+func (r *room) remove(client *client) {
+	delete(r.clients, client)
+	atomic.AddInt64(&r.members, -1)
+	r.metrics.addClients(r.name, -1)
+	r.presence(client, false)
+	close(client.send)
+	r.tracer.Trace("Client left")
+}
+
+// replayHistory sends the last historySize messages of the room to a newly
+// joined client, or those since it was moved from another server if it is
+// resuming, or those it missed if it reconnects saying which message it saw
+// last. It runs inside run, before the client can receive any live message,
+// and never sends more than fit in the client's send buffer.
+func (r *room) replayHistory(c *client) {
+	if c.lastSeq > 0 {
+		r.replayMissed(c)
+		return
+	}
+	limit := r.historySize
+	if limit > cap(c.send) {
+		limit = cap(c.send)
+	}
+	if limit <= 0 {
+		return
+	}
+	since := c.resumeSince
+	if c.historyFrom.After(since) {
+		since = c.historyFrom
+	}
+	history, err := r.store.Query(messageQuery{Room: r.name, Since: since, Limit: limit})
+	if err != nil {
+		r.tracer.Warn("Failed to load history: ", err)
+		return
+	}
+	for _, msg := range accounts.mask(history) {
+		c.send <- r.withReactions(msg)
+	}
+}
+
+// withReactions returns msg with its reaction counts, if it has any.
+func (r *room) withReactions(msg *message) *message {
+	if counts := reactionCounts(r.state, r.name, msg.ID); counts != nil {
+		// the stored message is shared; send a copy
+		m := *msg
+		m.Reactions = counts
+		return &m
+	}
+	return msg
+}
+
+// ack tells the client that sent msg, if it is still in the room, that msg
+// was accepted. Like broadcast, it does not wait for a client that cannot
+// keep up. It runs inside run.
+func (r *room) ack(msg *message) {
+	from := msg.from
+	if from == nil {
+		return
+	}
+	// the message is kept in history; don't keep the client with it
+	msg.from = nil
+	if !r.clients[from] {
+		return
+	}
+	select {
+	case from.send <- ackFor(msg):
+	default:
+		r.tracer.Debug(" -- ack dropped for slow client")
+	}
+}
+
+// ackFor returns the acknowledgement of msg.
+func ackFor(msg *message) *message {
+	return &message{ID: msg.ID, Type: msgTypeAck, Room: msg.Room, Seq: msg.Seq, When: time.Now()}
+}
+
+// directMessage is a message for a single client of a room, or for
+// every client of the room belonging to userID.
+type directMessage struct {
+	to      *client
+	userID  string
+	session string
+	msg     *message
+}
+
+// sendDirect sends msg to c alone. Like broadcast, it does not wait for a
+// client that cannot keep up. It runs inside run.
+func (r *room) sendDirect(c *client, msg *message) {
+	select {
+	case c.send <- msg:
+	default:
+		r.tracer.Debug(" -- direct message dropped for slow client")
+	}
+}
+
+// notice sends text to c alone, as a message from the server.
+func (r *room) notice(c *client, text string) {
+	r.direct <- &directMessage{to: c, msg: &message{ID: newID(), Type: msgTypeNotice, Room: r.name, Name: "system", Message: text, When: time.Now()}}
+}
+
+// newRoom makes a new room with the given name.
+func newRoom(name string) *room {
 	return &room{
-		forward: make(chan *message),
-		join:    make(chan *client),
-		leave:   make(chan *client),
-		clients: make(map[*client]bool),
-		tracer:  trace.Off(),
+		name:        name,
+		forward:     make(chan *message),
+		remote:      make(chan *message),
+		join:        make(chan *client),
+		leave:       make(chan *client),
+		direct:      make(chan *directMessage, directBufferSize),
+		shed:        make(chan *shedRequest),
+		control:     make(chan *roomControl),
+		clients:     make(map[*client]bool),
+		tracer:      trace.Off(),
+		recent:      newRecentIDs(recentIDsSize),
+		lastTyping:  make(map[string]time.Time),
+		state:       newFileState(""),
+		roster:      make(map[string]int),
+		store:       newMemoryStore(),
+		commands:    newCommandDispatcher(),
+		limiter:     newLocalLimiter(),
+		historySize: defaultHistorySize,
+		pongWait:    defaultPongWait,
+		pingPeriod:  defaultPingPeriod,
+		maxMessage:  defaultMaxMessage,
+		replay:      newReplayBuffer(replayBufferSize),
 	}
 }
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receive waits briefly for the next message on c.send.
+func receive(t *testing.T, c *client) *message {
+	t.Helper()
+	select {
+	case msg := <-c.send:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return nil
+}
+
+// receiveChat is receive, skipping presence events.
+func receiveChat(t *testing.T, c *client) *message {
+	t.Helper()
+	for {
+		if msg := receive(t, c); msg.Type != msgTypePresence {
+			return msg
+		}
+	}
+}
+
+func TestRoomDropsDuplicateMessages(t *testing.T) {
+	r := newRoom(defaultRoom)
+	go r.run()
+	c := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- c
+	r.forward <- &message{ID: "a", Message: "first"}
+	r.forward <- &message{ID: "a", Message: "first (resent)"}
+	r.forward <- &message{ID: "b", Message: "second"}
+	if msg := receive(t, c); msg.ID != "a" || msg.Message != "first" {
+		t.Errorf("expected first message, got %+v", msg)
+	}
+	if msg := receive(t, c); msg.ID != "b" {
+		t.Errorf("resent message should have been dropped, got %+v", msg)
+	}
+}
+
+// flakyStore fails to save the first message it is given.
+type flakyStore struct {
+	MessageStore
+	mu     sync.Mutex
+	failed bool
+}
+
+func (s *flakyStore) Save(msg *message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.failed {
+		s.failed = true
+		return errors.New("disk full")
+	}
+	return s.MessageStore.Save(msg)
+}
+
+func TestRoomDoesNotBroadcastUnsavedMessages(t *testing.T) {
+	r := newRoom("golang")
+	r.store = &flakyStore{MessageStore: newMemoryStore()}
+	go r.run()
+	sender := &client{send: make(chan *message, messageBufferSize), room: r}
+	other := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- sender
+	r.join <- other
+	r.forward <- &message{ID: "one", Message: "one", from: sender}
+	if msg := receiveChat(t, sender); msg.Type != msgTypeNotice {
+		t.Fatalf("the sender should be told the message was not saved, got %q", msg.Type)
+	}
+	// the resend is not a duplicate
+	r.forward <- &message{ID: "one", Message: "one", from: sender}
+	if msg := receiveChat(t, other); msg.ID != "one" {
+		t.Fatalf("only the saved resend should be broadcast, got %+v", msg)
+	}
+	if msgs, _ := r.store.Query(messageQuery{Room: "golang"}); len(msgs) != 1 {
+		t.Errorf("expected the resend to be saved, got %v", ids(msgs))
+	}
+}
+
+func TestRecentIDsForgetsOldest(t *testing.T) {
+	r := newRecentIDs(2)
+	if !r.add("a") || !r.add("b") {
+		t.Fatal("new IDs should be reported as new")
+	}
+	if r.add("a") {
+		t.Error("remembered ID should be reported as seen")
+	}
+	r.add("c") // pushes out "a"
+	if !r.add("a") {
+		t.Error("ID pushed out of the window should be new again")
+	}
+	r.forget("c")
+	if !r.add("c") {
+		t.Error("forgotten ID should be new again")
+	}
+}
+
+func TestValidID(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"":                         false,
+		"0f3a-b_9":                 true,
+		"has space":                false,
+		"<script>":                 false,
+		string(make([]byte, 65)):   false,
+		"abcdefabcdefabcdefabcdef": true,
+	} {
+		if validID(id) != valid {
+			t.Errorf("validID(%q) should be %v", id, valid)
+		}
+	}
+}
+
+func TestRoomManagerCreatesRoomsLazily(t *testing.T) {
+	m := newRoomManager()
+	if len(m.rooms) != 0 {
+		t.Fatal("new manager should have no rooms")
+	}
+	golang := m.get("golang")
+	if m.get("golang") != golang {
+		t.Error("get should return the existing room")
+	}
+	if m.get("rust") == golang || len(m.rooms) != 2 {
+		t.Error("different names should get different rooms")
+	}
+	if golang.name != "golang" {
+		t.Errorf("room should be named golang, not %s", golang.name)
+	}
+}
+
+func TestRoomFromPath(t *testing.T) {
+	for path, name := range map[string]string{
+		"/room":         defaultRoom,
+		"/room/":        defaultRoom,
+		"/room/golang":  "golang",
+		"/room/golang/": "golang",
+	} {
+		if got := roomFromPath("/room", path); got != name {
+			t.Errorf("roomFromPath(%q) should be %q, not %q", path, name, got)
+		}
+	}
+}
+
+func TestRoomReplaysHistoryOnJoin(t *testing.T) {
+	r := newRoom("golang")
+	r.historySize = 2
+	for i, text := range []string{"one", "two", "three"} {
+		r.store.Save(&message{ID: text, Room: "golang", Message: text, When: time.Now().Add(time.Duration(i) * time.Second)})
+	}
+	go r.run()
+	c := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- c
+	r.forward <- &message{ID: "live", Message: "live"}
+	for _, want := range []string{"two", "three", "live"} {
+		if msg := receive(t, c); msg.Message != want {
+			t.Errorf("expected %q, got %q", want, msg.Message)
+		}
+	}
+}
+
+func TestDirectMessagesOnlyReachParticipants(t *testing.T) {
+	m := newRoomManager()
+	join := func(room, userID string) *client {
+		r := m.get(room)
+		c := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": userID}}
+		r.join <- c
+		return c
+	}
+	alice, bob, carol := join("lobby", "alice"), join("golang", "bob"), join("lobby", "carol")
+	m.sendDirect(&message{ID: "dm1", Type: msgTypeDM, UserID: "alice", To: "bob", Message: "psst"})
+	for _, c := range []*client{bob, alice} {
+		if msg := receiveChat(t, c); msg.ID != "dm1" || msg.Room != dmRoom("alice", "bob") {
+			t.Errorf("participant should receive the direct message, got %+v", msg)
+		}
+	}
+	for timeout := time.After(50 * time.Millisecond); ; {
+		select {
+		case msg := <-carol.send:
+			if msg.Type != msgTypePresence {
+				t.Errorf("bystander should not receive the direct message: %+v", msg)
+			}
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	if msgs, _ := m.store.Query(messageQuery{Room: dmRoom("bob", "alice")}); len(msgs) != 1 {
+		t.Error("direct message should be stored under the dm room")
+	}
+}
+
+func TestDirectMessagesSkipSlowClients(t *testing.T) {
+	m := newRoomManager()
+	r := m.get("lobby")
+	// bob's connection never reads
+	bob := &client{send: make(chan *message), room: r, userData: map[string]interface{}{"userid": "bob"}}
+	alice := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": "alice"}}
+	r.join <- bob
+	r.join <- alice
+	m.sendDirect(&message{ID: "dm1", Type: msgTypeDM, UserID: "alice", To: "bob", Message: "psst"})
+	if msg := receiveChat(t, alice); msg.ID != "dm1" {
+		t.Fatalf("expected the direct message, got %+v", msg)
+	}
+	r.forward <- &message{ID: "m1", Type: msgTypeMessage, UserID: "alice", Message: "still there?", When: time.Now()}
+	if msg := receiveChat(t, alice); msg.ID != "m1" {
+		t.Errorf("the room should not wait for bob, got %+v", msg)
+	}
+}
+
+func TestDirectMessagesAreDeliveredOnce(t *testing.T) {
+	m := newRoomManager()
+	r := m.get("lobby")
+	bob := &client{send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": "bob"}}
+	r.join <- bob
+	for _, remembered := range []bool{true, false} {
+		if !remembered {
+			// a resend older than the recent IDs is found in the store
+			m.recentDirect = newRecentIDs(recentIDsSize)
+		}
+		if !m.sendDirect(&message{ID: "dm1", Type: msgTypeDM, UserID: "alice", To: "bob", Message: "psst"}) {
+			t.Error("a resend should be acknowledged")
+		}
+	}
+	if msg := receiveChat(t, bob); msg.ID != "dm1" {
+		t.Fatalf("expected the direct message, got %+v", msg)
+	}
+	m.recentDirect = newRecentIDs(recentIDsSize)
+	if m.sendDirect(&message{ID: "dm1", Type: msgTypeDM, UserID: "bob", To: "alice", Message: "mine"}) {
+		t.Error("an ID taken by someone else's message should be refused")
+	}
+	select {
+	case msg := <-bob.send:
+		t.Errorf("the direct message should be delivered once, got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTypingIsThrottledAndNotSaved(t *testing.T) {
+	r := newRoom(defaultRoom)
+	go r.run()
+	c := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- c
+	r.forward <- &message{ID: "t1", Type: msgTypeTyping, UserID: "ann"}
+	r.forward <- &message{ID: "t2", Type: msgTypeTyping, UserID: "ann"}
+	r.forward <- &message{ID: "t3", Type: msgTypeTyping, UserID: "bob"}
+	if msg := receive(t, c); msg.ID != "t1" {
+		t.Errorf("expected ann typing, got %+v", msg)
+	}
+	if msg := receive(t, c); msg.ID != "t3" {
+		t.Errorf("ann's second typing event should be throttled, got %+v", msg)
+	}
+	if history, _ := r.store.Query(messageQuery{}); len(history) != 0 {
+		t.Errorf("typing events should not be saved, found %d", len(history))
+	}
+}
+
+func TestPresence(t *testing.T) {
+	m := newRoomManager()
+	r := m.get("golang")
+	join := func(userID, name string) *client {
+		c := &client{send: make(chan *message, messageBufferSize), room: r,
+			userData: map[string]interface{}{"userid": userID, "name": name}}
+		r.join <- c
+		return c
+	}
+	ann := join("ann", "Ann")
+	if msg := receive(t, ann); msg.Type != msgTypePresence || msg.UserID != "ann" || msg.Message != "joined" {
+		t.Fatalf("expected ann joined, got %+v", msg)
+	}
+	bob := join("bob", "Bob")
+	receive(t, ann)
+	bob2 := join("bob", "Bob")
+	r.leave <- bob2
+	r.forward <- &message{ID: "marker"}
+	if msg := receive(t, ann); msg.ID != "marker" {
+		t.Errorf("a second connection of the same user should not be announced, got %+v", msg)
+	}
+	list, err := members(m.state, "golang", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "Ann" || list[1].Name != "Bob" {
+		t.Errorf("expected Ann and Bob, got %+v", list)
+	}
+	r.leave <- bob
+	if msg := receive(t, ann); msg.Type != msgTypePresence || msg.UserID != "bob" || msg.Message != "left" {
+		t.Errorf("expected bob left, got %+v", msg)
+	}
+	if list, _ := members(m.state, "golang", time.Now()); len(list) != 1 {
+		t.Errorf("bob should be gone, got %+v", list)
+	}
+	m.state.Put(presenceBucket, presenceKey("golang", "ghost", "stopped-node"), roomMember{UserID: "ghost"})
+	if list, _ := members(m.state, "golang", time.Now()); len(list) != 1 {
+		t.Errorf("members of servers that are gone should not be listed, got %+v", list)
+	}
+}
+
+func TestRoomAcknowledgesMessages(t *testing.T) {
+	r := newRoom("golang")
+	go r.run()
+	sender := &client{send: make(chan *message, messageBufferSize), room: r}
+	other := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- sender
+	r.join <- other
+	for i := 0; i < 2; i++ {
+		// the second is a resend, dropped but acknowledged again
+		r.forward <- &message{ID: "one", Message: "one", from: sender}
+	}
+	if msg := receiveChat(t, sender); msg.Type != msgTypeMessage {
+		t.Fatalf("expected the message, got %q", msg.Type)
+	}
+	for i := 0; i < 2; i++ {
+		if msg := receiveChat(t, sender); msg.Type != msgTypeAck || msg.ID != "one" {
+			t.Fatalf("expected an ack for one, got %q %q", msg.Type, msg.ID)
+		}
+	}
+	if msg := receiveChat(t, other); msg.Type != msgTypeMessage {
+		t.Fatalf("expected the message, got %q", msg.Type)
+	}
+	select {
+	case msg := <-other.send:
+		t.Errorf("only the sender should get an ack, got %q", msg.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The operations an admin can carry out on a room's clients.
+const (
+	// controlList lists the room's clients.
+	controlList = "list"
+	// controlKick sends msg to the client with clientID and removes it.
+	controlKick = "kick"
+	// controlRemove sends msg to every client of the user with userID and
+	// removes them.
+	controlRemove = "remove"
+	// controlNotice broadcasts msg to the room on every server.
+	controlNotice = "notice"
+	// controlClose sends msg to every client and disconnects them all.
+	controlClose = "close"
+	// controlReload has the room read its settings again.
+	controlReload = "reload"
+	// controlForward posts msg, a message forwarded from another room,
+	// setting refused to why not if it cannot.
+	controlForward = "forward"
+)
+
+// roomControl is an admin request carried out inside run, where the room's
+// clients may be read and changed. The clients it applied to are sent on
+// done.
+type roomControl struct {
+	op       string
+	clientID string
+	userID   string
+	msg      *message
+	refused  string
+	done     chan []clientInfo
+}
+
+// clientInfo describes a connected client to admins.
+type clientInfo struct {
+	ID     string
+	UserID string
+	Name   string
+	IP     string
+	Joined time.Time
+	// BytesIn and BytesOut are the bytes received from and sent to the
+	// client so far.
+	BytesIn  int64
+	BytesOut int64
+}
+
+func (c *client) info() clientInfo {
+	return clientInfo{ID: c.id, UserID: c.userID(), Name: c.name(), IP: c.ip, Joined: c.joined,
+		BytesIn: atomic.LoadInt64(&c.bytesIn), BytesOut: atomic.LoadInt64(&c.bytesOut)}
+}
+
+// applyControl carries out req. It runs inside run.
+func (r *room) applyControl(req *roomControl) []clientInfo {
+	applied := []clientInfo{}
+	if req.op == controlReload {
+		r.filtersLoaded = false
+		r.rulesLoaded = false
+		for client := range r.clients {
+			r.promptRules(client)
+		}
+		return applied
+	}
+	if req.op == controlForward {
+		req.refused = r.postForward(req.msg)
+		return applied
+	}
+	if req.op == controlNotice {
+		if r.rooms != nil {
+			r.rooms.publish(req.msg)
+		}
+		r.recent.add(req.msg.ID)
+		r.broadcast(req.msg)
+	}
+	for client := range r.clients {
+		switch req.op {
+		case controlKick, controlRemove:
+			if req.op == controlKick && client.id != req.clientID || req.op == controlRemove && client.userID() != req.userID {
+				continue
+			}
+			// write closes the connection after sending this; one
+			// that is not reading is removed without it
+			select {
+			case client.send <- req.msg:
+			default:
+			}
+			r.remove(client)
+		case controlClose:
+			select {
+			case client.send <- req.msg:
+			default:
+				// remove closes send, and write then closes the
+				// connection
+				r.remove(client)
+			}
+		}
+		applied = append(applied, client.info())
+	}
+	sort.Slice(applied, func(i, j int) bool {
+		if !applied[i].Joined.Equal(applied[j].Joined) {
+			return applied[i].Joined.Before(applied[j].Joined)
+		}
+		return applied[i].ID < applied[j].ID
+	})
+	return applied
+}
+
+// do has run carry out op and returns the clients it applied to.
+func (r *room) do(op, clientID string, msg *message) []clientInfo {
+	if msg != nil {
+		msg.ID, msg.Room, msg.Name, msg.When = newID(), r.name, "system", time.Now()
+	}
+	req := &roomControl{op: op, clientID: clientID, msg: msg, done: make(chan []clientInfo)}
+	r.control <- req
+	return <-req.done
+}
+
+// lookup returns the named room if it exists, without creating it.
+func (m *roomManager) lookup(name string) (*room, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.rooms[name]
+	return r, ok
+}
+
+// closeRoom disconnects everybody in the named room, telling them reason,
+// and forgets the room; joining it again starts it afresh with its history.
+// The closed room's run goroutine is left idle rather than stopped, so that
+// anything still holding the room never blocks sending to it.
+func (m *roomManager) closeRoom(name, reason string) ([]clientInfo, bool) {
+	m.mu.Lock()
+	r, ok := m.rooms[name]
+	delete(m.rooms, name)
+	m.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	m.tracer.Trace("Room closed: ", name)
+	return r.do(controlClose, "", &message{Type: msgTypeDisconnect, Message: reason}), true
+}
+
+// roomSummary is a room as listed by the admin API.
+type roomSummary struct {
+	Name    string
+	Clients int
+}
+
+// serveAdmin is the admin API for the rooms on this server:
+//
+//	GET    /admin/rooms                         list rooms
+//	GET    /admin/rooms/{name}/clients          list a room's clients
+//	DELETE /admin/rooms/{name}/clients/{id}     disconnect a client, ?reason=
+//	POST   /admin/rooms/{name}/notice           broadcast {"Message": "..."}
+//	DELETE /admin/rooms/{name}                  close a room, ?reason=
+//	POST   /admin/notice                        broadcast to every room
+func (m *roomManager) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/admin/notice" {
+		m.serveNotice(w, r, m.list())
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/rooms"), "/"), "/")
+	reason := r.URL.Query().Get("reason")
+	if parts[0] == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		rooms := []roomSummary{}
+		for _, room := range m.list() {
+			rooms = append(rooms, roomSummary{Name: room.name, Clients: int(atomic.LoadInt64(&room.members))})
+		}
+		sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rooms)
+		return
+	}
+	target, ok := m.lookup(parts[0])
+	if !ok {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "clients":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(target.do(controlList, "", nil))
+	case r.Method == http.MethodDelete && len(parts) == 3 && parts[1] == "clients":
+		if reason == "" {
+			reason = "You were disconnected by an admin."
+		}
+		kicked := target.do(controlKick, parts[2], &message{Type: msgTypeDisconnect, Message: reason})
+		if len(kicked) == 0 {
+			http.Error(w, "no such client", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(kicked)
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "notice":
+		m.serveNotice(w, r, []*room{target})
+	case r.Method == http.MethodDelete && len(parts) == 1:
+		if reason == "" {
+			reason = "This room was closed."
+		}
+		closed, ok := m.closeRoom(target.name, reason)
+		if !ok {
+			http.Error(w, "no such room", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(closed)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// serveNotice broadcasts the notice in the request body to rooms.
+func (m *roomManager) serveNotice(w http.ResponseWriter, r *http.Request, rooms []*room) {
+	var notice struct{ Message string }
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&notice); err != nil || strings.TrimSpace(notice.Message) == "" {
+		http.Error(w, "body must be {\"Message\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	for _, room := range rooms {
+		room.do(controlNotice, "", &message{Type: msgTypeNotice, Message: notice.Message})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
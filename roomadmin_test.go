@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoomAdmin(t *testing.T) {
+	m := newRoomManager()
+	r := m.get("golang")
+	ann := &client{id: "c1", send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": "ann"}}
+	bob := &client{id: "c2", send: make(chan *message, messageBufferSize), room: r, userData: map[string]interface{}{"userid": "bob"}}
+	r.join <- ann
+	r.join <- bob
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		m.serveAdmin(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	var clients []clientInfo
+	json.NewDecoder(serve(http.MethodGet, "/admin/rooms/golang/clients", "").Body).Decode(&clients)
+	if len(clients) != 2 || clients[0].ID != "c1" || clients[1].UserID != "bob" {
+		t.Errorf("unexpected clients %+v", clients)
+	}
+	var rooms []roomSummary
+	json.NewDecoder(serve(http.MethodGet, "/admin/rooms", "").Body).Decode(&rooms)
+	if len(rooms) != 1 || rooms[0].Name != "golang" || rooms[0].Clients != 2 {
+		t.Errorf("unexpected rooms %+v", rooms)
+	}
+	if w := serve(http.MethodGet, "/admin/rooms/rust/clients", ""); w.Code != http.StatusNotFound {
+		t.Errorf("a missing room should be 404, got %d", w.Code)
+	}
+
+	if w := serve(http.MethodPost, "/admin/notice", `{"Message": "Maintenance at noon."}`); w.Code != http.StatusNoContent {
+		t.Fatalf("notice failed: %d %s", w.Code, w.Body)
+	}
+	for _, c := range []*client{ann, bob} {
+		if msg := receiveChat(t, c); msg.Type != msgTypeNotice || msg.Message != "Maintenance at noon." {
+			t.Errorf("expected the notice, got %+v", msg)
+		}
+	}
+	if msgs, _ := r.store.Query(messageQuery{Room: "golang"}); len(msgs) != 0 {
+		t.Errorf("notices should not be saved, got %+v", msgs)
+	}
+
+	if w := serve(http.MethodDelete, "/admin/rooms/golang/clients/c1?reason=Be+nice.", ""); w.Code != http.StatusOK {
+		t.Fatalf("kick failed: %d %s", w.Code, w.Body)
+	}
+	if msg := receiveChat(t, ann); msg.Type != msgTypeDisconnect || msg.Message != "Be nice." {
+		t.Errorf("ann should be disconnected, got %+v", msg)
+	}
+	if w := serve(http.MethodDelete, "/admin/rooms/golang/clients/c9", ""); w.Code != http.StatusNotFound {
+		t.Errorf("kicking a missing client should be 404, got %d", w.Code)
+	}
+
+	if w := serve(http.MethodDelete, "/admin/rooms/golang", ""); w.Code != http.StatusOK {
+		t.Fatalf("close failed: %d %s", w.Code, w.Body)
+	}
+	if msg := receiveChat(t, bob); msg.Type != msgTypeDisconnect || msg.Message != "This room was closed." {
+		t.Errorf("bob should be disconnected, got %+v", msg)
+	}
+	if _, ok := m.lookup("golang"); ok {
+		t.Error("a closed room should be forgotten")
+	}
+}
+
+func TestRoomAdminDoesNotWaitForClients(t *testing.T) {
+	m := newRoomManager()
+	r := m.get("golang")
+	// none of these connections read
+	join := func(id, userID string) *client {
+		c := &client{id: id, send: make(chan *message), room: r, userData: map[string]interface{}{"userid": userID}}
+		r.join <- c
+		return c
+	}
+	dave, erin, frank := join("c1", "dave"), join("c2", "erin"), join("c3", "frank")
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		m.serveAdmin(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	if w := serve(http.MethodDelete, "/admin/rooms/golang/clients/c1"); w.Code != http.StatusOK {
+		t.Fatalf("kick failed: %d %s", w.Code, w.Body)
+	}
+	if _, ok := <-dave.send; ok {
+		t.Error("dave should have been removed")
+	}
+	req := &roomControl{op: controlRemove, userID: "erin", msg: &message{Type: msgTypeDisconnect}, done: make(chan []clientInfo)}
+	r.control <- req
+	if removed := <-req.done; len(removed) != 1 {
+		t.Errorf("erin should have been removed, got %+v", removed)
+	}
+	if _, ok := <-erin.send; ok {
+		t.Error("erin should have been removed")
+	}
+	if w := serve(http.MethodDelete, "/admin/rooms/golang"); w.Code != http.StatusOK {
+		t.Fatalf("close failed: %d %s", w.Code, w.Body)
+	}
+	if _, ok := <-frank.send; ok {
+		t.Error("frank should have been removed")
+	}
+}
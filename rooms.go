@@ -0,0 +1,283 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/law-lee/chat_server/trace"
+)
+
+// defaultRoom is the room used when no name is given, e.g. by /room.
+const defaultRoom = "lobby"
+
+// roomManager keeps track of the named rooms. Rooms are created lazily the
+// first time somebody joins them, and each runs its own run goroutine.
+type roomManager struct {
+	mu    sync.Mutex
+	rooms map[string]*room
+	// tracer is handed to every room the manager creates.
+	tracer trace.Tracer
+	// frames records the frames of sampled connections; nil if none are.
+	frames *trace.Frames
+	// store is where every room keeps its history.
+	store MessageStore
+	// attachments is handed to every room; nil if files can't be
+	// attached.
+	attachments *attachmentStore
+	// commands holds the slash commands shared by every room.
+	commands *commandDispatcher
+	// expander is handed to every room; nil if not configured.
+	expander *linkExpander
+	// moderators check the messages of every room.
+	moderators []Moderator
+	// meter counts what every room's users use; nil if not metering.
+	meter *usageMeter
+	// metrics is handed to every room.
+	metrics *metrics
+	// rateLimit is how fast clients may send in every room, and limiter
+	// keeps the buckets it is checked against.
+	rateLimit rateLimit
+	limiter   RateLimiter
+	// historySize is how many messages rooms replay to joining clients.
+	historySize int
+	// maxMessage is the longest text clients may send in every room.
+	maxMessage int
+	// bandwidth caps the bytes users send and are sent in every room;
+	// nil for no cap.
+	bandwidth *bandwidthMeter
+	// push tells users who are away that they were mentioned; nil to
+	// not tell them.
+	push *pushNotifier
+	// state is where rooms record their members.
+	state StateStore
+	// broker shares messages with other servers; nil when running alone.
+	broker Broker
+	// draining is set while the server is being drained; no new
+	// clients are accepted. It is guarded by mu.
+	draining bool
+	// recentDirect holds the conversations and IDs of recently sent
+	// direct messages, like a room's recent, guarded by directMu.
+	directMu     sync.Mutex
+	recentDirect *recentIDs
+	// node identifies this server in the outbox, and orphanedAfter is
+	// when it takes over the messages others queued there; they are
+	// nodeID and orphanedAfter but in tests.
+	node          string
+	orphanedAfter time.Duration
+	// relayOnce starts runRelay, and relayNow tells it a message was
+	// queued in the outbox.
+	relayOnce sync.Once
+	relayNow  chan struct{}
+}
+
+// newRoomManager makes a manager with no rooms.
+func newRoomManager() *roomManager {
+	return &roomManager{
+		rooms:         make(map[string]*room),
+		tracer:        trace.Off(),
+		store:         newMemoryStore(),
+		state:         newFileState(""),
+		commands:      newCommandDispatcher(),
+		limiter:       newLocalLimiter(),
+		historySize:   defaultHistorySize,
+		maxMessage:    defaultMaxMessage,
+		metrics:       serverMetrics,
+		recentDirect:  newRecentIDs(recentIDsSize),
+		node:          nodeID,
+		orphanedAfter: orphanedAfter,
+		relayNow:      make(chan struct{}, 1),
+	}
+}
+
+// get returns the room with the given name, creating and starting it
+// if it does not exist yet.
+func (m *roomManager) get(name string) *room {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.rooms[name]; ok {
+		return r
+	}
+	r := newRoom(name)
+	r.tracer = m.tracer.With("room", name)
+	r.frames = m.frames
+	r.rooms = m
+	r.store = m.store
+	r.attachments = m.attachments
+	r.state = m.state
+	r.commands = m.commands
+	r.expander = m.expander
+	r.moderators = m.moderators
+	r.meter = m.meter
+	r.metrics = m.metrics
+	r.rateLimit = m.rateLimit
+	r.limiter = m.limiter
+	r.historySize = m.historySize
+	r.maxMessage = m.maxMessage
+	r.bandwidth = m.bandwidth
+	r.push = m.push
+	m.rooms[name] = r
+	go r.run()
+	m.tracer.Trace("Room created: ", name)
+	return r
+}
+
+// ServeHTTP upgrades requests for /room/{name} into the named room, creating
+// it if needed. /room on its own joins the default room.
+func (m *roomManager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if m.isDraining() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "this server is draining", http.StatusServiceUnavailable)
+		return
+	}
+	name := roomFromPath("/room", req.URL.Path)
+	if !validRoomName(name) {
+		http.Error(w, "invalid room name", http.StatusBadRequest)
+		return
+	}
+	m.get(name).ServeHTTP(w, req)
+}
+
+// setDraining starts or stops draining.
+func (m *roomManager) setDraining(draining bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.draining = draining
+}
+
+func (m *roomManager) isDraining() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.draining
+}
+
+// clientCount returns how many clients are connected to all rooms.
+func (m *roomManager) clientCount() int {
+	count := 0
+	for _, r := range m.list() {
+		count += int(atomic.LoadInt64(&r.members))
+	}
+	return count
+}
+
+// shed sends msg, a reconnect or shutdown message, to n clients, or all of
+// them if n is negative, and returns how many it was sent to. A room that
+// does not answer within reconnectGrace is skipped.
+func (m *roomManager) shed(n int, msg *message) int {
+	moved := 0
+	for _, r := range m.list() {
+		if n >= 0 && moved >= n {
+			break
+		}
+		req := &shedRequest{n: -1, msg: msg, done: make(chan int)}
+		if n >= 0 {
+			req.n = n - moved
+		}
+		select {
+		case r.shed <- req:
+			moved += <-req.done
+		case <-time.After(reconnectGrace):
+			m.tracer.Warn("Room ", r.name, " did not answer in time to shed its clients")
+		}
+	}
+	return moved
+}
+
+// list returns the rooms that exist now.
+func (m *roomManager) list() []*room {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rooms := make([]*room, 0, len(m.rooms))
+	for _, r := range m.rooms {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+// roomFromPath returns the room name following prefix in path,
+// or defaultRoom if there is none.
+func roomFromPath(prefix, path string) string {
+	name := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if name == "" {
+		return defaultRoom
+	}
+	return name
+}
+
+// validRoomName reports whether name can be used as a room name. Room names
+// appear in URLs, so they follow the same rules as client chosen IDs.
+func validRoomName(name string) bool {
+	return validID(name)
+}
+
+// sendDirect delivers a direct message to every connection of the recipient
+// and of the sender, in whichever rooms they are. It is saved under a room
+// name made from both userids so the conversation has a history too. Like a
+// room's messages, a resent one is only delivered once; sendDirect reports
+// false if msg's ID was taken by someone else's message, which is dropped.
+func (m *roomManager) sendDirect(msg *message) bool {
+	msg.Room = dmRoom(msg.UserID, msg.To)
+	m.directMu.Lock()
+	fresh := m.recentDirect.add(msg.Room + "/" + msg.ID)
+	m.directMu.Unlock()
+	if !fresh {
+		m.tracer.Debug("Duplicate direct message dropped: ", msg.ID)
+		return true
+	}
+	// clients choose message IDs, so one already stored is either a
+	// resend older than recentDirect remembers or someone else's message
+	if stored, err := m.store.Get(msg.Room, msg.ID); err == nil {
+		return stored.UserID == msg.UserID
+	}
+	if err := m.store.Save(msg); err != nil {
+		m.tracer.Error("Failed to save direct message: ", err)
+	} else if err := m.attachments.claim(msg.Attachments); err != nil {
+		m.tracer.Error("Failed to count attachments: ", err)
+	}
+	m.publish(msg)
+	m.deliverDirect(msg)
+	return true
+}
+
+// deliverDirect hands a direct message to the rooms of this server. It
+// does not wait for a room too busy to take it; the message is saved, so
+// the recipient still finds it in the conversation's history.
+func (m *roomManager) deliverDirect(msg *message) {
+	for _, r := range m.list() {
+		m.handDirect(r, &directMessage{userID: msg.To, msg: msg})
+		if msg.UserID != msg.To {
+			m.handDirect(r, &directMessage{userID: msg.UserID, msg: msg})
+		}
+	}
+}
+
+// handDirect gives d to r unless its direct channel is full.
+func (m *roomManager) handDirect(r *room, d *directMessage) {
+	select {
+	case r.direct <- d:
+	default:
+		m.tracer.Warn("Room ", r.name, " is too busy for a direct message")
+	}
+}
+
+// canRead reports whether the user with userID may read the messages of
+// room as far as direct messages go: only their two participants may read
+// them. Other rooms may be read by whoever may enter them, see canEnter.
+func canRead(userID, room string) bool {
+	if !strings.HasPrefix(room, "dm:") {
+		return true
+	}
+	a, b, _ := strings.Cut(strings.TrimPrefix(room, "dm:"), ":")
+	return userID != "" && (userID == a || userID == b)
+}
+
+// dmRoom is the name direct messages between two users are stored under.
+// It contains a ':' so it can never clash with a real room name.
+func dmRoom(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return "dm:" + a + ":" + b
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// roomTemplatesBucket holds the room templates admins defined, by name.
+const roomTemplatesBucket = "room_templates"
+
+// roomTemplate presets a new room, such as one per incident or project:
+// whether it is private, who moderates it, the filters its messages go
+// through besides the server's, the bots whose commands work in it and a
+// welcome message pinned in it.
+type roomTemplate struct {
+	Name        string
+	Description string `json:",omitempty"`
+	Private     bool
+	// Moderators are the userids made moderators of the room.
+	Moderators []string `json:",omitempty"`
+	// Filters are applied to the room's messages after the server's
+	// -moderation rules.
+	Filters *moderationConfig `json:",omitempty"`
+	// Bots are the names of the slash commands installed in the room.
+	Bots []string `json:",omitempty"`
+	// Welcome is posted to the room when it is created, and pinned.
+	Welcome string `json:",omitempty"`
+	// Expiry makes the rooms created from the template temporary.
+	Expiry *roomExpiry `json:",omitempty"`
+}
+
+// errRoomExists is returned for a room that was created already.
+var errRoomExists = errors.New("the room already has an owner")
+
+// errRoomInUse is returned for a room that has no owner but is in use, so
+// that nobody can take over a room others are talking in.
+var errRoomInUse = errors.New("the room is already in use; choose another name")
+
+// roomInUse reports whether the room called name is in use: it is the
+// default room, it is running on this server or it has history.
+func roomInUse(rooms *roomManager, name string) (bool, error) {
+	if name == defaultRoom {
+		return true, nil
+	}
+	if rooms == nil {
+		return false, nil
+	}
+	if _, ok := rooms.lookup(name); ok {
+		return true, nil
+	}
+	history, err := rooms.store.Query(messageQuery{Room: name, Limit: 1})
+	return len(history) > 0, err
+}
+
+// loadRoomTemplate returns the template called name, or nil if there is
+// none.
+func loadRoomTemplate(state StateStore, name string) (*roomTemplate, error) {
+	var t roomTemplate
+	switch err := state.Get(roomTemplatesBucket, name, &t); err {
+	case nil:
+		return &t, nil
+	case ErrNoState:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// createRoom creates the room called name, unless it is in use, owned by
+// the user with userID, expiring as expiry says, or as template does if
+// expiry is nil, and set up as template says if it is not nil, in which case
+// rooms must not be nil either: the template's bots are installed in its
+// commands, its welcome message saved to its store and a running room told.
+func createRoom(state StateStore, rooms *roomManager, name, userID string, private bool, expiry *roomExpiry, template *roomTemplate) (roomSettings, error) {
+	now := time.Now()
+	settings := roomSettings{Room: name, Private: private, Owner: userID, Created: now, Expiry: expiry}
+	if template != nil {
+		settings.Private = private || template.Private
+		settings.Template = template.Name
+		settings.Filters = template.Filters
+		if expiry == nil {
+			settings.Expiry = template.Expiry
+		}
+	}
+	if inUse, err := roomInUse(rooms, name); err != nil || inUse {
+		if err == nil {
+			err = errRoomInUse
+		}
+		return settings, err
+	}
+	created, err := state.Create(roomSettingsBucket, name, settings)
+	if err != nil {
+		return settings, err
+	}
+	if !created {
+		return settings, errRoomExists
+	}
+	if template == nil {
+		return settings, nil
+	}
+	for _, moderator := range template.Moderators {
+		role := roomRole{Room: name, UserID: moderator, Role: roleModerator, By: userID, Granted: now}
+		if err := state.Put(roomRolesBucket, name+"/"+moderator, role); err != nil {
+			return settings, err
+		}
+	}
+	for _, bot := range template.Bots {
+		if !rooms.commands.install(bot, name) {
+			rooms.tracer.Warn("Template ", template.Name, " installs /", bot, ", which is not registered")
+		}
+	}
+	if template.Welcome != "" {
+		welcome := &message{ID: newID(), Type: msgTypeMessage, Room: name, Name: "system", Message: template.Welcome, When: now}
+		if err := rooms.store.Save(welcome); err != nil {
+			return settings, err
+		}
+		if err := state.Put(pinsBucket, name+"/"+welcome.ID, pin{MessageID: welcome.ID, By: userID, Pinned: now}); err != nil {
+			return settings, err
+		}
+	}
+	// a room started since it was checked picks up its filters
+	if r, ok := rooms.lookup(name); ok {
+		r.do(controlReload, "", nil)
+	}
+	return settings, nil
+}
+
+// roomFilters returns the room's own Moderators, read from its settings
+// the first time they are needed. It runs inside run.
+func (r *room) roomFilters() []Moderator {
+	if r.filtersLoaded {
+		return r.filters
+	}
+	r.filtersLoaded = true
+	r.filters = nil
+	settings, err := loadRoomSettings(r.state, r.name)
+	if err != nil {
+		r.tracer.Warn("Failed to load the room's settings: ", err)
+		return nil
+	}
+	if settings.Filters != nil {
+		if r.filters, err = settings.Filters.moderators(); err != nil {
+			r.tracer.Error("The room's filters are invalid: ", err)
+		}
+	}
+	return r.filters
+}
+
+// createFromTemplate carries out the /create-from-template command:
+//
+//	/create-from-template <template> <room>
+//
+// which creates a room from a template, owned by c's user.
+func (c *client) createFromTemplate(args []string) {
+	if len(args) != 2 || !validRoomName(args[1]) {
+		c.room.notice(c, "usage: /create-from-template <template> <room>")
+		return
+	}
+	if c.room.rooms == nil || c.userID() == "" {
+		c.room.notice(c, "Rooms cannot be created here.")
+		return
+	}
+	template, err := loadRoomTemplate(c.room.state, args[0])
+	if err == nil && template == nil {
+		err = fmt.Errorf("there is no template called %s", args[0])
+	}
+	if err == nil {
+		_, err = createRoom(c.room.state, c.room.rooms, args[1], c.userID(), false, nil, template)
+	}
+	if err != nil {
+		c.room.notice(c, "Could not create "+args[1]+": "+err.Error())
+		return
+	}
+	c.room.notice(c, "Created room "+args[1]+" from template "+args[0]+": /chat/"+args[1])
+}
+
+// roomTemplatesAPI is the admin API for room templates:
+//
+//	GET    /admin/room-templates         list templates
+//	PUT    /admin/room-templates/{name}  define or replace a template
+//	DELETE /admin/room-templates/{name}  remove a template
+//
+// Rooms already created from a template keep their settings.
+type roomTemplatesAPI struct {
+	state StateStore
+}
+
+func (a *roomTemplatesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/room-templates"), "/")
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		docs, err := a.state.List(roomTemplatesBucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		templates := []*roomTemplate{}
+		for _, doc := range docs {
+			var t roomTemplate
+			if json.Unmarshal(doc, &t) == nil {
+				templates = append(templates, &t)
+			}
+		}
+		sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(templates)
+	case r.Method == http.MethodPut && validID(name):
+		var t roomTemplate
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.Name = name
+		if t.Expiry != nil && !t.Expiry.valid() {
+			http.Error(w, "invalid Expiry", http.StatusBadRequest)
+			return
+		}
+		if t.Filters != nil {
+			if _, err := t.Filters.moderators(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := a.state.Put(roomTemplatesBucket, name, &t); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&t)
+	case r.Method == http.MethodDelete && name != "":
+		if err := a.state.Delete(roomTemplatesBucket, name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestRoomFromTemplate(t *testing.T) {
+	rooms := newRoomManager()
+	rooms.commands.register(&slashCommand{Name: "page", Rooms: []string{"ops"}, URL: "http://bot.example", Bot: "pager"})
+	templates := &roomTemplatesAPI{state: rooms.state}
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	serve := func(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, withAuthCookie(method, path, strings.NewReader(body), ann))
+		return w
+	}
+	if w := serve(templates, http.MethodPut, "/admin/room-templates/incident", `{"Filters": {"Words": {"Words": ["darn"], "Action": "nope"}}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid filters should be refused, got %d", w.Code)
+	}
+	template := `{"Private": true, "Moderators": ["bob"], "Filters": {"Words": {"Words": ["darn"]}}, "Bots": ["page"], "Welcome": "Post updates here."}`
+	if w := serve(templates, http.MethodPut, "/admin/room-templates/incident", template); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(api, http.MethodPost, "/api/rooms", `{"Name": "inc-42", "Template": "nope"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("an unknown template should be refused, got %d", w.Code)
+	}
+	if w := serve(api, http.MethodPost, "/api/rooms", `{"Name": "inc-42", "Template": "incident"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	settings, _ := loadRoomSettings(rooms.state, "inc-42")
+	if !settings.Private || settings.Owner != "ann" || settings.Template != "incident" {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+	if role, _ := userRole(rooms.state, "inc-42", "bob"); role != roleModerator {
+		t.Errorf("bob should moderate the room, got %q", role)
+	}
+	if _, _, ok := rooms.commands.lookup("inc-42", "/page oncall"); !ok {
+		t.Error("the template's bot should be installed in the room")
+	}
+	stored, _ := rooms.store.Query(messageQuery{Room: "inc-42"})
+	if len(stored) != 1 || stored[0].Message != "Post updates here." {
+		t.Fatalf("expected the welcome message, got %v", stored)
+	}
+	var p pin
+	if err := rooms.state.Get(pinsBucket, "inc-42/"+stored[0].ID, &p); err != nil {
+		t.Errorf("the welcome message should be pinned: %v", err)
+	}
+
+	r := rooms.get("inc-42")
+	c := &client{send: make(chan *message, messageBufferSize), room: r, userData: ann}
+	r.join <- c
+	r.forward <- &message{ID: "m1", UserID: "ann", Name: "Ann", Message: "darn it", When: time.Now()}
+	for {
+		if msg := receiveChat(t, c); msg.ID == "m1" {
+			if msg.Message != "**** it" {
+				t.Errorf("the room's filter should mask the message, got %q", msg.Message)
+			}
+			break
+		}
+	}
+
+	c.createFromTemplate([]string{"incident", "inc-43"})
+	if msg := receiveChat(t, c); !strings.Contains(msg.Message, "Created room inc-43") {
+		t.Errorf("expected the room created, got %q", msg.Message)
+	}
+	if settings, _ := loadRoomSettings(rooms.state, "inc-43"); settings.Owner != "ann" {
+		t.Errorf("expected ann to own inc-43, got %+v", settings)
+	}
+}
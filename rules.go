@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// rulesAcceptancesBucket holds, by room/userid, when each user last
+// accepted the room's rules.
+const rulesAcceptancesBucket = "rules_acceptances"
+
+// roomRules are rules users must accept before they may post to the room.
+// Changing them changes Updated, and everyone must accept them again.
+type roomRules struct {
+	Text    string
+	Updated time.Time
+}
+
+// rulesAcceptance records that a user accepted a room's rules.
+type rulesAcceptance struct {
+	Room     string
+	UserID   string
+	Accepted time.Time
+}
+
+// roomRules returns the rules of the room, or nil if it has none, loading
+// them the first time and after a reload. It runs inside run.
+func (r *room) roomRules() *roomRules {
+	if r.rulesLoaded {
+		return r.rules
+	}
+	r.rulesLoaded = true
+	r.rules = nil
+	r.accepted = make(map[string]bool)
+	settings, err := loadRoomSettings(r.state, r.name)
+	if err != nil {
+		r.tracer.Warn("Failed to load the room's settings: ", err)
+		return nil
+	}
+	r.rules = settings.Rules
+	return r.rules
+}
+
+// acceptedRules reports whether the user with userID may post to the room:
+// they accepted its current rules, it has none, or they own the room. It
+// runs inside run.
+func (r *room) acceptedRules(userID string) bool {
+	rules := r.roomRules()
+	if rules == nil || r.accepted[userID] {
+		return true
+	}
+	if role, err := userRole(r.state, r.name, userID); err == nil && role == roleOwner {
+		r.accepted[userID] = true
+		return true
+	}
+	var acceptance rulesAcceptance
+	if err := r.state.Get(rulesAcceptancesBucket, r.name+"/"+userID, &acceptance); err != nil || acceptance.Accepted.Before(rules.Updated) {
+		return false
+	}
+	r.accepted[userID] = true
+	return true
+}
+
+// promptRules sends c the room's rules, to accept with a message of type
+// msgTypeAcceptRules, unless its user need not. It runs inside run.
+func (r *room) promptRules(c *client) {
+	userID := c.userID()
+	if userID == "" || r.acceptedRules(userID) {
+		return
+	}
+	select {
+	case c.send <- &message{ID: newID(), Type: msgTypeRules, Room: r.name, Name: "system", Message: r.rules.Text, When: r.rules.Updated}:
+	default:
+	}
+}
+
+// acceptRules saves that the sender of msg accepted the room's rules. It
+// runs inside run.
+func (r *room) acceptRules(msg *message) {
+	from := msg.from
+	if r.roomRules() == nil || r.accepted[msg.UserID] {
+		return
+	}
+	acceptance := rulesAcceptance{Room: r.name, UserID: msg.UserID, Accepted: time.Now()}
+	if err := r.state.Put(rulesAcceptancesBucket, r.name+"/"+msg.UserID, acceptance); err != nil {
+		r.tracer.Error("Failed to save the acceptance of the rules: ", err)
+		r.refuse(from, "Your acceptance of the rules could not be saved; please try again.")
+		return
+	}
+	r.accepted[msg.UserID] = true
+	r.refuse(from, "Thanks for accepting the rules. You may post now.")
+}
+
+// serveRules is the rules part of the rooms API:
+//
+//	GET    /api/rooms/{name}/rules  the room's rules
+//	PUT    /api/rooms/{name}/rules  set them: {"Text": "..."}
+//	DELETE /api/rooms/{name}/rules  let anyone post again
+//
+// Only the room's owner and the admins may change them. Users in the room
+// who have not accepted the new rules are sent them at once.
+func (a *roomSettingsAPI) serveRules(w http.ResponseWriter, r *http.Request, settings roomSettings, user map[string]interface{}) {
+	userID, _ := user["userid"].(string)
+	email, _ := user["email"].(string)
+	if r.Method != http.MethodGet && !isAdmin(email) && (userID == "" || userID != settings.Owner) {
+		http.Error(w, "only the room's owner may change its rules", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if settings.Rules == nil {
+			http.Error(w, "the room has no rules", http.StatusNotFound)
+			return
+		}
+	case http.MethodPut:
+		var req struct{ Text string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+			http.Error(w, "body must be {\"Text\": \"...\"}", http.StatusBadRequest)
+			return
+		}
+		settings.Rules = &roomRules{Text: req.Text, Updated: time.Now()}
+	case http.MethodDelete:
+		settings.Rules = nil
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method != http.MethodGet {
+		if settings.Created.IsZero() {
+			settings.Created = time.Now()
+		}
+		if err := a.state.Put(roomSettingsBucket, settings.Room, settings); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if a.rooms != nil {
+			if running, ok := a.rooms.lookup(settings.Room); ok {
+				running.do(controlReload, "", nil)
+			}
+		}
+	}
+	if settings.Rules == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings.Rules)
+}
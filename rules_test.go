@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestRoomRules(t *testing.T) {
+	rooms := newRoomManager()
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})
+	serve := func(user objx.Map, method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(method, "/api/rooms/ops/rules", strings.NewReader(body), user))
+		return w
+	}
+	if _, err := createRoom(rooms.state, nil, "ops", "ann", false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	r := rooms.get("ops")
+	owner := &client{send: make(chan *message, messageBufferSize), room: r, userData: ann}
+	member := &client{send: make(chan *message, messageBufferSize), room: r, userData: bob}
+	r.join <- owner
+	r.join <- member
+	waitMembers(t, r, 2)
+
+	if w := serve(bob, http.MethodPut, `{"Text": "Be nice."}`); w.Code != http.StatusForbidden {
+		t.Errorf("only the owner should set the rules, got %d", w.Code)
+	}
+	if w := serve(ann, http.MethodPut, `{"Text": "Be nice."}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if msg := receiveChat(t, member); msg.Type != msgTypeRules || msg.Message != "Be nice." {
+		t.Errorf("bob should be sent the new rules, got %+v", msg)
+	}
+
+	r.forward <- &message{ID: "m1", Type: msgTypeMessage, UserID: "bob", Name: "Bob", Message: "hi", When: time.Now(), from: member}
+	if msg := receiveChat(t, member); msg.Type != msgTypeNotice || !strings.Contains(msg.Message, "accept the room's rules") {
+		t.Errorf("bob's message should be refused, got %+v", msg)
+	}
+	if msg := receiveChat(t, member); msg.Type != msgTypeRules {
+		t.Errorf("bob should be sent the rules again, got %+v", msg)
+	}
+	r.forward <- &message{ID: "m2", Type: msgTypeMessage, UserID: "ann", Name: "Ann", Message: "welcome", When: time.Now(), from: owner}
+	if msg := receiveChat(t, member); msg.ID != "m2" {
+		t.Errorf("the owner need not accept the rules, got %+v", msg)
+	}
+
+	r.forward <- &message{ID: "a1", Type: msgTypeAcceptRules, UserID: "bob", When: time.Now(), from: member}
+	if msg := receiveChat(t, member); !strings.Contains(msg.Message, "Thanks") {
+		t.Errorf("bob should be thanked, got %+v", msg)
+	}
+	r.forward <- &message{ID: "m3", Type: msgTypeMessage, UserID: "bob", Name: "Bob", Message: "hi", When: time.Now(), from: member}
+	if msg := receiveChat(t, member); msg.ID != "m3" {
+		t.Errorf("bob may post after accepting, got %+v", msg)
+	}
+
+	// a server that starts the room afresh finds the acceptance saved
+	rooms.closeRoom("ops", "restarting")
+	fresh := rooms.get("ops")
+	member = &client{send: make(chan *message, messageBufferSize), room: fresh, userData: bob}
+	fresh.join <- member
+	fresh.forward <- &message{ID: "m4", Type: msgTypeMessage, UserID: "bob", Name: "Bob", Message: "back", When: time.Now(), from: member}
+	for {
+		// after the history
+		msg := receiveChat(t, member)
+		if msg.Type == msgTypeRules || msg.Type == msgTypeNotice {
+			t.Fatalf("the acceptance should be saved, got %+v", msg)
+		}
+		if msg.ID == "m4" {
+			break
+		}
+	}
+	if w := serve(ann, http.MethodPut, `{"Text": "Be nicer."}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	msg := receiveChat(t, member)
+	for msg.Type == msgTypeAck {
+		msg = receiveChat(t, member)
+	}
+	if msg.Type != msgTypeRules || msg.Message != "Be nicer." {
+		t.Errorf("changed rules should be accepted again, got %+v", msg)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/law-lee/chat_server/trace"
+)
+
+// cronSpec is a parsed five field cron expression:
+// minute hour day-of-month month day-of-week.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar record whether the day fields were "*", which
+	// changes how they combine (see matches).
+	domStar, dowStar bool
+}
+
+// parseCron parses expressions such as "*/15 9-17 * * 1-5". Fields may be
+// "*", numbers, ranges ("1-5"), lists ("1,15") and steps ("*/10", "0-30/5").
+// Day-of-week 0 and 7 both mean Sunday.
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: want 5 fields, got %d", expr, len(fields))
+	}
+	var spec cronSpec
+	var err error
+	bounds := []struct {
+		set      *uint64
+		min, max int
+	}{
+		{&spec.minute, 0, 59},
+		{&spec.hour, 0, 23},
+		{&spec.dom, 1, 31},
+		{&spec.month, 1, 12},
+		{&spec.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		if *b.set, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	spec.domStar = fields[2] == "*"
+	spec.dowStar = fields[4] == "*"
+	return &spec, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rng = part[:i]
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			from, to, isRange := strings.Cut(rng, "-")
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if step > 1 && !isRange {
+				// "5/10" means from 5 to the end in steps of 10
+				hi = max
+			}
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether t (to the minute) is selected by the spec. As in
+// classic cron, when both day fields are restricted either may match.
+func (s *cronSpec) matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 || s.hour&(1<<uint(t.Hour())) == 0 || s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// scheduledPost is a recurring message posted into a room. Template is a
+// text/template executed with .Room and .Now.
+type scheduledPost struct {
+	ID        string
+	Cron      string
+	Room      string
+	Template  string
+	Bot       string
+	CreatedBy string
+	Created   time.Time
+}
+
+const (
+	schedulesBucket    = "schedules"
+	scheduleRunsBucket = "schedule_runs"
+)
+
+// scheduler posts scheduledPosts into their rooms. Posts are kept in the
+// StateStore so they survive restarts. Every server sharing that store runs a
+// scheduler, so before posting each one tries to Create a run record for the
+// post and minute: only the server that succeeds posts, which keeps a post
+// from appearing once per server.
+type scheduler struct {
+	state  StateStore
+	rooms  *roomManager
+	tracer trace.Tracer
+	// jobs are called every minute after the scheduled posts, with the
+	// same time; they must claim their work through state themselves.
+	jobs []func(now time.Time)
+}
+
+func newScheduler(state StateStore, rooms *roomManager) *scheduler {
+	return &scheduler{state: state, rooms: rooms, tracer: trace.Off()}
+}
+
+// add validates and stores a new scheduled post.
+func (s *scheduler) add(post *scheduledPost) error {
+	if _, err := parseCron(post.Cron); err != nil {
+		return err
+	}
+	if !validRoomName(post.Room) {
+		return fmt.Errorf("invalid room name %q", post.Room)
+	}
+	if _, err := template.New("post").Parse(post.Template); err != nil {
+		return err
+	}
+	if post.Bot == "" {
+		post.Bot = "scheduler"
+	}
+	post.ID = newID()
+	post.Created = time.Now()
+	return s.state.Put(schedulesBucket, post.ID, post)
+}
+
+// list returns every scheduled post, oldest first.
+func (s *scheduler) list() ([]*scheduledPost, error) {
+	docs, err := s.state.List(schedulesBucket)
+	if err != nil {
+		return nil, err
+	}
+	posts := make([]*scheduledPost, 0, len(docs))
+	for _, doc := range docs {
+		var post scheduledPost
+		if err := json.Unmarshal(doc, &post); err != nil {
+			return nil, err
+		}
+		posts = append(posts, &post)
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Created.Before(posts[j].Created) })
+	return posts, nil
+}
+
+// tick posts everything due at minute now, which must be truncated to the minute.
+func (s *scheduler) tick(now time.Time) {
+	posts, err := s.list()
+	if err != nil {
+		s.tracer.Warn("Failed to load schedules: ", err)
+		return
+	}
+	for _, post := range posts {
+		spec, err := parseCron(post.Cron)
+		if err != nil || !spec.matches(now) {
+			continue
+		}
+		claimed, err := s.state.Create(scheduleRunsBucket, post.ID+"@"+strconv.FormatInt(now.Unix(), 10), now)
+		if err != nil || !claimed {
+			continue
+		}
+		var text bytes.Buffer
+		tmpl, err := template.New("post").Parse(post.Template)
+		if err == nil {
+			err = tmpl.Execute(&text, map[string]interface{}{"Room": post.Room, "Now": now})
+		}
+		if err != nil {
+			s.tracer.Warn("Scheduled post ", post.ID, " failed: ", err)
+			continue
+		}
+		s.rooms.get(post.Room).forward <- &message{ID: newID(), Name: post.Bot, Message: text.String(), When: time.Now()}
+	}
+	for _, job := range s.jobs {
+		job(now)
+	}
+	if now.Minute() == 0 {
+		s.pruneRuns(now.Add(-24 * time.Hour))
+	}
+}
+
+// pruneRuns forgets run records from before cutoff.
+func (s *scheduler) pruneRuns(cutoff time.Time) {
+	runs, err := s.state.List(scheduleRunsBucket)
+	if err != nil {
+		return
+	}
+	for key, doc := range runs {
+		var at time.Time
+		if json.Unmarshal(doc, &at) == nil && at.Before(cutoff) {
+			s.state.Delete(scheduleRunsBucket, key)
+		}
+	}
+}
+
+// run calls tick at the start of every minute until stop is closed.
+func (s *scheduler) run(stop <-chan struct{}) {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Until(next)):
+			s.tick(next)
+		}
+	}
+}
+
+// ServeHTTP is the admin API for scheduled posts:
+//
+//	GET    /admin/schedules       list scheduled posts
+//	POST   /admin/schedules       add a post: {"Cron", "Room", "Template", "Bot"}
+//	DELETE /admin/schedules/{id}  remove a post
+func (s *scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/schedules"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		posts, err := s.list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(posts)
+	case r.Method == http.MethodPost && id == "":
+		var post scheduledPost
+		if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		post.CreatedBy = currentUser(r).Get("email").Str()
+		if err := s.add(&post); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(post)
+	case r.Method == http.MethodDelete && id != "":
+		if err := s.state.Delete(schedulesBucket, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	// 2024-01-01 is a Monday
+	monday9 := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	for expr, want := range map[string]bool{
+		"* * * * *":      true,
+		"0 9 * * 1-5":    true,
+		"0 9 * * 0,6":    false,
+		"*/15 * * * *":   true,
+		"5/10 * * * *":   false,
+		"0 9 15 * 1":     true, // either day field may match
+		"0 9 15 * 2":     false,
+		"0 8-10/2 * 1 *": false,
+		"0 8-10 * 1 *":   true,
+	} {
+		spec, err := parseCron(expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %s", expr, err)
+			continue
+		}
+		if got := spec.matches(monday9); got != want {
+			t.Errorf("%q matching Monday 09:00 should be %v", expr, want)
+		}
+	}
+	sunday := time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)
+	if spec, _ := parseCron("0 0 * * 7"); !spec.matches(sunday) {
+		t.Error("day-of-week 7 should mean Sunday")
+	}
+	for _, bad := range []string{"* * * *", "60 * * * *", "* * * * mon", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("parseCron(%q) should fail", bad)
+		}
+	}
+}
+
+func TestSchedulerPostsOncePerCluster(t *testing.T) {
+	state := newFileState("")
+	rooms := newRoomManager()
+	// two servers sharing the same state store
+	first, second := newScheduler(state, rooms), newScheduler(state, rooms)
+	err := first.add(&scheduledPost{Cron: "30 9 * * *", Room: "standup", Template: "Standup in #{{.Room}}!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{send: make(chan *message, messageBufferSize), room: rooms.get("standup")}
+	rooms.get("standup").join <- c
+	at := time.Date(2024, 1, 1, 9, 30, 0, 0, time.UTC)
+	first.tick(at)
+	second.tick(at)
+	first.tick(at.Add(time.Minute))
+	if msg := receive(t, c); msg.Message != "Standup in #standup!" || msg.Name != "scheduler" {
+		t.Errorf("unexpected scheduled post %+v", msg)
+	}
+	select {
+	case msg := <-c.send:
+		t.Errorf("post should only be made once, got another: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// defaultSearchLimit and maxSearchLimit bound how many results a
+	// search returns.
+	defaultSearchLimit = 50
+	maxSearchLimit     = 200
+	// snippetContext is how many characters of a message are shown
+	// either side of the first match.
+	snippetContext = 40
+)
+
+// searchResult is a message found by a search, with a snippet of its text
+// around the first match. The snippet is HTML: the text is escaped and the
+// matches are wrapped in <mark>.
+type searchResult struct {
+	Message *message
+	Snippet string
+}
+
+// parseSearch turns a search such as
+//
+//	deploy "release notes" from:alice in:ops has:link before:2024-01-01
+//
+// into a messageQuery. Words and quoted phrases must all appear in the
+// message. The filters are from:{userid or name}, in:{room}, has:link and
+// before: or after:{time}, see searchTime.
+func parseSearch(search string) (messageQuery, error) {
+	var q messageQuery
+	for _, token := range searchTokens(search) {
+		key, value, ok := strings.Cut(token, ":")
+		if !ok || value == "" {
+			q.Text = append(q.Text, token)
+			continue
+		}
+		key = strings.ToLower(key)
+		switch key {
+		case "from":
+			q.From = value
+		case "in":
+			if !validRoomName(value) {
+				return q, fmt.Errorf("in: %q is not a room name", value)
+			}
+			q.Room = value
+		case "has":
+			if value != "link" {
+				return q, fmt.Errorf("has: only has:link is supported")
+			}
+			q.HasLink = true
+		case "before", "after":
+			at, err := searchTime(key, value)
+			if err != nil {
+				return q, err
+			}
+			if key == "before" {
+				q.Before = at
+			} else {
+				q.Since = at
+			}
+		default:
+			// a word that happens to have a colon in it
+			q.Text = append(q.Text, token)
+		}
+	}
+	return q, nil
+}
+
+// searchTime parses the value of a before or after filter, named key: a
+// date, YYYY-MM-DD in UTC, or an RFC 3339 time. After a date means from the
+// start of the next day.
+func searchTime(key, value string) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return at, nil
+	}
+	day, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return day, fmt.Errorf("%s: times are YYYY-MM-DD or RFC 3339", key)
+	}
+	if key == "after" {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+// searchTokens splits a search into words, keeping "quoted phrases"
+// (and filters with quoted values such as from:"Ann Lee") together.
+func searchTokens(search string) []string {
+	var tokens []string
+	var token strings.Builder
+	quoted := false
+	for _, c := range search {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case unicode.IsSpace(c) && !quoted:
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(c)
+		}
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
+
+// snippet returns the part of text around the first of terms, escaped for
+// HTML with every match of terms marked.
+func snippet(text string, terms []string) string {
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	if len(lower) != len(runes) {
+		// lower casing changed the length; match case sensitively
+		lower = runes
+	}
+	// marked[i] is set for every rune that is part of a match
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		t := []rune(strings.ToLower(term))
+		if len(t) == 0 {
+			continue
+		}
+		for i := 0; i+len(t) <= len(lower); i++ {
+			if string(lower[i:i+len(t)]) != string(t) {
+				continue
+			}
+			for j := i; j < i+len(t); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+	start, end := 0, len(runes)
+	if first > snippetContext {
+		start = first - snippetContext
+	}
+	if end-start > 3*snippetContext {
+		end = start + 3*snippetContext
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		part := html.EscapeString(string(runes[i:j]))
+		if marked[i] {
+			part = "<mark>" + part + "</mark>"
+		}
+		b.WriteString(part)
+		i = j
+	}
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// searchHandler answers GET /api/search?q={search}&limit={n} with the most
+// recent matching messages the caller may read, newest first. See
+// parseSearch for the syntax. The room, from, before and after parameters
+// are the same as the filters in q, which they narrow further.
+//
+// Results come a page of limit at a time. When there may be more, the
+// response has a Link header with rel="next": the same search before the
+// oldest message of this page.
+type searchHandler struct {
+	store MessageStore
+	// state, if set, has the rooms' settings: which are private, and
+	// their history visibility, which hides from members what was sent
+	// before they joined.
+	state StateStore
+}
+
+// canEnter returns whether user may enter each room, remembering the
+// answers for the rooms of one search. Without a state store every room is
+// public.
+func (s *searchHandler) canEnter(user map[string]interface{}) func(room string) bool {
+	entered := make(map[string]bool)
+	return func(room string) bool {
+		if s.state == nil {
+			return true
+		}
+		ok, seen := entered[room]
+		if !seen {
+			var err error
+			ok, err = canEnter(s.state, room, user)
+			ok = ok && err == nil
+			entered[room] = ok
+		}
+		return ok
+	}
+}
+
+func (s *searchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	search := strings.TrimSpace(params.Get("q"))
+	if search == "" && params.Get("room") == "" && params.Get("from") == "" {
+		http.Error(w, "q, room or from is required", http.StatusBadRequest)
+		return
+	}
+	q, err := parseSearch(search)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if room := params.Get("room"); room != "" {
+		if !validRoomName(room) || q.Room != "" && q.Room != room {
+			http.Error(w, "room must be a room name, and the same as any in:", http.StatusBadRequest)
+			return
+		}
+		q.Room = room
+	}
+	if from := params.Get("from"); from != "" {
+		q.From = from
+	}
+	for _, key := range []string{"before", "after"} {
+		if params.Get(key) == "" {
+			continue
+		}
+		at, err := searchTime(key, params.Get(key))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if key == "before" && (q.Before.IsZero() || at.Before(q.Before)) {
+			q.Before = at
+		} else if key == "after" && at.After(q.Since) {
+			q.Since = at
+		}
+	}
+	user := currentUser(r)
+	q.Reader = user.Get("userid").Str()
+	q.CanEnter = s.canEnter(user)
+	q.Limit = defaultSearchLimit
+	if limit, err := strconv.Atoi(params.Get("limit")); err == nil && limit > 0 {
+		q.Limit = limit
+		if limit > maxSearchLimit {
+			q.Limit = maxSearchLimit
+		}
+	}
+	found, err := s.store.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(found) == q.Limit {
+		next := url.Values{}
+		for key, values := range params {
+			next[key] = values
+		}
+		next.Set("before", found[0].When.UTC().Format(time.RFC3339Nano))
+		w.Header().Set("Link", "<"+r.URL.Path+"?"+next.Encode()+">; rel=\"next\"")
+	}
+	found = accounts.mask(found)
+	results := make([]searchResult, 0, len(found))
+	starts := make(map[string]time.Time)
+	for i := len(found) - 1; i >= 0; i-- {
+		// the store should only have found what the caller may read, but
+		// a result that slipped through must not leak
+		if !canRead(q.Reader, found[i].Room) || !q.CanEnter(found[i].Room) {
+			continue
+		}
+		if !visibleTo(s.state, found[i], q.Reader, starts) {
+			continue
+		}
+		results = append(results, searchResult{Message: found[i], Snippet: snippet(found[i].Message, q.Text)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestParseSearch(t *testing.T) {
+	q, err := parseSearch(`deploy "release notes" from:alice in:ops has:link before:2024-01-01 after:2023-12-01 10:30`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Text) != 3 || q.Text[0] != "deploy" || q.Text[1] != "release notes" || q.Text[2] != "10:30" {
+		t.Errorf("unexpected terms %q", q.Text)
+	}
+	if q.From != "alice" || q.Room != "ops" || !q.HasLink {
+		t.Errorf("filters not applied: %+v", q)
+	}
+	if !q.Before.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) || !q.Since.Equal(time.Date(2023, 12, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected dates %v %v", q.Since, q.Before)
+	}
+	if q, _ := parseSearch(`from:"Ann Lee"`); q.From != "Ann Lee" {
+		t.Errorf("quoted filter values should be kept together, got %q", q.From)
+	}
+	for _, bad := range []string{"before:yesterday", "has:image", "in:no/such"} {
+		if _, err := parseSearch(bad); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	if got := snippet("Deploy <b>now</b>, deploy!", []string{"deploy"}); got != "<mark>Deploy</mark> &lt;b&gt;now&lt;/b&gt;, <mark>deploy</mark>!" {
+		t.Errorf("unexpected snippet %q", got)
+	}
+	long := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa needle bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	got := snippet(long, []string{"needle"})
+	if got[:len("…")] != "…" || got[len(got)-len("…"):] != "…" || len([]rune(got)) > 3*snippetContext+len("<mark></mark>")+2 {
+		t.Errorf("long text should be cut around the match, got %q", got)
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	store := newMemoryStore()
+	start := time.Now()
+	for i, msg := range []*message{
+		{UserID: "alice", Name: "Alice", Room: "ops", Message: "deploy done"},
+		{UserID: "bob", Name: "Bob", Room: "ops", Message: "Deploy failed, see https://ci/42"},
+		{UserID: "alice", Name: "Alice", Room: "dev", Message: "deploy the docs"},
+		{UserID: "alice", Name: "Alice", Room: dmRoom("alice", "bob"), Message: "deploy secrets", Type: msgTypeDM},
+	} {
+		msg.ID = string(rune('a' + i))
+		msg.When = start.Add(time.Duration(i) * time.Minute)
+		store.Save(msg)
+	}
+	s := &searchHandler{store: store}
+	search := func(q string) []searchResult {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/search?q="+q, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", q, w.Code, w.Body)
+		}
+		var results []searchResult
+		json.NewDecoder(w.Body).Decode(&results)
+		return results
+	}
+	if results := search("deploy"); len(results) != 3 || results[0].Message.ID != "c" || results[2].Message.ID != "a" {
+		t.Errorf("expected the room messages newest first, got %+v", results)
+	}
+	if results := search("deploy+from:alice+in:ops"); len(results) != 1 || results[0].Message.ID != "a" {
+		t.Errorf("from: and in: should narrow the results, got %+v", results)
+	}
+	if results := search("has:link"); len(results) != 1 || results[0].Snippet != "Deploy failed, see https://ci/42" {
+		t.Errorf("has:link should find the message with a URL, got %+v", results)
+	}
+	if results := search("secrets"); len(results) != 0 {
+		t.Errorf("direct messages should not be searched, got %+v", results)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/search?q=before:soon", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a bad filter should be a bad request, got %d", w.Code)
+	}
+}
+
+func TestSearchPages(t *testing.T) {
+	store := newMemoryStore()
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		store.Save(&message{ID: string(rune('a' + i)), UserID: "alice", Room: "ops", Message: "standup", When: start.Add(time.Duration(i) * time.Hour)})
+	}
+	store.Save(&message{ID: "z", UserID: "bob", Room: "dev", Message: "standup", When: start})
+	s := &searchHandler{store: store}
+	var ids []string
+	link := "/api/search?room=ops&from=alice&limit=2"
+	for pages := 0; link != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, link, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", link, w.Code, w.Body)
+		}
+		var results []searchResult
+		json.NewDecoder(w.Body).Decode(&results)
+		for _, result := range results {
+			ids = append(ids, result.Message.ID)
+		}
+		link = ""
+		if next := w.Header().Get("Link"); next != "" {
+			link = next[1:strings.Index(next, ">")]
+		}
+	}
+	if strings.Join(ids, "") != "edcba" {
+		t.Errorf("expected every page newest first, got %v", ids)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/search?q=standup&after=2024-03-01T10:30:00Z&before=2024-03-01T12:30:00Z", nil))
+	var results []searchResult
+	json.NewDecoder(w.Body).Decode(&results)
+	if len(results) != 2 || results[0].Message.ID != "d" || results[1].Message.ID != "c" {
+		t.Errorf("after and before should bound the results, got %+v", results)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/search?q=in:dev&room=ops", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("room and a different in: should be a bad request, got %d", w.Code)
+	}
+}
+
+// leakyStore ignores the Reader and CanEnter of queries, as an index that
+// knows nothing of permissions would.
+type leakyStore struct{ *memoryStore }
+
+func (s leakyStore) Query(q messageQuery) ([]*message, error) {
+	q.Reader = ""
+	q.CanEnter = nil
+	return s.memoryStore.Query(q)
+}
+
+func TestSearchOnlyFindsReadableMessages(t *testing.T) {
+	store := newMemoryStore()
+	for i, msg := range []*message{
+		{UserID: "alice", Room: "ops", Message: "plan in ops"},
+		{UserID: "alice", Room: dmRoom("alice", "bob"), To: "bob", Type: msgTypeDM, Message: "plan for bob"},
+		{UserID: "bob", Room: dmRoom("bob", "carol"), To: "carol", Type: msgTypeDM, Message: "plan for carol"},
+		{UserID: "al", Room: dmRoom("al", "dave"), To: "dave", Type: msgTypeDM, Message: "plan for dave"},
+	} {
+		msg.ID = string(rune('a' + i))
+		msg.When = time.Now().Add(time.Duration(i) * time.Second)
+		store.Save(msg)
+	}
+	search := func(s MessageStore, userID string) []string {
+		w := httptest.NewRecorder()
+		r := withAuthCookie(http.MethodGet, "/api/search?q=plan", nil, objx.New(map[string]interface{}{"userid": userID}))
+		(&searchHandler{store: s}).ServeHTTP(w, r)
+		var results []searchResult
+		json.NewDecoder(w.Body).Decode(&results)
+		var found []string
+		for _, result := range results {
+			found = append(found, result.Message.ID)
+		}
+		return found
+	}
+	for _, s := range []MessageStore{store, leakyStore{store}} {
+		if found := search(s, "alice"); len(found) != 2 || found[0] != "b" || found[1] != "a" {
+			t.Errorf("alice should find the room and her own direct message, got %v", found)
+		}
+		if found := search(s, "carol"); len(found) != 2 || found[0] != "c" || found[1] != "a" {
+			t.Errorf("carol should find the room and her direct message from bob, got %v", found)
+		}
+		if found := search(s, "eve"); len(found) != 1 || found[0] != "a" {
+			t.Errorf("eve should only find the room message, got %v", found)
+		}
+		if found := search(s, "a"); len(found) != 1 {
+			t.Errorf("a userid that is a prefix of a participant's should not read their messages, got %v", found)
+		}
+	}
+}
+
+func TestCanRead(t *testing.T) {
+	for _, c := range []struct {
+		userID, room string
+		want         bool
+	}{
+		{"alice", "golang", true},
+		{"", "golang", true},
+		{"alice", dmRoom("alice", "bob"), true},
+		{"bob", dmRoom("alice", "bob"), true},
+		{"carol", dmRoom("alice", "bob"), false},
+		{"", dmRoom("alice", "bob"), false},
+		{"ali", dmRoom("alice", "bob"), false},
+	} {
+		if got := canRead(c.userID, c.room); got != c.want {
+			t.Errorf("canRead(%q, %q) = %v", c.userID, c.room, got)
+		}
+	}
+}
+
+func TestSearchSkipsPrivateRooms(t *testing.T) {
+	state := newFileState("")
+	state.Put(roomSettingsBucket, "secret", roomSettings{Room: "secret", Owner: "ann", Private: true})
+	state.Put(roomMembersBucket, "secret/bob", roomMembership{Room: "secret", UserID: "bob"})
+	store := newMemoryStore()
+	store.Save(&message{ID: "s", UserID: "ann", Room: "secret", Message: "launch codes", When: time.Now()})
+	store.Save(&message{ID: "p", UserID: "ann", Room: "lobby", Message: "launch party", When: time.Now()})
+	search := func(s MessageStore, userID string) []string {
+		w := httptest.NewRecorder()
+		r := withAuthCookie(http.MethodGet, "/api/search?q=launch", nil, objx.New(map[string]interface{}{"userid": userID}))
+		(&searchHandler{store: s, state: state}).ServeHTTP(w, r)
+		var results []searchResult
+		json.NewDecoder(w.Body).Decode(&results)
+		var found []string
+		for _, result := range results {
+			found = append(found, result.Message.ID)
+		}
+		return found
+	}
+	for _, s := range []MessageStore{store, leakyStore{store}} {
+		if found := search(s, "eve"); len(found) != 1 || found[0] != "p" {
+			t.Errorf("a non-member should not find messages of a private room, got %v", found)
+		}
+		for _, userID := range []string{"ann", "bob"} {
+			if found := search(s, userID); len(found) != 2 {
+				t.Errorf("%s may enter the private room and should find both, got %v", userID, found)
+			}
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrSecretNotFound is returned by a SecretSource that has no value
+// for the requested secret.
+var ErrSecretNotFound = errors.New("chat: secret not found")
+
+// SecretSource is implemented by backends that hold OAuth secrets, signing
+// keys and credentials. Names are lower case, e.g. "google_client_id".
+type SecretSource interface {
+	Secret(name string) (string, error)
+}
+
+// newSecretSource builds a SecretSource from a -secrets spec:
+//
+//	env                  environment variables (GOOGLE_CLIENT_ID, ...)
+//	file:/path/to/file   a file written by `chat encrypt-secrets`, decrypted
+//	                     with the passphrase in CHAT_SECRETS_KEY
+//	vault:mount/path     a HashiCorp Vault KV v2 secret, using VAULT_ADDR
+//	                     and VAULT_TOKEN
+func newSecretSource(spec string) (SecretSource, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "", "env":
+		return envSecrets{}, nil
+	case "file":
+		return &fileSecrets{path: arg, passphrase: os.Getenv("CHAT_SECRETS_KEY")}, nil
+	case "vault":
+		mount, path := arg, ""
+		if i := strings.Index(arg, "/"); i >= 0 {
+			mount, path = arg[:i], arg[i+1:]
+		}
+		if path == "" || os.Getenv("VAULT_ADDR") == "" {
+			return nil, fmt.Errorf("vault secrets need VAULT_ADDR and a mount/path, got %q", arg)
+		}
+		return &vaultSecrets{
+			addr:   strings.TrimRight(os.Getenv("VAULT_ADDR"), "/"),
+			token:  os.Getenv("VAULT_TOKEN"),
+			mount:  mount,
+			path:   path,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown secrets backend %q", kind)
+}
+
+// envSecrets looks secrets up in the environment, upper casing the name.
+// It is the fallback for development setups.
+type envSecrets struct{}
+
+func (envSecrets) Secret(name string) (string, error) {
+	if v, ok := os.LookupEnv(strings.ToUpper(name)); ok {
+		return v, nil
+	}
+	return "", ErrSecretNotFound
+}
+
+// fileSecrets reads a JSON object of name/value pairs that has been sealed
+// with AES-256-GCM under a key derived from passphrase. The file is read on
+// every lookup so that rotated values are picked up, but only opened again
+// when it changed, as deriving the key is slow on purpose.
+type fileSecrets struct {
+	path       string
+	passphrase string
+
+	mu     sync.Mutex
+	sealed []byte
+	values map[string]string
+}
+
+func (f *fileSecrets) Secret(name string) (string, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !bytes.Equal(data, f.sealed) {
+		plain, err := openSecrets(f.passphrase, data)
+		if err != nil {
+			return "", fmt.Errorf("secrets file %s: %w", f.path, err)
+		}
+		var values map[string]string
+		if err := json.Unmarshal(plain, &values); err != nil {
+			return "", fmt.Errorf("secrets file %s: %w", f.path, err)
+		}
+		f.sealed, f.values = data, values
+	}
+	if v, ok := f.values[name]; ok {
+		return v, nil
+	}
+	return "", ErrSecretNotFound
+}
+
+// secretsSaltSize is the size of the random salt the key is derived with,
+// kept at the start of the sealed data.
+const secretsSaltSize = 16
+
+// sealSecrets encrypts plain for fileSecrets. The output is the salt, the
+// nonce and the ciphertext in base64.
+func sealSecrets(passphrase string, plain []byte) ([]byte, error) {
+	salt := make([]byte, secretsSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	gcm, err := secretsCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(append(salt, nonce...), nonce, plain, nil)
+	return []byte(base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// openSecrets reverses sealSecrets.
+func openSecrets(passphrase string, data []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < secretsSaltSize {
+		return nil, errors.New("sealed data too short")
+	}
+	salt, sealed := sealed[:secretsSaltSize], sealed[secretsSaltSize:]
+	gcm, err := secretsCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+// secretsCipher returns the cipher for passphrase, its key derived with
+// scrypt and salt.
+func secretsCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, errors.New("CHAT_SECRETS_KEY is not set")
+	}
+	// the parameters scrypt's documentation recommends for 2017
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// vaultSecrets reads a single KV version 2 secret from Vault; each key of
+// that secret is one of our secrets.
+type vaultSecrets struct {
+	addr, token string
+	mount, path string
+	client      *http.Client
+}
+
+func (v *vaultSecrets) Secret(name string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/%s/data/%s", v.addr, v.mount, v.path), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault %s/%s: %s", v.mount, v.path, resp.Status)
+	}
+	var body struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if s, ok := body.Data.Data[name]; ok {
+		return s, nil
+	}
+	return "", ErrSecretNotFound
+}
+
+// secretCache remembers the secrets looked up through it and periodically
+// fetches them again from the underlying source. When any value changes
+// (a rotation) every registered watcher is called, so the consumers of that
+// secret can rebuild whatever depends on it.
+type secretCache struct {
+	source   SecretSource
+	mu       sync.Mutex
+	values   map[string]string
+	watchers []func()
+}
+
+func newSecretCache(source SecretSource) *secretCache {
+	return &secretCache{source: source, values: make(map[string]string)}
+}
+
+func (c *secretCache) Secret(name string) (string, error) {
+	c.mu.Lock()
+	v, ok := c.values[name]
+	c.mu.Unlock()
+	if ok {
+		return v, nil
+	}
+	v, err := c.source.Secret(name)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.values[name] = v
+	c.mu.Unlock()
+	return v, nil
+}
+
+// secretOr returns the named secret, or def if it cannot be found.
+func (c *secretCache) secretOr(name, def string) string {
+	if v, err := c.Secret(name); err == nil {
+		return v
+	}
+	return def
+}
+
+// watch registers fn to be called after a refresh that changed a secret.
+func (c *secretCache) watch(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watchers = append(c.watchers, fn)
+}
+
+// refresh fetches every cached secret again and reports whether any changed.
+// A secret the source fails to return keeps its old value.
+func (c *secretCache) refresh() bool {
+	c.mu.Lock()
+	names := make([]string, 0, len(c.values))
+	for name := range c.values {
+		names = append(names, name)
+	}
+	c.mu.Unlock()
+	changed := false
+	for _, name := range names {
+		v, err := c.source.Secret(name)
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		if c.values[name] != v {
+			c.values[name] = v
+			changed = true
+		}
+		c.mu.Unlock()
+	}
+	if changed {
+		c.mu.Lock()
+		watchers := append([]func(){}, c.watchers...)
+		c.mu.Unlock()
+		for _, fn := range watchers {
+			fn()
+		}
+	}
+	return changed
+}
+
+// run refreshes the cache every interval until stop is closed.
+func (c *secretCache) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.refresh()
+		}
+	}
+}
+
+// encryptSecrets implements the encrypt-secrets subcommand: it seals the
+// JSON object read from in for use with a file: secrets backend.
+func encryptSecrets(in io.Reader, out io.Writer) error {
+	plain, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	var values map[string]string
+	if err := json.Unmarshal(plain, &values); err != nil {
+		return fmt.Errorf("secrets must be a JSON object of strings: %w", err)
+	}
+	sealed, err := sealSecrets(os.Getenv("CHAT_SECRETS_KEY"), plain)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(sealed))
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mapSecrets is a SecretSource backed by a map.
+type mapSecrets map[string]string
+
+func (m mapSecrets) Secret(name string) (string, error) {
+	if v, ok := m[name]; ok {
+		return v, nil
+	}
+	return "", ErrSecretNotFound
+}
+
+func TestFileSecrets(t *testing.T) {
+	t.Setenv("CHAT_SECRETS_KEY", "correct horse battery staple")
+	var sealed bytes.Buffer
+	if err := encryptSecrets(strings.NewReader(`{"google_client_id":"abc"}`), &sealed); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed.String(), "abc") {
+		t.Error("sealed secrets should not contain the plain text")
+	}
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+	ioutil.WriteFile(path, sealed.Bytes(), 0600)
+	source, err := newSecretSource("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := source.Secret("google_client_id"); err != nil || v != "abc" {
+		t.Errorf("Secret should return abc, got %q, %v", v, err)
+	}
+	if _, err := source.Secret("missing"); err != ErrSecretNotFound {
+		t.Errorf("missing secret should return ErrSecretNotFound, got %v", err)
+	}
+	wrongKey := &fileSecrets{path: path, passphrase: "wrong"}
+	if _, err := wrongKey.Secret("google_client_id"); err == nil {
+		t.Error("decrypting with the wrong passphrase should fail")
+	}
+}
+
+func TestSealSecretsSaltsTheKey(t *testing.T) {
+	plain := []byte(`{"google_client_id":"abc"}`)
+	one, err := sealSecrets("correct horse battery staple", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, _ := sealSecrets("correct horse battery staple", plain)
+	if bytes.Equal(one, two) {
+		t.Errorf("expected differently salted output, got %s and %s", one, two)
+	}
+	if opened, err := openSecrets("correct horse battery staple", one); err != nil || !bytes.Equal(opened, plain) {
+		t.Errorf("unexpected %s %v", opened, err)
+	}
+}
+
+func TestSecretCacheRotation(t *testing.T) {
+	source := mapSecrets{"security_key": "one"}
+	cache := newSecretCache(source)
+	rotations := 0
+	cache.watch(func() { rotations++ })
+	if v, _ := cache.Secret("security_key"); v != "one" {
+		t.Fatalf("expected one, got %s", v)
+	}
+	if cache.refresh() || rotations != 0 {
+		t.Error("refresh without changes should not notify watchers")
+	}
+	source["security_key"] = "two"
+	if v, _ := cache.Secret("security_key"); v != "one" {
+		t.Error("cached value should be served until the next refresh")
+	}
+	if !cache.refresh() || rotations != 1 {
+		t.Error("refresh should notice the rotated secret")
+	}
+	if v, _ := cache.Secret("security_key"); v != "two" {
+		t.Errorf("expected rotated value two, got %s", v)
+	}
+}
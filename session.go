@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoSession is returned by SessionStore.Get for sessions that do not
+// exist, were revoked or have expired.
+var ErrNoSession = errors.New("chat: no such session")
+
+// defaultSessionTTL is how long a sign in lasts unless configured otherwise.
+const defaultSessionTTL = 7 * 24 * time.Hour
+
+// session is a signed in user. The auth cookie only holds its ID, so the
+// user data can't be altered by the client and logging out really ends it.
+type session struct {
+	ID      string
+	User    map[string]interface{}
+	Created time.Time
+	Expires time.Time
+	// UserAgent and RemoteAddr describe where the session was started.
+	UserAgent  string
+	RemoteAddr string
+}
+
+// SessionStore is implemented by the backends that keep sessions.
+type SessionStore interface {
+	// Save stores s until s.Expires.
+	Save(s *session) error
+	// Get returns the session with the given ID.
+	Get(id string) (*session, error)
+	// Delete ends the session; deleting a missing session is not an error.
+	Delete(id string) error
+}
+
+// newSessionStore returns the store described by spec:
+//
+//	memory                                 sessions are lost on restart (the default)
+//	redis://[:password@]host[:port][/db]   Redis, shared between servers
+func newSessionStore(spec string) (SessionStore, error) {
+	switch {
+	case spec == "" || spec == "memory":
+		return newMemorySessions(), nil
+	case strings.HasPrefix(spec, "redis://"):
+		client, err := newRedisClient(spec)
+		if err != nil {
+			return nil, err
+		}
+		return &redisSessions{client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown session store %q", spec)
+}
+
+// memorySessions keeps sessions in memory.
+type memorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	now      func() time.Time
+}
+
+func newMemorySessions() *memorySessions {
+	return &memorySessions{sessions: make(map[string]*session), now: time.Now}
+}
+
+func (m *memorySessions) Save(s *session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	// drop expired sessions as we go so the map does not grow forever
+	for id, old := range m.sessions {
+		if !old.Expires.After(now) {
+			delete(m.sessions, id)
+		}
+	}
+	m.sessions[s.ID] = s
+	return nil
+}
+
+func (m *memorySessions) Get(id string) (*session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || !s.Expires.After(m.now()) {
+		return nil, ErrNoSession
+	}
+	return s, nil
+}
+
+func (m *memorySessions) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// redisSessionPrefix is prepended to session IDs to make their Redis keys.
+const redisSessionPrefix = "chat:session:"
+
+// redisSessions keeps each session as a JSON string that Redis expires.
+type redisSessions struct {
+	client *redisClient
+}
+
+func (r *redisSessions) Save(s *session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(s.Expires).Milliseconds()
+	if ttl <= 0 {
+		return nil
+	}
+	_, err = r.client.do("SET", redisSessionPrefix+s.ID, string(data), "PX", fmt.Sprint(ttl))
+	return err
+}
+
+func (r *redisSessions) Get(id string) (*session, error) {
+	reply, err := r.client.do("GET", redisSessionPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, ErrNoSession
+	}
+	var s session
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (r *redisSessions) Delete(id string) error {
+	_, err := r.client.do("DEL", redisSessionPrefix+id)
+	return err
+}
+
+// sessionCookieID returns the session ID from the request's auth cookie if
+// its signature is valid.
+func sessionCookieID(r *http.Request) (string, error) {
+	authCookie, err := r.Cookie("auth")
+	if err != nil {
+		return "", err
+	}
+	id, sig, ok := strings.Cut(authCookie.Value, ".")
+	if !ok || !validID(id) || !authKeys.verify([]byte(id), sig) {
+		return "", errBadAuthCookie
+	}
+	return id, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// settingsBucket holds server settings made at runtime.
+	settingsBucket = "settings"
+	// setupKey in settingsBucket holds the serverSettings made by the
+	// first-run setup; it exists once setup is done.
+	setupKey = "setup"
+)
+
+// errSetupDone is returned when the first-run setup was already completed.
+var errSetupDone = errors.New("the server is already set up")
+
+// serverSettings are what the first-run setup asks for.
+type serverSettings struct {
+	Admins    []string
+	PublicURL string
+	Providers map[string]providerCredentials
+	Completed time.Time
+}
+
+// providerCredentials are the OAuth client credentials of a login provider.
+type providerCredentials struct {
+	ClientID     string
+	ClientSecret string
+}
+
+// loadSettings returns the settings made by the first-run setup, or
+// ErrNoState if it has not been run.
+func loadSettings(state StateStore) (*serverSettings, error) {
+	var settings serverSettings
+	if err := state.Get(settingsBucket, setupKey, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// needsSetup reports whether the server has neither been set up nor been
+// given any admins, as on the first start with an empty store.
+func needsSetup(state StateStore) bool {
+	_, err := loadSettings(state)
+	return err == ErrNoState && !haveAdmins()
+}
+
+// settingsSecrets is a SecretSource that falls back to the login provider
+// credentials entered during setup for secrets next does not have. Until
+// use is called it only asks next.
+type settingsSecrets struct {
+	next SecretSource
+
+	mu    sync.Mutex
+	state StateStore
+}
+
+// use starts looking up credentials in state.
+func (s *settingsSecrets) use(state StateStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+func (s *settingsSecrets) Secret(name string) (string, error) {
+	v, err := s.next.Secret(name)
+	if err == nil {
+		return v, nil
+	}
+	s.mu.Lock()
+	state := s.state
+	s.mu.Unlock()
+	if state == nil {
+		return "", err
+	}
+	settings, serr := loadSettings(state)
+	if serr != nil {
+		return "", err
+	}
+	for provider, creds := range settings.Providers {
+		switch name {
+		case provider + "_client_id":
+			return creds.ClientID, nil
+		case provider + "_client_sec":
+			return creds.ClientSecret, nil
+		}
+	}
+	return "", err
+}
+
+// setupWizard is the one-time setup of a new server at /setup. It is only
+// served to whoever has token, which the server logs when it starts, and
+// only until setup is completed by any server sharing the state store.
+type setupWizard struct {
+	state StateStore
+	keys  *keyRing
+	token string
+	// done is called with the settings when setup completes.
+	done func(*serverSettings)
+
+	once  sync.Once
+	templ *template.Template
+}
+
+func newSetupWizard(state StateStore, keys *keyRing, done func(*serverSettings)) *setupWizard {
+	return &setupWizard{state: state, keys: keys, token: newID(), done: done}
+}
+
+// complete validates and stores the settings, makes a new signing key and
+// calls done.
+func (s *setupWizard) complete(settings *serverSettings) error {
+	if len(settings.Admins) == 0 {
+		return errors.New("an admin email address is needed")
+	}
+	for i, admin := range settings.Admins {
+		address, err := mail.ParseAddress(admin)
+		if err != nil {
+			return errors.New("invalid admin email address " + admin)
+		}
+		settings.Admins[i] = address.Address
+	}
+	if u, err := url.Parse(settings.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("the public URL must be an http(s) URL such as https://chat.example.com")
+	}
+	settings.PublicURL = strings.TrimSuffix(settings.PublicURL, "/")
+	configured := 0
+	for provider, creds := range settings.Providers {
+		if !knownProvider(provider) {
+			return errors.New("unknown login provider " + provider)
+		}
+		if creds.ClientID != "" && creds.ClientSecret != "" {
+			configured++
+		}
+	}
+	if configured == 0 {
+		return errors.New("at least one login provider needs a client ID and secret")
+	}
+	settings.Completed = time.Now()
+	claimed, err := s.state.Create(settingsBucket, setupKey, settings)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return errSetupDone
+	}
+	if _, err := s.keys.rotate(); err != nil {
+		return err
+	}
+	s.done(settings)
+	return nil
+}
+
+// knownProvider reports whether name is one of authProviders.
+func knownProvider(name string) bool {
+	for _, p := range authProviders {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP shows the setup form, GET /setup?token=..., and completes
+// setup when it is posted.
+func (s *setupWizard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, err := loadSettings(s.state); err != ErrNoState {
+		http.Error(w, errSetupDone.Error(), http.StatusNotFound)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		token = r.PostFormValue("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		http.Error(w, "open the setup link the server logged when it started", http.StatusForbidden)
+		return
+	}
+	data := map[string]interface{}{"Token": s.token, "Providers": authProviders, "PublicURL": "http://" + r.Host, "CSRFToken": csrfToken(w, r)}
+	if r.Method == http.MethodPost {
+		settings := &serverSettings{
+			Admins:    []string{strings.TrimSpace(r.PostFormValue("admin"))},
+			PublicURL: strings.TrimSpace(r.PostFormValue("public_url")),
+			Providers: map[string]providerCredentials{
+				r.PostFormValue("provider"): {
+					ClientID:     strings.TrimSpace(r.PostFormValue("client_id")),
+					ClientSecret: strings.TrimSpace(r.PostFormValue("client_secret")),
+				},
+			},
+		}
+		err := s.complete(settings)
+		if err == nil {
+			w.Header().Set("Location", "/login")
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		data["Error"] = err.Error()
+		data["Admin"] = r.PostFormValue("admin")
+		data["PublicURL"] = r.PostFormValue("public_url")
+	}
+	s.once.Do(func() {
+		s.templ = template.Must(template.ParseFiles(filepath.Join(templatesDir, "setup.html")))
+	})
+	s.templ.Execute(w, data)
+}
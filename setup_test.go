@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSetupWizard(t *testing.T) {
+	state := newFileState("")
+	keys, _ := newKeyRing("", 0)
+	before := keys.current()
+	var applied *serverSettings
+	s := newSetupWizard(state, keys, func(settings *serverSettings) { applied = settings })
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/setup", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	form := url.Values{
+		"token":         {s.token},
+		"admin":         {"Root <root@setup.example.com>"},
+		"public_url":    {"https://chat.example.com/"},
+		"provider":      {"github"},
+		"client_id":     {"id"},
+		"client_secret": {""},
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/setup?token=wrong", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("setup needs the logged token, got %d", w.Code)
+	}
+	if w := post(form); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "client ID and secret") {
+		t.Errorf("a provider without a secret should be refused, got %d", w.Code)
+	}
+	form.Set("client_secret", "sec")
+	if w := post(form); w.Code != http.StatusSeeOther {
+		t.Fatalf("setup failed: %d %s", w.Code, w.Body)
+	}
+	if applied == nil || applied.Admins[0] != "root@setup.example.com" || applied.PublicURL != "https://chat.example.com" {
+		t.Errorf("unexpected settings %+v", applied)
+	}
+	if keys.current() == before {
+		t.Error("setup should make a new signing key")
+	}
+	if w := post(form); w.Code != http.StatusNotFound {
+		t.Errorf("setup should only run once, got %d", w.Code)
+	}
+
+	secrets := &settingsSecrets{next: mapSecrets{"google_client_id": "from-env"}}
+	if _, err := secrets.Secret("github_client_sec"); err == nil {
+		t.Error("settings should not be used before use is called")
+	}
+	secrets.use(state)
+	if v, _ := secrets.Secret("github_client_sec"); v != "sec" {
+		t.Errorf("the secret entered during setup should be used, got %q", v)
+	}
+	if v, _ := secrets.Secret("google_client_id"); v != "from-env" {
+		t.Errorf("the secrets backend should come first, got %q", v)
+	}
+}
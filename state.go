@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrNoState is returned by StateStore.Get when the key does not exist.
+var ErrNoState = errors.New("chat: no such state")
+
+// StateStore keeps small JSON documents such as schedules, settings and ban
+// lists in named buckets. Unlike MessageStore it holds server state rather
+// than chat history. When several servers share a StateStore, Create is how
+// they agree on which of them does something.
+type StateStore interface {
+	// Get decodes the document stored under key into v.
+	Get(bucket, key string, v interface{}) error
+	// Put stores v under key, replacing any existing document.
+	Put(bucket, key string, v interface{}) error
+	// Create stores v under key only if the key does not exist yet,
+	// and reports whether it was stored.
+	Create(bucket, key string, v interface{}) (bool, error)
+	// Delete removes key; deleting a missing key is not an error.
+	Delete(bucket, key string) error
+	// List returns every document in the bucket by key.
+	List(bucket string) (map[string]json.RawMessage, error)
+}
+
+// newStateStore returns the StateStore to use alongside store: the same
+// database for a SQL message store, otherwise JSON files in dir.
+func newStateStore(store MessageStore, dir string) StateStore {
+	if s, ok := store.(*sqlStore); ok {
+		return &sqlState{db: s.db, dialect: s.dialect}
+	}
+	return newFileState(dir)
+}
+
+// fileState keeps each bucket as a JSON file in a directory. It is only
+// suitable for a single server. An empty dir keeps everything in memory.
+type fileState struct {
+	mu      sync.Mutex
+	dir     string
+	buckets map[string]map[string]json.RawMessage
+}
+
+func newFileState(dir string) *fileState {
+	return &fileState{dir: dir, buckets: make(map[string]map[string]json.RawMessage)}
+}
+
+// bucket returns the loaded bucket. The caller must hold s.mu.
+func (s *fileState) bucket(name string) (map[string]json.RawMessage, error) {
+	if b, ok := s.buckets[name]; ok {
+		return b, nil
+	}
+	b := make(map[string]json.RawMessage)
+	if s.dir != "" {
+		data, err := ioutil.ReadFile(s.path(name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s.buckets[name] = b
+	return b, nil
+}
+
+func (s *fileState) path(bucket string) string {
+	return filepath.Join(s.dir, "state-"+bucket+".json")
+}
+
+// save writes a bucket back to disk. The caller must hold s.mu.
+func (s *fileState) save(name string) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.buckets[name])
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path(name), data, 0600)
+}
+
+func (s *fileState) Get(bucket, key string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	data, ok := b[key]
+	if !ok {
+		return ErrNoState
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *fileState) Put(bucket, key string, v interface{}) error {
+	_, err := s.put(bucket, key, v, true)
+	return err
+}
+
+func (s *fileState) Create(bucket, key string, v interface{}) (bool, error) {
+	return s.put(bucket, key, v, false)
+}
+
+func (s *fileState) put(bucket, key string, v interface{}, replace bool) (bool, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return false, err
+	}
+	if _, exists := b[key]; exists && !replace {
+		return false, nil
+	}
+	b[key] = data
+	return true, s.save(bucket)
+}
+
+func (s *fileState) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	if _, ok := b[key]; !ok {
+		return nil
+	}
+	delete(b, key)
+	return s.save(bucket)
+}
+
+func (s *fileState) List(bucket string) (map[string]json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string]json.RawMessage, len(b))
+	for k, v := range b {
+		list[k] = v
+	}
+	return list, nil
+}
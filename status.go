@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// statusBucket holds the maintenance banner under bannerKey.
+	statusBucket = "status"
+	bannerKey    = "banner"
+)
+
+// maintenanceBanner is a notice shown on the status page until Until, or
+// until it is removed if Until is zero.
+type maintenanceBanner struct {
+	Message string
+	Until   time.Time `json:",omitempty"`
+}
+
+// serviceStatus is what the status page shows.
+type serviceStatus struct {
+	// Status is "up", or "degraded" when the state store can't be read.
+	Status  string
+	Nodes   int
+	Banner  *maintenanceBanner `json:",omitempty"`
+	Started time.Time
+}
+
+// statusPage serves the public status page at /status and /status.json.
+// It needs no sign in and may be embedded in other pages.
+type statusPage struct {
+	state   StateStore
+	started time.Time
+	now     func() time.Time
+
+	once  sync.Once
+	templ *template.Template
+}
+
+func newStatusPage(state StateStore) *statusPage {
+	return &statusPage{state: state, started: time.Now(), now: time.Now}
+}
+
+// current works out the status as of now.
+func (s *statusPage) current() serviceStatus {
+	now := s.now()
+	status := serviceStatus{Status: "up", Started: s.started}
+	nodes, err := liveNodes(s.state, now)
+	if err != nil {
+		status.Status = "degraded"
+		return status
+	}
+	status.Nodes = len(nodes)
+	var banner maintenanceBanner
+	if err := s.state.Get(statusBucket, bannerKey, &banner); err == nil && (banner.Until.IsZero() || now.Before(banner.Until)) {
+		status.Banner = &banner
+	}
+	return status
+}
+
+func (s *statusPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := s.current()
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.URL.Path == "/status.json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	s.once.Do(func() {
+		s.templ = template.Must(template.ParseFiles(filepath.Join(templatesDir, "status.html")))
+	})
+	s.templ.Execute(w, status)
+}
+
+// banner is the admin API for the maintenance banner:
+//
+//	PUT    /admin/status/banner  {"Message": "...", "Until": "2026-10-16T20:00:00Z"}
+//	DELETE /admin/status/banner
+func (s *statusPage) banner(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		var banner maintenanceBanner
+		if err := json.NewDecoder(r.Body).Decode(&banner); err != nil || banner.Message == "" {
+			http.Error(w, "body must be {\"Message\": \"...\"} with an optional Until", http.StatusBadRequest)
+			return
+		}
+		if err := s.state.Put(statusBucket, bannerKey, banner); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := s.state.Delete(statusBucket, bannerKey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusPage(t *testing.T) {
+	state := newFileState("")
+	now := time.Now()
+	s := newStatusPage(state)
+	s.now = func() time.Time { return now }
+	state.Put(nodesBucket, nodeID, nodeInfo{ID: nodeID, Seen: now})
+	state.Put(nodesBucket, "other", nodeInfo{ID: "other", Seen: now.Add(-heartbeatInterval)})
+	state.Put(nodesBucket, "gone", nodeInfo{ID: "gone", Seen: now.Add(-time.Hour)})
+	state.Put(statusBucket, bannerKey, maintenanceBanner{Message: "Upgrading tonight", Until: now.Add(time.Hour)})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status.json", nil))
+	var status serviceStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != "up" || status.Nodes != 2 {
+		t.Errorf("expected 2 nodes up, got %+v", status)
+	}
+	if status.Banner == nil || status.Banner.Message != "Upgrading tonight" {
+		t.Errorf("expected the banner, got %+v", status.Banner)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if body := w.Body.String(); !strings.Contains(body, "The chat service is up") || !strings.Contains(body, "Upgrading tonight") {
+		t.Errorf("unexpected page:\n%s", body)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if status := s.current(); status.Banner != nil {
+		t.Error("an expired banner should not be shown")
+	}
+}
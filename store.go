@@ -0,0 +1,452 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoMessage is returned when a message cannot be found in the store.
+var ErrNoMessage = errors.New("chat: no such message")
+
+// MessageStore is implemented by the backends that keep chat history.
+type MessageStore interface {
+	// Save stores msg, which has been sent to msg.Room.
+	Save(msg *message) error
+	// Query returns the stored messages matching q, oldest first.
+	Query(q messageQuery) ([]*message, error)
+	// Get returns the message of room with the given ID, or ErrNoMessage.
+	Get(room, id string) (*message, error)
+	// Delete removes the message of room with the given ID.
+	Delete(room, id string) error
+}
+
+// messageQuery selects messages from a MessageStore. Zero fields do not
+// restrict the query.
+type messageQuery struct {
+	Room string
+	// Since and Before restrict the time the message was sent.
+	Since  time.Time
+	Before time.Time
+	// Limit keeps only the most recent Limit matching messages.
+	Limit int
+	// From matches the sender's userid or name, ignoring case.
+	From string
+	// Text are words or phrases that must all appear in the message,
+	// ignoring case.
+	Text []string
+	// HasLink keeps only messages with a link in them.
+	HasLink bool
+	// Reader keeps only the messages the user with this userid may
+	// read, see canRead.
+	Reader string
+	// CanEnter, if set, keeps only the messages of the rooms it allows,
+	// the rooms the reader may enter.
+	CanEnter func(room string) bool
+}
+
+// checkedInGo reports whether q has filters SQL stores only narrow down,
+// leaving matches to decide.
+func (q messageQuery) checkedInGo() bool {
+	return q.From != "" || len(q.Text) > 0 || q.HasLink || q.Reader != "" || q.CanEnter != nil
+}
+
+// newMessageStore opens the store described by spec:
+//
+//	memory             history is kept in memory only (the default)
+//	sqlite:<path>      a SQLite database file (build with -tags sqlite)
+//	postgres:<dsn>     a Postgres database (build with -tags postgres); if the
+//	                   dsn is empty the database_url secret is used
+func newMessageStore(spec string, secrets SecretSource) (MessageStore, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "sqlite":
+		return openSQLStore("sqlite3", arg, sqliteDialect)
+	case "postgres":
+		if arg == "" && secrets != nil {
+			dsn, err := secrets.Secret("database_url")
+			if err != nil {
+				return nil, fmt.Errorf("postgres store: database_url secret: %w", err)
+			}
+			arg = dsn
+		}
+		return openSQLStore("postgres", arg, postgresDialect)
+	}
+	return nil, fmt.Errorf("unknown message store %q", kind)
+}
+
+// memoryStore keeps messages in memory. History is lost on restart.
+type memoryStore struct {
+	mu       sync.RWMutex
+	messages []*message
+	// byID finds messages by memoryKey.
+	byID map[string]*message
+	// queued is the outbox, see Outbox.
+	queued []queuedMessage
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{byID: make(map[string]*message)}
+}
+
+// memoryKey is the key of the message of room with the given ID in byID.
+func memoryKey(room, id string) string {
+	return room + "\x00" + id
+}
+
+func (s *memoryStore) Save(msg *message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	s.byID[memoryKey(msg.Room, msg.ID)] = msg
+	return nil
+}
+
+func (s *memoryStore) Get(room, id string) (*message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if msg, ok := s.byID[memoryKey(room, id)]; ok {
+		return msg, nil
+	}
+	return nil, ErrNoMessage
+}
+
+func (s *memoryStore) Query(q messageQuery) ([]*message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found []*message
+	for _, msg := range s.messages {
+		if q.matches(msg) {
+			found = append(found, msg)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].When.Before(found[j].When) })
+	if q.Limit > 0 && len(found) > q.Limit {
+		found = found[len(found)-q.Limit:]
+	}
+	return found, nil
+}
+
+func (s *memoryStore) Delete(room, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, msg := range s.messages {
+		if msg.Room == room && msg.ID == id {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			delete(s.byID, memoryKey(msg.Room, msg.ID))
+			s.unqueue(room, id)
+			return nil
+		}
+	}
+	return ErrNoMessage
+}
+
+// matches reports whether msg is selected by q.
+func (q messageQuery) matches(msg *message) bool {
+	if q.Room != "" && msg.Room != q.Room {
+		return false
+	}
+	if !q.Since.IsZero() && msg.When.Before(q.Since) {
+		return false
+	}
+	if !q.Before.IsZero() && !msg.When.Before(q.Before) {
+		return false
+	}
+	if q.Reader != "" && !canRead(q.Reader, msg.Room) {
+		return false
+	}
+	if q.CanEnter != nil && !q.CanEnter(msg.Room) {
+		return false
+	}
+	if q.From != "" && !strings.EqualFold(msg.UserID, q.From) && !strings.EqualFold(msg.Name, q.From) {
+		return false
+	}
+	if q.HasLink && len(msg.Links) == 0 && !strings.Contains(msg.Message, "http://") && !strings.Contains(msg.Message, "https://") {
+		return false
+	}
+	text := strings.ToLower(msg.Message)
+	for _, t := range q.Text {
+		if !strings.Contains(text, strings.ToLower(t)) {
+			return false
+		}
+	}
+	return true
+}
+
+// sqlDialect papers over the differences between the SQL databases we
+// support. So far that is only how query placeholders are written.
+type sqlDialect struct {
+	placeholder func(n int) string
+}
+
+var (
+	sqliteDialect   = sqlDialect{placeholder: func(int) string { return "?" }}
+	postgresDialect = sqlDialect{placeholder: func(n int) string { return "$" + strconv.Itoa(n) }}
+)
+
+// sqlStore keeps messages in a SQL database through database/sql. The columns
+// we filter on are stored separately, while the whole message is kept as JSON
+// in the data column, so new message fields don't need a schema change.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func openSQLStore(driver, dsn string, dialect sqlDialect) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%s store: %w (was the server built with -tags %s?)", driver, err, strings.TrimSuffix(driver, "3"))
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s store: %w", driver, err)
+	}
+	s := &sqlStore{db: db, dialect: dialect}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s store: %w", driver, err)
+	}
+	return s, nil
+}
+
+// migrate creates the tables. Message IDs are chosen by clients and only
+// unique within a room, so room_messages is keyed on both. The outbox holds
+// the keys of the messages still to be published, see Outbox.
+func (s *sqlStore) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS room_messages (
+		room    VARCHAR(255) NOT NULL,
+		id      VARCHAR(64) NOT NULL,
+		sent_at TIMESTAMP NOT NULL,
+		data    TEXT NOT NULL,
+		PRIMARY KEY (room, id)
+	)`)
+	if err == nil {
+		_, err = s.db.Exec(`CREATE INDEX IF NOT EXISTS room_messages_room_sent_at ON room_messages (room, sent_at)`)
+	}
+	if err == nil {
+		_, err = s.db.Exec(`CREATE TABLE IF NOT EXISTS outbox (
+			room      VARCHAR(255) NOT NULL,
+			id        VARCHAR(64) NOT NULL,
+			node      VARCHAR(64) NOT NULL,
+			queued_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (room, id)
+		)`)
+	}
+	if err == nil {
+		_, err = s.db.Exec(`CREATE TABLE IF NOT EXISTS state (
+			bucket VARCHAR(64) NOT NULL,
+			name   VARCHAR(255) NOT NULL,
+			value  TEXT NOT NULL,
+			PRIMARY KEY (bucket, name)
+		)`)
+	}
+	return err
+}
+
+func (s *sqlStore) Save(msg *message) error {
+	return s.insert(s.db, msg)
+}
+
+// insert adds msg to room_messages through db, the database or a
+// transaction.
+func (s *sqlStore) insert(db interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, msg *message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("INSERT INTO room_messages (id, room, sent_at, data) VALUES (%s, %s, %s, %s)",
+		s.dialect.placeholder(1), s.dialect.placeholder(2), s.dialect.placeholder(3), s.dialect.placeholder(4)),
+		msg.ID, msg.Room, msg.When.UTC(), string(data))
+	return err
+}
+
+func (s *sqlStore) Query(q messageQuery) ([]*message, error) {
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, s.dialect.placeholder(len(args))))
+	}
+	if q.Room != "" {
+		add("room = %s", q.Room)
+	}
+	if !q.Since.IsZero() {
+		add("sent_at >= %s", q.Since.UTC())
+	}
+	if !q.Before.IsZero() {
+		add("sent_at < %s", q.Before.UTC())
+	}
+	if q.Reader != "" {
+		reader := likeEscaper.Replace(q.Reader)
+		args = append(args, "dm:%", "dm:"+reader+":%", "dm:%:"+reader)
+		n := len(args)
+		where = append(where, fmt.Sprintf(`(room NOT LIKE %s OR room LIKE %s ESCAPE '\' OR room LIKE %s ESCAPE '\')`,
+			s.dialect.placeholder(n-2), s.dialect.placeholder(n-1), s.dialect.placeholder(n)))
+	}
+	// the content filters are checked against the JSON in data, which
+	// finds a superset of the matches; matches sorts them out below
+	for _, t := range q.Text {
+		add(`LOWER(data) LIKE %s ESCAPE '\'`, likeJSON(t))
+	}
+	if q.From != "" {
+		add(`LOWER(data) LIKE %s ESCAPE '\'`, likeJSON(q.From))
+	}
+	if q.HasLink {
+		add("data LIKE %s", "%http%")
+	}
+	query := "SELECT data FROM room_messages"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	// take the newest Limit rows, then put them back in order below
+	query += " ORDER BY sent_at DESC"
+	if q.Limit > 0 && !q.checkedInGo() {
+		query += " LIMIT " + strconv.Itoa(q.Limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []*message
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var msg message
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			return nil, err
+		}
+		if !q.checkedInGo() {
+			found = append(found, &msg)
+			continue
+		}
+		if q.matches(&msg) {
+			found = append(found, &msg)
+			if q.Limit > 0 && len(found) == q.Limit {
+				break
+			}
+		}
+	}
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found, rows.Err()
+}
+
+func (s *sqlStore) Get(room, id string) (*message, error) {
+	var data string
+	err := s.db.QueryRow(fmt.Sprintf("SELECT data FROM room_messages WHERE room = %s AND id = %s",
+		s.dialect.placeholder(1), s.dialect.placeholder(2)), room, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoMessage
+	}
+	if err != nil {
+		return nil, err
+	}
+	var msg message
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// likeJSON returns a LIKE pattern finding s, lower cased, as it appears in
+// a JSON string.
+func likeJSON(s string) string {
+	data, _ := json.Marshal(strings.ToLower(s))
+	return "%" + likeEscaper.Replace(string(data[1:len(data)-1])) + "%"
+}
+
+// likeEscaper escapes the LIKE wildcards, for LIKE ... ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *sqlStore) Delete(room, id string) error {
+	res, err := s.db.Exec(fmt.Sprintf("DELETE FROM room_messages WHERE room = %s AND id = %s",
+		s.dialect.placeholder(1), s.dialect.placeholder(2)), room, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNoMessage
+	}
+	return s.Unqueue(room, id)
+}
+
+// sqlState is the StateStore kept in the same database as a sqlStore, so
+// that servers sharing a database share their state as well.
+type sqlState struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func (s *sqlState) Get(bucket, key string, v interface{}) error {
+	var data string
+	err := s.db.QueryRow(fmt.Sprintf("SELECT value FROM state WHERE bucket = %s AND name = %s",
+		s.dialect.placeholder(1), s.dialect.placeholder(2)), bucket, key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return ErrNoState
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+func (s *sqlState) Put(bucket, key string, v interface{}) error {
+	_, err := s.insertState(bucket, key, v, "DO UPDATE SET value = excluded.value")
+	return err
+}
+
+func (s *sqlState) Create(bucket, key string, v interface{}) (bool, error) {
+	return s.insertState(bucket, key, v, "DO NOTHING")
+}
+
+func (s *sqlState) insertState(bucket, key string, v interface{}, onConflict string) (bool, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec(fmt.Sprintf("INSERT INTO state (bucket, name, value) VALUES (%s, %s, %s) ON CONFLICT (bucket, name) %s",
+		s.dialect.placeholder(1), s.dialect.placeholder(2), s.dialect.placeholder(3), onConflict),
+		bucket, key, string(data))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqlState) Delete(bucket, key string) error {
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM state WHERE bucket = %s AND name = %s",
+		s.dialect.placeholder(1), s.dialect.placeholder(2)), bucket, key)
+	return err
+}
+
+func (s *sqlState) List(bucket string) (map[string]json.RawMessage, error) {
+	rows, err := s.db.Query("SELECT name, value FROM state WHERE bucket = "+s.dialect.placeholder(1), bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		list[name] = json.RawMessage(value)
+	}
+	return list, rows.Err()
+}
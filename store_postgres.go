@@ -0,0 +1,7 @@
+//go:build postgres
+
+package main
+
+// Building with -tags postgres registers the Postgres driver used by the
+// postgres: message store. It needs github.com/lib/pq.
+import _ "github.com/lib/pq"
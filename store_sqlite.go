@@ -0,0 +1,7 @@
+//go:build sqlite
+
+package main
+
+// Building with -tags sqlite registers the SQLite driver used by the
+// sqlite: message store. It needs cgo and github.com/mattn/go-sqlite3.
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,128 @@
+//go:build sqlite
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQLiteStoreKeysMessagesByRoom(t *testing.T) {
+	s, err := openSQLStore("sqlite3", filepath.Join(t.TempDir(), "chat.db"), sqliteDialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	now := time.Now()
+	if err := s.Save(&message{ID: "same", Room: "a", When: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(&message{ID: "same", Room: "b", When: now}); err != nil {
+		t.Errorf("the same ID should be usable in another room, got %v", err)
+	}
+	if msg, err := s.Get("b", "same"); err != nil || msg.Room != "b" {
+		t.Errorf("expected the message of room b, got %v %v", msg, err)
+	}
+	if msg, err := s.Get("a", "same"); err != nil || msg.Room != "a" {
+		t.Errorf("expected the message of room a, got %v %v", msg, err)
+	}
+	if _, err := s.Get("c", "same"); err != ErrNoMessage {
+		t.Errorf("expected ErrNoMessage for another room, got %v", err)
+	}
+	if err := s.Delete("a", "same"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("b", "same"); err != nil {
+		t.Errorf("deleting the message of room a should leave room b's, got %v", err)
+	}
+}
+
+func TestSQLiteStoreSavesDirectMessages(t *testing.T) {
+	s, err := openSQLStore("sqlite3", filepath.Join(t.TempDir(), "chat.db"), sqliteDialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	// userids are md5 sums, and guests' longer; SQLite ignores the
+	// length of a VARCHAR, but Postgres refuses what does not fit
+	room := dmRoom(guestIDPrefix+strings.Repeat("a", 32), strings.Repeat("b", 32))
+	var columnType string
+	if err := s.db.QueryRow("SELECT type FROM pragma_table_info('room_messages') WHERE name = 'room'").Scan(&columnType); err != nil {
+		t.Fatal(err)
+	}
+	var size int
+	if _, err := fmt.Sscanf(columnType, "VARCHAR(%d)", &size); err != nil || size < len(room) {
+		t.Errorf("the room column, %s, should fit %d characters", columnType, len(room))
+	}
+	if err := s.Save(&message{ID: "dm1", Type: msgTypeDM, Room: room, Message: "psst", When: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := s.Get(room, "dm1"); err != nil || msg.Message != "psst" {
+		t.Errorf("expected the direct message, got %v %v", msg, err)
+	}
+}
+
+func TestSQLiteStoreOutbox(t *testing.T) {
+	s, err := openSQLStore("sqlite3", filepath.Join(t.TempDir(), "chat.db"), sqliteDialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	now := time.Now()
+	if err := s.SaveQueued(&message{ID: "mine", Room: "a", When: now}, "here"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveQueued(&message{ID: "theirs", Room: "a", When: now}, "gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveQueued(&message{ID: "mine", Room: "a", When: now}, "here"); err == nil {
+		t.Error("a message should not be saved and queued twice")
+	}
+	queued, err := s.Queued("here", now.Add(-time.Minute), relayBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 || queued[0].Message.ID != "mine" || queued[0].Node != "here" {
+		t.Errorf("only this node's message should be queued for it, got %+v", queued)
+	}
+	queued, _ = s.Queued("here", time.Now().Add(time.Second), relayBatch)
+	if len(queued) != 2 || queued[1].Message.ID != "theirs" || queued[1].Node != "gone" {
+		t.Errorf("orphaned messages should be taken over, got %+v", queued)
+	}
+	if err := s.Unqueue("a", "mine"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("a", "theirs"); err != nil {
+		t.Fatal(err)
+	}
+	if queued, _ := s.Queued("here", time.Now().Add(time.Second), relayBatch); len(queued) != 0 {
+		t.Errorf("unqueued and deleted messages should leave the outbox, got %+v", queued)
+	}
+	if _, err := s.Get("a", "mine"); err != nil {
+		t.Errorf("unqueued messages should stay saved: %v", err)
+	}
+}
+
+func TestSQLiteStoreSealsMessages(t *testing.T) {
+	inner, err := openSQLStore("sqlite3", filepath.Join(t.TempDir(), "chat.db"), sqliteDialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.db.Close()
+	state := newStateStore(inner, "")
+	keys, _ := newDataKeys("a long random master key", state)
+	s := &sealedStore{MessageStore: inner, keys: keys}
+	if err := s.SaveQueued(&message{ID: "a", Room: "golang", Message: "the launch code", When: time.Now()}, "here"); err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	if err := inner.db.QueryRow("SELECT data FROM room_messages").Scan(&data); err != nil || strings.Contains(data, "launch") {
+		t.Errorf("the database should only hold the sealed content, got %s %v", data, err)
+	}
+	if queued, err := s.Queued("here", time.Now(), relayBatch); err != nil || len(queued) != 1 || queued[0].Message.Message != "the launch code" {
+		t.Errorf("queued messages should be opened for the relay, got %+v %v", queued, err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreQuery(t *testing.T) {
+	s := newMemoryStore()
+	start := time.Now()
+	for i, room := range []string{"a", "b", "a", "a"} {
+		s.Save(&message{ID: string(rune('0' + i)), Room: room, When: start.Add(time.Duration(i) * time.Minute)})
+	}
+	msgs, _ := s.Query(messageQuery{Room: "a"})
+	if len(msgs) != 3 || msgs[0].ID != "0" || msgs[2].ID != "3" {
+		t.Errorf("expected room a messages in order, got %v", ids(msgs))
+	}
+	msgs, _ = s.Query(messageQuery{Room: "a", Limit: 2})
+	if len(msgs) != 2 || msgs[0].ID != "2" || msgs[1].ID != "3" {
+		t.Errorf("Limit should keep the most recent messages, got %v", ids(msgs))
+	}
+	msgs, _ = s.Query(messageQuery{Since: start.Add(time.Minute), Before: start.Add(3 * time.Minute)})
+	if len(msgs) != 2 || msgs[0].ID != "1" || msgs[1].ID != "2" {
+		t.Errorf("Since/Before should select a half open range, got %v", ids(msgs))
+	}
+	if err := s.Delete("a", "2"); err != nil {
+		t.Error(err)
+	}
+	if err := s.Delete("a", "2"); err != ErrNoMessage {
+		t.Error("deleting twice should return ErrNoMessage")
+	}
+	if msgs, _ = s.Query(messageQuery{}); len(msgs) != 3 {
+		t.Errorf("expected 3 messages after delete, got %v", ids(msgs))
+	}
+}
+
+func TestMemoryStoreGet(t *testing.T) {
+	s := newMemoryStore()
+	s.Save(&message{ID: "m1", Room: "a", Message: "in a"})
+	s.Save(&message{ID: "m1", Room: "b", Message: "in b"})
+	if msg, err := s.Get("b", "m1"); err != nil || msg.Message != "in b" {
+		t.Errorf("expected the message of room b, got %v %v", msg, err)
+	}
+	if _, err := s.Get("c", "m1"); err != ErrNoMessage {
+		t.Errorf("expected ErrNoMessage for another room, got %v", err)
+	}
+	s.Delete("a", "m1")
+	if _, err := s.Get("a", "m1"); err != ErrNoMessage {
+		t.Errorf("expected ErrNoMessage once deleted, got %v", err)
+	}
+}
+
+func TestRoomSavesMessages(t *testing.T) {
+	r := newRoom("golang")
+	go r.run()
+	c := &client{send: make(chan *message, messageBufferSize), room: r}
+	r.join <- c
+	r.forward <- &message{ID: "a", Message: "hello"}
+	receive(t, c)
+	msgs, _ := r.store.Query(messageQuery{Room: "golang"})
+	if len(msgs) != 1 || msgs[0].Message != "hello" {
+		t.Errorf("broadcast message should be saved, got %v", ids(msgs))
+	}
+}
+
+func ids(msgs []*message) []string {
+	var ids []string
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
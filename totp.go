@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+const (
+	// totpBucket holds a totpEnrollment per user, by userid.
+	totpBucket = "totp"
+	// totpChallengesBucket holds the sign-ins waiting for a second factor,
+	// by challenge ID.
+	totpChallengesBucket = "totp_challenges"
+)
+
+const (
+	// totpPeriod is how long each code lasts, and totpSkew how many
+	// periods either side of now are accepted, for clocks that are off.
+	totpPeriod = 30 * time.Second
+	totpSkew   = 1
+	// backupCodeCount is how many backup codes a user gets at a time.
+	backupCodeCount = 10
+	// totpChallengeTTL is how long a user has to enter their code after
+	// signing in with a login provider, and totpMaxAttempts how many codes
+	// they may try.
+	totpChallengeTTL = 5 * time.Minute
+	totpMaxAttempts  = 5
+)
+
+// totpCookie names the sign-in waiting for the browser's second factor.
+const totpCookie = "totp"
+
+// totpEnrollment is a user's TOTP secret. Until Enabled it is only being
+// set up, and signing in doesn't ask for a code.
+type totpEnrollment struct {
+	Secret  string
+	Enabled bool
+	Created time.Time
+	// LastStep is the period of the last code accepted; neither it nor an
+	// earlier one is accepted again.
+	LastStep int64 `json:",omitempty"`
+	// BackupCodes are the SHA-256 hashes of the unused backup codes.
+	BackupCodes []string `json:",omitempty"`
+}
+
+// totpChallenge is a sign-in waiting for its second factor: the user data
+// the session will get once the code is entered.
+type totpChallenge struct {
+	User     map[string]interface{}
+	Expires  time.Time
+	Attempts int
+}
+
+// totpCode returns the code of secret for the period step, as RFC 6238 and
+// RFC 4226 compute it: six digits of an HMAC-SHA1.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", n%1000000)
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// check reports whether code is a current code of e or one of its backup
+// codes, and uses it up.
+func (e *totpEnrollment) check(code string, now time.Time) bool {
+	code = strings.ToLower(strings.Join(strings.Fields(code), ""))
+	if len(code) == 6 {
+		secret, err := totpEncoding.DecodeString(e.Secret)
+		if err != nil {
+			return false
+		}
+		step := now.Unix() / int64(totpPeriod/time.Second)
+		for s := step - totpSkew; s <= step+totpSkew; s++ {
+			if s > e.LastStep && hmac.Equal([]byte(totpCode(secret, s)), []byte(code)) {
+				e.LastStep = s
+				return true
+			}
+		}
+		return false
+	}
+	hash := backupCodeHash(code)
+	for i, h := range e.BackupCodes {
+		if hmac.Equal([]byte(h), []byte(hash)) {
+			e.BackupCodes = append(e.BackupCodes[:i:i], e.BackupCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func backupCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(strings.ReplaceAll(code, "-", "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// newBackupCodes returns backupCodeCount new backup codes, such as
+// "4f1c-9a2e", and their hashes.
+func newBackupCodes() (codes, hashes []string) {
+	for i := 0; i < backupCodeCount; i++ {
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			panic("chat: unable to read random bytes: " + err.Error())
+		}
+		code := hex.EncodeToString(b[:2]) + "-" + hex.EncodeToString(b[2:])
+		codes = append(codes, code)
+		hashes = append(hashes, backupCodeHash(code))
+	}
+	return codes, hashes
+}
+
+// totpStore keeps the users' TOTP enrollments and the sign-ins waiting for
+// their code in a StateStore.
+type totpStore struct {
+	state StateStore
+
+	once sync.Once
+	page *template.Template
+}
+
+// twoFactor are the enrollments of this server's users. main replaces it
+// with one kept with the server's state.
+var twoFactor = &totpStore{state: newFileState("")}
+
+// enrollment returns the enrollment of the user with userID, or nil if
+// they have none.
+func (s *totpStore) enrollment(userID string) (*totpEnrollment, error) {
+	var e totpEnrollment
+	switch err := s.state.Get(totpBucket, userID, &e); err {
+	case nil:
+		return &e, nil
+	case ErrNoState:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// required reports whether the user with userID must enter a code to
+// sign in.
+func (s *totpStore) required(userID string) (bool, error) {
+	e, err := s.enrollment(userID)
+	return e != nil && e.Enabled, err
+}
+
+// challenge holds off signing in the user with userData until they enter
+// their code at /login/2fa, where it sends the browser.
+func (s *totpStore) challenge(w http.ResponseWriter, r *http.Request, userData objx.Map) error {
+	id := newID()
+	c := &totpChallenge{User: userData, Expires: time.Now().Add(totpChallengeTTL)}
+	if err := s.state.Put(totpChallengesBucket, id, c); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     totpCookie,
+		Value:    id + "." + authKeys.sign([]byte(id)),
+		Path:     "/",
+		Expires:  c.Expires,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/login/2fa", http.StatusTemporaryRedirect)
+	return nil
+}
+
+// ServeLogin asks for the code of a sign-in held off by challenge,
+// GET /login/2fa, and completes the sign-in when a current code or a backup
+// code is posted.
+func (s *totpStore) ServeLogin(w http.ResponseWriter, r *http.Request) {
+	s.once.Do(func() {
+		s.page = template.Must(template.ParseFiles(filepath.Join(templatesDir, "totp.html")))
+	})
+	show := func(status int, problem string) {
+		// the token may set a cookie, so it comes before the status
+		data := map[string]interface{}{"Problem": problem, "CSRFToken": csrfToken(w, r)}
+		w.WriteHeader(status)
+		s.page.Execute(w, data)
+	}
+	cookie, err := r.Cookie(totpCookie)
+	var id, sig string
+	if err == nil {
+		id, sig, _ = strings.Cut(cookie.Value, ".")
+	}
+	var c totpChallenge
+	if err != nil || !validID(id) || !authKeys.verify([]byte(id), sig) || s.state.Get(totpChallengesBucket, id, &c) != nil || time.Now().After(c.Expires) {
+		show(http.StatusUnauthorized, "This sign-in has expired. Please sign in again.")
+		return
+	}
+	if r.Method != http.MethodPost {
+		show(http.StatusOK, "")
+		return
+	}
+	c.Attempts++
+	if c.Attempts > totpMaxAttempts {
+		s.state.Delete(totpChallengesBucket, id)
+		show(http.StatusUnauthorized, "Too many wrong codes. Please sign in again.")
+		return
+	}
+	if err := s.state.Put(totpChallengesBucket, id, &c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	userID, _ := c.User["userid"].(string)
+	e, err := s.enrollment(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if e != nil && e.Enabled && !e.check(r.PostFormValue("code"), time.Now()) {
+		show(http.StatusUnauthorized, "That code is not right. Please try again.")
+		return
+	}
+	if e != nil {
+		if err := s.state.Put(totpBucket, userID, e); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	s.state.Delete(totpChallengesBucket, id)
+	http.SetCookie(w, &http.Cookie{Name: totpCookie, Value: "", Path: "/", MaxAge: -1})
+	if err := startSession(w, r, objx.Map(c.User)); err != nil {
+		http.Error(w, fmt.Sprintf("Error when trying to start session: %s", err), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, returnTo(w, r), http.StatusSeeOther)
+}
+
+// ServeHTTP lets signed in users manage their second factor:
+//
+//	GET    /api/2fa               {"Enabled", "BackupCodes"}, how many are left
+//	POST   /api/2fa/enroll        start setting it up: {"Secret", "URL"}, the
+//	                              secret and otpauth URL for the app
+//	POST   /api/2fa/confirm       turn it on with a code from the app:
+//	                              {"Code"}; answers with the backup codes
+//	POST   /api/2fa/backup-codes  replace the backup codes: {"Code"}
+//	DELETE /api/2fa               turn it off: {"Code"}
+//
+// Backup codes are only shown once; each can be used once instead of a code
+// from the app. Guests have no second factor.
+func (s *totpStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	userID := user.Get("userid").Str()
+	if userID == "" || isGuest(user) {
+		http.Error(w, "guests can't set up two-factor authentication", http.StatusForbidden)
+		return
+	}
+	e, err := s.enrollment(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var req struct{ Code string }
+	if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+		json.NewDecoder(r.Body).Decode(&req)
+	}
+	enabled := e != nil && e.Enabled
+	// codeOK checks the code of a request that changes an enabled second
+	// factor, or confirms one being set up
+	codeOK := func() bool {
+		if e == nil || !e.check(req.Code, time.Now()) {
+			http.Error(w, "the code is not right", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	var answer interface{}
+	switch action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/2fa"), "/"); {
+	case r.Method == http.MethodGet && action == "":
+		answer = map[string]interface{}{"Enabled": enabled, "BackupCodes": len(e.backupCodes())}
+	case r.Method == http.MethodPost && action == "enroll":
+		if enabled {
+			http.Error(w, "two-factor authentication is already on; turn it off first", http.StatusConflict)
+			return
+		}
+		secret := make([]byte, 20)
+		if _, err := rand.Read(secret); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		e = &totpEnrollment{Secret: totpEncoding.EncodeToString(secret), Created: time.Now()}
+		account := user.Get("email").Str()
+		if account == "" {
+			account = user.Get("name").Str()
+		}
+		answer = map[string]string{"Secret": e.Secret, "URL": "otpauth://totp/" + url.PathEscape("Chat:"+account) + "?" + url.Values{
+			"secret": {e.Secret}, "issuer": {"Chat"}, "period": {"30"}, "digits": {"6"},
+		}.Encode()}
+	case r.Method == http.MethodPost && (action == "confirm" && !enabled || action == "backup-codes" && enabled):
+		if !codeOK() {
+			return
+		}
+		codes, hashes := newBackupCodes()
+		e.Enabled, e.BackupCodes = true, hashes
+		answer = map[string][]string{"BackupCodes": codes}
+	case r.Method == http.MethodPost && (action == "confirm" || action == "backup-codes"):
+		http.Error(w, "two-factor authentication is not being set up or on", http.StatusConflict)
+		return
+	case r.Method == http.MethodDelete && action == "":
+		if !enabled {
+			http.Error(w, "two-factor authentication is off", http.StatusConflict)
+			return
+		}
+		if !codeOK() {
+			return
+		}
+		if err := s.state.Delete(totpBucket, userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err := s.state.Put(totpBucket, userID, e); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(answer)
+}
+
+func (e *totpEnrollment) backupCodes() []string {
+	if e == nil {
+		return nil
+	}
+	return e.BackupCodes
+}
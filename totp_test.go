@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// the SHA-1 test vectors of RFC 6238, cut to six digits
+	secret := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if got := totpCode(secret, unix/30); got != want {
+			t.Errorf("code at %d: got %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	defer func(s *totpStore) { twoFactor = s }(twoFactor)
+	twoFactor = &totpStore{state: newFileState("")}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann", "email": "ann@example.com"})
+	api := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		twoFactor.ServeHTTP(w, withAuthCookie(method, path, strings.NewReader(body), ann))
+		return w
+	}
+	codeAt := func(e *totpEnrollment, step int64) string {
+		secret, _ := totpEncoding.DecodeString(e.Secret)
+		return totpCode(secret, step)
+	}
+	step := time.Now().Unix() / 30
+
+	w := api(http.MethodPost, "/api/2fa/enroll", "")
+	var enrolled struct{ Secret, URL string }
+	json.NewDecoder(w.Body).Decode(&enrolled)
+	if w.Code != http.StatusOK || !strings.HasPrefix(enrolled.URL, "otpauth://totp/Chat:ann@example.com?") || !strings.Contains(enrolled.URL, "secret="+enrolled.Secret) {
+		t.Fatalf("unexpected enrollment %d %+v", w.Code, enrolled)
+	}
+	if required, _ := twoFactor.required("ann"); required {
+		t.Error("a second factor should not be required before it is confirmed")
+	}
+	e := &totpEnrollment{Secret: enrolled.Secret}
+	if w := api(http.MethodPost, "/api/2fa/confirm", `{"Code": "000000x"}`); w.Code != http.StatusForbidden {
+		t.Errorf("a wrong code should not confirm, got %d", w.Code)
+	}
+	w = api(http.MethodPost, "/api/2fa/confirm", `{"Code": "`+codeAt(e, step)+`"}`)
+	var confirmed struct{ BackupCodes []string }
+	json.NewDecoder(w.Body).Decode(&confirmed)
+	if w.Code != http.StatusOK || len(confirmed.BackupCodes) != backupCodeCount {
+		t.Fatalf("unexpected confirmation %d %+v", w.Code, confirmed)
+	}
+
+	// signing in now waits for a code
+	w = httptest.NewRecorder()
+	if err := twoFactor.challenge(w, httptest.NewRequest(http.MethodGet, "/auth/callback/github", nil), ann); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Location") != "/login/2fa" {
+		t.Errorf("expected to be sent to /login/2fa, got %q", w.Header().Get("Location"))
+	}
+	challenge := w.Result().Cookies()[0]
+	login := func(code string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader(url.Values{"code": {code}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(challenge)
+		w := httptest.NewRecorder()
+		twoFactor.ServeLogin(w, r)
+		return w
+	}
+	if w := login(codeAt(e, step)); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "not right") {
+		t.Errorf("a code already used should be refused, got %d", w.Code)
+	}
+	w = login(confirmed.BackupCodes[0])
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("a backup code should sign in, got %d: %s", w.Code, w.Body)
+	}
+	signedIn := false
+	for _, c := range w.Result().Cookies() {
+		signedIn = signedIn || c.Name == "auth" && c.Value != ""
+	}
+	if !signedIn {
+		t.Error("expected a session to be started")
+	}
+	if w := login(confirmed.BackupCodes[1]); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "expired") {
+		t.Errorf("a challenge should only be completed once, got %d", w.Code)
+	}
+	if w := api(http.MethodGet, "/api/2fa", ""); !strings.Contains(w.Body.String(), `"BackupCodes":9`) {
+		t.Errorf("the backup code should be used up, got %s", w.Body)
+	}
+
+	if w := api(http.MethodDelete, "/api/2fa", `{"Code": "`+confirmed.BackupCodes[0]+`"}`); w.Code != http.StatusForbidden {
+		t.Errorf("a used backup code should not turn it off, got %d", w.Code)
+	}
+	if w := api(http.MethodDelete, "/api/2fa", `{"Code": "`+codeAt(e, step+1)+`"}`); w.Code != http.StatusNoContent {
+		t.Errorf("expected the second factor to be turned off, got %d: %s", w.Code, w.Body)
+	}
+	if required, _ := twoFactor.required("ann"); required {
+		t.Error("a second factor should no longer be required")
+	}
+}
+
+func TestTwoFactorAttempts(t *testing.T) {
+	defer func(s *totpStore) { twoFactor = s }(twoFactor)
+	twoFactor = &totpStore{state: newFileState("")}
+	twoFactor.state.Put(totpBucket, "bob", &totpEnrollment{Secret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", Enabled: true})
+	w := httptest.NewRecorder()
+	twoFactor.challenge(w, httptest.NewRequest(http.MethodGet, "/", nil), objx.New(map[string]interface{}{"userid": "bob"}))
+	challenge := w.Result().Cookies()[0]
+	var last *httptest.ResponseRecorder
+	for i := 0; i <= totpMaxAttempts; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader("code=000000"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(challenge)
+		last = httptest.NewRecorder()
+		twoFactor.ServeLogin(last, r)
+	}
+	if !strings.Contains(last.Body.String(), "Too many wrong codes") {
+		t.Errorf("guessing should be cut off after %d codes, got %s", totpMaxAttempts, last.Body)
+	}
+}
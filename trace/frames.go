@@ -0,0 +1,86 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The directions of a frame.
+const (
+	// In is a frame received from a client.
+	In = "in"
+	// Out is a frame sent to a client.
+	Out = "out"
+)
+
+// Frames records the websocket frames of a sample of sessions, in full, to a
+// sink of their own, for debugging protocol problems in production. Whether
+// a session is recorded is decided once, when it starts, by Sample. A nil
+// *Frames samples nothing.
+type Frames struct {
+	out io.Writer
+	// rate is the share of sessions recorded, from 0 to 1, and users are
+	// the users whose sessions are always recorded.
+	rate  float64
+	users map[string]bool
+	mu    sync.Mutex
+	rand  func() float64
+	now   func() time.Time
+}
+
+// NewFrames creates a Frames that samples rate of the sessions, and every
+// session of users, and writes their frames to w as JSON objects, one per
+// line:
+//
+//	{"time":"2024-05-01T12:00:00.123Z","dir":"in","frame":"{\"Message\":\"hi\"}","session":"4f1c...","user":"ann"}
+func NewFrames(w io.Writer, rate float64, users []string) *Frames {
+	f := &Frames{out: w, rate: rate, users: make(map[string]bool), rand: rand.Float64, now: time.Now}
+	for _, u := range users {
+		f.users[u] = true
+	}
+	return f
+}
+
+// Sample reports whether the session of the user with userID should be
+// recorded.
+func (f *Frames) Sample(userID string) bool {
+	if f == nil {
+		return false
+	}
+	if userID != "" && f.users[userID] {
+		return true
+	}
+	if f.rate <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand() < f.rate
+}
+
+// Record writes frame, going in direction dir, with the key/value pairs in
+// keyvals, such as "session", id. Frames of sessions that are recorded are
+// written whole; it is up to the caller to only record sampled sessions.
+func (f *Frames) Record(dir string, frame []byte, keyvals ...interface{}) {
+	if f == nil {
+		return
+	}
+	event := map[string]interface{}{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		event[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	event["time"] = f.now().UTC().Format(time.RFC3339Nano)
+	event["dir"] = dir
+	event["frame"] = string(frame)
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.out.Write(append(line, '\n'))
+}
@@ -0,0 +1,39 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestFramesSample(t *testing.T) {
+	var none *Frames
+	if none.Sample("ann") {
+		t.Error("a nil Frames should sample nothing")
+	}
+	f := NewFrames(&bytes.Buffer{}, 0.5, []string{"ann"})
+	f.rand = func() float64 { return 0.7 }
+	if !f.Sample("ann") {
+		t.Error("a targeted user should always be sampled")
+	}
+	if f.Sample("bob") {
+		t.Error("bob should not be sampled at 0.7")
+	}
+	f.rand = func() float64 { return 0.2 }
+	if !f.Sample("bob") {
+		t.Error("bob should be sampled at 0.2")
+	}
+}
+
+func TestFramesRecord(t *testing.T) {
+	var buf bytes.Buffer
+	f := NewFrames(&buf, 1, nil)
+	f.Record(In, []byte(`{"Message":"hi"}`), "session", "s1")
+	var event map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event["dir"] != In || event["frame"] != `{"Message":"hi"}` || event["session"] != "s1" || event["time"] == "" {
+		t.Errorf("unexpected event %v", event)
+	}
+}
@@ -0,0 +1,45 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// NewJSON creates a Tracer that writes every event to w as a JSON object on
+// a line of its own, for log aggregators:
+//
+//	{"time":"2024-05-01T12:00:00.123Z","level":"info","msg":"Client left","room":"golang"}
+//
+// The pairs added by With become fields of the object.
+func NewJSON(w io.Writer) Tracer {
+	return NewJSONLevel(w, LevelDebug)
+}
+
+// NewJSONLevel creates a Tracer that writes events at min and above to w as
+// NewJSON does.
+func NewJSONLevel(w io.Writer, min Level) Tracer {
+	return &tracer{out: w, min: min, json: true, now: time.Now}
+}
+
+// traceJSON writes an event as a JSON object. It is written with a single
+// Write so that events traced at the same time do not interleave.
+func (t *tracer) traceJSON(level Level, msg string) {
+	event := map[string]interface{}{}
+	for i := 0; i+1 < len(t.fields); i += 2 {
+		value := t.fields[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		event[fmt.Sprint(t.fields[i])] = value
+	}
+	event["time"] = t.now().UTC().Format(time.RFC3339Nano)
+	event["level"] = level.String()
+	event["msg"] = msg
+	line, err := json.Marshal(event)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{"time": event["time"], "level": event["level"], "msg": event["msg"], "error": err.Error()})
+	}
+	t.out.Write(append(line, '\n'))
+}
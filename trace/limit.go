@@ -0,0 +1,80 @@
+package trace
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits bound how much a Tracer writes, so that a flood of messages traced
+// at debug can't fill the disk or swamp the log pipeline.
+type Limits struct {
+	// MaxBytes cuts the text of each event to that many bytes; 0 for no
+	// limit.
+	MaxBytes int
+	// PerSecond is how many events may be written each second, with
+	// bursts of up to a second's worth; 0 for no limit. Events over it
+	// are dropped, and the next event written says how many were.
+	PerSecond int
+}
+
+// Limit returns a copy of t that keeps to limits, if t was created by New,
+// NewLevel, NewJSON or NewJSONLevel; other Tracers are returned as they are.
+// The Tracers returned by the copy's With share its rate.
+func Limit(t Tracer, limits Limits) Tracer {
+	tr, ok := t.(*tracer)
+	if !ok || limits == (Limits{}) {
+		return t
+	}
+	limited := *tr
+	limited.limit = &limiter{Limits: limits, tokens: float64(limits.PerSecond)}
+	return &limited
+}
+
+// limiter is a token bucket for events, which also cuts their text. A nil
+// *limiter lets everything through.
+type limiter struct {
+	Limits
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	dropped int
+}
+
+// allow reports whether an event may be written at now, and how many were
+// dropped since the last one that was.
+func (l *limiter) allow(now time.Time) (ok bool, dropped int) {
+	if l == nil || l.PerSecond <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.PerSecond)
+		if l.tokens > float64(l.PerSecond) {
+			l.tokens = float64(l.PerSecond)
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		l.dropped++
+		return false, 0
+	}
+	l.tokens--
+	dropped, l.dropped = l.dropped, 0
+	return true, dropped
+}
+
+// cut returns msg cut to MaxBytes, on a rune boundary, saying how much was
+// left out.
+func (l *limiter) cut(msg string) string {
+	if l == nil || l.MaxBytes <= 0 || len(msg) <= l.MaxBytes {
+		return msg
+	}
+	n := l.MaxBytes
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s... (%d bytes cut)", msg[:n], len(msg)-n)
+}
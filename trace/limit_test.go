@@ -0,0 +1,42 @@
+package trace
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitCuts(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := Limit(New(&buf), Limits{MaxBytes: 9})
+	tracer.Debug("hello, wörld")
+	// the ö takes two bytes, so the cut falls before it
+	if got := buf.String(); got != "DEBUG: hello, w... (5 bytes cut)\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	var buf bytes.Buffer
+	limited := Limit(NewJSONLevel(&buf, LevelDebug), Limits{PerSecond: 2})
+	now := time.Now()
+	limited.(*tracer).now = func() time.Time { return now }
+	room := limited.With("room", "golang")
+	for i := 0; i < 5; i++ {
+		room.Debug("message")
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 2 {
+		t.Errorf("expected a burst of 2 events, got %d:\n%s", n, buf.String())
+	}
+	buf.Reset()
+	now = now.Add(time.Second)
+	limited.Info("later")
+	if !strings.Contains(buf.String(), `"msg":"Dropped 3 events over the trace rate limit"`) || !strings.Contains(buf.String(), `"msg":"later"`) {
+		t.Errorf("expected the dropped events to be counted, got %s", buf.String())
+	}
+
+	if Limit(Off(), Limits{PerSecond: 1}) == nil {
+		t.Error("other Tracers should be returned as they are")
+	}
+}
@@ -0,0 +1,40 @@
+package trace
+
+import "sync"
+
+// Ring is an io.Writer that keeps only the last writes made to it, for
+// looking at recent events without writing them anywhere. Each Write is
+// kept as one entry, which suits the JSON Tracers since they write every
+// event at once.
+type Ring struct {
+	mu      sync.Mutex
+	entries [][]byte
+	next    int
+	full    bool
+}
+
+// NewRing creates a Ring that keeps the last size writes.
+func NewRing(size int) *Ring {
+	return &Ring{entries: make([][]byte, size)}
+}
+
+func (r *Ring) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = append([]byte(nil), p...)
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+	return len(p), nil
+}
+
+// Entries returns the writes kept, oldest first.
+func (r *Ring) Entries() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([][]byte(nil), r.entries[:r.next]...)
+	}
+	return append(append([][]byte(nil), r.entries[r.next:]...), r.entries[:r.next]...)
+}
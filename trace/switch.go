@@ -0,0 +1,59 @@
+package trace
+
+import "sync"
+
+// Switch is a Tracer that passes events on to another Tracer, which can be
+// replaced at any time, for example to turn on debugging in a running
+// server. The Tracers returned by its With follow the replacement too.
+type Switch struct {
+	mu sync.RWMutex
+	t  Tracer
+}
+
+// NewSwitch creates a Switch that passes events on to t.
+func NewSwitch(t Tracer) *Switch {
+	return &Switch{t: t}
+}
+
+// Set makes s pass events on to t from now on.
+func (s *Switch) Set(t Tracer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.t = t
+}
+
+// Tracer returns the Tracer s passes events on to.
+func (s *Switch) Tracer() Tracer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t
+}
+
+func (s *Switch) Trace(a ...interface{}) { s.Tracer().Trace(a...) }
+func (s *Switch) Debug(a ...interface{}) { s.Tracer().Debug(a...) }
+func (s *Switch) Info(a ...interface{})  { s.Tracer().Info(a...) }
+func (s *Switch) Warn(a ...interface{})  { s.Tracer().Warn(a...) }
+func (s *Switch) Error(a ...interface{}) { s.Tracer().Error(a...) }
+
+func (s *Switch) With(keyvals ...interface{}) Tracer {
+	return &switchWith{s: s, keyvals: keyvals}
+}
+
+// switchWith adds keyvals to every event before passing it on to whatever
+// Tracer its Switch has at the time.
+type switchWith struct {
+	s       *Switch
+	keyvals []interface{}
+}
+
+func (w *switchWith) tracer() Tracer { return w.s.Tracer().With(w.keyvals...) }
+
+func (w *switchWith) Trace(a ...interface{}) { w.tracer().Trace(a...) }
+func (w *switchWith) Debug(a ...interface{}) { w.tracer().Debug(a...) }
+func (w *switchWith) Info(a ...interface{})  { w.tracer().Info(a...) }
+func (w *switchWith) Warn(a ...interface{})  { w.tracer().Warn(a...) }
+func (w *switchWith) Error(a ...interface{}) { w.tracer().Error(a...) }
+
+func (w *switchWith) With(keyvals ...interface{}) Tracer {
+	return &switchWith{s: w.s, keyvals: append(append([]interface{}(nil), w.keyvals...), keyvals...)}
+}
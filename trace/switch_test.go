@@ -0,0 +1,35 @@
+package trace
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSwitch(t *testing.T) {
+	var before, after bytes.Buffer
+	s := NewSwitch(New(&before))
+	room := s.With("room", "golang")
+	room.Trace("one")
+	s.Set(NewLevel(&after, LevelWarn))
+	room.Trace("two")
+	room.Warn("three")
+	if before.String() != "one room=golang\n" {
+		t.Errorf("unexpected trace before the switch %q", before.String())
+	}
+	if after.String() != "WARN: three room=golang\n" {
+		t.Errorf("unexpected trace after the switch %q", after.String())
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := NewRing(2)
+	tracer := NewJSON(r)
+	for _, msg := range []string{"one", "two", "three"} {
+		tracer.Info(msg)
+	}
+	entries := r.Entries()
+	if len(entries) != 2 || !strings.Contains(string(entries[0]), `"two"`) || !strings.Contains(string(entries[1]), `"three"`) {
+		t.Errorf("expected the last two events, got %q", entries)
+	}
+}
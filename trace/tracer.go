@@ -3,12 +3,58 @@ package trace
 import (
 	"fmt"
 	"io"
+	"strings"
+	"time"
 )
 
+// Level is how much an event matters. A Tracer leaves out events below
+// its minimum level.
+type Level int
+
+const (
+	// LevelDebug is for the detail of every message, useful while
+	// developing.
+	LevelDebug Level = iota
+	// LevelInfo is for what happens now and then, such as rooms being
+	// created and clients joining. Trace traces at this level.
+	LevelInfo
+	// LevelWarn is for failures the server works around.
+	LevelWarn
+	// LevelError is for failures that lose something, such as a message
+	// that could not be saved.
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level called name: debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return LevelDebug, fmt.Errorf("unknown trace level %q", name)
+}
+
 // Tracer is the interface that describes an object capable of
 // tracing events throughout code.
 type Tracer interface {
 	Trace(...interface{})
+	Debug(...interface{})
+	Info(...interface{})
+	Warn(...interface{})
+	Error(...interface{})
+	// With returns a Tracer that adds the key/value pairs in keyvals,
+	// such as "room", "golang", to every event.
+	With(keyvals ...interface{}) Tracer
 }
 
 //This is perfectly acceptable and valid Go code; the user
@@ -17,22 +63,87 @@ type Tracer interface {
 //wouldn't matter if our tracer implementation exposed other methods or fields;
 type tracer struct {
 	out io.Writer
+	min Level
+	// json writes events as JSON objects rather than lines of text.
+	json bool
+	// fields are the key/value pairs added by With.
+	fields []interface{}
+	now    func() time.Time
+	// limit, if set, is the Limits the tracer keeps to.
+	limit *limiter
 }
 
-func (t *tracer) Trace(a ...interface{}) {
-	fmt.Fprint(t.out, a...)
+// Trace traces at LevelInfo.
+func (t *tracer) Trace(a ...interface{}) { t.trace(LevelInfo, a) }
+func (t *tracer) Debug(a ...interface{}) { t.trace(LevelDebug, a) }
+func (t *tracer) Info(a ...interface{})  { t.trace(LevelInfo, a) }
+func (t *tracer) Warn(a ...interface{})  { t.trace(LevelWarn, a) }
+func (t *tracer) Error(a ...interface{}) { t.trace(LevelError, a) }
+
+func (t *tracer) With(keyvals ...interface{}) Tracer {
+	with := *t
+	with.fields = append(append([]interface{}(nil), t.fields...), keyvals...)
+	return &with
+}
+
+// trace writes an event at level, if it is not below t.min and t.limit lets
+// it through.
+func (t *tracer) trace(level Level, a []interface{}) {
+	if level < t.min {
+		return
+	}
+	now := time.Now
+	if t.now != nil {
+		now = t.now
+	}
+	ok, dropped := t.limit.allow(now())
+	if !ok {
+		return
+	}
+	if dropped > 0 {
+		t.write(LevelWarn, fmt.Sprintf("Dropped %d events over the trace rate limit", dropped))
+	}
+	t.write(level, t.limit.cut(fmt.Sprint(a...)))
+}
+
+// write writes msg as an event at level. Info lines are written as they
+// are; the others start with their level. Fields follow as key=value.
+func (t *tracer) write(level Level, msg string) {
+	if t.json {
+		t.traceJSON(level, msg)
+		return
+	}
+	if level != LevelInfo {
+		fmt.Fprint(t.out, strings.ToUpper(level.String()), ": ")
+	}
+	fmt.Fprint(t.out, msg)
+	for i := 0; i+1 < len(t.fields); i += 2 {
+		fmt.Fprintf(t.out, " %v=%v", t.fields[i], t.fields[i+1])
+	}
 	fmt.Fprintln(t.out)
 }
 
+// New creates a Tracer that writes every event to w.
 func New(w io.Writer) Tracer {
-	return &tracer{out: w}
+	return &tracer{out: w, min: LevelDebug}
+}
+
+// NewLevel creates a Tracer that writes events at min and above to w.
+func NewLevel(w io.Writer, min Level) Tracer {
+	return &tracer{out: w, min: min}
 }
 
 type nilTracer struct{}
 
 func (t *nilTracer) Trace(a ...interface{}) {}
+func (t *nilTracer) Debug(a ...interface{}) {}
+func (t *nilTracer) Info(a ...interface{})  {}
+func (t *nilTracer) Warn(a ...interface{})  {}
+func (t *nilTracer) Error(a ...interface{}) {}
+
+func (t *nilTracer) With(keyvals ...interface{}) Tracer { return t }
 
-// Off creates a Tracer that will ignore calls to Trace.
+// Off creates a Tracer that will ignore every event.
 func Off() Tracer {
 	return &nilTracer{}
 }
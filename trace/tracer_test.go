@@ -2,7 +2,10 @@ package trace
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
@@ -21,3 +24,55 @@ func TestOff(t *testing.T) {
 	var silentTracer Tracer = Off()
 	silentTracer.Trace("something")
 }
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewLevel(&buf, LevelInfo)
+	tracer.Debug("every message")
+	tracer.Trace("room created")
+	tracer.Warn("broker lost")
+	tracer.Error("save failed")
+	want := "room created\nWARN: broker lost\nERROR: save failed\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]Level{"debug": LevelDebug, "Info": LevelInfo, "WARN": LevelWarn, "error": LevelError} {
+		if got, err := ParseLevel(name); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel should refuse unknown levels")
+	}
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf).With("room", "golang").Trace("Client left")
+	if buf.String() != "Client left room=golang\n" {
+		t.Errorf("got %q", buf.String())
+	}
+	Off().With("room", "golang").Trace("nothing")
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewJSONLevel(&buf, LevelInfo).With("room", "golang", "err", errors.New("disk full"))
+	tracer.Debug("Message received")
+	tracer.Error("Failed to save message")
+	var event map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("%q is not one JSON object: %v", buf.String(), err)
+	}
+	for key, want := range map[string]string{"level": "error", "msg": "Failed to save message", "room": "golang", "err": "disk full"} {
+		if event[key] != want {
+			t.Errorf("%s is %v, want %s", key, event[key], want)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, event["time"].(string)); err != nil {
+		t.Errorf("bad time: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/law-lee/chat_server/trace"
+)
+
+// The outputs the server's events can be traced to.
+const (
+	traceOff    = "off"
+	traceStdout = "stdout"
+	// traceFile appends to the -trace-file file.
+	traceFile = "file"
+	// traceRing keeps the last traceRingSize events in memory, for
+	// GET /admin/trace/events.
+	traceRing = "ring"
+)
+
+// traceRingSize is how many events the ring output keeps.
+const traceRingSize = 1000
+
+// traceSettings are how the server traces events. MaxBytes and PerSecond
+// are the trace.Limits events are kept to.
+type traceSettings struct {
+	Output    string
+	Level     string
+	Format    string
+	MaxBytes  int
+	PerSecond int
+}
+
+// traceControl lets admins change how the server traces events while it
+// runs. Every Tracer handed out by the server is a view of sw, so changing
+// it changes them all.
+type traceControl struct {
+	sw *trace.Switch
+	// file is where the file output writes to; empty if there is none.
+	file  string
+	ring  *trace.Ring
+	audit *auditLog
+	// stdout is where the stdout output writes to; it may be replaced in
+	// tests.
+	stdout io.Writer
+
+	mu       sync.Mutex
+	settings traceSettings
+	// open is the file of the file output while it is in use.
+	open *os.File
+}
+
+func newTraceControl(file string, audit *auditLog) *traceControl {
+	return &traceControl{
+		sw:     trace.NewSwitch(trace.Off()),
+		file:   file,
+		ring:   trace.NewRing(traceRingSize),
+		audit:  audit,
+		stdout: os.Stdout,
+	}
+}
+
+// set starts tracing as settings say, if they are valid.
+func (t *traceControl) set(settings traceSettings) error {
+	level, err := trace.ParseLevel(settings.Level)
+	if err != nil {
+		return err
+	}
+	if settings.Format != "text" && settings.Format != "json" {
+		return fmt.Errorf("unknown trace format %q", settings.Format)
+	}
+	if settings.MaxBytes < 0 || settings.PerSecond < 0 {
+		return errors.New("trace limits must not be negative")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var w io.Writer
+	var open *os.File
+	switch settings.Output {
+	case traceOff:
+	case traceStdout:
+		w = t.stdout
+	case traceFile:
+		if t.file == "" {
+			return errors.New("no -trace-file to trace to")
+		}
+		if t.open != nil {
+			open = t.open
+		} else if open, err = os.OpenFile(t.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+			return err
+		}
+		w = open
+	case traceRing:
+		// the ring keeps whole events, which the JSON tracers write at once
+		settings.Format = "json"
+		w = t.ring
+	default:
+		return fmt.Errorf("unknown trace output %q", settings.Output)
+	}
+	var tracer trace.Tracer = trace.Off()
+	switch {
+	case w == nil:
+	case settings.Format == "json":
+		tracer = trace.NewJSONLevel(w, level)
+	default:
+		tracer = trace.NewLevel(w, level)
+	}
+	t.sw.Set(trace.Limit(tracer, trace.Limits{MaxBytes: settings.MaxBytes, PerSecond: settings.PerSecond}))
+	if t.open != nil && t.open != open {
+		t.open.Close()
+	}
+	t.open = open
+	t.settings = settings
+	return nil
+}
+
+func (t *traceControl) current() traceSettings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.settings
+}
+
+// ServeHTTP is the admin API for tracing:
+//
+//	GET /admin/trace          the current settings
+//	PUT /admin/trace          change them, {"Output": "ring", "Level": "debug"}
+//	GET /admin/trace/events   the events kept by the ring output, oldest first
+//
+// Output is off, stdout, file or ring; Level is debug, info, warn or error;
+// Format is text or json; MaxBytes and PerSecond limit events, 0 for no
+// limit. Fields left out of a PUT keep their value. Changes
+// are recorded in the audit log.
+func (t *traceControl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/trace"), "/")
+	switch {
+	case r.Method == http.MethodGet && path == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.current())
+	case r.Method == http.MethodPut && path == "":
+		settings := t.current()
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "body must be {\"Output\": \"...\", \"Level\": \"...\"}", http.StatusBadRequest)
+			return
+		}
+		old := t.current()
+		if err := t.set(settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		settings = t.current()
+		if err := t.audit.record(r, "trace", fmt.Sprintf("%s/%s/%s -> %s/%s/%s", old.Output, old.Level, old.Format, settings.Output, settings.Level, settings.Format)); err != nil {
+			t.sw.Error("Failed to record trace change in the audit log: ", err)
+		}
+		t.sw.Info("Tracing changed by ", currentUser(r).Get("email").Str(), " to ", settings.Output, " at ", settings.Level)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+	case r.Method == http.MethodGet && path == "events":
+		events := []json.RawMessage{}
+		for _, entry := range t.ring.Entries() {
+			events = append(events, json.RawMessage(entry))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
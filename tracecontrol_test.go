@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/objx"
+)
+
+func TestTraceControl(t *testing.T) {
+	audit := newAuditLog(newFileState(""))
+	var stdout bytes.Buffer
+	traces := newTraceControl(filepath.Join(t.TempDir(), "trace.log"), audit)
+	traces.stdout = &stdout
+	if err := traces.set(traceSettings{Output: traceStdout, Level: "info", Format: "text"}); err != nil {
+		t.Fatal(err)
+	}
+	room := traces.sw.With("room", "golang")
+	room.Debug("hidden")
+	admin := objx.New(map[string]interface{}{"userid": "root", "email": "root@example.com"})
+	put := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		traces.ServeHTTP(w, withAuthCookie(http.MethodPut, "/admin/trace", strings.NewReader(body), admin))
+		return w
+	}
+
+	if w := put(`{"Output": "ring", "Level": "debug"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	room.Debug("shown")
+	if stdout.Len() != 0 {
+		t.Errorf("nothing should have been traced to stdout, got %q", stdout.String())
+	}
+	w := httptest.NewRecorder()
+	traces.ServeHTTP(w, withAuthCookie(http.MethodGet, "/admin/trace/events", nil, admin))
+	var events []map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(events); n == 0 || events[n-1]["msg"] != "shown" || events[n-1]["room"] != "golang" {
+		t.Errorf("the ring should have the debug event, got %v", events)
+	}
+
+	if w := put(`{"MaxBytes": 5}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	room.Debug("a long message")
+	if entries := traces.ring.Entries(); !strings.Contains(string(entries[len(entries)-1]), `"msg":"a lon... (9 bytes cut)"`) {
+		t.Errorf("the event should have been cut, got %s", entries[len(entries)-1])
+	}
+
+	if w := put(`{"Output": "file"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	for _, body := range []string{`{"Output": "syslog"}`, `{"Level": "verbose"}`, `{"PerSecond": -1}`} {
+		if w := put(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+	if got := traces.current(); got.Output != traceFile || got.Level != "debug" {
+		t.Errorf("a rejected change should keep the settings, got %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	audit.ServeHTTP(w, withAuthCookie(http.MethodGet, "/admin/audit", nil, admin))
+	var entries []auditEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Detail != "ring/debug/json -> file/debug/json" || entries[1].Admin != "root@example.com" || entries[1].Action != "trace" {
+		t.Errorf("unexpected audit log %+v", entries)
+	}
+}
@@ -1,36 +1,105 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"path"
+	"strings"
 )
 
-//uploaderHandler uses the FormValue method in http.Request to get the
-//user ID that we placed in the hidden input in our HTML form. Then, it gets an io.Reader
-//type capable of reading the uploaded bytes by calling req.FormFile, which returns three
+//upload uses the FormFile method in http.Request to get an io.Reader
+//type capable of reading the uploaded bytes, which returns three
 //arguments. The first argument represents the file itself with the multipart.File interface
 //type, which is also io.Reader. The second is a multipart.FileHeader object that
 //contains the metadata about the file, such as the filename. And finally, the third argument is
-//an error that we hope will have a nil value
-func uploaderHandler(w http.ResponseWriter, req *http.Request) {
-	userId := req.FormValue("userid")
+//an error that we hope will have a nil value. The user ID is that of the signed in user,
+//so users can only replace their own avatar, and not while an admin has blocked them. The
+//picture is checked and normalized by processAvatar, and its extension comes from its
+//format rather than the file name, which must not be a path. Pictures over maxSize are refused
+//before they are read in full.
+func (s *avatarStore) upload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := currentUser(req)
+	userId := user.Get("userid").Str()
+	if !validAvatarUserID(userId) {
+		http.Error(w, "sign in to upload a picture", http.StatusUnauthorized)
+		return
+	}
+	if s.blocked(userId) {
+		http.Error(w, "you may not upload pictures for now", http.StatusForbidden)
+		return
+	}
+	// the form around the picture is small
+	req.Body = http.MaxBytesReader(w, req.Body, s.maxSize+1<<10)
 	file, header, err := req.FormFile("avatarFile")
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			http.Error(w, fmt.Sprintf("pictures may be at most %d bytes", s.maxSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "the picture must be in the multipart field \"avatarFile\"", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if !validCSRF(req) {
+		http.Error(w, errCSRF, http.StatusForbidden)
+		return
+	}
+	if !validUploadName(header.Filename) {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(file, s.maxSize+1))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	data, err := ioutil.ReadAll(file)
+	if int64(len(data)) > s.maxSize {
+		http.Error(w, fmt.Sprintf("pictures may be at most %d bytes", s.maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	serverMetrics.observeUpload("avatar", int64(len(data)))
+	img, err := processAvatar(data)
+	if err == errUnsupportedAvatar {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	filename := path.Join("avatars", userId+path.Ext(header.Filename))
-	err = ioutil.WriteFile(filename, data, 0777)
+	// an avatar with another extension would be found instead
+	if err := s.remove(userId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filename := userId + img.Ext
+	err = s.blobs.Put(filename, img.Data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	upload := &avatarUpload{UserID: userId, Name: user.Get("name").Str(), URL: "/avatars/" + filename, StaticURL: "/avatars/" + filename + "?static=1",
+		ContentType: img.ContentType, Animated: img.Animated, Size: int64(len(img.Data)), Uploaded: s.now()}
+	if img.Static != nil {
+		if err := s.blobs.Put(userId+staticAvatarSuffix, img.Static); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := s.state.Put(avatarUploadsBucket, userId, upload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	io.WriteString(w, "Successful")
 }
+
+//validUploadName reports whether name, the file name a browser sent with an upload, is a plain
+//file name rather than a path or something that could be mistaken for one.
+func validUploadName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
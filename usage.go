@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/law-lee/chat_server/trace"
+)
+
+const (
+	// usageBucket holds what each server metered for a workspace in a
+	// month, under "workspace@2006-01@node". Every server only writes its
+	// own keys, so they never overwrite each other's counts.
+	usageBucket = "usage"
+	// quotasBucket holds the limits of each workspace; "*" holds the
+	// limits of workspaces without their own.
+	quotasBucket = "quotas"
+	// usageClaimsBucket records the usage reports and soft limit warnings
+	// already sent, so that only one server sends each.
+	usageClaimsBucket = "usage_claims"
+	// usagePeriod is the layout of the monthly billing period.
+	usagePeriod = "2006-01"
+	// defaultWorkspace is the workspace of users without an email domain.
+	defaultWorkspace = "default"
+)
+
+// errQuotaExceeded is returned when something would take a workspace over
+// one of its hard limits.
+var errQuotaExceeded = errors.New("your workspace has used up its quota for this month")
+
+// usage is what a workspace used in a billing period: messages sent, bytes
+// stored in messages and attachments, and seats, the users who connected or
+// sent anything.
+type usage struct {
+	Messages     int64
+	StorageBytes int64
+	Seats        int64
+}
+
+// exceeds returns which of the limits u is over; zero limits are unlimited.
+func (u usage) exceeds(limits usage) []string {
+	var over []string
+	if limits.Messages > 0 && u.Messages > limits.Messages {
+		over = append(over, "messages")
+	}
+	if limits.StorageBytes > 0 && u.StorageBytes > limits.StorageBytes {
+		over = append(over, "storage")
+	}
+	if limits.Seats > 0 && u.Seats > limits.Seats {
+		over = append(over, "seats")
+	}
+	return over
+}
+
+// quota holds a workspace's limits. Going over a Soft limit is allowed but
+// warned about and reported; anything that would go over a Hard limit is
+// refused.
+type quota struct {
+	Soft usage
+	Hard usage
+}
+
+// meteredUsage is what one server metered for a workspace in a period.
+type meteredUsage struct {
+	Messages     int64
+	StorageBytes int64
+	Users        []string
+}
+
+// usageReport is what UsageReporters are sent: the workspace's usage so far
+// this period, hourly, and when it goes over a soft limit, which limits.
+type usageReport struct {
+	Workspace string
+	Period    string
+	Usage     usage
+	Quota     quota
+	Exceeded  []string `json:",omitempty"`
+	At        time.Time
+}
+
+// UsageReporter passes usage on to whatever bills for it.
+type UsageReporter interface {
+	Report(r *usageReport) error
+}
+
+// logReporter writes reports to the server log.
+type logReporter struct{}
+
+func (logReporter) Report(r *usageReport) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	log.Println("Usage:", string(data))
+	return nil
+}
+
+// webhookReporter POSTs reports as JSON to url, through the dead-letter
+// queue so that reports are retried while the billing system is down.
+type webhookReporter struct {
+	url   string
+	queue *deadLetterQueue
+}
+
+func (w *webhookReporter) Report(r *usageReport) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	// a failed send is kept and retried by the queue
+	w.queue.send(&delivery{Kind: "webhook", Target: w.url, Payload: payload})
+	return nil
+}
+
+// newUsageReporter returns the reporter for spec: "log", or an http(s) URL
+// reports are POSTed to.
+func newUsageReporter(spec string, queue *deadLetterQueue) (UsageReporter, error) {
+	if spec == "log" {
+		return logReporter{}, nil
+	}
+	if u, err := url.Parse(spec); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return &webhookReporter{url: spec, queue: queue}, nil
+	}
+	return nil, fmt.Errorf("unknown usage reporter %q", spec)
+}
+
+// workspaceOf returns the workspace a user belongs to, which is the domain
+// of their email address.
+func workspaceOf(userData map[string]interface{}) string {
+	email, _ := userData["email"].(string)
+	if i := strings.LastIndex(email, "@"); i >= 0 && i < len(email)-1 {
+		return strings.ToLower(email[i+1:])
+	}
+	return defaultWorkspace
+}
+
+// usageMeter counts what each workspace uses and enforces its quota. Counts
+// are kept in memory and saved by flush, which also picks up what the other
+// servers counted, so limits hold across servers to within a flush. A nil
+// *usageMeter meters nothing.
+type usageMeter struct {
+	state     StateStore
+	node      string
+	reporters []UsageReporter
+	tracer    trace.Tracer
+
+	mu     sync.Mutex
+	period string
+	// local is what this server counted this period, by workspace, and
+	// users the userids of the seats among it.
+	local map[string]*meteredUsage
+	users map[string]map[string]bool
+	// others is what the other servers had counted at the last flush.
+	others map[string]*meteredUsage
+	quotas map[string]quota
+}
+
+func newUsageMeter(state StateStore) *usageMeter {
+	return &usageMeter{state: state, node: nodeID, tracer: trace.Off()}
+}
+
+// roll starts a new period if now is not in the current one. The caller
+// must hold m.mu.
+func (m *usageMeter) roll(now time.Time) {
+	period := now.UTC().Format(usagePeriod)
+	if period == m.period {
+		return
+	}
+	m.period = period
+	m.local = make(map[string]*meteredUsage)
+	m.users = make(map[string]map[string]bool)
+	m.others = make(map[string]*meteredUsage)
+	if m.quotas == nil {
+		m.quotas = make(map[string]quota)
+	}
+}
+
+// current returns the workspace's usage this period. The caller must hold
+// m.mu.
+func (m *usageMeter) current(workspace string) usage {
+	var u usage
+	seats := make(map[string]bool)
+	for _, metered := range []*meteredUsage{m.local[workspace], m.others[workspace]} {
+		if metered == nil {
+			continue
+		}
+		u.Messages += metered.Messages
+		u.StorageBytes += metered.StorageBytes
+		for _, user := range metered.Users {
+			seats[user] = true
+		}
+	}
+	u.Seats = int64(len(seats))
+	return u
+}
+
+// quotaOf returns the workspace's quota. The caller must hold m.mu.
+func (m *usageMeter) quotaOf(workspace string) quota {
+	if q, ok := m.quotas[workspace]; ok {
+		return q
+	}
+	return m.quotas["*"]
+}
+
+// allow counts messages and bytes used by userID in workspace, unless that
+// would go over a hard limit, in which case it returns errQuotaExceeded.
+// warning is set when this goes over a soft limit.
+func (m *usageMeter) allow(workspace, userID string, messages, bytes int64) (warning string, err error) {
+	if m == nil {
+		return "", nil
+	}
+	now := time.Now()
+	m.mu.Lock()
+	m.roll(now)
+	before := m.current(workspace)
+	after := before
+	after.Messages += messages
+	after.StorageBytes += bytes
+	newSeat := userID != "" && !m.users[workspace][userID] && !m.seated(workspace, userID)
+	if newSeat {
+		after.Seats++
+	}
+	q := m.quotaOf(workspace)
+	if after != before && len(after.exceeds(q.Hard)) > 0 {
+		m.mu.Unlock()
+		return "", errQuotaExceeded
+	}
+	local := m.local[workspace]
+	if local == nil {
+		local = &meteredUsage{}
+		m.local[workspace] = local
+		m.users[workspace] = make(map[string]bool)
+	}
+	local.Messages += messages
+	local.StorageBytes += bytes
+	if newSeat {
+		local.Users = append(local.Users, userID)
+		m.users[workspace][userID] = true
+	}
+	exceeded := after.exceeds(q.Soft)
+	crossed := len(exceeded) > len(before.exceeds(q.Soft))
+	report := &usageReport{Workspace: workspace, Period: m.period, Usage: after, Quota: q, Exceeded: exceeded, At: now}
+	m.mu.Unlock()
+	if !crossed {
+		return "", nil
+	}
+	key := workspace + "@" + report.Period + "@" + strings.Join(exceeded, ",")
+	if claimed, err := m.state.Create(usageClaimsBucket, key, now); err == nil && claimed {
+		m.report(report)
+	}
+	return "your workspace is over its " + strings.Join(exceeded, " and ") + " allowance for this month.", nil
+}
+
+// seated reports whether another server already counted userID as a seat.
+// The caller must hold m.mu.
+func (m *usageMeter) seated(workspace, userID string) bool {
+	if others := m.others[workspace]; others != nil {
+		for _, user := range others.Users {
+			if user == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *usageMeter) report(r *usageReport) {
+	for _, reporter := range m.reporters {
+		if err := reporter.Report(r); err != nil {
+			m.tracer.Warn("Failed to report usage: ", err)
+		}
+	}
+}
+
+// flush saves what this server counted and loads what the others counted
+// and the quotas.
+func (m *usageMeter) flush(now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.roll(now)
+	period := m.period
+	local := make(map[string]meteredUsage, len(m.local))
+	for workspace, metered := range m.local {
+		local[workspace] = meteredUsage{Messages: metered.Messages, StorageBytes: metered.StorageBytes, Users: append([]string(nil), metered.Users...)}
+	}
+	m.mu.Unlock()
+	for workspace, metered := range local {
+		if err := m.state.Put(usageBucket, workspace+"@"+period+"@"+m.node, metered); err != nil {
+			m.tracer.Error("Failed to save usage: ", err)
+		}
+	}
+	others := make(map[string]*meteredUsage)
+	docs, err := m.state.List(usageBucket)
+	if err != nil {
+		m.tracer.Warn("Failed to load usage: ", err)
+		return
+	}
+	for key, doc := range docs {
+		parts := strings.Split(key, "@")
+		var metered meteredUsage
+		if len(parts) != 3 || parts[1] != period || parts[2] == m.node || json.Unmarshal(doc, &metered) != nil {
+			continue
+		}
+		sum := others[parts[0]]
+		if sum == nil {
+			sum = &meteredUsage{}
+			others[parts[0]] = sum
+		}
+		sum.Messages += metered.Messages
+		sum.StorageBytes += metered.StorageBytes
+		sum.Users = append(sum.Users, metered.Users...)
+	}
+	quotas := make(map[string]quota)
+	if docs, err := m.state.List(quotasBucket); err == nil {
+		for workspace, doc := range docs {
+			var q quota
+			if json.Unmarshal(doc, &q) == nil {
+				quotas[workspace] = q
+			}
+		}
+	}
+	m.mu.Lock()
+	if m.period == period {
+		m.others = others
+	}
+	m.quotas = quotas
+	m.mu.Unlock()
+}
+
+// usageOf returns every workspace's usage and quota this period.
+func (m *usageMeter) usageOf() []*usageReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.roll(now)
+	workspaces := make(map[string]bool)
+	for workspace := range m.local {
+		workspaces[workspace] = true
+	}
+	for workspace := range m.others {
+		workspaces[workspace] = true
+	}
+	reports := make([]*usageReport, 0, len(workspaces))
+	for workspace := range workspaces {
+		reports = append(reports, &usageReport{Workspace: workspace, Period: m.period, Usage: m.current(workspace), Quota: m.quotaOf(workspace), At: now})
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Workspace < reports[j].Workspace })
+	return reports
+}
+
+// tick is the meter's scheduler job: it flushes every minute and, on the
+// hour, one server sends every workspace's usage to the reporters.
+func (m *usageMeter) tick(now time.Time) {
+	m.flush(now)
+	if now.Minute() != 0 || len(m.reporters) == 0 {
+		return
+	}
+	if claimed, err := m.state.Create(usageClaimsBucket, "report@"+now.UTC().Format(time.RFC3339), now); err != nil || !claimed {
+		return
+	}
+	for _, r := range m.usageOf() {
+		m.report(r)
+	}
+}
+
+// ServeHTTP is the admin API for usage and quotas:
+//
+//	GET    /admin/usage                         every workspace's usage this month
+//	PUT    /admin/usage/{workspace}/quota       set limits: {"Soft": {...}, "Hard": {...}}
+//	DELETE /admin/usage/{workspace}/quota       remove them
+//
+// The workspace "*" holds the limits of workspaces without their own.
+func (m *usageMeter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/usage"), "/")
+	workspace := strings.TrimSuffix(path, "/quota")
+	switch {
+	case r.Method == http.MethodGet && path == "":
+		m.flush(time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.usageOf())
+	case r.Method == http.MethodPut && workspace != path && workspace != "":
+		var q quota
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.state.Put(quotasBucket, workspace, q); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m.flush(time.Now())
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && workspace != path && workspace != "":
+		if err := m.state.Delete(quotasBucket, workspace); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m.flush(time.Now())
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reportRecorder is a UsageReporter that keeps what it is sent.
+type reportRecorder struct {
+	reports []*usageReport
+}
+
+func (r *reportRecorder) Report(report *usageReport) error {
+	r.reports = append(r.reports, report)
+	return nil
+}
+
+func TestUsageQuotas(t *testing.T) {
+	state := newFileState("")
+	state.Put(quotasBucket, "*", quota{Soft: usage{Messages: 2}, Hard: usage{Messages: 3, Seats: 2}})
+	recorder := &reportRecorder{}
+	a, b := newUsageMeter(state), newUsageMeter(state)
+	a.node, b.node = "a", "b"
+	a.reporters = []UsageReporter{recorder}
+	a.flush(time.Now())
+	b.flush(time.Now())
+
+	if warning, err := a.allow("example.com", "ann", 1, 5); warning != "" || err != nil {
+		t.Fatalf("first message should be fine, got %q %v", warning, err)
+	}
+	if warning, err := a.allow("example.com", "ann", 1, 5); warning != "" || err != nil {
+		t.Fatalf("second message is at the soft limit, got %q %v", warning, err)
+	}
+	if warning, err := a.allow("example.com", "ann", 1, 5); !strings.Contains(warning, "messages") || err != nil {
+		t.Fatalf("third message should warn, got %q %v", warning, err)
+	}
+	if len(recorder.reports) != 1 || recorder.reports[0].Exceeded[0] != "messages" {
+		t.Errorf("going over the soft limit should be reported, got %+v", recorder.reports)
+	}
+	if _, err := a.allow("example.com", "ann", 1, 5); err != errQuotaExceeded {
+		t.Errorf("fourth message should be refused, got %v", err)
+	}
+	if _, err := a.allow("other.org", "zoe", 1, 5); err != nil {
+		t.Errorf("other workspaces have their own quota, got %v", err)
+	}
+
+	// b learns what a counted when both flush
+	a.flush(time.Now())
+	b.flush(time.Now())
+	if _, err := b.allow("example.com", "ann", 1, 0); err != errQuotaExceeded {
+		t.Errorf("the quota should hold across servers, got %v", err)
+	}
+	if _, err := b.allow("example.com", "ann", 0, 0); err != nil {
+		t.Errorf("ann already has a seat, got %v", err)
+	}
+	if _, err := b.allow("example.com", "bob", 0, 0); err != nil {
+		t.Errorf("bob should get the second seat, got %v", err)
+	}
+	if _, err := b.allow("example.com", "cat", 0, 0); err != errQuotaExceeded {
+		t.Errorf("there is no third seat, got %v", err)
+	}
+
+	b.flush(time.Now())
+	reports := b.usageOf()
+	if len(reports) != 2 || reports[0].Workspace != "example.com" || reports[0].Usage != (usage{Messages: 3, StorageBytes: 15, Seats: 2}) {
+		t.Errorf("unexpected usage %+v", reports[0])
+	}
+
+	var nilMeter *usageMeter
+	if _, err := nilMeter.allow("example.com", "ann", 100, 100); err != nil {
+		t.Errorf("a nil meter should allow everything, got %v", err)
+	}
+}
+
+func TestUsageAdmin(t *testing.T) {
+	m := newUsageMeter(newFileState(""))
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/usage/example.com/quota", strings.NewReader(`{"Hard": {"Messages": 1}}`)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("setting a quota failed: %d %s", w.Code, w.Body)
+	}
+	m.allow("example.com", "ann", 1, 0)
+	if _, err := m.allow("example.com", "ann", 1, 0); err != errQuotaExceeded {
+		t.Errorf("the new quota should apply, got %v", err)
+	}
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/usage", nil))
+	if !strings.Contains(w.Body.String(), `"Workspace":"example.com"`) || !strings.Contains(w.Body.String(), `"Messages":1,`) {
+		t.Errorf("unexpected usage %s", w.Body)
+	}
+}
+
+func TestWorkspaceOf(t *testing.T) {
+	for email, want := range map[string]string{"ann@Example.com": "example.com", "": defaultWorkspace, "ann@": defaultWorkspace} {
+		if got := workspaceOf(map[string]interface{}{"email": email}); got != want {
+			t.Errorf("workspaceOf(%q) = %q, want %q", email, got, want)
+		}
+	}
+}
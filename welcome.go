@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// roomWelcomesBucket records, by room/userid, who has been welcomed to each
+// room, so that users are only welcomed the first time they join.
+const roomWelcomesBucket = "room_welcomes"
+
+// roomWelcome is the message a room sends users the first time they join.
+// In Message, {name} is replaced by the user's name, {room} by the room's
+// and {rules} by RulesURL.
+type roomWelcome struct {
+	Message string
+	// DM sends the message as a direct message, which stays in the user's
+	// history, rather than a notice only their connection sees.
+	DM       bool   `json:",omitempty"`
+	RulesURL string `json:",omitempty"`
+}
+
+// text returns the message for the user called name in room.
+func (w *roomWelcome) text(name, room string) string {
+	return strings.NewReplacer("{name}", name, "{room}", room, "{rules}", w.RulesURL).Replace(w.Message)
+}
+
+// welcome sends c the room's welcome message, if it has one and c's user
+// has not been welcomed to the room before. It runs inside run, after
+// c joined.
+func (r *room) welcome(c *client) {
+	userID := c.userID()
+	if userID == "" {
+		return
+	}
+	settings, err := loadRoomSettings(r.state, r.name)
+	if err != nil || settings.Welcome == nil {
+		return
+	}
+	now := time.Now()
+	if first, err := r.state.Create(roomWelcomesBucket, r.name+"/"+userID, now); err != nil || !first {
+		return
+	}
+	text := settings.Welcome.text(c.name(), r.name)
+	if settings.Welcome.DM && r.rooms != nil {
+		// sendDirect hands the message to every room, this one included,
+		// so it can't be sent from inside run
+		go r.rooms.sendDirect(&message{ID: newID(), Type: msgTypeDM, UserID: "welcome", To: userID, Name: "#" + r.name, Message: text, When: now})
+		return
+	}
+	select {
+	case c.send <- &message{ID: newID(), Type: msgTypeNotice, Room: r.name, Name: "#" + r.name, Message: text, When: now}:
+	default:
+	}
+}
+
+// serveWelcome is the welcome part of the rooms API:
+//
+//	GET    /api/rooms/{name}/welcome  the room's welcome message
+//	PUT    /api/rooms/{name}/welcome  set it: {"Message", "DM", "RulesURL"}
+//	DELETE /api/rooms/{name}/welcome  stop welcoming new members
+//
+// Only the room's owner and the admins may change it.
+func (a *roomSettingsAPI) serveWelcome(w http.ResponseWriter, r *http.Request, settings roomSettings, user map[string]interface{}) {
+	userID, _ := user["userid"].(string)
+	email, _ := user["email"].(string)
+	if r.Method != http.MethodGet && !isAdmin(email) && (userID == "" || userID != settings.Owner) {
+		http.Error(w, "only the room's owner may change its welcome message", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if settings.Welcome == nil {
+			http.Error(w, "the room has no welcome message", http.StatusNotFound)
+			return
+		}
+	case http.MethodPut:
+		var welcome roomWelcome
+		if err := json.NewDecoder(r.Body).Decode(&welcome); err != nil || strings.TrimSpace(welcome.Message) == "" {
+			http.Error(w, "body must be {\"Message\": \"Welcome, {name}!\", \"DM\": false, \"RulesURL\": \"...\"}", http.StatusBadRequest)
+			return
+		}
+		settings.Welcome = &welcome
+	case http.MethodDelete:
+		settings.Welcome = nil
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method != http.MethodGet {
+		if settings.Created.IsZero() {
+			settings.Created = time.Now()
+		}
+		if err := a.state.Put(roomSettingsBucket, settings.Room, settings); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if settings.Welcome == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings.Welcome)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+func TestRoomWelcome(t *testing.T) {
+	rooms := newRoomManager()
+	api := &roomSettingsAPI{state: rooms.state, rooms: rooms}
+	ann := objx.New(map[string]interface{}{"userid": "ann", "name": "Ann"})
+	bob := objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})
+	serve := func(user objx.Map, method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, withAuthCookie(method, "/api/rooms/ops/welcome", strings.NewReader(body), user))
+		return w
+	}
+	if _, err := createRoom(rooms.state, nil, "ops", "ann", false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	welcome := `{"Message": "Hi {name}, welcome to {room}. Please read {rules}", "RulesURL": "https://wiki/ops-rules"}`
+	if w := serve(bob, http.MethodPut, welcome); w.Code != http.StatusForbidden {
+		t.Errorf("only the owner should set the welcome message, got %d", w.Code)
+	}
+	if w := serve(ann, http.MethodPut, `{"Message": " "}`); w.Code != http.StatusBadRequest {
+		t.Errorf("an empty message should be refused, got %d", w.Code)
+	}
+	if w := serve(ann, http.MethodPut, welcome); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	r := rooms.get("ops")
+	join := func() *client {
+		c := &client{send: make(chan *message, messageBufferSize), room: r, userData: bob}
+		r.join <- c
+		return c
+	}
+	c := join()
+	msg := receiveChat(t, c)
+	if msg.Type != msgTypeNotice || msg.Message != "Hi Bob, welcome to ops. Please read https://wiki/ops-rules" {
+		t.Errorf("expected the welcome notice, got %+v", msg)
+	}
+	r.leave <- c
+	c = join()
+	waitMembers(t, r, 1)
+	timeout := time.After(50 * time.Millisecond)
+	for {
+		select {
+		case msg := <-c.send:
+			if msg.Type == msgTypeNotice {
+				t.Errorf("users should only be welcomed once, got %q", msg.Message)
+			}
+			continue
+		case <-timeout:
+		}
+		break
+	}
+}
+
+func TestRoomWelcomeDM(t *testing.T) {
+	rooms := newRoomManager()
+	createRoom(rooms.state, nil, "ops", "ann", false, nil, nil)
+	settings, _ := loadRoomSettings(rooms.state, "ops")
+	settings.Welcome = &roomWelcome{Message: "Welcome, {name}!", DM: true}
+	rooms.state.Put(roomSettingsBucket, "ops", settings)
+
+	r := rooms.get("ops")
+	c := &client{send: make(chan *message, messageBufferSize), room: r, userData: objx.New(map[string]interface{}{"userid": "bob", "name": "Bob"})}
+	r.join <- c
+	msg := receiveChat(t, c)
+	if msg.Type != msgTypeDM || msg.To != "bob" || msg.Message != "Welcome, Bob!" {
+		t.Errorf("expected the welcome as a direct message, got %+v", msg)
+	}
+	if stored, _ := rooms.store.Query(messageQuery{Room: dmRoom("welcome", "bob")}); len(stored) != 1 {
+		t.Errorf("the direct message should be kept, got %v", stored)
+	}
+}